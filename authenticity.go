@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+	"github.com/rwcarlsen/goexif/mknote"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Finding severities. A fail is a strong sign of editing; a warn is
+// something a reviewer should look at.
+const (
+	severityInfo = "info"
+	severityWarn = "warn"
+	severityFail = "fail"
+)
+
+// Authenticity checks.
+const (
+	findingExif         = "exif"
+	findingCaptureTime  = "capturetime"
+	findingSoftware     = "software"
+	findingMakerNote    = "makernote"
+	findingGPSTime      = "gpstime"
+	findingQuantisation = "quantisation"
+)
+
+const (
+	// capture times further ahead of the server clock than this are fails
+	captureFutureSkew = 10 * time.Minute
+	// photos older than these when uploaded are warned about or failed
+	captureStaleWarn = 72 * time.Hour
+	captureStaleFail = 30 * 24 * time.Hour
+	// GPS fixes can lag the shutter, so only larger gaps count
+	gpsTimeWarn = 10 * time.Minute
+	gpsTimeFail = 24 * time.Hour
+	// a model needs this many uploads before unseen tables are suspicious
+	qtableMinSamples = 20
+)
+
+// Capture times without an offset are read as local farm time. Upload
+// dates in this service are already kept in UTC+8.
+var farmZone = time.FixedZone("CST", 8*3600)
+
+// editorSoftware are lower case substrings of EXIF Software values written
+// by photo editors rather than camera firmware.
+var editorSoftware = []string{
+	"photoshop", "lightroom", "gimp", "snapseed", "picsart", "meitu", "美圖", "美图",
+	"pixelmator", "affinity photo", "paint.net", "facetune", "vsco", "canva",
+	"photoscape", "luminar", "capture one", "acdsee", "polarr", "b612",
+	"beautycam", "photodirector", "fotor",
+}
+
+// makerNoteHeaders are the fixed prefixes cameras write at the start of
+// their maker note. Canon has none; it is checked through the mknote parser.
+var makerNoteHeaders = map[string][]string{
+	"nikon":     {"Nikon\x00"},
+	"olympus":   {"OLYMP\x00", "OLYMPUS\x00", "OM SYSTEM\x00"},
+	"fujifilm":  {"FUJIFILM"},
+	"panasonic": {"Panasonic\x00"},
+	"apple":     {"Apple iOS\x00"},
+	"pentax":    {"AOC\x00", "PENTAX \x00"},
+	"sony":      nil,
+	"canon":     nil,
+}
+
+type Finding struct {
+	Check    string `json:"check" bson:"check"`
+	Severity string `json:"severity" bson:"severity"`
+	Detail   string `json:"detail" bson:"detail"`
+}
+
+// Authenticity is the tamper score for one upload, 100 meaning nothing
+// looked wrong.
+type Authenticity struct {
+	Score    int       `json:"score" bson:"score"`
+	Review   bool      `json:"review" bson:"review"`
+	Findings []Finding `json:"findings" bson:"findings"`
+	Quality  int       `json:"quality,omitempty" bson:"quality,omitempty"`
+	QTables  string    `json:"qtables,omitempty" bson:"qtables,omitempty"`
+}
+
+func (a *Authenticity) add(check string, severity string, format string, args ...interface{}) {
+	a.Findings = append(a.Findings, Finding{Check: check, Severity: severity, Detail: fmt.Sprintf(format, args...)})
+}
+
+func (a *Authenticity) score() {
+	a.Score = 100
+	fails := 0
+	for _, f := range a.Findings {
+		switch f.Severity {
+		case severityWarn:
+			a.Score -= 15
+		case severityFail:
+			a.Score -= 40
+			fails++
+		}
+	}
+	if a.Score < 0 {
+		a.Score = 0
+	}
+	a.Review = fails > 0 || a.Score < 70
+}
+
+// qtableCount is how often a camera model has produced a set of JPEG
+// quantisation tables, kept in the "qtables" collection.
+type qtableCount struct {
+	ID    primitive.ObjectID `bson:"_id"`
+	Model string             `bson:"model"`
+	Hash  string             `bson:"hash"`
+	Count int                `bson:"count"`
+}
+
+// checkAuthenticity scores an upload before it is anchored. data is the
+// file as uploaded and meta what ExtractMeta made of it.
+func (s *service) checkAuthenticity(ctx context.Context, data []byte, meta *PhotoMeta, uploaded time.Time) *Authenticity {
+	a := &Authenticity{Findings: []Finding{}}
+	x, err := exif.Decode(bytes.NewReader(data))
+	if err != nil && (x == nil || exif.IsCriticalError(err)) {
+		a.add(findingExif, severityWarn, "no EXIF data; metadata was never written or has been stripped")
+		x = nil
+	}
+
+	checkCaptureTime(a, meta, uploaded)
+	if x != nil {
+		checkSoftware(a, x)
+		checkMakerNote(a, x, meta)
+		checkGPSTime(a, x, meta)
+	}
+	s.checkQuantisation(ctx, a, data, meta)
+	a.score()
+	return a
+}
+
+func checkCaptureTime(a *Authenticity, meta *PhotoMeta, uploaded time.Time) {
+	if meta.Captured == nil {
+		a.add(findingCaptureTime, severityInfo, "no capture time recorded")
+		return
+	}
+	taken := meta.Captured.Time
+	assumed := ""
+	if taken == nil {
+		local, err := time.ParseInLocation("2006-01-02T15:04:05", meta.Captured.Local, farmZone)
+		if err != nil {
+			return
+		}
+		taken = &local
+		assumed = " (assuming UTC+8)"
+	}
+	age := uploaded.Sub(*taken)
+	switch {
+	case age < -captureFutureSkew:
+		a.add(findingCaptureTime, severityFail, "taken %s after upload%s", (-age).Round(time.Minute), assumed)
+	case age > captureStaleFail:
+		a.add(findingCaptureTime, severityFail, "taken %d days before upload%s", int(age.Hours()/24), assumed)
+	case age > captureStaleWarn:
+		a.add(findingCaptureTime, severityWarn, "taken %d days before upload%s", int(age.Hours()/24), assumed)
+	}
+}
+
+func checkSoftware(a *Authenticity, x *exif.Exif) {
+	sw, err := stringTag(x, exif.Software)
+	if err != nil || sw == "" {
+		return
+	}
+	l := strings.ToLower(sw)
+	for _, e := range editorSoftware {
+		if strings.Contains(l, e) {
+			a.add(findingSoftware, severityFail, "saved by photo editor %q", sw)
+			return
+		}
+	}
+	a.add(findingSoftware, severityInfo, "software %q", sw)
+}
+
+// checkMakerNote looks for the maker note a camera of the declared make
+// always writes. Editors commonly drop it or rewrite it without the
+// vendor header.
+func checkMakerNote(a *Authenticity, x *exif.Exif, meta *PhotoMeta) {
+	if meta.Camera == nil || meta.Camera.Make == "" {
+		return
+	}
+	mk := strings.ToLower(meta.Camera.Make)
+	var brand string
+	for b := range makerNoteHeaders {
+		if strings.Contains(mk, b) {
+			brand = b
+		}
+	}
+	if brand == "" {
+		return
+	}
+	tag, err := x.Get(exif.MakerNote)
+	if err != nil || len(tag.Val) == 0 {
+		a.add(findingMakerNote, severityWarn, "%s photo without maker note", meta.Camera.Make)
+		return
+	}
+	if brand == "canon" {
+		if _, err := x.Get(mknote.Canon_CameraSettings); err != nil {
+			a.add(findingMakerNote, severityWarn, "Canon maker note cannot be parsed")
+		}
+		return
+	}
+	headers := makerNoteHeaders[brand]
+	if len(headers) == 0 {
+		return
+	}
+	for _, h := range headers {
+		if bytes.HasPrefix(tag.Val, []byte(h)) {
+			return
+		}
+	}
+	a.add(findingMakerNote, severityWarn, "%s maker note does not start with the vendor header", meta.Camera.Make)
+}
+
+// checkGPSTime compares the GPS fix time, which is UTC from the satellites,
+// with the camera clock.
+func checkGPSTime(a *Authenticity, x *exif.Exif, meta *PhotoMeta) {
+	if meta.Captured == nil {
+		return
+	}
+	utc, err := gpsTime(x)
+	if err != nil {
+		return
+	}
+	local, err := time.Parse("2006-01-02T15:04:05", meta.Captured.Local)
+	if err != nil {
+		return
+	}
+	if meta.Captured.OffsetSource == "gps" {
+		// the offset was derived from this same fix, so only the part
+		// that is not a whole quarter hour is drift
+		raw := local.Sub(utc)
+		drift := raw - raw.Round(15*time.Minute)
+		if math.Abs(drift.Minutes()) > 2 {
+			a.add(findingGPSTime, severityWarn, "camera clock is %s off the GPS fix", drift.Round(time.Second))
+		}
+		return
+	}
+	if meta.Captured.Time == nil {
+		return
+	}
+	diff := meta.Captured.Time.Sub(utc)
+	if diff < 0 {
+		diff = -diff
+	}
+	switch {
+	case diff > gpsTimeFail:
+		a.add(findingGPSTime, severityFail, "GPS fix %s away from capture time", diff.Round(time.Minute))
+	case diff > gpsTimeWarn:
+		a.add(findingGPSTime, severityWarn, "GPS fix %s away from capture time", diff.Round(time.Minute))
+	}
+}
+
+// zigzag maps the order tables are stored in a DQT segment to natural
+// row-major order.
+var zigzag = [64]int{
+	0, 1, 8, 16, 9, 2, 3, 10, 17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34, 27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36, 29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46, 53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+// The example tables of ITU T.81 Annex K in natural order, which libjpeg
+// and most software encoders scale by a quality setting.
+var ijgLuma = [64]int{
+	16, 11, 10, 16, 24, 40, 51, 61,
+	12, 12, 14, 19, 26, 58, 60, 55,
+	14, 13, 16, 24, 40, 57, 69, 56,
+	14, 17, 22, 29, 51, 87, 80, 62,
+	18, 22, 37, 56, 68, 109, 103, 77,
+	24, 35, 55, 64, 81, 104, 113, 92,
+	49, 64, 78, 87, 103, 121, 120, 101,
+	72, 92, 95, 98, 112, 100, 103, 99,
+}
+
+var ijgChroma = [64]int{
+	17, 18, 24, 47, 99, 99, 99, 99,
+	18, 21, 26, 66, 99, 99, 99, 99,
+	24, 26, 56, 99, 99, 99, 99, 99,
+	47, 66, 99, 99, 99, 99, 99, 99,
+	99, 99, 99, 99, 99, 99, 99, 99,
+	99, 99, 99, 99, 99, 99, 99, 99,
+	99, 99, 99, 99, 99, 99, 99, 99,
+	99, 99, 99, 99, 99, 99, 99, 99,
+}
+
+// quantTables reads the DQT segments of a JPEG, keyed by table id, in
+// natural order.
+func quantTables(data []byte) map[int][64]int {
+	ret := map[int][64]int{}
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return ret
+	}
+	i := 2
+	for i+4 <= len(data) {
+		if data[i] != 0xff {
+			return ret
+		}
+		marker := data[i+1]
+		if marker == 0xff {
+			i++
+			continue
+		}
+		if marker == 0xda || marker == 0xd9 {
+			return ret
+		}
+		n := int(binary.BigEndian.Uint16(data[i+2:]))
+		if n < 2 || i+2+n > len(data) {
+			return ret
+		}
+		if marker == 0xdb {
+			seg := data[i+4 : i+2+n]
+			for len(seg) > 0 {
+				precision, id := seg[0]>>4, int(seg[0]&0x0f)
+				size := 64
+				if precision == 1 {
+					size = 128
+				}
+				if len(seg) < 1+size {
+					break
+				}
+				var t [64]int
+				for k := 0; k < 64; k++ {
+					v := int(seg[1+k])
+					if precision == 1 {
+						v = int(binary.BigEndian.Uint16(seg[1+2*k:]))
+					}
+					t[zigzag[k]] = v
+				}
+				ret[id] = t
+				seg = seg[1+size:]
+			}
+		}
+		i += 2 + n
+	}
+	return ret
+}
+
+func scaleIJG(base [64]int, q int) [64]int {
+	scale := 200 - 2*q
+	if q < 50 {
+		scale = 5000 / q
+	}
+	var t [64]int
+	for i, b := range base {
+		v := (b*scale + 50) / 100
+		if v < 1 {
+			v = 1
+		}
+		if v > 255 {
+			v = 255
+		}
+		t[i] = v
+	}
+	return t
+}
+
+// ijgQuality returns the libjpeg quality setting that produces exactly
+// these tables, or 0 when the encoder used its own.
+func ijgQuality(tables map[int][64]int) int {
+	luma, ok := tables[0]
+	if !ok {
+		return 0
+	}
+	chroma, hasChroma := tables[1]
+	for q := 1; q <= 100; q++ {
+		if scaleIJG(ijgLuma, q) != luma {
+			continue
+		}
+		if hasChroma && scaleIJG(ijgChroma, q) != chroma {
+			continue
+		}
+		return q
+	}
+	return 0
+}
+
+func hashTables(tables map[int][64]int) string {
+	var ids []int
+	for id := range tables {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	h := sha256.New()
+	for _, id := range ids {
+		t := tables[id]
+		h.Write([]byte{byte(id)})
+		for _, v := range t {
+			h.Write([]byte{byte(v >> 8), byte(v)})
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// checkQuantisation compares the JPEG tables with what the declared camera
+// produces. Camera firmware ships its own tables; a standard libjpeg set
+// or a set the model has never produced before means the file was
+// re-encoded. Counts per model are learned from uploads.
+func (s *service) checkQuantisation(ctx context.Context, a *Authenticity, data []byte, meta *PhotoMeta) {
+	tables := quantTables(data)
+	if len(tables) == 0 {
+		return
+	}
+	a.QTables = hashTables(tables)
+	a.Quality = ijgQuality(tables)
+	if meta.Camera == nil || (meta.Camera.Make == "" && meta.Camera.Model == "") {
+		if a.Quality > 0 {
+			a.add(findingQuantisation, severityInfo, "standard libjpeg tables at quality %d", a.Quality)
+		}
+		return
+	}
+	model := strings.TrimSpace(meta.Camera.Make + " " + meta.Camera.Model)
+	if a.Quality > 0 {
+		a.add(findingQuantisation, severityWarn, "standard libjpeg tables at quality %d, not the tables of a %s", a.Quality, model)
+	}
+
+	cur, err := s.db.Query(ctx, "qtables", "model", model)
+	if err != nil {
+		log.Println("err querying qtables")
+		return
+	}
+	defer cur.Close(ctx)
+	var seen *qtableCount
+	total := 0
+	for cur.Next(ctx) {
+		c := &qtableCount{}
+		if err := cur.Decode(c); err != nil {
+			continue
+		}
+		total += c.Count
+		if c.Hash == a.QTables {
+			seen = c
+		}
+	}
+	if seen == nil && total >= qtableMinSamples && a.Quality == 0 {
+		a.add(findingQuantisation, severityWarn, "tables never seen in %d uploads from %s", total, model)
+	}
+
+	if seen == nil {
+		seen = &qtableCount{ID: primitive.NewObjectID(), Model: model, Hash: a.QTables}
+	}
+	seen.Count++
+	if err := s.db.Update(ctx, "qtables", "_id", seen.ID, bson.M{"model": seen.Model, "hash": seen.Hash, "count": seen.Count}).Err(); err != nil && err != mongo.ErrNoDocuments {
+		log.Println("err counting qtables", err)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+
+	"mongo/geo"
+)
+
+// loadCadastre indexes the parcel files listed in PARCEL_DATA (comma
+// separated GeoJSON or shapefiles). PARCEL_CRS overrides the CRS declared
+// in the files, e.g. EPSG:3826 for TWD97 TM2.
+func loadCadastre() (*geo.Cadastre, error) {
+	var paths []string
+	for _, p := range strings.Split(os.Getenv("PARCEL_DATA"), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			paths = append(paths, p)
+		}
+	}
+	if len(paths) == 0 {
+		log.Println("PARCEL_DATA not set, cadastral lookup disabled")
+		return nil, nil
+	}
+	var proj geo.Projection
+	if crs := os.Getenv("PARCEL_CRS"); crs != "" {
+		if proj = geo.ProjectionFor(crs); proj == nil {
+			log.Println("unknown PARCEL_CRS", crs, "- using the files' own CRS")
+		}
+	}
+	c, err := geo.LoadCadastre(paths, proj)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("cadastre loaded:", c.Len(), "parcels")
+	return c, nil
+}
+
+// photoView turns extracted metadata into the camera view for a lookup.
+func photoView(meta *PhotoMeta) (geo.View, bool) {
+	if meta == nil || meta.GPS == nil {
+		return geo.View{}, false
+	}
+	v := geo.View{Position: geo.Point{Lon: meta.GPS.Long, Lat: meta.GPS.Lat}, FocalLength: meta.FocalLength}
+	if meta.Heading != nil {
+		h := meta.Heading.Degrees
+		v.Heading = &h
+	}
+	if meta.GPS.Accuracy != nil {
+		v.Accuracy = *meta.GPS.Accuracy
+	}
+	return v, true
+}
+
+// lookupParcel finds the 地段地號 a photo shows. It returns nil when there
+// is no parcel data or the photo has no position.
+func (s *service) lookupParcel(meta *PhotoMeta) *geo.Result {
+	if s.cadastre == nil {
+		return nil
+	}
+	v, ok := photoView(meta)
+	if !ok {
+		return nil
+	}
+	return s.cadastre.Lookup(v)
+}
@@ -0,0 +1,150 @@
+// Command stubidp is a minimal OpenID Connect provider for exercising the
+// /oidc login flow locally. It approves every authorisation request as the
+// user given by -sub and signs ID tokens with a throwaway RSA key.
+//
+//	go run ./cmd/stubidp -addr :9000 -client sc-local
+//
+// with an oidc.json such as
+//
+//	{"providers": [{"name": "stub", "issuer": "http://localhost:9000",
+//	  "clientid": "sc-local", "redirecturl": "http://localhost:8000/oidc/stub/callback",
+//	  "identityclaim": "role", "identitymap": {"plant-manager": "factory"},
+//	  "departmentclaim": "org"}]}
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+type grant struct {
+	clientID  string
+	redirect  string
+	nonce     string
+	challenge string
+}
+
+type idp struct {
+	issuer string
+	client string
+	sub    string
+	role   string
+	org    string
+	key    *rsa.PrivateKey
+
+	mu     sync.Mutex
+	grants map[string]*grant
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (p *idp) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]interface{}{
+		"issuer":                                p.issuer,
+		"authorization_endpoint":                p.issuer + "/authorize",
+		"token_endpoint":                        p.issuer + "/token",
+		"jwks_uri":                              p.issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (p *idp) jwks(w http.ResponseWriter, r *http.Request) {
+	pub := p.key.PublicKey
+	writeJSON(w, map[string]interface{}{"keys": []map[string]string{{
+		"kty": "RSA", "kid": "stub", "use": "sig", "alg": "RS256",
+		"n": b64(pub.N.Bytes()), "e": b64(big.NewInt(int64(pub.E)).Bytes()),
+	}}})
+}
+
+func (p *idp) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != p.client || q.Get("code_challenge_method") != "S256" {
+		http.Error(w, "bad authorisation request", http.StatusBadRequest)
+		return
+	}
+	code := make([]byte, 16)
+	rand.Read(code)
+	c := b64(code)
+	p.mu.Lock()
+	p.grants[c] = &grant{clientID: q.Get("client_id"), redirect: q.Get("redirect_uri"), nonce: q.Get("nonce"), challenge: q.Get("code_challenge")}
+	p.mu.Unlock()
+	v := url.Values{"code": {c}, "state": {q.Get("state")}}
+	http.Redirect(w, r, q.Get("redirect_uri")+"?"+v.Encode(), http.StatusFound)
+}
+
+func (p *idp) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	p.mu.Lock()
+	g, ok := p.grants[r.PostForm.Get("code")]
+	delete(p.grants, r.PostForm.Get("code"))
+	p.mu.Unlock()
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || g.redirect != r.PostForm.Get("redirect_uri") || b64(sum[:]) != g.challenge {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, map[string]string{"error": "invalid_grant"})
+		return
+	}
+	now := time.Now().Unix()
+	claims := map[string]interface{}{
+		"iss": p.issuer, "aud": g.clientID, "sub": p.sub, "nonce": g.nonce,
+		"iat": now, "exp": now + 300,
+		"preferred_username": p.sub, "name": "Stub " + p.sub, "email": p.sub + "@stub.local",
+		"role": p.role, "org": p.org,
+	}
+	hd, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "stub", "typ": "JWT"})
+	cd, _ := json.Marshal(claims)
+	signing := b64(hd) + "." + b64(cd)
+	h := sha256.Sum256([]byte(signing))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, h[:])
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"access_token": "stub", "token_type": "Bearer", "expires_in": 300,
+		"id_token": signing + "." + b64(sig),
+	})
+}
+
+func main() {
+	addr := flag.String("addr", ":9000", "listen address")
+	issuer := flag.String("issuer", "http://localhost:9000", "issuer URL")
+	client := flag.String("client", "sc-local", "accepted client_id")
+	sub := flag.String("sub", "alice", "subject of every issued token")
+	role := flag.String("role", "plant-manager", "value of the role claim")
+	org := flag.String("org", "Stub Farms", "value of the org claim")
+	flag.Parse()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		log.Fatal(err)
+	}
+	p := &idp{issuer: strings.TrimSuffix(*issuer, "/"), client: *client, sub: *sub, role: *role, org: *org, key: key, grants: map[string]*grant{}}
+	http.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	http.HandleFunc("/jwks", p.jwks)
+	http.HandleFunc("/authorize", p.authorize)
+	http.HandleFunc("/token", p.token)
+	log.Println("stub idp listening on", *addr, "as", p.issuer)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Transfer states.
+const (
+	transferPending   = "pending"
+	transferAccepted  = "accepted"
+	transferRejected  = "rejected"
+	transferCancelled = "cancelled"
+)
+
+const transfersDir = "transfers/"
+
+// custodyLocks keeps one custody change per post in flight, so what a
+// sender holds is not promised twice.
+var custodyLocks sync.Map
+
+// Signature is the server's countersignature of what one party did to a
+// transfer, made while that party's session was verified. Digest is the
+// sha256 of the transfer's terms, so both parties sign the same thing.
+type Signature struct {
+	User     string `json:"user" bson:"user"`
+	Identity string `json:"identity" bson:"identity"`
+	Action   string `json:"action" bson:"action"`
+	Time     string `json:"time" bson:"time"`
+	Digest   string `json:"digest" bson:"digest"`
+	Sig      string `json:"sig" bson:"sig"`
+}
+
+// Transfer hands Amount of a post from Sender to Receiver. Once the
+// receiver accepts, the transfer with both signatures is written to Record
+// and anchored.
+type Transfer struct {
+	ID                primitive.ObjectID `json:"id" bson:"_id"`
+	Post              primitive.ObjectID `json:"post" bson:"post"`
+	Tag               string             `json:"tag" bson:"tag"`
+	Sender            string             `json:"sender" bson:"sender"`
+	Receiver          string             `json:"receiver" bson:"receiver"`
+	Amount            int                `json:"amount" bson:"amount"`
+	Unit              string             `json:"unit" bson:"unit"`
+	Documents         []Evidence         `json:"documents,omitempty" bson:"documents,omitempty"`
+	Note              string             `json:"note,omitempty" bson:"note,omitempty"`
+	Created           string             `json:"created" bson:"created"`
+	Status            string             `json:"status" bson:"status"`
+	Decided           string             `json:"decided,omitempty" bson:"decided,omitempty"`
+	ReceiverNote      string             `json:"receivernote,omitempty" bson:"receivernote,omitempty"`
+	SenderSignature   *Signature         `json:"sendersignature" bson:"sendersignature"`
+	ReceiverSignature *Signature         `json:"receiversignature,omitempty" bson:"receiversignature,omitempty"`
+	Record            string             `json:"record,omitempty" bson:"record,omitempty"`
+	Hash              string             `json:"hash,omitempty" bson:"hash,omitempty"`
+	TxHash            string             `json:"txhash,omitempty" bson:"txhash,omitempty"`
+	// Source is the EPCIS event a transfer was captured from.
+	Source string `json:"source,omitempty" bson:"source,omitempty"`
+	// Contents are the transfers of what is packed in a package, which
+	// go with it; each of them is PartOf the package's transfer.
+	Contents []primitive.ObjectID `json:"contents,omitempty" bson:"contents,omitempty"`
+	PartOf   primitive.ObjectID   `json:"partof,omitempty" bson:"partof,omitempty"`
+}
+
+// digest is the sha256 of the terms the sender proposed.
+func (t *Transfer) digest() string {
+	terms := struct {
+		ID        string     `json:"id"`
+		Post      string     `json:"post"`
+		Tag       string     `json:"tag"`
+		Sender    string     `json:"sender"`
+		Receiver  string     `json:"receiver"`
+		Amount    int        `json:"amount"`
+		Unit      string     `json:"unit"`
+		Documents []Evidence `json:"documents"`
+		Note      string     `json:"note"`
+		Created   string     `json:"created"`
+		Contents  []string   `json:"contents,omitempty"`
+		PartOf    string     `json:"partof,omitempty"`
+	}{ID: t.ID.Hex(), Post: t.Post.Hex(), Tag: t.Tag, Sender: t.Sender, Receiver: t.Receiver, Amount: t.Amount, Unit: t.Unit, Documents: t.Documents, Note: t.Note, Created: t.Created}
+	for _, c := range t.Contents {
+		terms.Contents = append(terms.Contents, c.Hex())
+	}
+	if !t.PartOf.IsZero() {
+		terms.PartOf = t.PartOf.Hex()
+	}
+	data, _ := json.Marshal(terms)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func signaturePayload(sig *Signature) []byte {
+	return []byte("custody\n" + sig.Action + "\n" + sig.Digest + "\n" + sig.User + "\n" + sig.Identity + "\n" + sig.Time)
+}
+
+func (s *service) countersign(se *session, t *Transfer, action string) *Signature {
+	sig := &Signature{User: se.Username, Identity: se.Identity, Action: action, Time: time.Now().In(farmZone).Format(time.RFC3339), Digest: t.digest()}
+	sig.Sig = s.sessions.sign(signaturePayload(sig))
+	return sig
+}
+
+// verifySignature checks sig was made by this server over t's terms.
+func (s *service) verifySignature(t *Transfer, sig *Signature) bool {
+	return sig != nil && sig.Digest == t.digest() && hmac.Equal([]byte(s.sessions.sign(signaturePayload(sig))), []byte(sig.Sig))
+}
+
+// firstHolder is who has a post before any transfer: the factory for lots
+// made from other lots, otherwise the farmer who posted it.
+func firstHolder(p *Post) string {
+	if len(p.Parents) > 0 && p.Factory != "" {
+		return p.Factory
+	}
+	return p.User
+}
+
+func (s *service) transfersWhere(ctx context.Context, filter bson.M) ([]*Transfer, error) {
+	cur, err := s.db.QueryFilter(ctx, "transfers", filter, options.Find().SetSort(bson.M{"created": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	ret := []*Transfer{}
+	for cur.Next(ctx) {
+		t := &Transfer{}
+		if err := cur.Decode(t); err != nil {
+			log.Println(err)
+			continue
+		}
+		ret = append(ret, t)
+	}
+	return ret, nil
+}
+
+// Holding is how much of a post one party has.
+type Holding struct {
+	Party  string `json:"party"`
+	Amount int    `json:"amount"`
+}
+
+// holdings replays the accepted transfers decided by at over who held
+// the post first.
+func holdings(p *Post, transfers []*Transfer, at time.Time) map[string]int {
+	held := map[string]int{firstHolder(p): p.Amount}
+	var accepted []*Transfer
+	for _, t := range transfers {
+		if t.Status != transferAccepted {
+			continue
+		}
+		decided, err := time.Parse(time.RFC3339, t.Decided)
+		if err != nil || decided.After(at) {
+			continue
+		}
+		accepted = append(accepted, t)
+	}
+	sort.SliceStable(accepted, func(i, j int) bool { return accepted[i].Decided < accepted[j].Decided })
+	for _, t := range accepted {
+		held[t.Sender] -= t.Amount
+		held[t.Receiver] += t.Amount
+		if held[t.Sender] <= 0 {
+			delete(held, t.Sender)
+		}
+	}
+	return held
+}
+
+type transferRequest struct {
+	Receiver  string   `json:"receiver"`
+	Amount    int      `json:"amount"`
+	Documents []string `json:"documents"`
+	Note      string   `json:"note"`
+	// Source is set on transfers captured from EPCIS.
+	Source string `json:"-"`
+}
+
+// initiateTransfer handles POST /post/{id}/transfers. The caller has to
+// hold at least Amount of the post beyond what they already have pending.
+func (s *service) initiateTransfer(w http.ResponseWriter, r *http.Request) {
+	se := s.sessionFrom(r)
+	if se == nil {
+		writeMessage(w, http.StatusUnauthorized, "session required")
+		return
+	}
+	p, ok := s.postFromVars(w, r)
+	if !ok {
+		return
+	}
+	in := &transferRequest{}
+	if err := json.NewDecoder(r.Body).Decode(in); err != nil {
+		writeMessage(w, http.StatusBadRequest, "body must be a json transfer")
+		return
+	}
+	t, err := s.openTransfer(se, p, in)
+	if err != nil {
+		writeMessage(w, uploadStatus(err), err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(t)
+}
+
+// openTransfer does the work of initiateTransfer.
+func (s *service) openTransfer(se *session, p *Post, in *transferRequest) (*Transfer, error) {
+	if in.Receiver == "" || in.Amount <= 0 {
+		return nil, uploadErrorf(http.StatusBadRequest, "receiver and a positive amount are required")
+	}
+	if in.Receiver == se.Username {
+		return nil, uploadErrorf(http.StatusBadRequest, "cannot transfer to yourself")
+	}
+	if p.Container != "" {
+		return nil, uploadErrorf(http.StatusConflict, "%s is packed in %s, transfer that or unpack it first", p.Tag, p.Container)
+	}
+	if p.Package != "" && in.Amount != p.Amount {
+		return nil, uploadErrorf(http.StatusBadRequest, "a package is transferred whole")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := s.findUser(ctx, "username", in.Receiver); err != nil {
+		return nil, uploadErrorf(http.StatusNotFound, "no user %s", in.Receiver)
+	}
+	docs, err := s.paperworkEvidence(ctx, p.Tag, in.Documents, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+
+	mu, _ := custodyLocks.LoadOrStore(p.ID.Hex(), &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	defer mu.(*sync.Mutex).Unlock()
+	transfers, err := s.transfersWhere(ctx, bson.M{"post": p.ID})
+	if err != nil {
+		return nil, err
+	}
+	free := holdings(p, transfers, time.Now())[se.Username]
+	for _, t := range transfers {
+		if t.Status == transferPending && t.Sender == se.Username {
+			free -= t.Amount
+		}
+	}
+	if free < in.Amount {
+		return nil, uploadErrorf(http.StatusConflict, "%s does not hold that much of %s", se.Username, p.Tag)
+	}
+
+	t := &Transfer{ID: primitive.NewObjectID(), Post: p.ID, Tag: p.Tag, Sender: se.Username, Receiver: in.Receiver, Amount: in.Amount, Unit: unitOf(p), Documents: docs, Note: in.Note, Created: time.Now().In(farmZone).Format(time.RFC3339), Status: transferPending, Source: in.Source}
+	var contents []*Transfer
+	if p.Package != "" {
+		if contents, err = s.packageTransfers(ctx, se, p, t); err != nil {
+			return nil, err
+		}
+	}
+	t.SenderSignature = s.countersign(se, t, "send")
+	// the contents go in before the package transfer listing them, and
+	// come out again if any of it fails
+	var added []*Transfer
+	for _, ct := range append(contents, t) {
+		if _, err := s.db.Add(ctx, "transfers", ct); err != nil {
+			log.Println("err adding transfer", err)
+			for _, a := range added {
+				s.db.DeleteOne(ctx, "transfers", "_id", a.ID)
+			}
+			return nil, err
+		}
+		added = append(added, ct)
+	}
+	return t, nil
+}
+
+func (s *service) findTransfer(ctx context.Context, id primitive.ObjectID) (*Transfer, error) {
+	t := &Transfer{}
+	if err := s.db.QueryOne(ctx, "transfers", "_id", id).Decode(t); err != nil {
+		return nil, uploadErrorf(http.StatusNotFound, "transfer not found")
+	}
+	return t, nil
+}
+
+// decideTransfer lets the receiver accept or reject a pending transfer, or
+// the sender cancel it. Acceptance is anchored before it takes effect.
+func (s *service) decideTransfer(w http.ResponseWriter, r *http.Request, status string) {
+	se := s.sessionFrom(r)
+	if se == nil {
+		writeMessage(w, http.StatusUnauthorized, "session required")
+		return
+	}
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var in struct {
+		Note string `json:"note"`
+	}
+	json.NewDecoder(r.Body).Decode(&in)
+	t, err := s.settleTransfer(se, id, status, in.Note)
+	if err != nil {
+		writeMessage(w, uploadStatus(err), err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+// settleTransfer does the work of decideTransfer.
+func (s *service) settleTransfer(se *session, id primitive.ObjectID, status string, note string) (*Transfer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	t, err := s.findTransfer(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	party := t.Receiver
+	if status == transferCancelled {
+		party = t.Sender
+	}
+	if se.Username != party {
+		return nil, uploadErrorf(http.StatusForbidden, "only %s can do that", party)
+	}
+	if !t.PartOf.IsZero() {
+		return nil, uploadErrorf(http.StatusConflict, "%s goes with its package, settle transfer %s", t.Tag, t.PartOf.Hex())
+	}
+
+	mu, _ := custodyLocks.LoadOrStore(t.Post.Hex(), &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	defer mu.(*sync.Mutex).Unlock()
+	if t, err = s.findTransfer(ctx, id); err != nil {
+		return nil, err
+	}
+	if t.Status == status && len(t.Contents) > 0 {
+		// settling a package again finishes contents left pending
+		if err := s.settleContents(se, t); err != nil {
+			return nil, err
+		}
+		return t, nil
+	}
+	if t.Status != transferPending {
+		return nil, uploadErrorf(http.StatusConflict, "transfer is already %s", t.Status)
+	}
+	if !s.verifySignature(t, t.SenderSignature) {
+		return nil, uploadErrorf(http.StatusConflict, "transfer terms do not match the sender's signature")
+	}
+
+	t.Status, t.ReceiverNote = status, note
+	set := bson.M{"status": status}
+	if status != transferCancelled {
+		action := map[string]string{transferAccepted: "accept", transferRejected: "reject"}[status]
+		t.ReceiverSignature = s.countersign(se, t, action)
+		t.Decided = t.ReceiverSignature.Time
+		set["receivernote"], set["receiversignature"], set["decided"] = t.ReceiverNote, t.ReceiverSignature, t.Decided
+	}
+	if status == transferAccepted {
+		t.Record = transfersDir + t.Tag + "/" + t.ID.Hex() + ".json"
+		t.Hash, t.TxHash, err = anchorRecord(t.Record, t)
+		if err != nil {
+			log.Println("err anchoring "+t.Record, err)
+			return nil, uploadErrorf(http.StatusBadGateway, "could not anchor the handoff")
+		}
+		set["record"], set["hash"], set["txhash"] = t.Record, t.Hash, t.TxHash
+	}
+
+	// anchoring can take a while, use a fresh context for the write
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = s.db.ModifyFilter(ctx, "transfers", bson.M{"_id": t.ID, "status": transferPending}, bson.M{"$set": set}).Decode(t)
+	if err == mongo.ErrNoDocuments {
+		return nil, uploadErrorf(http.StatusConflict, "transfer changed meanwhile")
+	}
+	if err != nil {
+		log.Println("err updating transfer", err)
+		return nil, err
+	}
+	if err := s.settleContents(se, t); err != nil {
+		return nil, uploadErrorf(http.StatusInternalServerError, "transfer is %s but its contents are not yet, settle it again: %s", t.Status, err.Error())
+	}
+	return t, nil
+}
+
+func (s *service) acceptTransfer(w http.ResponseWriter, r *http.Request) {
+	s.decideTransfer(w, r, transferAccepted)
+}
+
+func (s *service) rejectTransfer(w http.ResponseWriter, r *http.Request) {
+	s.decideTransfer(w, r, transferRejected)
+}
+
+func (s *service) cancelTransfer(w http.ResponseWriter, r *http.Request) {
+	s.decideTransfer(w, r, transferCancelled)
+}
+
+// postTransfers lists every transfer of a post, oldest first.
+func (s *service) postTransfers(w http.ResponseWriter, r *http.Request) {
+	p, ok := s.postFromVars(w, r)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ret, err := s.transfersWhere(ctx, bson.M{"post": p.ID})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ret)
+}
+
+// myTransfers lists the caller's transfers either way, narrowed by
+// ?status=, so a receiver can find what waits for them.
+func (s *service) myTransfers(w http.ResponseWriter, r *http.Request) {
+	se := s.sessionFrom(r)
+	if se == nil {
+		writeMessage(w, http.StatusUnauthorized, "session required")
+		return
+	}
+	filter := bson.M{"$or": bson.A{bson.M{"sender": se.Username}, bson.M{"receiver": se.Username}}}
+	if st := r.URL.Query().Get("status"); st != "" {
+		filter["status"] = st
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ret, err := s.transfersWhere(ctx, filter)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ret)
+}
+
+// postCustody answers who held a post at ?at= (RFC 3339, default now).
+func (s *service) postCustody(w http.ResponseWriter, r *http.Request) {
+	p, ok := s.postFromVars(w, r)
+	if !ok {
+		return
+	}
+	at := time.Now()
+	if v := r.URL.Query().Get("at"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			writeMessage(w, http.StatusBadRequest, "at must be an RFC 3339 time")
+			return
+		}
+		at = t
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	transfers, err := s.transfersWhere(ctx, bson.M{"post": p.ID, "status": transferAccepted})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	ret := []Holding{}
+	for party, amount := range holdings(p, transfers, at) {
+		ret = append(ret, Holding{Party: party, Amount: amount})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Amount > ret[j].Amount })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"post": p.ID, "tag": p.Tag, "at": at.In(farmZone).Format(time.RFC3339), "unit": unitOf(p), "holders": ret})
+}
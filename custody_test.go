@@ -0,0 +1,52 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHoldings(t *testing.T) {
+	at := func(s string) time.Time {
+		tm, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			panic(err)
+		}
+		return tm
+	}
+	tr := func(from, to string, amount int, status, decided string) *Transfer {
+		return &Transfer{Sender: from, Receiver: to, Amount: amount, Status: status, Decided: decided}
+	}
+	harvest := &Post{User: "ann", Factory: "mill", Amount: 100}
+	lot := &Post{User: "ann", Factory: "mill", Amount: 40, Parents: []LotLink{{Tag: "parent"}}}
+	chain := []*Transfer{
+		tr("bob", "cat", 10, transferAccepted, "2026-03-03T09:00:00+08:00"),
+		tr("ann", "bob", 30, transferAccepted, "2026-03-02T09:00:00+08:00"),
+		tr("ann", "dan", 20, transferPending, ""),
+		tr("ann", "eve", 20, transferRejected, "2026-03-02T10:00:00+08:00"),
+		tr("ann", "fay", 5, transferAccepted, "yesterday"),
+	}
+	tests := []struct {
+		name      string
+		post      *Post
+		transfers []*Transfer
+		at        string
+		want      map[string]int
+	}{
+		{"no transfers", harvest, nil, "2026-03-01T00:00:00+08:00", map[string]int{"ann": 100}},
+		{"lot starts at the factory", lot, nil, "2026-03-01T00:00:00+08:00", map[string]int{"mill": 40}},
+		{"before any decision", harvest, chain, "2026-03-01T00:00:00+08:00", map[string]int{"ann": 100}},
+		{"first decided", harvest, chain, "2026-03-02T12:00:00+08:00", map[string]int{"ann": 70, "bob": 30}},
+		{"replayed in decision order", harvest, chain, "2026-03-04T00:00:00+08:00", map[string]int{"ann": 70, "bob": 20, "cat": 10}},
+		{"decided in another zone", harvest, chain, "2026-03-02T01:00:00Z", map[string]int{"ann": 70, "bob": 30}},
+		{"all passed on", harvest, []*Transfer{
+			tr("ann", "bob", 100, transferAccepted, "2026-03-02T09:00:00+08:00"),
+			tr("bob", "cat", 100, transferAccepted, "2026-03-03T09:00:00+08:00"),
+		}, "2026-03-04T00:00:00+08:00", map[string]int{"cat": 100}},
+	}
+	for _, tt := range tests {
+		if got := holdings(tt.post, tt.transfers, at(tt.at)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: holdings = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
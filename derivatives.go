@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"mongo/derive"
+)
+
+// Public renditions by name, as the longest edge in pixels.
+var renditions = map[string]int{
+	"thumb":  160,
+	"small":  480,
+	"medium": 1024,
+	"large":  2048,
+}
+
+const (
+	defaultRendition = "large"
+	derivedDir       = "derived/"
+	derivedQuality   = 85
+)
+
+// derivedLocks makes concurrent requests for the same rendition wait for
+// one encoder instead of each doing the work.
+var derivedLocks sync.Map
+
+// verificationCode is a short form of the original's sha256, the same hash
+// that is anchored on chain, for people to compare by eye.
+func verificationCode(data []byte) string {
+	sum := sha256.Sum256(data)
+	h := strings.ToUpper(hex.EncodeToString(sum[:4]))
+	return h[:4] + "-" + h[4:]
+}
+
+// imagePath turns the {tag} and {file} route variables into the path of an
+// original, refusing anything that would leave images/.
+func imagePath(r *http.Request) (string, string, string, bool) {
+	v := mux.Vars(r)
+	tag, file := v["tag"], v["file"]
+	if tag == "" || file == "" || tag != filepath.Base(tag) || file != filepath.Base(file) || strings.HasPrefix(tag, ".") || strings.HasPrefix(file, ".") {
+		return "", "", "", false
+	}
+	return tag, file, "images/" + tag + "/" + file, true
+}
+
+// loadUpright decodes an original and turns it the way its EXIF
+// orientation says it should be viewed. It also returns the file's bytes.
+func loadUpright(original string) (*image.RGBA, []byte, error) {
+	data, err := ioutil.ReadFile(original)
+	if err != nil {
+		return nil, nil, err
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+	orientation := 1
+	if meta, err := ExtractMeta(bytes.NewReader(data)); err == nil && meta.Orientation != nil {
+		orientation = *meta.Orientation
+	}
+	return derive.Orient(img, orientation), data, nil
+}
+
+// renderDerived turns the original upright, scales it and re-encodes it
+// without any metadata.
+func renderDerived(original string, size int, mark string) ([]byte, error) {
+	img, data, err := loadUpright(original)
+	if err != nil {
+		return nil, err
+	}
+	out := derive.Fit(img, size)
+	if mark != "" {
+		derive.Watermark(out, mark+"  "+verificationCode(data))
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, out, &jpeg.Options{Quality: derivedQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// derivedImage serves a metadata-free rendition of an uploaded photo to a
+// signed URL or a session with rights on the post, rendering and caching it
+// under derived/ on first request. ?size= picks a rendition and
+// ?watermark=1 stamps the tag and verification code.
+func (s *service) derivedImage(w http.ResponseWriter, r *http.Request) {
+	tag, file, original, ok := imagePath(r)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !s.authorizeTag(w, r, tag, "/"+original) {
+		return
+	}
+	src, err := os.Stat(original)
+	if err != nil || src.IsDir() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	name := r.URL.Query().Get("size")
+	if name == "" {
+		name = defaultRendition
+	}
+	size, ok := renditions[name]
+	if !ok {
+		writeMessage(w, http.StatusBadRequest, "size must be thumb, small, medium or large")
+		return
+	}
+	mark := ""
+	if wm := r.URL.Query().Get("watermark"); wm == "1" || wm == "true" {
+		mark = tag
+	}
+
+	base := strings.TrimSuffix(file, filepath.Ext(file))
+	cached := derivedDir + tag + "/" + base + "_" + name
+	if mark != "" {
+		cached += "_wm"
+	}
+	cached += ".jpeg"
+
+	mu, _ := derivedLocks.LoadOrStore(cached, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	fi, err := os.Stat(cached)
+	if err != nil || fi.ModTime().Before(src.ModTime()) {
+		err = s.writeDerived(original, cached, size, mark)
+	}
+	mu.(*sync.Mutex).Unlock()
+	if err != nil {
+		log.Println("err rendering", original, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	http.ServeFile(w, r, cached)
+}
+
+func (s *service) writeDerived(original string, cached string, size int, mark string) error {
+	out, err := renderDerived(original, size, mark)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(cached), 0777); err != nil {
+		return err
+	}
+	tmp := cached + ".tmp"
+	if err := ioutil.WriteFile(tmp, out, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmp, cached)
+}
+
+// originalImage serves the anchored original, with its full EXIF, to the
+// identities in ORIGINAL_IDENTITIES that also have rights on the post.
+func (s *service) originalImage(w http.ResponseWriter, r *http.Request) {
+	se := s.sessionFrom(r)
+	if se == nil {
+		writeMessage(w, http.StatusUnauthorized, "session required")
+		return
+	}
+	if !identitySet("ORIGINAL_IDENTITIES", "admin,factory")[se.Identity] {
+		writeMessage(w, http.StatusForbidden, "originals are not available to "+se.Identity)
+		return
+	}
+	tag, _, original, ok := imagePath(r)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	p, err := s.findPost(ctx, "tag", tag)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if !canAccessPost(se, p) {
+		writeMessage(w, http.StatusForbidden, se.Username+" has no rights on "+tag)
+		return
+	}
+	if fi, err := os.Stat(original); err != nil || fi.IsDir() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Cache-Control", "private, no-store")
+	http.ServeFile(w, r, original)
+}
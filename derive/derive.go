@@ -0,0 +1,115 @@
+// Package derive makes public renditions of uploaded photos: upright,
+// scaled down and re-encoded, so none of the original's metadata survives.
+package derive
+
+import (
+	"image"
+	"image/draw"
+)
+
+// toRGBA copies img into a fresh RGBA, which the other functions work on.
+// image/draw has fast paths for the YCbCr images the JPEG decoder returns.
+func toRGBA(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+	return dst
+}
+
+// Orient turns img upright according to an EXIF orientation value (1-8).
+// Stripping metadata drops the tag, so the pixels have to be rotated.
+func Orient(img image.Image, orientation int) *image.RGBA {
+	src := toRGBA(img)
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			si := y*src.Stride + x*4
+			di := dy*dst.Stride + dx*4
+			copy(dst.Pix[di:di+4], src.Pix[si:si+4])
+		}
+	}
+	return dst
+}
+
+// Fit scales img down with an area average so its longer edge is at most
+// max pixels. Smaller images are returned unchanged.
+func Fit(img *image.RGBA, max int) *image.RGBA {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	if max <= 0 || (w <= max && h <= max) {
+		return img
+	}
+	dw, dh := max, h*max/w
+	if h > w {
+		dw, dh = w*max/h, max
+	}
+	return Resize(img, dw, dh)
+}
+
+// Resize scales img to exactly dw×dh. Each output pixel averages the
+// source pixels it covers, which is right for shrinking; enlarging repeats
+// pixels.
+func Resize(img *image.RGBA, dw int, dh int) *image.RGBA {
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*h/dh, (y+1)*h/dh
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*w/dw, (x+1)*w/dw
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var r, g, b, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				i := img.PixOffset(img.Rect.Min.X+x0, img.Rect.Min.Y+sy)
+				for sx := x0; sx < x1; sx++ {
+					r += uint32(img.Pix[i])
+					g += uint32(img.Pix[i+1])
+					b += uint32(img.Pix[i+2])
+					a += uint32(img.Pix[i+3])
+					i += 4
+					n++
+				}
+			}
+			di := y*dst.Stride + x*4
+			dst.Pix[di] = uint8(r / n)
+			dst.Pix[di+1] = uint8(g / n)
+			dst.Pix[di+2] = uint8(b / n)
+			dst.Pix[di+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,58 @@
+package derive
+
+import (
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+)
+
+// grid draws rows of letters as one pixel each.
+func grid(rows ...string) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, len(rows[0]), len(rows)))
+	for y, r := range rows {
+		for x, c := range r {
+			img.Set(x, y, color.RGBA{uint8(c), 0, 0, 255})
+		}
+	}
+	return img
+}
+
+// letters reads a grid back.
+func letters(img *image.RGBA) string {
+	var rows []string
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		var r []byte
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r = append(r, img.RGBAAt(x, y).R)
+		}
+		rows = append(rows, string(r))
+	}
+	return strings.Join(rows, "/")
+}
+
+func TestOrient(t *testing.T) {
+	// every case stores the same upright picture, abc over def, the way a
+	// camera held at that orientation would
+	tests := []struct {
+		orientation int
+		stored      []string
+	}{
+		{0, []string{"abc", "def"}},
+		{1, []string{"abc", "def"}},
+		{2, []string{"cba", "fed"}},
+		{3, []string{"fed", "cba"}},
+		{4, []string{"def", "abc"}},
+		{5, []string{"ad", "be", "cf"}},
+		{6, []string{"cf", "be", "ad"}},
+		{7, []string{"fc", "eb", "da"}},
+		{8, []string{"da", "eb", "fc"}},
+		{9, []string{"abc", "def"}},
+	}
+	for _, tt := range tests {
+		if got := letters(Orient(grid(tt.stored...), tt.orientation)); got != "abc/def" {
+			t.Errorf("Orient(%v, %d) = %s, want abc/def", tt.stored, tt.orientation, got)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package derive
+
+import (
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"sort"
+)
+
+// Frame is one photo of a time-lapse with the caption stamped on it.
+type Frame struct {
+	Image   *image.RGBA
+	Caption string
+}
+
+// maxShift bounds alignment to this fraction of the frame, so a different
+// scene is not dragged half out of view.
+const maxShift = 0.08
+
+// crop cuts the largest centred w:h region out of img.
+func crop(img *image.RGBA, w int, h int) *image.RGBA {
+	b := img.Rect
+	cw, ch := b.Dx(), b.Dx()*h/w
+	if ch > b.Dy() {
+		cw, ch = b.Dy()*w/h, b.Dy()
+	}
+	x0 := b.Min.X + (b.Dx()-cw)/2
+	y0 := b.Min.Y + (b.Dy()-ch)/2
+	return img.SubImage(image.Rect(x0, y0, x0+cw, y0+ch)).(*image.RGBA)
+}
+
+// grey is a small luminance copy used for alignment.
+func grey(img *image.RGBA) ([]float64, int, int) {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	g := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := img.PixOffset(img.Rect.Min.X+x, img.Rect.Min.Y+y)
+			g[y*w+x] = 0.299*float64(img.Pix[i]) + 0.587*float64(img.Pix[i+1]) + 0.114*float64(img.Pix[i+2])
+		}
+	}
+	return g, w, h
+}
+
+// offset finds the shift of b that best lines it up with a, by mean
+// absolute difference over the overlap.
+func offset(a []float64, b []float64, w int, h int, max int) image.Point {
+	best, bestErr := image.Point{}, -1.0
+	for dy := -max; dy <= max; dy++ {
+		for dx := -max; dx <= max; dx++ {
+			sum, n := 0.0, 0
+			for y := 0; y < h; y++ {
+				sy := y + dy
+				if sy < 0 || sy >= h {
+					continue
+				}
+				for x := 0; x < w; x++ {
+					sx := x + dx
+					if sx < 0 || sx >= w {
+						continue
+					}
+					d := a[y*w+x] - b[sy*w+sx]
+					if d < 0 {
+						d = -d
+					}
+					sum += d
+					n++
+				}
+			}
+			if n == 0 {
+				continue
+			}
+			e := sum / float64(n)
+			// prefer smaller shifts on ties
+			if bestErr < 0 || e < bestErr-0.01 {
+				best, bestErr = image.Pt(dx, dy), e
+			}
+		}
+	}
+	return best
+}
+
+// Normalize crops every frame to a common aspect ratio, scales them to
+// w×h, and shifts each one to line up with the one before it so the
+// camera's small position changes between visits do not make the
+// sequence jump.
+func Normalize(frames []Frame, w int, h int) []Frame {
+	out := make([]Frame, len(frames))
+	for i, f := range frames {
+		out[i] = Frame{Image: Resize(crop(f.Image, w, h), w, h), Caption: f.Caption}
+	}
+	if len(out) < 2 {
+		return out
+	}
+
+	probe := 64
+	ph := probe * h / w
+	if ph < 1 {
+		ph = 1
+	}
+	max := int(float64(probe) * maxShift)
+	scale := float64(w) / float64(probe)
+	prev, _, _ := grey(Resize(out[0].Image, probe, ph))
+	total := image.Point{}
+	for i := 1; i < len(out); i++ {
+		cur, _, _ := grey(Resize(out[i].Image, probe, ph))
+		d := offset(prev, cur, probe, ph, max)
+		prev = cur
+		total = total.Add(d)
+		if total.X > max {
+			total.X = max
+		}
+		if total.X < -max {
+			total.X = -max
+		}
+		if total.Y > max {
+			total.Y = max
+		}
+		if total.Y < -max {
+			total.Y = -max
+		}
+		if total == (image.Point{}) {
+			continue
+		}
+		shift := image.Pt(int(float64(total.X)*scale), int(float64(total.Y)*scale))
+		moved := image.NewRGBA(image.Rect(0, 0, w, h))
+		draw.Draw(moved, moved.Bounds(), image.NewUniform(color.Black), image.Point{}, draw.Src)
+		draw.Draw(moved, moved.Bounds(), out[i].Image, shift, draw.Src)
+		out[i].Image = moved
+	}
+	return out
+}
+
+// Sheet lays frames out on a grid, cols wide, with their captions.
+func Sheet(frames []Frame, cols int, gap int) *image.RGBA {
+	if len(frames) == 0 || cols < 1 {
+		return image.NewRGBA(image.Rect(0, 0, 1, 1))
+	}
+	if cols > len(frames) {
+		cols = len(frames)
+	}
+	rows := (len(frames) + cols - 1) / cols
+	cw, ch := frames[0].Image.Rect.Dx(), frames[0].Image.Rect.Dy()
+	sheet := image.NewRGBA(image.Rect(0, 0, cols*cw+(cols+1)*gap, rows*ch+(rows+1)*gap))
+	draw.Draw(sheet, sheet.Bounds(), image.NewUniform(color.RGBA{24, 24, 24, 255}), image.Point{}, draw.Src)
+	for i, f := range frames {
+		cell := copyRGBA(f.Image)
+		Watermark(cell, f.Caption)
+		x := gap + (i%cols)*(cw+gap)
+		y := gap + (i/cols)*(ch+gap)
+		draw.Draw(sheet, image.Rect(x, y, x+cw, y+ch), cell, cell.Rect.Min, draw.Src)
+	}
+	return sheet
+}
+
+// GIF makes an animation of frames, each shown for delay hundredths of a
+// second and the last one held three times as long.
+func GIF(frames []Frame, delay int) *gif.GIF {
+	g := &gif.GIF{LoopCount: 0}
+	for i, f := range frames {
+		cell := copyRGBA(f.Image)
+		Watermark(cell, f.Caption)
+		p := image.NewPaletted(cell.Rect, palette.Plan9)
+		draw.FloydSteinberg.Draw(p, cell.Rect, cell, cell.Rect.Min)
+		g.Image = append(g.Image, p)
+		d := delay
+		if i == len(frames)-1 {
+			d *= 3
+		}
+		g.Delay = append(g.Delay, d)
+	}
+	return g
+}
+
+func copyRGBA(img *image.RGBA) *image.RGBA {
+	c := image.NewRGBA(image.Rect(0, 0, img.Rect.Dx(), img.Rect.Dy()))
+	draw.Draw(c, c.Rect, img, img.Rect.Min, draw.Src)
+	return c
+}
+
+// Sample keeps at most n indexes spread evenly over 0..total-1, always
+// including the first and last.
+func Sample(total int, n int) []int {
+	if total <= n || n < 2 {
+		ret := make([]int, total)
+		for i := range ret {
+			ret[i] = i
+		}
+		if n < 2 && total > n {
+			return ret[:n]
+		}
+		return ret
+	}
+	seen := map[int]bool{}
+	var ret []int
+	for i := 0; i < n; i++ {
+		k := i * (total - 1) / (n - 1)
+		if !seen[k] {
+			seen[k] = true
+			ret = append(ret, k)
+		}
+	}
+	sort.Ints(ret)
+	return ret
+}
@@ -0,0 +1,120 @@
+package derive
+
+import (
+	"image"
+	"strings"
+)
+
+// glyphs is a 5×7 bitmap font covering what tags and verification codes
+// use. Anything else is drawn as '?'.
+var glyphs = map[rune][7]string{
+	' ': {"00000", "00000", "00000", "00000", "00000", "00000", "00000"},
+	'0': {"01110", "10001", "10011", "10101", "11001", "10001", "01110"},
+	'1': {"00100", "01100", "00100", "00100", "00100", "00100", "01110"},
+	'2': {"01110", "10001", "00001", "00010", "00100", "01000", "11111"},
+	'3': {"11111", "00010", "00100", "00010", "00001", "10001", "01110"},
+	'4': {"00010", "00110", "01010", "10010", "11111", "00010", "00010"},
+	'5': {"11111", "10000", "11110", "00001", "00001", "10001", "01110"},
+	'6': {"00110", "01000", "10000", "11110", "10001", "10001", "01110"},
+	'7': {"11111", "00001", "00010", "00100", "01000", "01000", "01000"},
+	'8': {"01110", "10001", "10001", "01110", "10001", "10001", "01110"},
+	'9': {"01110", "10001", "10001", "01111", "00001", "00010", "01100"},
+	'A': {"01110", "10001", "10001", "11111", "10001", "10001", "10001"},
+	'B': {"11110", "10001", "10001", "11110", "10001", "10001", "11110"},
+	'C': {"01110", "10001", "10000", "10000", "10000", "10001", "01110"},
+	'D': {"11100", "10010", "10001", "10001", "10001", "10010", "11100"},
+	'E': {"11111", "10000", "10000", "11110", "10000", "10000", "11111"},
+	'F': {"11111", "10000", "10000", "11110", "10000", "10000", "10000"},
+	'G': {"01110", "10001", "10000", "10111", "10001", "10001", "01111"},
+	'H': {"10001", "10001", "10001", "11111", "10001", "10001", "10001"},
+	'I': {"01110", "00100", "00100", "00100", "00100", "00100", "01110"},
+	'J': {"00111", "00010", "00010", "00010", "00010", "10010", "01100"},
+	'K': {"10001", "10010", "10100", "11000", "10100", "10010", "10001"},
+	'L': {"10000", "10000", "10000", "10000", "10000", "10000", "11111"},
+	'M': {"10001", "11011", "10101", "10101", "10001", "10001", "10001"},
+	'N': {"10001", "10001", "11001", "10101", "10011", "10001", "10001"},
+	'O': {"01110", "10001", "10001", "10001", "10001", "10001", "01110"},
+	'P': {"11110", "10001", "10001", "11110", "10000", "10000", "10000"},
+	'Q': {"01110", "10001", "10001", "10001", "10101", "10010", "01101"},
+	'R': {"11110", "10001", "10001", "11110", "10100", "10010", "10001"},
+	'S': {"01111", "10000", "10000", "01110", "00001", "00001", "11110"},
+	'T': {"11111", "00100", "00100", "00100", "00100", "00100", "00100"},
+	'U': {"10001", "10001", "10001", "10001", "10001", "10001", "01110"},
+	'V': {"10001", "10001", "10001", "10001", "10001", "01010", "00100"},
+	'W': {"10001", "10001", "10001", "10101", "10101", "10101", "01010"},
+	'X': {"10001", "10001", "01010", "00100", "01010", "10001", "10001"},
+	'Y': {"10001", "10001", "10001", "01010", "00100", "00100", "00100"},
+	'Z': {"11111", "00001", "00010", "00100", "01000", "10000", "11111"},
+	'-': {"00000", "00000", "00000", "11111", "00000", "00000", "00000"},
+	':': {"00000", "01100", "01100", "00000", "01100", "01100", "00000"},
+	'.': {"00000", "00000", "00000", "00000", "00000", "01100", "01100"},
+	'/': {"00000", "00001", "00010", "00100", "01000", "10000", "00000"},
+	'#': {"01010", "01010", "11111", "01010", "11111", "01010", "01010"},
+	'_': {"00000", "00000", "00000", "00000", "00000", "00000", "11111"},
+	'?': {"01110", "10001", "00001", "00010", "00100", "00000", "00100"},
+}
+
+// Watermark draws text on a translucent band along the bottom edge of
+// img, scaled to the image width.
+func Watermark(img *image.RGBA, text string) {
+	text = strings.ToUpper(text)
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	n := len([]rune(text))
+	if n == 0 || w < 40 || h < 20 {
+		return
+	}
+	// 6 columns per glyph including spacing, text over at most 90% width
+	scale := w * 9 / 10 / (n * 6)
+	if scale > w/160+1 {
+		scale = w/160 + 1
+	}
+	if scale < 1 {
+		scale = 1
+	}
+	pad := 2 * scale
+	band := 7*scale + 2*pad
+	if band > h {
+		return
+	}
+
+	top := h - band
+	for y := top; y < h; y++ {
+		i := y * img.Stride
+		for x := 0; x < w; x++ {
+			// darken to 45%
+			img.Pix[i] = uint8(uint32(img.Pix[i]) * 45 / 100)
+			img.Pix[i+1] = uint8(uint32(img.Pix[i+1]) * 45 / 100)
+			img.Pix[i+2] = uint8(uint32(img.Pix[i+2]) * 45 / 100)
+			i += 4
+		}
+	}
+
+	x0 := w - pad - n*6*scale + scale
+	if x0 < pad {
+		x0 = pad
+	}
+	for k, c := range []rune(text) {
+		g, ok := glyphs[c]
+		if !ok {
+			g = glyphs['?']
+		}
+		gx := x0 + k*6*scale
+		for row := 0; row < 7; row++ {
+			for col := 0; col < 5; col++ {
+				if g[row][col] != '1' {
+					continue
+				}
+				for dy := 0; dy < scale; dy++ {
+					for dx := 0; dx < scale; dx++ {
+						x, y := gx+col*scale+dx, top+pad+row*scale+dy
+						if x >= w || y >= h {
+							continue
+						}
+						i := y*img.Stride + x*4
+						img.Pix[i], img.Pix[i+1], img.Pix[i+2] = 255, 255, 255
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,688 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Document kinds. Certificates have to say who issued them and until when
+// they hold; they are what expiry notices are sent for.
+const (
+	docCertificate = "certificate"
+	docInspection  = "inspection"
+	docInvoice     = "invoice"
+	docOther       = "other"
+)
+
+var documentKinds = map[string]bool{docCertificate: true, docInspection: true, docInvoice: true, docOther: true}
+
+// Document states as the API shows them, worked out from ValidUntil.
+const (
+	docValid    = "valid"
+	docExpiring = "expiring"
+	docExpired  = "expired"
+)
+
+const (
+	documentsDir = "documents/"
+	alertExpiry  = "expiry"
+)
+
+// documentNoticeDays are how many days before a certificate expires its
+// parties are told, DOCUMENT_NOTICE_DAYS such as "30,7,1", largest first.
+// A notice also goes out on the day it lapses.
+func documentNoticeDays() []int {
+	var ret []int
+	for _, v := range strings.Split(os.Getenv("DOCUMENT_NOTICE_DAYS"), ",") {
+		if n, err := strconv.Atoi(strings.TrimSpace(v)); err == nil && n > 0 {
+			ret = append(ret, n)
+		}
+	}
+	if len(ret) == 0 {
+		ret = []int{30, 7}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(ret)))
+	return ret
+}
+
+// DocumentVersion is one file filed for a document, with what it said at
+// the time. Hash is the sha256 of the JSON kept at Record, the version
+// without Hash and TxHash, so anchoring it anchors SHA256 of the file too.
+// PrevHash chains each version to the one before it.
+type DocumentVersion struct {
+	Document   primitive.ObjectID `json:"document" bson:"document"`
+	Tag        string             `json:"tag" bson:"tag"`
+	Kind       string             `json:"kind" bson:"kind"`
+	Version    int                `json:"version" bson:"version"`
+	Name       string             `json:"name" bson:"name"`
+	File       string             `json:"file" bson:"file"`
+	Size       int64              `json:"size" bson:"size"`
+	SHA256     string             `json:"sha256" bson:"sha256"`
+	Issuer     string             `json:"issuer,omitempty" bson:"issuer,omitempty"`
+	Number     string             `json:"number,omitempty" bson:"number,omitempty"`
+	Issued     string             `json:"issued,omitempty" bson:"issued,omitempty"`
+	ValidFrom  string             `json:"validfrom,omitempty" bson:"validfrom,omitempty"`
+	ValidUntil string             `json:"validuntil,omitempty" bson:"validuntil,omitempty"`
+	User       string             `json:"user" bson:"user"`
+	Time       string             `json:"time" bson:"time"`
+	Note       string             `json:"note,omitempty" bson:"note,omitempty"`
+	PrevHash   string             `json:"prevhash,omitempty" bson:"prevhash,omitempty"`
+	Record     string             `json:"record,omitempty" bson:"record,omitempty"`
+	Hash       string             `json:"hash,omitempty" bson:"hash,omitempty"`
+	TxHash     string             `json:"txhash,omitempty" bson:"txhash,omitempty"`
+	URL        string             `json:"url,omitempty" bson:"-"`
+}
+
+// Document is a piece of paperwork of a post, such as an organic
+// certificate. The fields beside Versions are those of the current
+// version; Expires is the end of its last valid day.
+type Document struct {
+	ID            primitive.ObjectID `json:"id" bson:"_id"`
+	Post          primitive.ObjectID `json:"post" bson:"post"`
+	Tag           string             `json:"tag" bson:"tag"`
+	Kind          string             `json:"kind" bson:"kind"`
+	Title         string             `json:"title" bson:"title"`
+	Certification string             `json:"certification,omitempty" bson:"certification,omitempty"`
+	Issuer        string             `json:"issuer,omitempty" bson:"issuer,omitempty"`
+	Number        string             `json:"number,omitempty" bson:"number,omitempty"`
+	Issued        string             `json:"issued,omitempty" bson:"issued,omitempty"`
+	ValidFrom     string             `json:"validfrom,omitempty" bson:"validfrom,omitempty"`
+	ValidUntil    string             `json:"validuntil,omitempty" bson:"validuntil,omitempty"`
+	Expires       *time.Time         `json:"-" bson:"expires,omitempty"`
+	SHA256        string             `json:"sha256" bson:"sha256"`
+	Version       int                `json:"version" bson:"version"`
+	Versions      []*DocumentVersion `json:"versions" bson:"versions"`
+	Created       string             `json:"created" bson:"created"`
+	// Noticed are the notice days already sent for the current version, 0
+	// standing for the notice that it lapsed.
+	Noticed []int  `json:"noticed,omitempty" bson:"noticed,omitempty"`
+	Status  string `json:"status,omitempty" bson:"-"`
+}
+
+// status says whether the document holds at now, and whether it runs out
+// within the first notice period.
+func (d *Document) status(now time.Time) string {
+	if d.Expires == nil {
+		return ""
+	}
+	days := documentNoticeDays()
+	switch {
+	case !now.Before(*d.Expires):
+		return docExpired
+	case now.AddDate(0, 0, days[0]).After(*d.Expires):
+		return docExpiring
+	}
+	return docValid
+}
+
+// documentRequest is the multipart form a document or a version is filed
+// with. On a new version blank fields keep what the last version said.
+type documentRequest struct {
+	Kind          string
+	Title         string
+	Certification string
+	Issuer        string
+	Number        string
+	Issued        string
+	ValidFrom     string
+	ValidUntil    string
+	Note          string
+}
+
+func documentForm(r *http.Request, prefix string) *documentRequest {
+	return documentFields(r.FormValue, prefix)
+}
+
+// documentFields reads a document request from form values or upload
+// metadata, each field name starting with prefix.
+func documentFields(get func(string) string, prefix string) *documentRequest {
+	v := func(name string) string {
+		return strings.TrimSpace(get(prefix + name))
+	}
+	return &documentRequest{Kind: v("kind"), Title: v("title"), Certification: v("certification"), Issuer: v("issuer"), Number: v("number"), Issued: v("issued"), ValidFrom: v("validfrom"), ValidUntil: v("validuntil"), Note: v("note")}
+}
+
+// farmDate reads a farm date such as 2006-01-02.
+func farmDate(name string, v string) (time.Time, error) {
+	t, err := time.ParseInLocation("2006-01-02", v, farmZone)
+	if err != nil {
+		return t, uploadErrorf(http.StatusBadRequest, "%s must be a date like 2006-01-02", name)
+	}
+	return t, nil
+}
+
+// checkDocument checks what a version says of itself and returns when it
+// stops holding, nil for paperwork without an end date.
+func checkDocument(kind string, v *DocumentVersion) (*time.Time, error) {
+	if kind == docCertificate && (v.Issuer == "" || v.ValidUntil == "") {
+		return nil, uploadErrorf(http.StatusBadRequest, "a certificate needs its issuer and validuntil")
+	}
+	var from time.Time
+	var err error
+	if v.Issued != "" {
+		if _, err = farmDate("issued", v.Issued); err != nil {
+			return nil, err
+		}
+	}
+	if v.ValidFrom != "" {
+		if from, err = farmDate("validfrom", v.ValidFrom); err != nil {
+			return nil, err
+		}
+	}
+	if v.ValidUntil == "" {
+		return nil, nil
+	}
+	until, err := farmDate("validuntil", v.ValidUntil)
+	if err != nil {
+		return nil, err
+	}
+	if until.Before(from) {
+		return nil, uploadErrorf(http.StatusBadRequest, "validuntil is before validfrom")
+	}
+	expires := until.AddDate(0, 0, 1)
+	return &expires, nil
+}
+
+// checkNewDocument checks what a new document says of itself before
+// anything is stored, for uploads that are filed only later.
+func checkNewDocument(in *documentRequest) error {
+	if in.Kind != "" && !documentKinds[in.Kind] {
+		return uploadErrorf(http.StatusBadRequest, "kind must be certificate, inspection, invoice or other")
+	}
+	_, err := checkDocument(in.Kind, &DocumentVersion{Issuer: in.Issuer, Issued: in.Issued, ValidFrom: in.ValidFrom, ValidUntil: in.ValidUntil})
+	return err
+}
+
+// storeDocumentFile copies src to path and returns its size and sha256.
+// An existing file is never overwritten.
+func storeDocumentFile(src io.Reader, path string) (int64, string, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return 0, "", err
+	}
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return 0, "", err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(out, h), src)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fileDocument files src, uploaded as filename, as the next version of d,
+// or as the first version of a new document of p when d is nil. The file
+// goes to file/<tag>/ next to the post's other paperwork, and the version
+// is anchored before it is saved.
+func (s *service) fileDocument(user string, p *Post, d *Document, in *documentRequest, filename string, src io.Reader) (*Document, error) {
+	name := filepath.Base(filename)
+	if !validTag(name) {
+		return nil, uploadErrorf(http.StatusBadRequest, "%q cannot be used as a file name", filename)
+	}
+	if !validTag(p.Tag) {
+		return nil, uploadErrorf(http.StatusConflict, "post has no usable tag")
+	}
+	if d == nil {
+		if in.Kind == "" {
+			in.Kind = docOther
+		}
+		if !documentKinds[in.Kind] {
+			return nil, uploadErrorf(http.StatusBadRequest, "kind must be certificate, inspection, invoice or other")
+		}
+		if in.Title == "" {
+			in.Title = name
+		}
+		if in.Kind == docCertificate && in.Certification == "" {
+			in.Certification = p.Certification
+		}
+		d = &Document{ID: primitive.NewObjectID(), Post: p.ID, Tag: p.Tag, Kind: in.Kind, Title: in.Title, Certification: in.Certification, Versions: []*DocumentVersion{}}
+	} else if in.Kind != "" && in.Kind != d.Kind {
+		return nil, uploadErrorf(http.StatusBadRequest, "a new version cannot change the kind of a %s", d.Kind)
+	}
+	unlock := lockPosts(d.ID)
+	defer unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if d.Version > 0 {
+		// another version may have been filed while this one uploaded
+		cur := &Document{}
+		if err := s.db.QueryOne(ctx, "documents", "_id", d.ID).Decode(cur); err != nil {
+			return nil, uploadErrorf(http.StatusNotFound, "document not found")
+		}
+		d = cur
+	}
+	cancel()
+
+	at := time.Now().In(farmZone)
+	v := &DocumentVersion{Document: d.ID, Tag: d.Tag, Kind: d.Kind, Version: d.Version + 1, Name: name, Issuer: d.Issuer, Number: d.Number, Issued: d.Issued, ValidFrom: d.ValidFrom, ValidUntil: d.ValidUntil, User: user, Time: at.Format(time.RFC3339), Note: in.Note}
+	if d.Version > 0 {
+		v.PrevHash = d.Versions[len(d.Versions)-1].Hash
+	}
+	for _, f := range []struct {
+		to *string
+		v  string
+	}{{&v.Issuer, in.Issuer}, {&v.Number, in.Number}, {&v.Issued, in.Issued}, {&v.ValidFrom, in.ValidFrom}, {&v.ValidUntil, in.ValidUntil}} {
+		if f.v != "" {
+			*f.to = f.v
+		}
+	}
+	expires, err := checkDocument(d.Kind, v)
+	if err != nil {
+		return nil, err
+	}
+
+	v.File = fmt.Sprintf("file/%s/%s_v%d_%s", d.Tag, d.ID.Hex(), v.Version, name)
+	v.Size, v.SHA256, err = storeDocumentFile(src, v.File)
+	if err != nil {
+		log.Println("err storing "+v.File, err)
+		return nil, err
+	}
+	if v.SHA256 == d.SHA256 {
+		os.Remove(v.File)
+		return nil, uploadErrorf(http.StatusConflict, "version %d already is this file", d.Version)
+	}
+	v.Record = fmt.Sprintf("%s%s/%s_v%d.json", documentsDir, d.Tag, d.ID.Hex(), v.Version)
+	v.Hash, v.TxHash, err = anchorRecord(v.Record, v)
+	if err != nil {
+		log.Println("err anchoring "+v.Record, err)
+		os.Remove(v.File)
+		return nil, uploadErrorf(http.StatusBadGateway, "could not anchor the document")
+	}
+
+	// anchoring can take a while, use a fresh context for the writes
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	set := bson.M{"issuer": v.Issuer, "number": v.Number, "issued": v.Issued, "validfrom": v.ValidFrom, "validuntil": v.ValidUntil, "sha256": v.SHA256, "version": v.Version, "noticed": []int{}}
+	if expires != nil {
+		set["expires"] = *expires
+	}
+	if d.Version == 0 {
+		d.Issuer, d.Number, d.Issued, d.ValidFrom, d.ValidUntil = v.Issuer, v.Number, v.Issued, v.ValidFrom, v.ValidUntil
+		d.Expires, d.SHA256, d.Version, d.Created = expires, v.SHA256, v.Version, v.Time
+		d.Versions = append(d.Versions, v)
+		if _, err := s.db.Add(ctx, "documents", d); err != nil {
+			log.Println("err saving document", err)
+			os.Remove(v.File)
+			return nil, err
+		}
+		return d, nil
+	}
+	update := bson.M{"$set": set, "$push": bson.M{"versions": v}}
+	if expires == nil {
+		update["$unset"] = bson.M{"expires": ""}
+	}
+	ret := &Document{}
+	if err := s.db.ModifyFilter(ctx, "documents", bson.M{"_id": d.ID, "version": d.Version}, update).Decode(ret); err != nil {
+		os.Remove(v.File)
+		if err == mongo.ErrNoDocuments {
+			return nil, uploadErrorf(http.StatusConflict, "version %d of the document was filed meanwhile", d.Version+1)
+		}
+		log.Println("err saving document version", err)
+		return nil, err
+	}
+	return ret, nil
+}
+
+// signDocument fills in signed URLs for the files of d and its status.
+func (s *service) signDocument(d *Document, now time.Time) {
+	d.Status = d.status(now)
+	for _, v := range d.Versions {
+		path := "/" + v.File
+		v.URL = s.signURL((&url.URL{Path: path}).EscapedPath(), path)
+	}
+}
+
+func (s *service) postDocumentsOf(ctx context.Context, filter bson.M) ([]*Document, error) {
+	cur, err := s.db.QueryFilter(ctx, "documents", filter, options.Find().SetSort(bson.M{"created": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	ret := []*Document{}
+	for cur.Next(ctx) {
+		d := &Document{}
+		if err := cur.Decode(d); err != nil {
+			log.Println("err decoding document", err)
+			continue
+		}
+		ret = append(ret, d)
+	}
+	return ret, nil
+}
+
+// documentPost answers for requests about the documents of the post in the
+// path, which the session has to have rights on.
+func (s *service) documentPost(w http.ResponseWriter, r *http.Request) (*session, *Post, bool) {
+	se := s.sessionFrom(r)
+	if se == nil {
+		writeMessage(w, http.StatusUnauthorized, "session required")
+		return nil, nil, false
+	}
+	p, ok := s.postFromVars(w, r)
+	if !ok {
+		return nil, nil, false
+	}
+	if !canAccessPost(se, p) {
+		writeMessage(w, http.StatusForbidden, se.Username+" has no rights on "+p.Tag)
+		return nil, nil, false
+	}
+	return se, p, true
+}
+
+// documentFromVars loads the document in the path when the session has
+// rights on its post.
+func (s *service) documentFromVars(w http.ResponseWriter, r *http.Request) (*session, *Post, *Document, bool) {
+	se := s.sessionFrom(r)
+	if se == nil {
+		writeMessage(w, http.StatusUnauthorized, "session required")
+		return nil, nil, nil, false
+	}
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, nil, nil, false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	d := &Document{}
+	if err := s.db.QueryOne(ctx, "documents", "_id", id).Decode(d); err != nil {
+		writeMessage(w, http.StatusNotFound, "document not found")
+		return nil, nil, nil, false
+	}
+	p, err := s.findPost(ctx, "_id", d.Post)
+	if err != nil || !canAccessPost(se, p) {
+		writeMessage(w, http.StatusForbidden, se.Username+" has no rights on "+d.Tag)
+		return nil, nil, nil, false
+	}
+	return se, p, d, true
+}
+
+// uploadedDocument opens the one file of a document upload.
+func uploadedDocument(w http.ResponseWriter, r *http.Request) (*multipart.FileHeader, multipart.File, bool) {
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		writeMessage(w, http.StatusBadRequest, "body must be a multipart form")
+		return nil, nil, false
+	}
+	files := r.MultipartForm.File["file"]
+	if len(files) != 1 {
+		writeMessage(w, http.StatusBadRequest, "send exactly one file")
+		return nil, nil, false
+	}
+	f, err := files[0].Open()
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, "cannot read "+files[0].Filename)
+		return nil, nil, false
+	}
+	return files[0], f, true
+}
+
+// newDocument answers POST /post/{id}/documents, a multipart form with one
+// file and the kind, title, issuer, number, issued, validfrom, validuntil
+// and note of the document.
+func (s *service) newDocument(w http.ResponseWriter, r *http.Request) {
+	se, p, ok := s.documentPost(w, r)
+	if !ok {
+		return
+	}
+	fh, f, ok := uploadedDocument(w, r)
+	if !ok {
+		return
+	}
+	defer f.Close()
+	d, err := s.fileDocument(se.Username, p, nil, documentForm(r, ""), fh.Filename, f)
+	if err != nil {
+		writeMessage(w, uploadStatus(err), err.Error())
+		return
+	}
+	s.signDocument(d, time.Now())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(d)
+}
+
+// postDocuments answers GET /post/{id}/documents, optionally of one kind.
+func (s *service) postDocuments(w http.ResponseWriter, r *http.Request) {
+	_, p, ok := s.documentPost(w, r)
+	if !ok {
+		return
+	}
+	filter := bson.M{"post": p.ID}
+	if k := r.URL.Query().Get("kind"); k != "" {
+		filter["kind"] = k
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	docs, err := s.postDocumentsOf(ctx, filter)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	for _, d := range docs {
+		s.signDocument(d, now)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(docs)
+}
+
+// document answers GET /documents/{id} with every version of a document.
+func (s *service) document(w http.ResponseWriter, r *http.Request) {
+	_, _, d, ok := s.documentFromVars(w, r)
+	if !ok {
+		return
+	}
+	s.signDocument(d, time.Now())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d)
+}
+
+// newDocumentVersion answers POST /documents/{id}/versions, filing a
+// replacement such as a renewed certificate. Fields left out of the form
+// carry over from the current version.
+func (s *service) newDocumentVersion(w http.ResponseWriter, r *http.Request) {
+	se, p, d, ok := s.documentFromVars(w, r)
+	if !ok {
+		return
+	}
+	fh, f, ok := uploadedDocument(w, r)
+	if !ok {
+		return
+	}
+	defer f.Close()
+	in := documentForm(r, "")
+	if in.Title != "" || in.Certification != "" {
+		writeMessage(w, http.StatusBadRequest, "title and certification belong to the document, not a version")
+		return
+	}
+	ret, err := s.fileDocument(se.Username, p, d, in, fh.Filename, f)
+	if err != nil {
+		writeMessage(w, uploadStatus(err), err.Error())
+		return
+	}
+	s.signDocument(ret, time.Now())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(ret)
+}
+
+// expiringDocuments answers GET /documents/expiring?days= with the
+// documents running out within days, by default the first notice period,
+// including those already expired, of the posts the session has rights on.
+func (s *service) expiringDocuments(w http.ResponseWriter, r *http.Request) {
+	se := s.sessionFrom(r)
+	if se == nil {
+		writeMessage(w, http.StatusUnauthorized, "session required")
+		return
+	}
+	days := documentNoticeDays()[0]
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeMessage(w, http.StatusBadRequest, "days must be a whole number of days")
+			return
+		}
+		days = n
+	}
+	now := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	docs, err := s.postDocumentsOf(ctx, bson.M{"expires": bson.M{"$lte": now.AddDate(0, 0, days)}})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	posts := map[primitive.ObjectID]*Post{}
+	ret := []*Document{}
+	for _, d := range docs {
+		p, ok := posts[d.Post]
+		if !ok {
+			p, _ = s.findPost(ctx, "_id", d.Post)
+			posts[d.Post] = p
+		}
+		if !canAccessPost(se, p) {
+			continue
+		}
+		s.signDocument(d, now)
+		ret = append(ret, d)
+	}
+	sort.SliceStable(ret, func(i, j int) bool { return ret[i].Expires.Before(*ret[j].Expires) })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ret)
+}
+
+// watchDocuments sends the expiry notices of certificates as they fall
+// due.
+func (s *service) watchDocuments() {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		if err := s.noticeExpiring(ctx, time.Now()); err != nil {
+			log.Println("err checking document expiry", err)
+		}
+		cancel()
+		time.Sleep(time.Hour)
+	}
+}
+
+// noticeDue picks, of the notice days d has reached at now, the one
+// closest to expiry that has not been noticed, or -1 when none is due. It
+// also returns every day reached so earlier ones are not sent later.
+func (d *Document) noticeDue(days []int, now time.Time) (int, []int) {
+	noticed := map[int]bool{}
+	for _, n := range d.Noticed {
+		noticed[n] = true
+	}
+	var reached []int
+	due := -1
+	for _, n := range days {
+		if now.AddDate(0, 0, n).Before(*d.Expires) {
+			continue
+		}
+		reached = append(reached, n)
+		if !noticed[n] {
+			due = n
+		}
+	}
+	return due, reached
+}
+
+// noticeExpiring tells the parties of each certificate that reached a
+// notice day at now and has not been noticed for it. A certificate filed
+// late gets only the closest notice, and one that lapsed raises an alert
+// as well.
+func (s *service) noticeExpiring(ctx context.Context, now time.Time) error {
+	days := append(documentNoticeDays(), 0)
+	docs, err := s.postDocumentsOf(ctx, bson.M{"kind": docCertificate, "expires": bson.M{"$lte": now.AddDate(0, 0, days[0])}, "noticed": bson.M{"$ne": 0}})
+	if err != nil {
+		return err
+	}
+	hook := os.Getenv("DOCUMENT_WEBHOOK_URL")
+	for _, d := range docs {
+		due, reached := d.noticeDue(days, now)
+		if due < 0 {
+			continue
+		}
+		// a version filed meanwhile starts its own notices
+		err := s.db.ModifyFilter(ctx, "documents", bson.M{"_id": d.ID, "version": d.Version}, bson.M{"$addToSet": bson.M{"noticed": bson.M{"$each": reached}}}).Err()
+		if err == mongo.ErrNoDocuments {
+			continue
+		}
+		if err != nil {
+			log.Println("err marking notice of", d.ID.Hex(), err)
+			continue
+		}
+
+		subject := fmt.Sprintf("%s of %s from %s expires on %s", d.Title, d.Tag, d.Issuer, d.ValidUntil)
+		if due == 0 {
+			subject = fmt.Sprintf("%s of %s from %s expired after %s", d.Title, d.Tag, d.Issuer, d.ValidUntil)
+		}
+		created := now.In(farmZone).Format(time.RFC3339)
+		p, err := s.findPost(ctx, "_id", d.Post)
+		if err != nil {
+			log.Println("err finding post of document", d.ID.Hex(), err)
+			continue
+		}
+		sent := map[string]bool{}
+		for _, name := range []string{p.User, p.Factory, p.Market} {
+			if name == "" || sent[name] {
+				continue
+			}
+			sent[name] = true
+			note := &Notification{ID: primitive.NewObjectID(), Recipient: name, Kind: alertExpiry, Ref: d.ID, Subject: subject, Lots: []string{d.Tag}, Created: created}
+			if _, err := s.db.Add(ctx, "notifications", note); err != nil {
+				log.Println("err notifying", name, err)
+				continue
+			}
+			if hook != "" {
+				go postWebhook(hook, note)
+			}
+		}
+		if due == 0 {
+			a := &FraudAlert{ID: primitive.NewObjectID(), Kind: alertExpiry, Date: created, Reason: subject, Tags: []string{d.Tag}, Images: []*PhotoHash{}}
+			if _, err := s.db.Add(ctx, "alerts", a); err != nil {
+				log.Println("err raising expiry alert", err)
+			}
+		}
+	}
+	return nil
+}
+
+// ensureDocumentIndex makes the expiry sweep, per-post listings and
+// evidence lookups cheap.
+func (s *service) ensureDocumentIndex() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if _, err := s.db.CreateIndex(ctx, "documents", bson.M{"post": 1}); err != nil {
+		return err
+	}
+	if _, err := s.db.CreateIndex(ctx, "documents", bson.M{"expires": 1}); err != nil {
+		return err
+	}
+	_, err := s.db.CreateIndex(ctx, "documents", bson.M{"versions.file": 1})
+	return err
+}
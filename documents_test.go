@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// certificateUntil is a certificate valid through the farm date until.
+func certificateUntil(t *testing.T, until string, noticed ...int) *Document {
+	expires, err := checkDocument(docCertificate, &DocumentVersion{Issuer: "TOC", ValidUntil: until})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Document{Kind: docCertificate, ValidUntil: until, Expires: expires, Noticed: noticed}
+}
+
+func farmTime(s string) time.Time {
+	tm, err := time.ParseInLocation("2006-01-02 15:04", s, farmZone)
+	if err != nil {
+		panic(err)
+	}
+	return tm
+}
+
+func TestDocumentStatus(t *testing.T) {
+	os.Setenv("DOCUMENT_NOTICE_DAYS", "30,7")
+	defer os.Unsetenv("DOCUMENT_NOTICE_DAYS")
+
+	tests := []struct {
+		name string
+		doc  *Document
+		now  string
+		want string
+	}{
+		{"no end date", &Document{Kind: docCertificate}, "2026-06-30 12:00", ""},
+		{"well before", certificateUntil(t, "2026-06-30"), "2026-05-01 12:00", docValid},
+		{"a day before the first notice", certificateUntil(t, "2026-06-30"), "2026-05-31 23:59", docValid},
+		{"first notice day", certificateUntil(t, "2026-06-30"), "2026-06-01 00:01", docExpiring},
+		{"last valid day", certificateUntil(t, "2026-06-30"), "2026-06-30 23:59", docExpiring},
+		{"day after", certificateUntil(t, "2026-06-30"), "2026-07-01 00:00", docExpired},
+		{"long gone", certificateUntil(t, "2025-06-30"), "2026-06-30 12:00", docExpired},
+	}
+	for _, tt := range tests {
+		if got := tt.doc.status(farmTime(tt.now)); got != tt.want {
+			t.Errorf("%s: status = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNoticeDue(t *testing.T) {
+	days := []int{30, 7, 1, 0}
+	tests := []struct {
+		name    string
+		noticed []int
+		now     string
+		due     int
+		reached []int
+	}{
+		{"too early", nil, "2026-05-01 09:00", -1, nil},
+		{"first notice", nil, "2026-06-01 09:00", 30, []int{30}},
+		{"first notice sent", []int{30}, "2026-06-10 09:00", -1, []int{30}},
+		{"second notice", []int{30}, "2026-06-24 09:00", 7, []int{30, 7}},
+		{"filed late gets the closest", nil, "2026-06-25 09:00", 7, []int{30, 7}},
+		{"missed notices skipped", []int{30}, "2026-06-30 09:00", 1, []int{30, 7, 1}},
+		{"lapsed", []int{30, 7, 1}, "2026-07-01 09:00", 0, []int{30, 7, 1, 0}},
+		{"lapse noticed", []int{30, 7, 1, 0}, "2026-07-05 09:00", -1, []int{30, 7, 1, 0}},
+		{"lapsed unnoticed", nil, "2026-08-01 09:00", 0, []int{30, 7, 1, 0}},
+	}
+	for _, tt := range tests {
+		due, reached := certificateUntil(t, "2026-06-30", tt.noticed...).noticeDue(days, farmTime(tt.now))
+		if due != tt.due || !reflect.DeepEqual(reached, tt.reached) {
+			t.Errorf("%s: noticeDue = %d, %v; want %d, %v", tt.name, due, reached, tt.due, tt.reached)
+		}
+	}
+}
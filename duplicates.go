@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"mongo/phash"
+)
+
+// Two photos whose pHash differ in at most duplicatePHash bits and whose
+// dHash differ in at most duplicateDHash bits are treated as the same shot.
+// pHash drives the index search; dHash weeds out look-alike fields.
+const (
+	duplicatePHash = 10
+	duplicateDHash = 14
+)
+
+const alertDuplicate = "duplicate"
+
+// PhotoHash is an upload's perceptual fingerprint, kept in the "phashes"
+// collection and mirrored in memory for Hamming distance search.
+type PhotoHash struct {
+	ID       primitive.ObjectID `json:"id" bson:"_id"`
+	Post     primitive.ObjectID `json:"post" bson:"post"`
+	Tag      string             `json:"tag" bson:"tag"`
+	File     string             `json:"file" bson:"file"`
+	Date     string             `json:"date" bson:"date"`
+	Captured string             `json:"captured,omitempty" bson:"captured,omitempty"`
+	DHash    string             `json:"dhash" bson:"dhash"`
+	PHash    string             `json:"phash" bson:"phash"`
+}
+
+// day is the calendar day the photo belongs to: when it was taken if the
+// camera said so, otherwise when it was uploaded.
+func (h *PhotoHash) day() string {
+	if len(h.Captured) >= 10 {
+		return h.Captured[:10]
+	}
+	if len(h.Date) >= 10 {
+		return h.Date[:10]
+	}
+	return h.Date
+}
+
+// DuplicateMatch is a stored photo that looks like a new upload.
+type DuplicateMatch struct {
+	Post     primitive.ObjectID `json:"post" bson:"post"`
+	Tag      string             `json:"tag" bson:"tag"`
+	File     string             `json:"file" bson:"file"`
+	Date     string             `json:"date" bson:"date"`
+	PHash    int                `json:"phashdistance" bson:"phashdistance"`
+	DHash    int                `json:"dhashdistance" bson:"dhashdistance"`
+	Alert    bool               `json:"alert" bson:"alert"`
+	Captured string             `json:"captured,omitempty" bson:"captured,omitempty"`
+
+	photo *PhotoHash
+}
+
+// FraudAlert links images that should not look alike.
+type FraudAlert struct {
+	ID       primitive.ObjectID `json:"id" bson:"_id"`
+	Kind     string             `json:"kind" bson:"kind"`
+	Date     string             `json:"date" bson:"date"`
+	Reason   string             `json:"reason" bson:"reason"`
+	Tags     []string           `json:"tags" bson:"tags"`
+	Images   []*PhotoHash       `json:"images" bson:"images"`
+	Distance int                `json:"distance" bson:"distance"`
+	Resolved bool               `json:"resolved" bson:"resolved"`
+}
+
+type photoIndex struct {
+	mu     sync.RWMutex
+	tree   *phash.Tree
+	photos map[string]*PhotoHash
+}
+
+func newPhotoIndex() *photoIndex {
+	return &photoIndex{tree: phash.NewTree(), photos: map[string]*PhotoHash{}}
+}
+
+func (x *photoIndex) add(h *PhotoHash) {
+	p, err := strconv.ParseUint(h.PHash, 16, 64)
+	if err != nil {
+		log.Println("err bad phash", h.ID.Hex(), h.PHash)
+		return
+	}
+	x.mu.Lock()
+	x.photos[h.ID.Hex()] = h
+	x.mu.Unlock()
+	x.tree.Add(p, h.ID.Hex())
+}
+
+// similar returns the stored photos within maxP bits of pHash and maxD
+// bits of dHash.
+func (x *photoIndex) similar(dh uint64, ph uint64, maxP int, maxD int) []*DuplicateMatch {
+	var ret []*DuplicateMatch
+	for _, m := range x.tree.Search(ph, maxP) {
+		x.mu.RLock()
+		h := x.photos[m.ID]
+		x.mu.RUnlock()
+		if h == nil {
+			continue
+		}
+		d, err := strconv.ParseUint(h.DHash, 16, 64)
+		if err != nil {
+			continue
+		}
+		dd := phash.Distance(d, dh)
+		if dd > maxD {
+			continue
+		}
+		ret = append(ret, &DuplicateMatch{Post: h.Post, Tag: h.Tag, File: h.File, Date: h.Date, Captured: h.Captured, PHash: m.Distance, DHash: dd, photo: h})
+	}
+	return ret
+}
+
+func hashImage(r io.Reader) (uint64, uint64, error) {
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return 0, 0, err
+	}
+	return phash.DHash(img), phash.PHash(img), nil
+}
+
+func hashFile(filename string) (uint64, uint64, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	return hashImage(f)
+}
+
+func hexHash(h uint64) string {
+	return fmt.Sprintf("%016x", h)
+}
+
+// loadPhotoIndex reads every stored fingerprint, then hashes photos
+// uploaded before fingerprints existed so reuse of old photos is caught too.
+func (s *service) loadPhotoIndex() error {
+	s.photos = newPhotoIndex()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	if _, err := s.db.CreateIndex(ctx, "phashes", bson.M{"file": 1}); err != nil {
+		return err
+	}
+	cur, err := s.db.QueryAll(ctx, "phashes")
+	if err != nil {
+		return err
+	}
+	known := map[string]bool{}
+	for cur.Next(ctx) {
+		h := &PhotoHash{}
+		if err := cur.Decode(h); err != nil {
+			log.Println(err)
+			continue
+		}
+		s.photos.add(h)
+		known[h.File] = true
+	}
+	cur.Close(ctx)
+
+	cur, err = s.db.QueryFilter(ctx, "bcposts", bson.M{"images.0": bson.M{"$exists": true}})
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+	n := 0
+	for cur.Next(ctx) {
+		bc := &BCdataa{}
+		if err := cur.Decode(bc); err != nil {
+			log.Println(err)
+			continue
+		}
+		for _, img := range bc.Images {
+			if known[img.File] {
+				continue
+			}
+			dh, ph, err := hashFile(img.File)
+			if err != nil {
+				log.Println("err hashing", img.File, err)
+				continue
+			}
+			h := newPhotoHash(bc.ID, bc.Tag, img.File, img.Date, img.Meta, dh, ph)
+			if _, err := s.db.Add(ctx, "phashes", h); err != nil {
+				return err
+			}
+			s.photos.add(h)
+			n++
+		}
+	}
+	log.Printf("photo index: %d photos, %d backfilled", s.photos.tree.Len(), n)
+	return nil
+}
+
+func newPhotoHash(post primitive.ObjectID, tag string, file string, date string, meta *PhotoMeta, dh uint64, ph uint64) *PhotoHash {
+	h := &PhotoHash{ID: primitive.NewObjectID(), Post: post, Tag: tag, File: file, Date: date, DHash: hexHash(dh), PHash: hexHash(ph)}
+	if meta != nil && meta.Captured != nil {
+		h.Captured = meta.Captured.Local
+	}
+	return h
+}
+
+// checkDuplicates compares a new upload with every stored photo, records
+// its fingerprint and raises an alert for each match from another tag or
+// another day. Matches from the same tag and day are burst shots and only
+// reported.
+func (s *service) checkDuplicates(ctx context.Context, h *PhotoHash) ([]*DuplicateMatch, error) {
+	dh, err := strconv.ParseUint(h.DHash, 16, 64)
+	if err != nil {
+		return nil, err
+	}
+	ph, err := strconv.ParseUint(h.PHash, 16, 64)
+	if err != nil {
+		return nil, err
+	}
+	matches := s.photos.similar(dh, ph, duplicatePHash, duplicateDHash)
+	if _, err := s.db.Add(ctx, "phashes", h); err != nil {
+		return nil, err
+	}
+	s.photos.add(h)
+
+	for _, m := range matches {
+		prev := m.photo
+		var reason []string
+		if m.Tag != h.Tag {
+			reason = append(reason, "same photo under tags "+m.Tag+" and "+h.Tag)
+		}
+		if prev.day() != h.day() {
+			reason = append(reason, "same photo on "+prev.day()+" and "+h.day())
+		}
+		if len(reason) == 0 {
+			continue
+		}
+		m.Alert = true
+		a := &FraudAlert{
+			ID:       primitive.NewObjectID(),
+			Kind:     alertDuplicate,
+			Date:     time.Now().Add(time.Hour * 8).Format(time.ANSIC),
+			Reason:   strings.Join(reason, "; "),
+			Tags:     []string{m.Tag, h.Tag},
+			Images:   []*PhotoHash{prev, h},
+			Distance: m.PHash,
+		}
+		if _, err := s.db.Add(ctx, "alerts", a); err != nil {
+			log.Println("err adding alert", err)
+			continue
+		}
+		log.Println("fraud alert:", a.Reason, m.File, h.File)
+	}
+	return matches, nil
+}
+
+// alerts lists fraud alerts, optionally for one tag, kind or resolution
+// state.
+func (s *service) alerts(w http.ResponseWriter, r *http.Request) {
+	log.Println("alerts called")
+	q := r.URL.Query()
+	filter := bson.M{}
+	if tag := q.Get("tag"); tag != "" {
+		filter["tags"] = tag
+	}
+	if kind := q.Get("kind"); kind != "" {
+		filter["kind"] = kind
+	}
+	if res := q.Get("resolved"); res != "" {
+		b, err := strconv.ParseBool(res)
+		if err != nil {
+			writeMessage(w, http.StatusBadRequest, "resolved must be true or false")
+			return
+		}
+		filter["resolved"] = b
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cur, err := s.db.QueryFilter(ctx, "alerts", filter)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer cur.Close(ctx)
+	ret := []*FraudAlert{}
+	for cur.Next(ctx) {
+		a := &FraudAlert{}
+		if err := cur.Decode(a); err != nil {
+			log.Println(err)
+			continue
+		}
+		ret = append(ret, a)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(ret)
+	if err != nil {
+		log.Println("err encoding alerts")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *service) resolveAlert(w http.ResponseWriter, r *http.Request) {
+	log.Println("resolvealert called")
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		log.Println("err object id from hex")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	a := &FraudAlert{}
+	if err := s.db.QueryOne(ctx, "alerts", "_id", id).Decode(a); err != nil {
+		writeMessage(w, http.StatusNotFound, "alert not found")
+		return
+	}
+	if err := s.db.Update(ctx, "alerts", "_id", id, bson.M{"resolved": true}).Err(); err != nil {
+		log.Println("err resolving alert")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	a.Resolved = true
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(a)
+	if err != nil {
+		log.Println("err encoding alert")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// similarImages looks up a photo without storing it. ?distance= widens or
+// narrows the pHash search.
+func (s *service) similarImages(w http.ResponseWriter, r *http.Request) {
+	log.Println("similarimages called")
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		writeMessage(w, http.StatusBadRequest, "invalid multipart form")
+		return
+	}
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, "missing image")
+		return
+	}
+	defer file.Close()
+	dh, ph, err := hashImage(file)
+	if err != nil {
+		writeMessage(w, http.StatusUnsupportedMediaType, errNotImage.Error())
+		return
+	}
+	max := duplicatePHash
+	if d := r.FormValue("distance"); d != "" {
+		if max, err = strconv.Atoi(d); err != nil || max < 0 || max > 32 {
+			writeMessage(w, http.StatusBadRequest, "distance must be between 0 and 32")
+			return
+		}
+	}
+
+	ret := s.photos.similar(dh, ph, max, 64)
+	if ret == nil {
+		ret = []*DuplicateMatch{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(map[string]interface{}{"dhash": hexHash(dh), "phash": hexHash(ph), "matches": ret})
+	if err != nil {
+		log.Println("err encoding matches")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
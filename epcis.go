@@ -0,0 +1,1420 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"mongo/gs1"
+)
+
+const (
+	epcisContext     = "https://ref.gs1.org/standards/epcis/2.0.0/epcis-context.jsonld"
+	epcisVersion     = "2.0.0"
+	epcisContentType = "application/ld+json"
+
+	objectEvent         = "ObjectEvent"
+	aggregationEvent    = "AggregationEvent"
+	transformationEvent = "TransformationEvent"
+
+	// maxCaptureSize and maxCaptureEvents bound one capture document.
+	maxCaptureSize   = 16 << 20
+	maxCaptureEvents = 10000
+	// defaultPerPage is how many events a query returns at once.
+	defaultPerPage = 1000
+
+	captureRollback = "rollback"
+	captureProceed  = "proceed"
+
+	// eventClockSkew is how far ahead of the server clock an eventTime
+	// may be.
+	eventClockSkew = 5 * time.Minute
+	// defaultEventAge is how old an eventTime may be unless EPCIS_MAX_AGE
+	// says otherwise.
+	defaultEventAge = 30 * 24 * time.Hour
+)
+
+// epcisNamespace is what the URIs of lots, parties, places and events
+// exchanged as EPCIS start with. Set EPCIS_NAMESPACE to one the partners
+// agree on, a URN or a web address.
+func epcisNamespace() string {
+	ns := strings.TrimRight(os.Getenv("EPCIS_NAMESPACE"), ":/")
+	if ns == "" {
+		ns = "urn:sc-blockchain"
+	}
+	return ns
+}
+
+// epcisMaxAge reads EPCIS_MAX_AGE as a Go duration, e.g. "720h".
+func epcisMaxAge() time.Duration {
+	d, err := time.ParseDuration(os.Getenv("EPCIS_MAX_AGE"))
+	if err != nil || d <= 0 {
+		return defaultEventAge
+	}
+	return d
+}
+
+// checkEventTime bounds when a partner says something happened: no later
+// than now give or take eventClockSkew, and no earlier than EPCIS_MAX_AGE
+// ago, so a captured event cannot be dated to suit.
+func checkEventTime(t time.Time) error {
+	now := time.Now()
+	if t.After(now.Add(eventClockSkew)) {
+		return uploadErrorf(http.StatusUnprocessableEntity, "eventTime %s is in the future", t.Format(time.RFC3339))
+	}
+	if t.Before(now.Add(-epcisMaxAge())) {
+		return uploadErrorf(http.StatusUnprocessableEntity, "eventTime %s is more than %s ago", t.Format(time.RFC3339), epcisMaxAge())
+	}
+	return nil
+}
+
+func epcisSep(ns string) string {
+	if strings.HasPrefix(ns, "http://") || strings.HasPrefix(ns, "https://") {
+		return "/"
+	}
+	return ":"
+}
+
+// epcisURI names something of kind in the namespace, e.g. the lot of a tag
+// is epcisURI("lot", tag).
+func epcisURI(kind string, parts ...string) string {
+	ns := epcisNamespace()
+	sep := epcisSep(ns)
+	uri := ns + sep + kind
+	for _, p := range parts {
+		uri += sep + url.PathEscape(p)
+	}
+	return uri
+}
+
+// epcisPart is the inverse of epcisURI with one part.
+func epcisPart(uri string, kind string) (string, bool) {
+	prefix := epcisURI(kind) + epcisSep(epcisNamespace())
+	if !strings.HasPrefix(uri, prefix) {
+		return "", false
+	}
+	v, err := url.PathUnescape(strings.TrimPrefix(uri, prefix))
+	return v, err == nil && v != ""
+}
+
+// lotEPC names a lot by its GS1 Digital Link, or in the namespace when
+// its tag is not a GS1 code.
+func lotEPC(tag string) string {
+	if id, err := typedTag(tag); err == nil && id.Kind != gs1.Internal {
+		return id.DigitalLink(linkResolver())
+	}
+	return epcisURI("lot", tag)
+}
+
+// tagFromEPC turns an identifier back into a tag: lots of this namespace
+// by their tag, and GS1 Digital Links and EPC URNs by the identifier they
+// carry.
+func tagFromEPC(uri string) (string, bool) {
+	if tag, ok := epcisPart(uri, "lot"); ok {
+		return tag, validTag(tag)
+	}
+	id, err := gs1.ParseAny(uri)
+	if err != nil {
+		return "", false
+	}
+	return id.String(), true
+}
+
+func eventURI(kind string, ref string) string {
+	return epcisURI("event", kind, ref)
+}
+
+// cbvTerm reduces a CBV value given bare, as a URN or as a web URI to the
+// bare term.
+func cbvTerm(v string) string {
+	for _, p := range []string{"urn:epcglobal:cbv:bizstep:", "urn:epcglobal:cbv:disp:", "urn:epcglobal:cbv:sdt:"} {
+		if strings.HasPrefix(v, p) {
+			return strings.TrimPrefix(v, p)
+		}
+	}
+	if i := strings.Index(v, "ref.gs1.org/cbv/"); i >= 0 {
+		rest := v[i+len("ref.gs1.org/cbv/"):]
+		if j := strings.Index(rest, "-"); j >= 0 {
+			return rest[j+1:]
+		}
+	}
+	return v
+}
+
+// stageBizSteps are the CBV steps stages are exchanged as. Stages with no
+// fitting step go as a bizstep URI of the namespace.
+var stageBizSteps = map[string]string{
+	"packed":  "packing",
+	"shipped": "departing",
+	"market":  "stocking",
+}
+
+var stageDispositions = map[string]string{
+	"shipped": "in_transit",
+	"market":  "sellable_accessible",
+}
+
+func stageBizStep(stage string) string {
+	if b, ok := stageBizSteps[stage]; ok {
+		return b
+	}
+	return epcisURI("bizstep", stage)
+}
+
+func bizStepStage(bizStep string) string {
+	if st, ok := epcisPart(bizStep, "bizstep"); ok && stageIndex(st) >= 0 {
+		return st
+	}
+	t := cbvTerm(bizStep)
+	for st, b := range stageBizSteps {
+		if b == t {
+			return st
+		}
+	}
+	return ""
+}
+
+// uomCodes are the UN/ECE Recommendation 20 codes of the units that have
+// one. Amounts in other units are sent in their dimension's base.
+var uomCodes = map[string]string{
+	"g":     "GRM",
+	"kg":    "KGM",
+	"t":     "TNE",
+	"lb":    "LBR",
+	"pcs":   "H87",
+	"dozen": "DZN",
+}
+
+// EPCISQuantity is a QuantityElement. Quantity is left out of events that
+// observe a lot without counting it.
+type EPCISQuantity struct {
+	EPCClass string  `json:"epcClass"`
+	Quantity float64 `json:"quantity,omitempty"`
+	UOM      string  `json:"uom,omitempty"`
+}
+
+// EPCISParty is one entry of a sourceList or destinationList.
+type EPCISParty struct {
+	Type        string `json:"type"`
+	Source      string `json:"source,omitempty"`
+	Destination string `json:"destination,omitempty"`
+}
+
+type EPCISPlace struct {
+	ID string `json:"id"`
+}
+
+// EPCISEvent is an ObjectEvent, AggregationEvent or TransformationEvent
+// in EPCIS 2.0 JSON-LD. Fields under sc: are this service's extensions.
+type EPCISEvent struct {
+	Type                string          `json:"type" bson:"type"`
+	EventID             string          `json:"eventID,omitempty" bson:"eventid,omitempty"`
+	EventTime           string          `json:"eventTime" bson:"eventtime"`
+	EventTimeZoneOffset string          `json:"eventTimeZoneOffset" bson:"eventtimezoneoffset"`
+	Action              string          `json:"action,omitempty" bson:"action,omitempty"`
+	BizStep             string          `json:"bizStep,omitempty" bson:"bizstep,omitempty"`
+	Disposition         string          `json:"disposition,omitempty" bson:"disposition,omitempty"`
+	EPCList             []string        `json:"epcList,omitempty" bson:"epclist,omitempty"`
+	QuantityList        []EPCISQuantity `json:"quantityList,omitempty" bson:"quantitylist,omitempty"`
+	ParentID            string          `json:"parentID,omitempty" bson:"parentid,omitempty"`
+	ChildEPCs           []string        `json:"childEPCs,omitempty" bson:"childepcs,omitempty"`
+	ChildQuantityList   []EPCISQuantity `json:"childQuantityList,omitempty" bson:"childquantitylist,omitempty"`
+	InputEPCList        []string        `json:"inputEPCList,omitempty" bson:"inputepclist,omitempty"`
+	InputQuantityList   []EPCISQuantity `json:"inputQuantityList,omitempty" bson:"inputquantitylist,omitempty"`
+	OutputEPCList       []string        `json:"outputEPCList,omitempty" bson:"outputepclist,omitempty"`
+	OutputQuantityList  []EPCISQuantity `json:"outputQuantityList,omitempty" bson:"outputquantitylist,omitempty"`
+	ReadPoint           *EPCISPlace     `json:"readPoint,omitempty" bson:"readpoint,omitempty"`
+	BizLocation         *EPCISPlace     `json:"bizLocation,omitempty" bson:"bizlocation,omitempty"`
+	SourceList          []EPCISParty    `json:"sourceList,omitempty" bson:"sourcelist,omitempty"`
+	DestinationList     []EPCISParty    `json:"destinationList,omitempty" bson:"destinationlist,omitempty"`
+
+	Stage         string `json:"sc:stage,omitempty" bson:"stage,omitempty"`
+	Process       string `json:"sc:process,omitempty" bson:"process,omitempty"`
+	Title         string `json:"sc:title,omitempty" bson:"title,omitempty"`
+	Certification string `json:"sc:certification,omitempty" bson:"certification,omitempty"`
+	Note          string `json:"sc:note,omitempty" bson:"note,omitempty"`
+	Hash          string `json:"sc:hash,omitempty" bson:"hash,omitempty"`
+	TxHash        string `json:"sc:txHash,omitempty" bson:"txhash,omitempty"`
+
+	ref  string
+	time time.Time
+}
+
+type epcisResults struct {
+	QueryName   string `json:"queryName"`
+	ResultsBody struct {
+		EventList []*EPCISEvent `json:"eventList"`
+	} `json:"resultsBody"`
+}
+
+type epcisBody struct {
+	EventList    []*EPCISEvent `json:"eventList,omitempty"`
+	QueryResults *epcisResults `json:"queryResults,omitempty"`
+}
+
+// EPCISDocument is an EPCISDocument to capture or an EPCISQueryDocument
+// answering a query.
+type EPCISDocument struct {
+	Context       interface{} `json:"@context"`
+	Type          string      `json:"type"`
+	SchemaVersion string      `json:"schemaVersion"`
+	CreationDate  string      `json:"creationDate"`
+	EPCISBody     epcisBody   `json:"epcisBody"`
+}
+
+func newEPCISDocument(kind string) *EPCISDocument {
+	ns := epcisNamespace()
+	return &EPCISDocument{
+		Context:       []interface{}{epcisContext, map[string]string{"sc": epcisURI("ext") + epcisSep(ns)}},
+		Type:          kind,
+		SchemaVersion: "2.0",
+		CreationDate:  time.Now().In(farmZone).Format(time.RFC3339),
+	}
+}
+
+// EPCISLink ties a captured event to the records it became, so exporting
+// them gives the partner's eventID back.
+type EPCISLink struct {
+	ID      primitive.ObjectID `json:"id" bson:"_id"`
+	EventID string             `json:"eventID" bson:"eventid"`
+	Capture primitive.ObjectID `json:"capture" bson:"capture"`
+	Refs    []string           `json:"refs" bson:"refs"`
+	Event   *EPCISEvent        `json:"event" bson:"event"`
+}
+
+func setEventTime(ev *EPCISEvent, t time.Time) {
+	t = t.In(farmZone)
+	ev.time = t
+	ev.EventTime = t.Format(time.RFC3339)
+	ev.EventTimeZoneOffset = t.Format("-07:00")
+}
+
+// ansicTime reads the farm wall clock times posts and lot operations are
+// dated with.
+func ansicTime(d string) time.Time {
+	t, _ := time.ParseInLocation(time.ANSIC, d, farmZone)
+	return t
+}
+
+// quantity says amount of unit in the lot of tag.
+func (mb *massBalance) quantity(tag string, amount int, unit string) EPCISQuantity {
+	if code, ok := uomCodes[unit]; ok {
+		return EPCISQuantity{EPCClass: lotEPC(tag), Quantity: float64(amount), UOM: code}
+	}
+	b, dim, err := mb.base(amount, unit)
+	if err != nil {
+		return EPCISQuantity{EPCClass: lotEPC(tag), Quantity: float64(amount)}
+	}
+	return EPCISQuantity{EPCClass: lotEPC(tag), Quantity: math.Round(b*1000) / 1000, UOM: uomCodes[baseUnits[dim]]}
+}
+
+func (mb *massBalance) uomUnit(uom string) (string, error) {
+	if uom == "" {
+		return "pcs", nil
+	}
+	for unit, code := range uomCodes {
+		if code == uom {
+			if _, ok := mb.Units[unit]; ok {
+				return unit, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("unknown uom %s", uom)
+}
+
+// fromQuantity turns a quantity into a whole amount for a new lot, in the
+// quantity's own unit or, when that leaves a fraction, the smallest unit of
+// its dimension.
+func (mb *massBalance) fromQuantity(q EPCISQuantity) (int, string, error) {
+	unit, err := mb.uomUnit(q.UOM)
+	if err != nil {
+		return 0, "", err
+	}
+	n := q.Quantity
+	if n == 0 && q.UOM == "" {
+		n = 1
+	}
+	if math.Abs(n-math.Round(n)) > 1e-9 {
+		u := mb.Units[unit]
+		for name, v := range mb.Units {
+			if v.Dimension == u.Dimension && v.Factor < mb.Units[unit].Factor {
+				unit = name
+			}
+		}
+		n = n * u.Factor / mb.Units[unit].Factor
+	}
+	if math.Round(n) <= 0 {
+		return 0, "", fmt.Errorf("%s needs a positive quantity", q.EPCClass)
+	}
+	return int(math.Round(n)), unit, nil
+}
+
+// amountIn converts a quantity into unit, the unit an existing lot counts
+// in.
+func (mb *massBalance) amountIn(q EPCISQuantity, unit string) (int, error) {
+	from, err := mb.uomUnit(q.UOM)
+	if err != nil {
+		return 0, err
+	}
+	f, t := mb.Units[from], mb.Units[unit]
+	if f.Dimension != t.Dimension {
+		return 0, fmt.Errorf("%s is counted in %s, not %s", q.EPCClass, t.Dimension, f.Dimension)
+	}
+	n := math.Round(q.Quantity * f.Factor / t.Factor)
+	if n <= 0 {
+		return 0, fmt.Errorf("%s needs a positive quantity", q.EPCClass)
+	}
+	return int(n), nil
+}
+
+func commissionEvent(mb *massBalance, p *Post) *EPCISEvent {
+	ev := &EPCISEvent{Type: objectEvent, EventID: eventURI("post", p.ID.Hex()), Action: "ADD", BizStep: "commissioning", Disposition: "active", QuantityList: []EPCISQuantity{mb.quantity(p.Tag, p.Amount, unitOf(p))}, Title: p.Title, Certification: p.Certification, ref: "post/" + p.ID.Hex()}
+	if p.Farm != "" {
+		ev.BizLocation = &EPCISPlace{ID: epcisURI("farm", p.Farm)}
+	}
+	setEventTime(ev, ansicTime(p.Date))
+	return ev
+}
+
+func stageEvent(e *LifecycleEvent) *EPCISEvent {
+	ref := e.Post + "." + strconv.Itoa(e.Seq)
+	disposition := stageDispositions[e.To]
+	if disposition == "" {
+		disposition = "active"
+	}
+	ev := &EPCISEvent{Type: objectEvent, EventID: eventURI("stage", ref), Action: "OBSERVE", BizStep: stageBizStep(e.To), Disposition: disposition, QuantityList: []EPCISQuantity{{EPCClass: lotEPC(e.Tag)}}, Stage: e.To, Hash: e.Hash, TxHash: e.TxHash, ref: "stage/" + ref}
+	t, _ := time.Parse(time.RFC3339, e.Time)
+	setEventTime(ev, t)
+	return ev
+}
+
+func parties(kind string, from string, to string) ([]EPCISParty, []EPCISParty) {
+	return []EPCISParty{{Type: kind, Source: epcisURI("party", from)}}, []EPCISParty{{Type: kind, Destination: epcisURI("party", to)}}
+}
+
+// transferEvents sends a transfer as shipping and, once accepted, as
+// receiving. Transfers of a package's contents are left to the package's.
+func transferEvents(mb *massBalance, t *Transfer) []*EPCISEvent {
+	if t.Status == transferCancelled || !t.PartOf.IsZero() {
+		return nil
+	}
+	src, dst := parties("owning_party", t.Sender, t.Receiver)
+	q := []EPCISQuantity{mb.quantity(t.Tag, t.Amount, t.Unit)}
+	ship := &EPCISEvent{Type: objectEvent, EventID: eventURI("ship", t.ID.Hex()), Action: "OBSERVE", BizStep: "shipping", Disposition: "in_transit", QuantityList: q, SourceList: src, DestinationList: dst, Note: t.Note, ref: "ship/" + t.ID.Hex()}
+	created, _ := time.Parse(time.RFC3339, t.Created)
+	setEventTime(ship, created)
+	ret := []*EPCISEvent{ship}
+	if t.Status == transferAccepted {
+		recv := &EPCISEvent{Type: objectEvent, EventID: eventURI("receive", t.ID.Hex()), Action: "OBSERVE", BizStep: "receiving", Disposition: "in_progress", QuantityList: q, SourceList: src, DestinationList: dst, Note: t.ReceiverNote, Hash: t.Hash, TxHash: t.TxHash, ref: "receive/" + t.ID.Hex()}
+		decided, _ := time.Parse(time.RFC3339, t.Decided)
+		setEventTime(recv, decided)
+		ret = append(ret, recv)
+	}
+	return ret
+}
+
+func lotEvent(mb *massBalance, op *LotOperation) *EPCISEvent {
+	ev := &EPCISEvent{Type: transformationEvent, EventID: eventURI("lot", op.ID.Hex()), BizStep: epcisURI("bizstep", op.Kind), Note: op.Note, ref: "lot/" + op.ID.Hex()}
+	if op.Balance != nil {
+		ev.Process = op.Balance.Process
+	}
+	for _, l := range op.Inputs {
+		ev.InputQuantityList = append(ev.InputQuantityList, mb.quantity(l.Tag, l.Amount, l.Unit))
+	}
+	for _, l := range op.Outputs {
+		ev.OutputQuantityList = append(ev.OutputQuantityList, mb.quantity(l.Tag, l.Amount, l.Unit))
+	}
+	setEventTime(ev, ansicTime(op.Date))
+	return ev
+}
+
+func aggregationEventOf(mb *massBalance, a *Aggregation) *EPCISEvent {
+	ev := &EPCISEvent{Type: aggregationEvent, EventID: eventURI("aggregation", a.ID.Hex()), Action: a.Action, BizStep: a.BizStep, ParentID: lotEPC(a.Parent), Note: a.Note, Hash: a.Hash, TxHash: a.TxHash, ref: "aggregation/" + a.ID.Hex()}
+	for _, c := range a.Children {
+		ev.ChildQuantityList = append(ev.ChildQuantityList, mb.quantity(c.Tag, c.Amount, c.Unit))
+	}
+	t, _ := time.Parse(time.RFC3339, a.Time)
+	setEventTime(ev, t)
+	return ev
+}
+
+// epcisFilter narrows the events epcisEvents gathers: types are the event
+// types wanted, all when empty, and from and to bound eventTime when set.
+type epcisFilter struct {
+	types    map[string]bool
+	from, to time.Time
+}
+
+func (f *epcisFilter) wants(eventType string) bool {
+	return f == nil || len(f.types) == 0 || f.types[eventType]
+}
+
+// timeRange is the Mongo condition on an RFC 3339 field for the times of
+// f, or nil when f has none. The records are dated in farmZone, so their
+// strings sort as the times do; the bounds are widened to whole seconds
+// and the exact ones are left to the caller.
+func (f *epcisFilter) timeRange() bson.M {
+	if f == nil || f.from.IsZero() && f.to.IsZero() {
+		return nil
+	}
+	r := bson.M{}
+	if !f.from.IsZero() {
+		r["$gte"] = f.from.In(farmZone).Truncate(time.Second).Format(time.RFC3339)
+	}
+	if !f.to.IsZero() {
+		r["$lt"] = f.to.In(farmZone).Truncate(time.Second).Add(time.Second).Format(time.RFC3339)
+	}
+	return r
+}
+
+// epcisEvents maps everything recorded about posts to EPCIS events, oldest
+// first, leaving out in the queries what f does not want. Lots made by lot
+// operations are not commissioned on their own; they are the outputs of a
+// TransformationEvent.
+func (s *service) epcisEvents(ctx context.Context, posts []*Post, f *epcisFilter) ([]*EPCISEvent, error) {
+	var events []*EPCISEvent
+	var hexes []string
+	var ids []primitive.ObjectID
+	for _, p := range posts {
+		hexes = append(hexes, p.ID.Hex())
+		ids = append(ids, p.ID)
+		if len(p.Parents) == 0 && p.Package == "" && f.wants(objectEvent) {
+			events = append(events, commissionEvent(s.balance, p))
+		}
+	}
+	if len(ids) == 0 {
+		return events, nil
+	}
+	when := f.timeRange()
+
+	if f.wants(objectEvent) {
+		filter := bson.M{"post": bson.M{"$in": hexes}}
+		if when != nil {
+			filter["time"] = when
+		}
+		cur, err := s.db.QueryFilter(ctx, "lifecycle", filter)
+		if err != nil {
+			return nil, err
+		}
+		for cur.Next(ctx) {
+			e := &LifecycleEvent{}
+			if err := cur.Decode(e); err == nil {
+				events = append(events, stageEvent(e))
+			}
+		}
+		cur.Close(ctx)
+
+		filter = bson.M{"post": bson.M{"$in": ids}}
+		if when != nil {
+			filter["$or"] = []bson.M{{"created": when}, {"decided": when}}
+		}
+		transfers, err := s.transfersWhere(ctx, filter)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range transfers {
+			events = append(events, transferEvents(s.balance, t)...)
+		}
+	}
+
+	// lot operations are dated in ANSIC, which does not sort, so only
+	// their type is left out here
+	if f.wants(transformationEvent) {
+		cur, err := s.db.QueryFilter(ctx, "lots", bson.M{"$or": []bson.M{{"inputs.post": bson.M{"$in": ids}}, {"outputs.post": bson.M{"$in": ids}}}})
+		if err != nil {
+			return nil, err
+		}
+		for cur.Next(ctx) {
+			op := &LotOperation{}
+			if err := cur.Decode(op); err == nil {
+				events = append(events, lotEvent(s.balance, op))
+			}
+		}
+		cur.Close(ctx)
+	}
+
+	if f.wants(aggregationEvent) {
+		filter := bson.M{"$or": []bson.M{{"post": bson.M{"$in": ids}}, {"children.post": bson.M{"$in": ids}}}}
+		if when != nil {
+			filter["time"] = when
+		}
+		cur, err := s.db.QueryFilter(ctx, "aggregations", filter)
+		if err != nil {
+			return nil, err
+		}
+		for cur.Next(ctx) {
+			a := &Aggregation{}
+			if err := cur.Decode(a); err == nil {
+				events = append(events, aggregationEventOf(s.balance, a))
+			}
+		}
+		cur.Close(ctx)
+	}
+
+	// records captured from a partner keep the partner's eventID
+	byRef := map[string]*EPCISEvent{}
+	var refs []string
+	for _, ev := range events {
+		byRef[ev.ref] = ev
+		refs = append(refs, ev.ref)
+	}
+	if len(refs) == 0 {
+		return events, nil
+	}
+	cur, err := s.db.QueryFilter(ctx, "epcis", bson.M{"refs": bson.M{"$in": refs}})
+	if err != nil {
+		return nil, err
+	}
+	for cur.Next(ctx) {
+		l := &EPCISLink{}
+		if err := cur.Decode(l); err == nil && len(l.Refs) == 1 && l.EventID != "" && byRef[l.Refs[0]] != nil {
+			byRef[l.Refs[0]].EventID = l.EventID
+		}
+	}
+	cur.Close(ctx)
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].time.Before(events[j].time)
+	})
+	return events, nil
+}
+
+func splitList(v string) []string {
+	var ret []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+// epcisQuery answers GET /epcis/events with an EPCISQueryDocument of the
+// events on posts the session has rights on. It takes the REST binding's
+// eventType, GE_eventTime, LT_eventTime, EQ_bizStep, EQ_action,
+// MATCH_anyEPC and MATCH_anyEPCClass, and pages with perPage and
+// nextPageToken.
+func (s *service) epcisQuery(w http.ResponseWriter, r *http.Request) {
+	se := s.sessionFrom(r)
+	if se == nil {
+		writeMessage(w, http.StatusUnauthorized, "session required")
+		return
+	}
+	q := r.URL.Query()
+	f := &epcisFilter{types: map[string]bool{}}
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"GE_eventTime", &f.from}, {"LT_eventTime", &f.to}} {
+		if v := q.Get(p.name); v != "" {
+			t, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				writeMessage(w, http.StatusBadRequest, p.name+" must be an RFC 3339 time")
+				return
+			}
+			*p.t = t
+		}
+	}
+	perPage, offset := defaultPerPage, 0
+	if v := q.Get("perPage"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeMessage(w, http.StatusBadRequest, "perPage must be a positive number")
+			return
+		}
+		perPage = n
+	}
+	if v := q.Get("nextPageToken"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeMessage(w, http.StatusBadRequest, "bad nextPageToken")
+			return
+		}
+		offset = n
+	}
+	steps, actions := map[string]bool{}, map[string]bool{}
+	for _, t := range splitList(q.Get("eventType")) {
+		f.types[t] = true
+	}
+	for _, b := range splitList(q.Get("EQ_bizStep")) {
+		steps[cbvTerm(b)] = true
+	}
+	for _, a := range splitList(q.Get("EQ_action")) {
+		actions[a] = true
+	}
+
+	filter := bson.M{}
+	if match := append(splitList(q.Get("MATCH_anyEPC")), splitList(q.Get("MATCH_anyEPCClass"))...); len(match) > 0 {
+		// none may parse, and $in needs an array even then
+		tags := []string{}
+		for _, m := range match {
+			if tag, ok := tagFromEPC(m); ok {
+				tags = append(tags, tag)
+			}
+		}
+		filter["tag"] = bson.M{"$in": tags}
+	}
+	if !identitySet("FILE_IDENTITIES", "admin")[se.Identity] {
+		filter["$or"] = []bson.M{{"user": se.Username}, {"factory": se.Username}, {"market": se.Username}}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	all, err := s.postsWhere(ctx, filter)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var posts []*Post
+	for _, p := range all {
+		if canAccessPost(se, p) {
+			posts = append(posts, p)
+		}
+	}
+	events, err := s.epcisEvents(ctx, posts, f)
+	if err != nil {
+		log.Println("err gathering epcis events", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var matched []*EPCISEvent
+	for _, ev := range events {
+		if !f.wants(ev.Type) || len(steps) > 0 && !steps[cbvTerm(ev.BizStep)] || len(actions) > 0 && !actions[ev.Action] {
+			continue
+		}
+		if !f.from.IsZero() && ev.time.Before(f.from) || !f.to.IsZero() && !ev.time.Before(f.to) {
+			continue
+		}
+		matched = append(matched, ev)
+	}
+	doc := newEPCISDocument("EPCISQueryDocument")
+	doc.EPCISBody.QueryResults = &epcisResults{QueryName: "SimpleEventQuery"}
+	page := []*EPCISEvent{}
+	if offset < len(matched) {
+		end := offset + perPage
+		if end > len(matched) {
+			end = len(matched)
+		} else {
+			next := *r.URL
+			nq := next.Query()
+			nq.Set("nextPageToken", strconv.Itoa(end))
+			next.RawQuery = nq.Encode()
+			w.Header().Set("Link", "<"+next.RequestURI()+">; rel=\"next\"")
+		}
+		page = matched[offset:end]
+	}
+	doc.EPCISBody.QueryResults.ResultsBody.EventList = page
+	w.Header().Set("GS1-EPCIS-Version", epcisVersion)
+	w.Header().Set("GS1-CBV-Version", epcisVersion)
+	w.Header().Set("Content-Type", epcisContentType)
+	json.NewEncoder(w).Encode(doc)
+}
+
+// CaptureResult is what became of one captured event: captured, duplicate
+// when its eventID was seen before, or failed.
+type CaptureResult struct {
+	EventID string   `json:"eventID,omitempty" bson:"eventid,omitempty"`
+	Type    string   `json:"type" bson:"type"`
+	Status  string   `json:"status" bson:"status"`
+	Records []string `json:"records,omitempty" bson:"records,omitempty"`
+	Error   string   `json:"error,omitempty" bson:"error,omitempty"`
+}
+
+// Capture is a capture job. With captureErrorBehaviour rollback nothing is
+// applied when any event is malformed or fails precheckEPCIS. What only
+// applying can find out, such as a transfer the sender no longer holds,
+// stops the capture at that event; events applied before it stay, as
+// anchored records cannot be taken back. With proceed every event is
+// tried.
+type Capture struct {
+	ID             primitive.ObjectID `json:"captureID" bson:"_id"`
+	User           string             `json:"user" bson:"user"`
+	CreatedAt      string             `json:"createdAt" bson:"createdat"`
+	FinishedAt     string             `json:"finishedAt,omitempty" bson:"finishedat,omitempty"`
+	Running        bool               `json:"running" bson:"running"`
+	Success        bool               `json:"success" bson:"success"`
+	ErrorBehaviour string             `json:"captureErrorBehaviour" bson:"errorbehaviour"`
+	Errors         []string           `json:"errors,omitempty" bson:"errors,omitempty"`
+	Events         []*CaptureResult   `json:"events" bson:"events"`
+}
+
+// checkEPCIS is the validation every event passes before any is applied.
+func checkEPCIS(ev *EPCISEvent) error {
+	t, err := time.Parse(time.RFC3339Nano, ev.EventTime)
+	if err != nil {
+		return fmt.Errorf("eventTime must be an RFC 3339 time")
+	}
+	if err := checkEventTime(t); err != nil {
+		return err
+	}
+	ev.time = t
+	switch ev.Type {
+	case objectEvent, aggregationEvent:
+		if ev.Action != "ADD" && ev.Action != "OBSERVE" && ev.Action != "DELETE" {
+			return fmt.Errorf("action must be ADD, OBSERVE or DELETE")
+		}
+	case transformationEvent:
+		if len(ev.InputQuantityList)+len(ev.InputEPCList) == 0 || len(ev.OutputQuantityList)+len(ev.OutputEPCList) == 0 {
+			return fmt.Errorf("a transformation needs inputs and outputs")
+		}
+	default:
+		return fmt.Errorf("%s events are not supported", ev.Type)
+	}
+	if ev.Type == aggregationEvent {
+		if _, ok := tagFromEPC(ev.ParentID); !ok {
+			return fmt.Errorf("an aggregation needs a parentID usable as a tag")
+		}
+	}
+	for _, q := range lotsOf(ev.EPCList, ev.QuantityList, ev.ChildEPCs, ev.ChildQuantityList, ev.InputEPCList, ev.InputQuantityList, ev.OutputEPCList, ev.OutputQuantityList) {
+		if _, ok := tagFromEPC(q.EPCClass); !ok {
+			return fmt.Errorf("%s cannot be used as a tag", q.EPCClass)
+		}
+	}
+	return nil
+}
+
+// lotsOf gathers the lots an event names, epc lists as single pieces.
+func lotsOf(lists ...interface{}) []EPCISQuantity {
+	var ret []EPCISQuantity
+	for _, l := range lists {
+		switch v := l.(type) {
+		case []string:
+			for _, epc := range v {
+				ret = append(ret, EPCISQuantity{EPCClass: epc})
+			}
+		case []EPCISQuantity:
+			ret = append(ret, v...)
+		}
+	}
+	return ret
+}
+
+// partyOf finds the user of a source or destination list.
+func partyOf(list []EPCISParty, dest bool) string {
+	for _, p := range list {
+		if t := cbvTerm(p.Type); t != "owning_party" && t != "possessing_party" {
+			continue
+		}
+		uri := p.Source
+		if dest {
+			uri = p.Destination
+		}
+		if u, ok := epcisPart(uri, "party"); ok {
+			return u
+		}
+	}
+	return ""
+}
+
+// known says whether an event exported from here already is a record.
+func (s *service) known(ctx context.Context, eventID string) bool {
+	v, ok := epcisPart(eventID, "event")
+	if !ok {
+		return false
+	}
+	parts := strings.SplitN(v, epcisSep(epcisNamespace()), 2)
+	if len(parts) != 2 {
+		return false
+	}
+	kind, ref := parts[0], parts[1]
+	if kind == "stage" {
+		i := strings.LastIndex(ref, ".")
+		seq, err := strconv.Atoi(ref[i+1:])
+		if i < 0 || err != nil {
+			return false
+		}
+		return s.db.QueryFilterOne(ctx, "lifecycle", bson.M{"post": ref[:i], "seq": seq}).Err() == nil
+	}
+	id, err := primitive.ObjectIDFromHex(ref)
+	if err != nil {
+		return false
+	}
+	col := map[string]string{"post": "posts", "ship": "transfers", "receive": "transfers", "lot": "lots", "aggregation": "aggregations"}[kind]
+	if col == "" {
+		return false
+	}
+	filter := bson.M{"_id": id}
+	if kind == "receive" {
+		filter["status"] = transferAccepted
+	}
+	return s.db.QueryFilterOne(ctx, col, filter).Err() == nil
+}
+
+func (s *service) lotPost(ctx context.Context, epc string) (*Post, error) {
+	tag, _ := tagFromEPC(epc)
+	p, err := s.findPost(ctx, "tag", tag)
+	if err != nil {
+		return nil, uploadErrorf(http.StatusNotFound, "no lot %s", tag)
+	}
+	return p, nil
+}
+
+// applyEPCIS turns one event into records the way the service's own
+// endpoints would, as the capturing user:
+//
+//	ObjectEvent ADD commissioning   new posts
+//	ObjectEvent with a stage        lifecycle transitions
+//	ObjectEvent shipping            transfers from the capturing user
+//	ObjectEvent receiving           acceptance of the matching transfer
+//	TransformationEvent             a split, merge or transform
+//	AggregationEvent                packing or unpacking
+func (s *service) applyEPCIS(se *session, ev *EPCISEvent) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	switch epcisRecord(ev) {
+	case "transformation":
+		return s.captureTransformation(ctx, se, ev)
+	case "aggregation":
+		return s.captureAggregation(ctx, se, ev)
+	case "commissioning":
+		return s.captureCommissioning(ctx, se, ev)
+	case "stage":
+		stage := eventStage(ev)
+		var refs []string
+		for _, q := range lotsOf(ev.EPCList, ev.QuantityList) {
+			p, err := s.lotPost(ctx, q.EPCClass)
+			if err != nil {
+				return refs, err
+			}
+			_, le, err := s.applyTransition(se, p, &transitionRequest{To: stage, Note: ev.Note, Source: ev.EventID, At: ev.time})
+			if err != nil {
+				return refs, err
+			}
+			refs = append(refs, "stage/"+le.Post+"."+strconv.Itoa(le.Seq))
+		}
+		return refs, nil
+	case "shipping":
+		return s.captureShipping(ctx, se, ev)
+	case "receiving":
+		return s.captureReceiving(ctx, se, ev)
+	}
+	return nil, uploadErrorf(http.StatusUnprocessableEntity, "nothing here records a %s %s event", ev.Action, ev.BizStep)
+}
+
+// epcisRecord says what applyEPCIS turns an event into, or "" when
+// nothing here records it.
+func epcisRecord(ev *EPCISEvent) string {
+	step := cbvTerm(ev.BizStep)
+	switch {
+	case ev.Type == transformationEvent:
+		return "transformation"
+	case ev.Type == aggregationEvent:
+		return "aggregation"
+	case ev.Action == "ADD" && step == "commissioning":
+		return "commissioning"
+	case ev.Stage != "" || bizStepStage(ev.BizStep) != "" && len(ev.DestinationList) == 0:
+		return "stage"
+	case step == "shipping" || step == "departing":
+		return "shipping"
+	case step == "receiving" || step == "accepting":
+		return "receiving"
+	}
+	return ""
+}
+
+func eventStage(ev *EPCISEvent) string {
+	if ev.Stage != "" {
+		return ev.Stage
+	}
+	return bizStepStage(ev.BizStep)
+}
+
+// precheckEPCIS is what a rollback capture asks of every event before it
+// applies any: the event must map to a record, its new lots must have
+// free tags and whole quantities, and the lots it names must exist or be
+// made by an earlier event of the document. tags holds the tags that
+// exist; the lots ev makes are added to it.
+func (mb *massBalance) precheckEPCIS(user string, ev *EPCISEvent, tags map[string]bool) error {
+	named := func(lists ...interface{}) error {
+		for _, q := range lotsOf(lists...) {
+			tag, _ := tagFromEPC(q.EPCClass)
+			if !tags[tag] {
+				return uploadErrorf(http.StatusNotFound, "no lot %s", tag)
+			}
+			if q.Quantity > 0 {
+				if _, err := mb.uomUnit(q.UOM); err != nil {
+					return uploadErrorf(http.StatusUnprocessableEntity, "%s", err.Error())
+				}
+			}
+		}
+		return nil
+	}
+	made := func(lists ...interface{}) error {
+		for _, q := range lotsOf(lists...) {
+			tag, _ := tagFromEPC(q.EPCClass)
+			if _, _, err := mb.fromQuantity(q); err != nil {
+				return uploadErrorf(http.StatusUnprocessableEntity, "%s", err.Error())
+			}
+			if _, err := typedTag(tag); err != nil {
+				return uploadErrorf(http.StatusUnprocessableEntity, "%s", err.Error())
+			}
+			if tags[tag] {
+				return uploadErrorf(http.StatusConflict, "tag %s is taken", tag)
+			}
+			tags[tag] = true
+		}
+		return nil
+	}
+
+	switch epcisRecord(ev) {
+	case "transformation":
+		if err := named(ev.InputEPCList, ev.InputQuantityList); err != nil {
+			return err
+		}
+		return made(ev.OutputEPCList, ev.OutputQuantityList)
+	case "aggregation":
+		parent, _ := tagFromEPC(ev.ParentID)
+		if ev.Action == "ADD" && len(ev.ChildEPCs)+len(ev.ChildQuantityList) == 0 {
+			return uploadErrorf(http.StatusUnprocessableEntity, "packing needs children")
+		}
+		if ev.Action != "ADD" && !tags[parent] {
+			return uploadErrorf(http.StatusNotFound, "no package %s", parent)
+		}
+		if err := named(ev.ChildEPCs, ev.ChildQuantityList); err != nil {
+			return err
+		}
+		tags[parent] = true
+		return nil
+	case "commissioning":
+		return made(ev.EPCList, ev.QuantityList)
+	case "stage":
+		if stage := eventStage(ev); stageIndex(stage) < 0 {
+			return uploadErrorf(http.StatusUnprocessableEntity, "unknown stage %s", stage)
+		}
+		return named(ev.EPCList, ev.QuantityList)
+	case "shipping":
+		sender, receiver := partyOf(ev.SourceList, false), partyOf(ev.DestinationList, true)
+		if receiver == "" {
+			return uploadErrorf(http.StatusUnprocessableEntity, "shipping needs a destination party")
+		}
+		if sender != "" && sender != user {
+			return uploadErrorf(http.StatusForbidden, "only %s can ship as %s", sender, sender)
+		}
+		return named(ev.EPCList, ev.QuantityList)
+	case "receiving":
+		if receiver := partyOf(ev.DestinationList, true); receiver != "" && receiver != user {
+			return uploadErrorf(http.StatusForbidden, "only %s can receive as %s", receiver, receiver)
+		}
+		return named(ev.EPCList, ev.QuantityList)
+	}
+	return uploadErrorf(http.StatusUnprocessableEntity, "nothing here records a %s %s event", ev.Action, ev.BizStep)
+}
+
+// precheckCapture runs precheckEPCIS over the events of a rollback
+// capture that checkEPCIS passed, and fails those it rejects. It says
+// whether any was rejected.
+func (s *service) precheckCapture(ctx context.Context, se *session, c *Capture, events []*EPCISEvent) (bool, error) {
+	var names []string
+	for _, ev := range events {
+		for _, q := range lotsOf(ev.EPCList, ev.QuantityList, ev.ChildEPCs, ev.ChildQuantityList, ev.InputEPCList, ev.InputQuantityList, ev.OutputEPCList, ev.OutputQuantityList) {
+			tag, _ := tagFromEPC(q.EPCClass)
+			names = append(names, tag)
+		}
+		if tag, ok := tagFromEPC(ev.ParentID); ok {
+			names = append(names, tag)
+		}
+	}
+	tags := map[string]bool{}
+	if len(names) > 0 {
+		posts, err := s.postsWhere(ctx, bson.M{"tag": bson.M{"$in": names}})
+		if err != nil {
+			return false, err
+		}
+		for _, p := range posts {
+			tags[p.Tag] = true
+		}
+	}
+	rejected := false
+	for i, ev := range events {
+		res := c.Events[i]
+		if res.Status != "" || s.captured(ctx, ev.EventID) {
+			continue
+		}
+		if err := s.balance.precheckEPCIS(se.Username, ev, tags); err != nil {
+			rejected = true
+			res.Status, res.Error = "failed", err.Error()
+			c.Errors = append(c.Errors, fmt.Sprintf("event %d: %s", i, err.Error()))
+		}
+	}
+	return rejected, nil
+}
+
+// captured says whether an event was exported from here or captured
+// before.
+func (s *service) captured(ctx context.Context, eventID string) bool {
+	if eventID == "" {
+		return false
+	}
+	return s.known(ctx, eventID) || s.db.QueryFilterOne(ctx, "epcis", bson.M{"eventid": eventID}).Err() == nil
+}
+
+func (s *service) captureCommissioning(ctx context.Context, se *session, ev *EPCISEvent) ([]string, error) {
+	farm := ""
+	if ev.BizLocation != nil {
+		farm, _ = epcisPart(ev.BizLocation.ID, "farm")
+	}
+	var refs []string
+	for _, q := range lotsOf(ev.EPCList, ev.QuantityList) {
+		tag, _ := tagFromEPC(q.EPCClass)
+		amount, unit, err := s.balance.fromQuantity(q)
+		if err != nil {
+			return refs, uploadErrorf(http.StatusUnprocessableEntity, "%s", err.Error())
+		}
+		if _, err := typedTag(tag); err != nil {
+			return refs, uploadErrorf(http.StatusUnprocessableEntity, "%s", err.Error())
+		}
+		if _, err := s.findPost(ctx, "tag", tag); err == nil {
+			return refs, uploadErrorf(http.StatusConflict, "tag %s is taken", tag)
+		}
+		path := "file/" + tag + "/"
+		os.MkdirAll(path, 0777)
+		p := &Post{ID: primitive.NewObjectID(), Tag: tag, Title: ev.Title, User: se.Username, Date: ev.time.In(farmZone).Format(time.ANSIC), Amount: amount, Unit: unit, Certification: ev.Certification, Paperwork: path, Farm: farm, TagKind: tagKind(tag)}
+		bc := &BCdataa{ID: p.ID, Tag: tag, ImgHash: []string{}, Hash: []string{}}
+		if _, err := s.db.Add(ctx, "posts", p); err != nil {
+			return refs, err
+		}
+		if _, err := s.db.Add(ctx, "bcposts", bc); err != nil {
+			return refs, err
+		}
+		refs = append(refs, "post/"+p.ID.Hex())
+	}
+	return refs, nil
+}
+
+func (s *service) captureShipping(ctx context.Context, se *session, ev *EPCISEvent) ([]string, error) {
+	sender, receiver := partyOf(ev.SourceList, false), partyOf(ev.DestinationList, true)
+	if receiver == "" {
+		return nil, uploadErrorf(http.StatusUnprocessableEntity, "shipping needs a destination party")
+	}
+	if sender != "" && sender != se.Username {
+		return nil, uploadErrorf(http.StatusForbidden, "only %s can ship as %s", sender, sender)
+	}
+	var refs []string
+	for _, q := range lotsOf(ev.EPCList, ev.QuantityList) {
+		p, err := s.lotPost(ctx, q.EPCClass)
+		if err != nil {
+			return refs, err
+		}
+		// a lot named without a quantity, such as a pallet's SSCC, goes
+		// whole
+		amount := p.Amount
+		if q.Quantity > 0 {
+			if amount, err = s.balance.amountIn(q, unitOf(p)); err != nil {
+				return refs, uploadErrorf(http.StatusUnprocessableEntity, "%s", err.Error())
+			}
+		}
+		t, err := s.openTransfer(se, p, &transferRequest{Receiver: receiver, Amount: amount, Note: ev.Note, Source: ev.EventID})
+		if err != nil {
+			return refs, err
+		}
+		refs = append(refs, "ship/"+t.ID.Hex())
+	}
+	return refs, nil
+}
+
+// captureReceiving accepts the pending transfer of each lot from the
+// source party to the capturing user.
+func (s *service) captureReceiving(ctx context.Context, se *session, ev *EPCISEvent) ([]string, error) {
+	sender := partyOf(ev.SourceList, false)
+	if receiver := partyOf(ev.DestinationList, true); receiver != "" && receiver != se.Username {
+		return nil, uploadErrorf(http.StatusForbidden, "only %s can receive as %s", receiver, receiver)
+	}
+	var refs []string
+	for _, q := range lotsOf(ev.EPCList, ev.QuantityList) {
+		p, err := s.lotPost(ctx, q.EPCClass)
+		if err != nil {
+			return refs, err
+		}
+		filter := bson.M{"post": p.ID, "receiver": se.Username, "status": transferPending, "partof": bson.M{"$exists": false}}
+		if sender != "" {
+			filter["sender"] = sender
+		}
+		if q.Quantity > 0 {
+			amount, err := s.balance.amountIn(q, unitOf(p))
+			if err != nil {
+				return refs, uploadErrorf(http.StatusUnprocessableEntity, "%s", err.Error())
+			}
+			filter["amount"] = amount
+		}
+		pending, err := s.transfersWhere(ctx, filter)
+		if err != nil {
+			return refs, err
+		}
+		if len(pending) == 0 {
+			return refs, uploadErrorf(http.StatusConflict, "no pending transfer of %s to %s", p.Tag, se.Username)
+		}
+		t, err := s.settleTransfer(se, pending[0].ID, transferAccepted, ev.Note)
+		if err != nil {
+			return refs, err
+		}
+		refs = append(refs, "receive/"+t.ID.Hex())
+	}
+	return refs, nil
+}
+
+func (s *service) captureTransformation(ctx context.Context, se *session, ev *EPCISEvent) ([]string, error) {
+	in := &lotRequest{Process: ev.Process, Note: ev.Note, Source: ev.EventID, At: ev.time}
+	for _, q := range lotsOf(ev.InputEPCList, ev.InputQuantityList) {
+		p, err := s.lotPost(ctx, q.EPCClass)
+		if err != nil {
+			return nil, err
+		}
+		amount := p.Amount - p.Allocated
+		if q.Quantity > 0 {
+			if amount, err = s.balance.amountIn(q, unitOf(p)); err != nil {
+				return nil, uploadErrorf(http.StatusUnprocessableEntity, "%s", err.Error())
+			}
+		}
+		in.Inputs = append(in.Inputs, LotInput{Post: p.ID.Hex(), Amount: amount})
+	}
+	for _, q := range lotsOf(ev.OutputEPCList, ev.OutputQuantityList) {
+		tag, _ := tagFromEPC(q.EPCClass)
+		amount, unit, err := s.balance.fromQuantity(q)
+		if err != nil {
+			return nil, uploadErrorf(http.StatusUnprocessableEntity, "%s", err.Error())
+		}
+		in.Outputs = append(in.Outputs, LotOutput{Tag: tag, Amount: amount, Unit: unit, Certification: ev.Certification})
+	}
+	kind, ok := epcisPart(ev.BizStep, "bizstep")
+	if !ok || kind != lotSplit && kind != lotMerge && kind != lotTransform {
+		switch {
+		case len(in.Inputs) == 1 && len(in.Outputs) > 1 && in.Process == "":
+			kind = lotSplit
+		case len(in.Inputs) > 1 && len(in.Outputs) == 1 && in.Process == "":
+			kind = lotMerge
+		default:
+			kind = lotTransform
+		}
+	}
+	if kind == lotTransform && in.Process == "" {
+		if _, ok := s.balance.Yields[cbvTerm(ev.BizStep)]; ok {
+			in.Process = cbvTerm(ev.BizStep)
+		}
+	}
+	op, _, err := s.applyLotOperation(se, kind, in)
+	if err != nil {
+		return nil, err
+	}
+	return []string{"lot/" + op.ID.Hex()}, nil
+}
+
+// captureAggregation packs or unpacks whole lots as the event says. Packing
+// into a parent not seen before makes it a package, a pallet when cases go
+// on it and a case otherwise. OBSERVE only checks the children are in the
+// parent.
+func (s *service) captureAggregation(ctx context.Context, se *session, ev *EPCISEvent) ([]string, error) {
+	tag, _ := tagFromEPC(ev.ParentID)
+	in := &packRequest{Tag: tag, Note: ev.Note, Source: ev.EventID, At: ev.time}
+	for _, q := range lotsOf(ev.ChildEPCs, ev.ChildQuantityList) {
+		child, _ := tagFromEPC(q.EPCClass)
+		in.Children = append(in.Children, child)
+	}
+	if ev.Action == "ADD" && len(in.Children) == 0 {
+		return nil, uploadErrorf(http.StatusUnprocessableEntity, "packing needs children")
+	}
+	pkg, err := s.findPost(ctx, "tag", tag)
+	if err != nil && ev.Action != "ADD" {
+		return nil, uploadErrorf(http.StatusNotFound, "no package %s", tag)
+	}
+	if err == nil && pkg.Package == "" {
+		return nil, uploadErrorf(http.StatusConflict, "%s is not a package", tag)
+	}
+
+	var a *Aggregation
+	switch {
+	case ev.Action == "OBSERVE":
+		children, err := s.packChildren(ctx, in.Children)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range children {
+			if c.Container != pkg.Tag {
+				return nil, uploadErrorf(http.StatusConflict, "%s is not in %s", c.Tag, pkg.Tag)
+			}
+		}
+		return nil, nil
+	case ev.Action == "DELETE":
+		a, err = s.unpack(se, pkg, in)
+	case pkg == nil:
+		var children []*Post
+		children, err = s.packChildren(ctx, in.Children)
+		if err != nil {
+			return nil, err
+		}
+		in.Level = packageCase
+		for _, c := range children {
+			if c.Package == packageCase {
+				in.Level = packagePallet
+			}
+		}
+		_, a, err = s.newPackage(se, in)
+	default:
+		a, err = s.pack(se, pkg, in)
+	}
+	if a == nil {
+		return nil, err
+	}
+	return []string{"aggregation/" + a.ID.Hex()}, err
+}
+
+// runCapture applies a capture's events in order and records the outcome.
+func (s *service) runCapture(se *session, c *Capture, events []*EPCISEvent) {
+	failed := false
+	for i, ev := range events {
+		res := c.Events[i]
+		if res.Status != "" {
+			continue
+		}
+		if failed && c.ErrorBehaviour == captureRollback {
+			res.Status, res.Error = "failed", "not applied after an earlier failure"
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		dup := s.captured(ctx, ev.EventID)
+		cancel()
+		if dup {
+			res.Status = "duplicate"
+			continue
+		}
+		refs, err := s.applyEPCIS(se, ev)
+		res.Records = refs
+		if len(refs) > 0 {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			if _, err := s.db.Add(ctx, "epcis", &EPCISLink{ID: primitive.NewObjectID(), EventID: ev.EventID, Capture: c.ID, Refs: refs, Event: ev}); err != nil {
+				log.Println("err linking captured event", ev.EventID, err)
+			}
+			cancel()
+		}
+		if err != nil {
+			failed = true
+			res.Status, res.Error = "failed", err.Error()
+			c.Errors = append(c.Errors, fmt.Sprintf("event %d: %s", i, err.Error()))
+			continue
+		}
+		res.Status = "captured"
+	}
+	c.Running, c.Success = false, !failed
+	c.FinishedAt = time.Now().In(farmZone).Format(time.RFC3339)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.db.Update(ctx, "captures", "_id", c.ID, c).Err(); err != nil {
+		log.Println("err saving capture", c.ID.Hex(), err)
+	}
+}
+
+// epcisCapture takes an EPCISDocument on POST /epcis/capture. The events
+// are checked at once and applied in the background; the capture job at
+// the Location answered with says how it went. GS1-Capture-Error-Behaviour
+// picks rollback, the default, or proceed.
+func (s *service) epcisCapture(w http.ResponseWriter, r *http.Request) {
+	se := s.sessionFrom(r)
+	if se == nil {
+		writeMessage(w, http.StatusUnauthorized, "session required")
+		return
+	}
+	behaviour := strings.ToLower(r.Header.Get("GS1-Capture-Error-Behaviour"))
+	if behaviour == "" {
+		behaviour = captureRollback
+	}
+	if behaviour != captureRollback && behaviour != captureProceed {
+		writeMessage(w, http.StatusNotImplemented, "capture error behaviour must be rollback or proceed")
+		return
+	}
+	doc := &EPCISDocument{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxCaptureSize)).Decode(doc); err != nil || doc.Type != "EPCISDocument" {
+		writeMessage(w, http.StatusBadRequest, "body must be an EPCISDocument")
+		return
+	}
+	events := doc.EPCISBody.EventList
+	if len(events) > maxCaptureEvents {
+		writeMessage(w, http.StatusRequestEntityTooLarge, "at most "+strconv.Itoa(maxCaptureEvents)+" events per capture")
+		return
+	}
+
+	c := &Capture{ID: primitive.NewObjectID(), User: se.Username, CreatedAt: time.Now().In(farmZone).Format(time.RFC3339), Running: true, ErrorBehaviour: behaviour}
+	invalid := false
+	for i, ev := range events {
+		res := &CaptureResult{EventID: ev.EventID, Type: ev.Type}
+		if err := checkEPCIS(ev); err != nil {
+			invalid = true
+			res.Status, res.Error = "failed", err.Error()
+			c.Errors = append(c.Errors, fmt.Sprintf("event %d: %s", i, err.Error()))
+		}
+		c.Events = append(c.Events, res)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if !invalid && behaviour == captureRollback {
+		rejected, err := s.precheckCapture(ctx, se, c, events)
+		if err != nil {
+			log.Println("err checking capture", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		invalid = rejected
+	}
+	if invalid && behaviour == captureRollback {
+		for _, res := range c.Events {
+			if res.Status == "" {
+				res.Status, res.Error = "failed", "not applied, the document has events that would fail"
+			}
+		}
+		c.Running = false
+		c.FinishedAt = c.CreatedAt
+	}
+	if _, err := s.db.Add(ctx, "captures", c); err != nil {
+		log.Println("err adding capture", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if c.Running {
+		go s.runCapture(se, c, events)
+	}
+	w.Header().Set("GS1-EPCIS-Version", epcisVersion)
+	w.Header().Set("GS1-EPCIS-Capture-Limit", strconv.Itoa(maxCaptureEvents))
+	w.Header().Set("Location", "/epcis/capture/"+c.ID.Hex())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(c)
+}
+
+// epcisCaptureJob answers GET /epcis/capture/{id} for the user who
+// captured it.
+func (s *service) epcisCaptureJob(w http.ResponseWriter, r *http.Request) {
+	se := s.sessionFrom(r)
+	if se == nil {
+		writeMessage(w, http.StatusUnauthorized, "session required")
+		return
+	}
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c := &Capture{}
+	if err := s.db.QueryOne(ctx, "captures", "_id", id).Decode(c); err != nil {
+		writeMessage(w, http.StatusNotFound, "capture not found")
+		return
+	}
+	if c.User != se.Username && !identitySet("FILE_IDENTITIES", "admin")[se.Identity] {
+		writeMessage(w, http.StatusForbidden, "capture belongs to "+c.User)
+		return
+	}
+	w.Header().Set("GS1-EPCIS-Version", epcisVersion)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"mongo/geo"
+)
+
+const exportConeSteps = 12
+
+// exportFilter narrows an export. From and To are inclusive days; zero
+// values leave that side open.
+type exportFilter struct {
+	Factory string
+	Tag     string
+	From    time.Time
+	To      time.Time
+}
+
+func parseExportFilter(get func(string) string) (*exportFilter, error) {
+	f := &exportFilter{Factory: get("factory"), Tag: get("tag")}
+	var err error
+	if v := get("from"); v != "" {
+		if f.From, err = time.Parse("2006-01-02", v); err != nil {
+			return nil, errors.New("from must be YYYY-MM-DD")
+		}
+	}
+	if v := get("to"); v != "" {
+		if f.To, err = time.Parse("2006-01-02", v); err != nil {
+			return nil, errors.New("to must be YYYY-MM-DD")
+		}
+		f.To = f.To.Add(24*time.Hour - time.Nanosecond)
+	}
+	return f, nil
+}
+
+func (f *exportFilter) query() bson.M {
+	q := bson.M{}
+	if f.Factory != "" {
+		q["factory"] = f.Factory
+	}
+	if f.Tag != "" {
+		q["tag"] = f.Tag
+	}
+	return q
+}
+
+func (f *exportFilter) allows(day time.Time) bool {
+	if day.IsZero() {
+		return f.From.IsZero() && f.To.IsZero()
+	}
+	return (f.From.IsZero() || !day.Before(f.From)) && (f.To.IsZero() || !day.After(f.To))
+}
+
+// exportPhoto is one photo location flattened for the writers.
+type exportPhoto struct {
+	Tag      string
+	Factory  string
+	File     string
+	Captured time.Time
+	DDDH     string
+	TxHash   string
+	Heading  *float64
+	Position geo.Point
+	Cone     geo.Polygon
+}
+
+// photoDate is the capture time from EXIF when we have it, otherwise the
+// upload time encoded in the stored file name.
+func photoDate(img ImageEntry) time.Time {
+	if img.Meta != nil && img.Meta.Captured != nil {
+		if t, err := time.Parse("2006-01-02T15:04:05", img.Meta.Captured.Local); err == nil {
+			return t
+		}
+	}
+	t, _ := time.Parse("2006-01-02_150405", img.Date)
+	return t
+}
+
+func (s *service) collectExport(ctx context.Context, f *exportFilter) ([]*exportPhoto, []*Boundary, error) {
+	cur, err := s.db.QueryFilter(ctx, "bcposts", f.query())
+	if err != nil {
+		return nil, nil, err
+	}
+	defer cur.Close(ctx)
+
+	var photos []*exportPhoto
+	tags := map[string]bool{}
+	for cur.Next(ctx) {
+		bc := &BCdataa{}
+		if err := cur.Decode(bc); err != nil {
+			log.Println(err)
+			continue
+		}
+		for _, img := range bc.Images {
+			if img.Location == nil {
+				continue
+			}
+			p := &exportPhoto{Tag: bc.Tag, Factory: bc.Factory, File: img.File, Captured: photoDate(img), TxHash: img.Hash, Position: img.Location.point()}
+			if !f.allows(p.Captured) {
+				continue
+			}
+			if img.Cadastral != nil && img.Cadastral.Best != nil {
+				p.DDDH = img.Cadastral.Best.Label
+			}
+			if v, ok := photoView(img.Meta); ok && v.Heading != nil {
+				p.Heading = v.Heading
+				p.Cone = v.Cone(exportConeSteps)
+			}
+			photos = append(photos, p)
+			tags[bc.Tag] = true
+		}
+		// posts from before per-image entries only kept the last position
+		if len(bc.Images) == 0 && bc.Location != nil {
+			p := &exportPhoto{Tag: bc.Tag, Factory: bc.Factory, File: bc.Image, DDDH: bc.DDDH, Position: bc.Location.point()}
+			p.Captured, _ = time.Parse("2006-01-02_150405", bc.Date)
+			if len(bc.Hash) > 0 {
+				p.TxHash = bc.Hash[len(bc.Hash)-1]
+			}
+			if f.allows(p.Captured) {
+				photos = append(photos, p)
+				tags[bc.Tag] = true
+			}
+		}
+	}
+
+	var bounds []*Boundary
+	for tag := range tags {
+		post, err := s.findPost(ctx, "tag", tag)
+		if err != nil {
+			continue
+		}
+		b, err := s.boundariesFor(ctx, post)
+		if err != nil {
+			return nil, nil, err
+		}
+		bounds = append(bounds, b...)
+	}
+	return photos, dedupeBoundaries(bounds), nil
+}
+
+// dedupeBoundaries drops repeats of a farm boundary shared by several posts.
+func dedupeBoundaries(in []*Boundary) []*Boundary {
+	seen := map[string]bool{}
+	var out []*Boundary
+	for _, b := range in {
+		if !seen[b.ID.Hex()] {
+			seen[b.ID.Hex()] = true
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+func ringCoords(r geo.Ring) [][]float64 {
+	ret := make([][]float64, 0, len(r)+1)
+	for _, p := range r {
+		ret = append(ret, []float64{p.Lon, p.Lat})
+	}
+	if len(r) > 0 && r[0] != r[len(r)-1] {
+		ret = append(ret, []float64{r[0].Lon, r[0].Lat})
+	}
+	return ret
+}
+
+func polygonCoords(p geo.Polygon) [][][]float64 {
+	var ret [][][]float64
+	for _, r := range p {
+		ret = append(ret, ringCoords(r))
+	}
+	return ret
+}
+
+type geoJSONOut struct {
+	Type       string                 `json:"type"`
+	Geometry   map[string]interface{} `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+func (p *exportPhoto) properties(kind string) map[string]interface{} {
+	props := map[string]interface{}{
+		"kind":    kind,
+		"tag":     p.Tag,
+		"factory": p.Factory,
+		"file":    p.File,
+		"dddh":    p.DDDH,
+		"txhash":  p.TxHash,
+	}
+	if !p.Captured.IsZero() {
+		props["captured"] = p.Captured.Format("2006-01-02T15:04:05")
+	}
+	if p.Heading != nil {
+		props["heading"] = *p.Heading
+	}
+	return props
+}
+
+// writeGeoJSON emits a FeatureCollection with a point per photo, a polygon
+// per camera view cone and the registered boundaries, told apart by the
+// "kind" property.
+func writeGeoJSON(w io.Writer, photos []*exportPhoto, bounds []*Boundary) error {
+	features := []geoJSONOut{}
+	for _, p := range photos {
+		features = append(features, geoJSONOut{
+			Type:       "Feature",
+			Geometry:   map[string]interface{}{"type": "Point", "coordinates": []float64{p.Position.Lon, p.Position.Lat}},
+			Properties: p.properties("photo"),
+		})
+		if p.Cone != nil {
+			features = append(features, geoJSONOut{
+				Type:       "Feature",
+				Geometry:   map[string]interface{}{"type": "Polygon", "coordinates": polygonCoords(p.Cone)},
+				Properties: p.properties("viewcone"),
+			})
+		}
+	}
+	for _, b := range bounds {
+		features = append(features, geoJSONOut{
+			Type:       "Feature",
+			Geometry:   map[string]interface{}{"type": "Polygon", "coordinates": polygonCoords(b.Polygon)},
+			Properties: map[string]interface{}{"kind": "boundary", "name": b.Name, "post": b.Post, "farm": b.Farm, "parcels": b.Parcels},
+		})
+	}
+	enc := json.NewEncoder(w)
+	return enc.Encode(map[string]interface{}{"type": "FeatureCollection", "features": features})
+}
+
+type kmlData struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value"`
+}
+
+type kmlPoint struct {
+	Coordinates string `xml:"coordinates"`
+}
+
+type kmlInner struct {
+	Coordinates string `xml:"LinearRing>coordinates"`
+}
+
+type kmlPolygonGeom struct {
+	Outer string     `xml:"outerBoundaryIs>LinearRing>coordinates"`
+	Inner []kmlInner `xml:"innerBoundaryIs"`
+}
+
+type kmlTimeStamp struct {
+	When string `xml:"when"`
+}
+
+type kmlPlacemark struct {
+	Name        string          `xml:"name"`
+	Description string          `xml:"description,omitempty"`
+	TimeStamp   *kmlTimeStamp   `xml:"TimeStamp,omitempty"`
+	Data        []kmlData       `xml:"ExtendedData>Data"`
+	Point       *kmlPoint       `xml:"Point,omitempty"`
+	Polygon     *kmlPolygonGeom `xml:"Polygon,omitempty"`
+}
+
+type kmlFolder struct {
+	Name       string         `xml:"name"`
+	Placemarks []kmlPlacemark `xml:"Placemark"`
+}
+
+type kmlDoc struct {
+	XMLName xml.Name    `xml:"kml"`
+	NS      string      `xml:"xmlns,attr"`
+	Name    string      `xml:"Document>name"`
+	Folders []kmlFolder `xml:"Document>Folder"`
+}
+
+func kmlRing(r geo.Ring) string {
+	var parts []string
+	for _, c := range ringCoords(r) {
+		parts = append(parts, strconv.FormatFloat(c[0], 'f', 7, 64)+","+strconv.FormatFloat(c[1], 'f', 7, 64))
+	}
+	return strings.Join(parts, " ")
+}
+
+func kmlPolygon(pm *kmlPlacemark, p geo.Polygon) {
+	if len(p) == 0 {
+		return
+	}
+	pm.Polygon = &kmlPolygonGeom{Outer: kmlRing(p[0])}
+	for _, h := range p[1:] {
+		pm.Polygon.Inner = append(pm.Polygon.Inner, kmlInner{kmlRing(h)})
+	}
+}
+
+func (p *exportPhoto) kmlData() []kmlData {
+	d := []kmlData{{"tag", p.Tag}, {"factory", p.Factory}, {"file", p.File}, {"dddh", p.DDDH}, {"txhash", p.TxHash}}
+	if p.Heading != nil {
+		d = append(d, kmlData{"heading", strconv.FormatFloat(*p.Heading, 'f', 1, 64)})
+	}
+	return d
+}
+
+func writeKML(w io.Writer, photos []*exportPhoto, bounds []*Boundary) error {
+	pts := kmlFolder{Name: "Photos"}
+	cones := kmlFolder{Name: "View cones"}
+	for _, p := range photos {
+		pm := kmlPlacemark{Name: p.Tag, Description: p.File, Data: p.kmlData()}
+		if !p.Captured.IsZero() {
+			pm.TimeStamp = &kmlTimeStamp{p.Captured.Format("2006-01-02T15:04:05")}
+		}
+		pm.Point = &kmlPoint{strconv.FormatFloat(p.Position.Lon, 'f', 7, 64) + "," + strconv.FormatFloat(p.Position.Lat, 'f', 7, 64)}
+		pts.Placemarks = append(pts.Placemarks, pm)
+		if p.Cone != nil {
+			c := kmlPlacemark{Name: p.Tag + " view", Data: p.kmlData(), TimeStamp: pm.TimeStamp}
+			kmlPolygon(&c, p.Cone)
+			cones.Placemarks = append(cones.Placemarks, c)
+		}
+	}
+	bf := kmlFolder{Name: "Boundaries"}
+	for _, b := range bounds {
+		pm := kmlPlacemark{Name: b.Name, Data: []kmlData{{"post", b.Post}, {"farm", b.Farm}, {"parcels", strings.Join(b.Parcels, ";")}}}
+		kmlPolygon(&pm, b.Polygon)
+		bf.Placemarks = append(bf.Placemarks, pm)
+	}
+	doc := kmlDoc{NS: "http://www.opengis.net/kml/2.2", Name: "SC-blockchain evidence", Folders: []kmlFolder{pts, cones, bf}}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(doc)
+}
+
+func (s *service) export(w http.ResponseWriter, r *http.Request, format string) {
+	log.Println("export called:", format)
+	f, err := parseExportFilter(r.URL.Query().Get)
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	photos, bounds, err := s.collectExport(ctx, f)
+	if err != nil {
+		log.Println("err collecting export:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if format == "kml" {
+		w.Header().Set("Content-Type", "application/vnd.google-earth.kml+xml")
+		w.Header().Set("Content-Disposition", `attachment; filename="evidence.kml"`)
+		err = writeKML(w, photos, bounds)
+	} else {
+		w.Header().Set("Content-Type", "application/geo+json")
+		w.Header().Set("Content-Disposition", `attachment; filename="evidence.geojson"`)
+		err = writeGeoJSON(w, photos, bounds)
+	}
+	if err != nil {
+		log.Println("err writing export:", err)
+	}
+}
+
+func (s *service) exportGeoJSON(w http.ResponseWriter, r *http.Request) {
+	s.export(w, r, "geojson")
+}
+
+func (s *service) exportKML(w http.ResponseWriter, r *http.Request) {
+	s.export(w, r, "kml")
+}
+
+// runExport implements "export" on the command line:
+//
+//	mongo export -format kml -factory F01 -from 2019-01-01 -o evidence.kml
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", "geojson", "geojson or kml")
+	out := fs.String("o", "", "output file, stdout when empty")
+	dbip := fs.String("dbip", "localhost", "mongodb host")
+	dbport := fs.String("dbport", "27017", "mongodb port")
+	dbname := fs.String("dbname", "testing", "database name")
+	factory := fs.String("factory", "", "only this factory")
+	tag := fs.String("tag", "", "only this product tag")
+	from := fs.String("from", "", "first capture day, YYYY-MM-DD")
+	to := fs.String("to", "", "last capture day, YYYY-MM-DD")
+	fs.Parse(args)
+
+	vals := map[string]string{"factory": *factory, "tag": *tag, "from": *from, "to": *to}
+	f, err := parseExportFilter(func(k string) string { return vals[k] })
+	if err != nil {
+		return err
+	}
+	s := NewService("", "")
+	if err := s.db.Connect(*dbip, *dbport, *dbname); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	photos, bounds, err := s.collectExport(ctx, f)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	switch *format {
+	case "kml":
+		err = writeKML(w, photos, bounds)
+	case "geojson":
+		err = writeGeoJSON(w, photos, bounds)
+	default:
+		err = fmt.Errorf("unknown format %q", *format)
+	}
+	if err == nil {
+		log.Println("exported", len(photos), "photos and", len(bounds), "boundaries")
+	}
+	return err
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const defaultSignedURLTTL = 15 * time.Minute
+
+// PaperworkFile is one document filed under a post, with a signed URL to
+// fetch it.
+type PaperworkFile struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	URL  string `json:"url"`
+}
+
+// signedURLTTL reads SIGNED_URL_TTL as a Go duration, e.g. "30m".
+func signedURLTTL() time.Duration {
+	d, err := time.ParseDuration(os.Getenv("SIGNED_URL_TTL"))
+	if err != nil || d <= 0 {
+		return defaultSignedURLTTL
+	}
+	return d
+}
+
+// urlPayload is what a URL signature covers. The newlines keep it apart
+// from session tokens, which are signed with the same key but never
+// contain one.
+func urlPayload(scope string, exp int64) []byte {
+	return []byte("url\n" + scope + "\n" + strconv.FormatInt(exp, 10))
+}
+
+// signURL returns path with a signature that lets whoever holds it GET
+// anything under scope until it expires. scope is either path itself or a
+// prefix of it ending in "/".
+func (s *service) signURL(path string, scope string) string {
+	exp := time.Now().Add(signedURLTTL()).Unix()
+	q := url.Values{}
+	q.Set("exp", strconv.FormatInt(exp, 10))
+	q.Set("scope", scope)
+	q.Set("sig", s.sessions.sign(urlPayload(scope, exp)))
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	return path + sep + q.Encode()
+}
+
+// signedFor reports whether r carries an unexpired signature whose scope
+// covers path.
+func (s *service) signedFor(r *http.Request, path string) bool {
+	q := r.URL.Query()
+	sig, scope := q.Get("sig"), q.Get("scope")
+	if sig == "" || scope == "" {
+		return false
+	}
+	exp, err := strconv.ParseInt(q.Get("exp"), 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return false
+	}
+	if scope != path && !(strings.HasSuffix(scope, "/") && strings.HasPrefix(path, scope)) {
+		return false
+	}
+	return hmac.Equal([]byte(s.sessions.sign(urlPayload(scope, exp))), []byte(sig))
+}
+
+// canAccessPost says whether the session may see a post's files: the
+// identities in FILE_IDENTITIES see everything, anyone else only the posts
+// they are the user, factory or market of.
+func canAccessPost(se *session, p *Post) bool {
+	if se == nil || p == nil {
+		return false
+	}
+	if identitySet("FILE_IDENTITIES", "admin")[se.Identity] {
+		return true
+	}
+	return se.Username != "" && (se.Username == p.User || se.Username == p.Factory || se.Username == p.Market)
+}
+
+// authorizeTag lets a request through when it is signed for path or its
+// session has rights on the post owning tag. Otherwise it answers the
+// request and returns false.
+func (s *service) authorizeTag(w http.ResponseWriter, r *http.Request, tag string, path string) bool {
+	if s.signedFor(r, path) {
+		return true
+	}
+	se := s.sessionFrom(r)
+	if se == nil {
+		writeMessage(w, http.StatusUnauthorized, "signed url or session required")
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	p, err := s.findPost(ctx, "tag", tag)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return false
+	}
+	if !canAccessPost(se, p) {
+		writeMessage(w, http.StatusForbidden, se.Username+" has no rights on "+tag)
+		return false
+	}
+	return true
+}
+
+// paperworkFiles lists the documents filed for a post with signed URLs.
+func (s *service) paperworkFiles(p *Post) []*PaperworkFile {
+	dir := "file/" + p.Tag + "/"
+	if !validTag(p.Tag) {
+		return nil
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	ret := []*PaperworkFile{}
+	for _, fi := range files {
+		if !fi.Mode().IsRegular() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		path := "/" + dir + fi.Name()
+		ret = append(ret, &PaperworkFile{Name: fi.Name(), Size: fi.Size(), URL: s.signURL((&url.URL{Path: path}).EscapedPath(), path)})
+	}
+	return ret
+}
+
+// signPost fills in a post's paperwork URLs when se has rights on it.
+func (s *service) signPost(se *session, p *Post) {
+	if canAccessPost(se, p) {
+		p.Files = s.paperworkFiles(p)
+	}
+}
+
+// signImages fills in signed URLs for a bcpost's photos when se has rights
+// on the post it belongs to.
+func (s *service) signImages(ctx context.Context, se *session, bc *BCdataa) {
+	if se == nil || len(bc.Images) == 0 {
+		return
+	}
+	p, err := s.findPost(ctx, "_id", bc.ID)
+	if err != nil || !canAccessPost(se, p) {
+		return
+	}
+	for i := range bc.Images {
+		path := "/" + bc.Images[i].File
+		bc.Images[i].URL = s.signURL(path, path)
+	}
+}
+
+// paperworkFile serves one document from file/<tag>/. There are no
+// directory listings; the files of a post are listed in its API response.
+func (s *service) paperworkFile(w http.ResponseWriter, r *http.Request) {
+	tag, file := mux.Vars(r)["tag"], mux.Vars(r)["file"]
+	if !validTag(tag) || !validTag(file) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	path := "file/" + tag + "/" + file
+	if !s.authorizeTag(w, r, tag, "/"+path) {
+		return
+	}
+	fi, err := os.Stat(path)
+	if err != nil || !fi.Mode().IsRegular() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		log.Println("err opening", path, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, file, fi.ModTime(), f)
+}
@@ -0,0 +1,203 @@
+package geo
+
+import (
+	"math"
+	"sort"
+)
+
+const (
+	// DefaultSensorWidth is a 1/2.3" phone sensor, used when the camera
+	// model's sensor is unknown.
+	DefaultSensorWidth = 6.17
+	// DefaultRange is how far into a field a photo is assumed to show.
+	DefaultRange = 80.0
+	// defaultFOV is used when the photo has no focal length.
+	defaultFOV = 65.0
+
+	raySteps      = 31
+	distanceSteps = 20
+	minCandidate  = 0.05
+	maxCandidates = 5
+)
+
+// View describes where a photo was taken from and what it looked at.
+// Heading and FocalLength are optional.
+type View struct {
+	Position    Point
+	Heading     *float64
+	FocalLength *float64
+	SensorWidth float64
+	Range       float64
+	Accuracy    float64
+}
+
+// FieldOfView is the horizontal angle of view in degrees.
+func (v View) FieldOfView() float64 {
+	if v.FocalLength == nil || *v.FocalLength <= 0 {
+		return defaultFOV
+	}
+	sw := v.SensorWidth
+	if sw <= 0 {
+		sw = DefaultSensorWidth
+	}
+	return deg(2 * math.Atan(sw/(2**v.FocalLength)))
+}
+
+func (v View) viewRange() float64 {
+	if v.Range > 0 {
+		return v.Range
+	}
+	return DefaultRange
+}
+
+// Cone is the area the camera saw: a sector from the camera position
+// along the heading. Without a heading it is a circle of the view range.
+func (v View) Cone(arcSteps int) Polygon {
+	r := v.viewRange()
+	if arcSteps < 2 {
+		arcSteps = 2
+	}
+	var ring Ring
+	if v.Heading == nil {
+		for i := 0; i < arcSteps*4; i++ {
+			ring = append(ring, Destination(v.Position, float64(i)*360/float64(arcSteps*4), r))
+		}
+		return Polygon{ring}
+	}
+	half := v.FieldOfView() / 2
+	ring = append(ring, v.Position)
+	for i := 0; i <= arcSteps; i++ {
+		b := *v.Heading - half + 2*half*float64(i)/float64(arcSteps)
+		ring = append(ring, Destination(v.Position, b, r))
+	}
+	ring = append(ring, v.Position)
+	return Polygon{ring}
+}
+
+// Match is one parcel a photo may show. Confidence is in [0, 1].
+type Match struct {
+	Section    string  `json:"section" bson:"section"`
+	Number     string  `json:"number" bson:"number"`
+	Label      string  `json:"label" bson:"label"`
+	Confidence float64 `json:"confidence" bson:"confidence"`
+}
+
+// Result of a cadastral lookup. Method is "view" when the heading was used
+// and "position" when only the camera location was.
+type Result struct {
+	Best       *Match  `json:"best,omitempty" bson:"best,omitempty"`
+	Candidates []Match `json:"candidates,omitempty" bson:"candidates,omitempty"`
+	Method     string  `json:"method" bson:"method"`
+}
+
+// Cadastre is an in-memory parcel dataset.
+type Cadastre struct {
+	idx *Index
+}
+
+func NewCadastre(parcels []*Parcel) *Cadastre {
+	items := make([]Item, len(parcels))
+	for i, p := range parcels {
+		items[i] = p
+	}
+	return &Cadastre{idx: NewIndex(items)}
+}
+
+// LoadCadastre reads and indexes every file in paths.
+func LoadCadastre(paths []string, proj Projection) (*Cadastre, error) {
+	var all []*Parcel
+	for _, p := range paths {
+		parcels, err := LoadFile(p, proj)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, parcels...)
+	}
+	return NewCadastre(all), nil
+}
+
+func (c *Cadastre) Len() int {
+	return c.idx.Len()
+}
+
+// At returns the parcel containing pt, or nil.
+func (c *Cadastre) At(pt Point) *Parcel {
+	var found *Parcel
+	c.idx.Search(Rect{Min: pt, Max: pt}, func(it Item) bool {
+		p := it.(*Parcel)
+		if p.Contains(pt) {
+			found = p
+			return false
+		}
+		return true
+	})
+	return found
+}
+
+// Lookup samples the view and scores each parcel by the weighted share of
+// samples that fall in it. Samples near the centre of the frame and near
+// the camera weigh more, since that is what a photo is usually of. Poor GPS
+// accuracy scales every score down.
+func (c *Cadastre) Lookup(v View) *Result {
+	weights := map[*Parcel]float64{}
+	total := 0.0
+	add := func(pt Point, w float64) {
+		total += w
+		if p := c.At(pt); p != nil {
+			weights[p] += w
+		}
+	}
+
+	r := v.viewRange()
+	res := &Result{Method: "view"}
+	if v.Heading != nil {
+		half := v.FieldOfView() / 2
+		for i := 0; i < raySteps; i++ {
+			off := -half + 2*half*float64(i)/float64(raySteps-1)
+			for j := 1; j <= distanceSteps; j++ {
+				d := r * float64(j) / distanceSteps
+				w := (1 - 0.5*math.Abs(off)/half) * (1 - 0.5*d/r)
+				add(Destination(v.Position, *v.Heading+off, d), w)
+			}
+		}
+	} else {
+		res.Method = "position"
+		radius := math.Max(v.Accuracy, 5)
+		add(v.Position, 1)
+		for ring := 1; ring <= 3; ring++ {
+			d := radius * float64(ring) / 3
+			for i := 0; i < 12*ring; i++ {
+				add(Destination(v.Position, float64(i)*360/float64(12*ring), d), 1/float64(ring))
+			}
+		}
+	}
+	if total == 0 {
+		return res
+	}
+
+	penalty := 1.0
+	if v.Accuracy > 0 {
+		penalty = r / (r + v.Accuracy)
+	}
+	for p, w := range weights {
+		conf := w / total * penalty
+		if conf < minCandidate {
+			continue
+		}
+		res.Candidates = append(res.Candidates, Match{Section: p.Section, Number: p.Number, Label: p.Label(), Confidence: math.Round(conf*1000) / 1000})
+	}
+	sort.Slice(res.Candidates, func(i, j int) bool {
+		if res.Candidates[i].Confidence != res.Candidates[j].Confidence {
+			return res.Candidates[i].Confidence > res.Candidates[j].Confidence
+		}
+		return res.Candidates[i].Label < res.Candidates[j].Label
+	})
+	if len(res.Candidates) > maxCandidates {
+		res.Candidates = res.Candidates[:maxCandidates]
+	}
+	if len(res.Candidates) > 0 {
+		best := res.Candidates[0]
+		res.Best = &best
+	}
+	return res
+}
@@ -0,0 +1,176 @@
+// Package geo holds the spatial primitives the service needs without
+// calling out to GIS tools: polygons in WGS84 lon/lat, point-in-polygon,
+// distances, and the camera view cone used for cadastral lookups.
+package geo
+
+import "math"
+
+const earthRadius = 6371008.8
+
+// Point is a WGS84 position. Lon comes first to match GeoJSON.
+type Point struct {
+	Lon float64 `json:"lon" bson:"lon"`
+	Lat float64 `json:"lat" bson:"lat"`
+}
+
+// Ring is a closed linear ring; the last point may or may not repeat the
+// first.
+type Ring []Point
+
+// Polygon is an outer ring followed by any holes.
+type Polygon []Ring
+
+// Rect is an axis aligned bounding box in degrees.
+type Rect struct {
+	Min Point `json:"min" bson:"min"`
+	Max Point `json:"max" bson:"max"`
+}
+
+func emptyRect() Rect {
+	return Rect{Min: Point{math.Inf(1), math.Inf(1)}, Max: Point{math.Inf(-1), math.Inf(-1)}}
+}
+
+func (r Rect) extend(p Point) Rect {
+	r.Min.Lon = math.Min(r.Min.Lon, p.Lon)
+	r.Min.Lat = math.Min(r.Min.Lat, p.Lat)
+	r.Max.Lon = math.Max(r.Max.Lon, p.Lon)
+	r.Max.Lat = math.Max(r.Max.Lat, p.Lat)
+	return r
+}
+
+func (r Rect) union(o Rect) Rect {
+	return r.extend(o.Min).extend(o.Max)
+}
+
+func (r Rect) Intersects(o Rect) bool {
+	return r.Min.Lon <= o.Max.Lon && o.Min.Lon <= r.Max.Lon && r.Min.Lat <= o.Max.Lat && o.Min.Lat <= r.Max.Lat
+}
+
+func (r Rect) Contains(p Point) bool {
+	return p.Lon >= r.Min.Lon && p.Lon <= r.Max.Lon && p.Lat >= r.Min.Lat && p.Lat <= r.Max.Lat
+}
+
+func (r Rect) center() Point {
+	return Point{(r.Min.Lon + r.Max.Lon) / 2, (r.Min.Lat + r.Max.Lat) / 2}
+}
+
+// Bounds returns the bounding box of all rings.
+func (p Polygon) Bounds() Rect {
+	b := emptyRect()
+	for _, ring := range p {
+		for _, pt := range ring {
+			b = b.extend(pt)
+		}
+	}
+	return b
+}
+
+// contains is the even-odd ray casting test.
+func (r Ring) contains(pt Point) bool {
+	in := false
+	n := len(r)
+	for i, j := 0, n-1; i < n; j, i = i, i+1 {
+		a, b := r[i], r[j]
+		if (a.Lat > pt.Lat) != (b.Lat > pt.Lat) &&
+			pt.Lon < (b.Lon-a.Lon)*(pt.Lat-a.Lat)/(b.Lat-a.Lat)+a.Lon {
+			in = !in
+		}
+	}
+	return in
+}
+
+// Contains reports whether pt is inside the outer ring and outside every
+// hole.
+func (p Polygon) Contains(pt Point) bool {
+	if len(p) == 0 || !p[0].contains(pt) {
+		return false
+	}
+	for _, hole := range p[1:] {
+		if hole.contains(pt) {
+			return false
+		}
+	}
+	return true
+}
+
+func rad(d float64) float64 {
+	return d * math.Pi / 180
+}
+
+func deg(r float64) float64 {
+	return r * 180 / math.Pi
+}
+
+// Distance is the great circle distance in metres.
+func Distance(a, b Point) float64 {
+	dLat := rad(b.Lat - a.Lat)
+	dLon := rad(b.Lon - a.Lon)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(rad(a.Lat))*math.Cos(rad(b.Lat))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// Destination moves distance metres from p along bearing degrees clockwise
+// from north.
+func Destination(p Point, bearing float64, distance float64) Point {
+	d := distance / earthRadius
+	b := rad(bearing)
+	lat1, lon1 := rad(p.Lat), rad(p.Lon)
+	lat2 := math.Asin(math.Sin(lat1)*math.Cos(d) + math.Cos(lat1)*math.Sin(d)*math.Cos(b))
+	lon2 := lon1 + math.Atan2(math.Sin(b)*math.Sin(d)*math.Cos(lat1), math.Cos(d)-math.Sin(lat1)*math.Sin(lat2))
+	return Point{Lon: math.Mod(deg(lon2)+540, 360) - 180, Lat: deg(lat2)}
+}
+
+// local projects q onto a plane in metres centred on origin. It is only
+// accurate over the few kilometres a farm spans.
+func local(origin, q Point) (x, y float64) {
+	x = rad(q.Lon-origin.Lon) * earthRadius * math.Cos(rad(origin.Lat))
+	y = rad(q.Lat-origin.Lat) * earthRadius
+	return x, y
+}
+
+// DistanceToRing is the shortest distance in metres from pt to any edge of
+// the ring.
+func DistanceToRing(pt Point, r Ring) float64 {
+	best := math.Inf(1)
+	n := len(r)
+	for i, j := 0, n-1; i < n; j, i = i, i+1 {
+		ax, ay := local(pt, r[j])
+		bx, by := local(pt, r[i])
+		dx, dy := bx-ax, by-ay
+		t := 0.0
+		if l := dx*dx + dy*dy; l > 0 {
+			t = math.Max(0, math.Min(1, -(ax*dx+ay*dy)/l))
+		}
+		cx, cy := ax+t*dx, ay+t*dy
+		best = math.Min(best, math.Hypot(cx, cy))
+	}
+	return best
+}
+
+// DistanceToPolygon is 0 inside the polygon and the distance to the nearest
+// boundary otherwise.
+func DistanceToPolygon(pt Point, p Polygon) float64 {
+	if p.Contains(pt) {
+		return 0
+	}
+	best := math.Inf(1)
+	for _, r := range p {
+		best = math.Min(best, DistanceToRing(pt, r))
+	}
+	return best
+}
+
+// NewPolygon converts GeoJSON Polygon coordinates, [lon, lat] pairs.
+func NewPolygon(coords [][][]float64) Polygon {
+	var poly Polygon
+	for _, r := range coords {
+		ring := make(Ring, 0, len(r))
+		for _, c := range r {
+			if len(c) >= 2 {
+				ring = append(ring, Point{Lon: c[0], Lat: c[1]})
+			}
+		}
+		poly = append(poly, ring)
+	}
+	return poly
+}
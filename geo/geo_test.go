@@ -0,0 +1,136 @@
+package geo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// square is a ring around (x, y) with sides of 2*h, clockwise when cw.
+func square(x, y, h float64, cw bool) Ring {
+	r := Ring{{x - h, y - h}, {x + h, y - h}, {x + h, y + h}, {x - h, y + h}, {x - h, y - h}}
+	if cw {
+		for i, j := 0, len(r)-1; i < j; i, j = i+1, j-1 {
+			r[i], r[j] = r[j], r[i]
+		}
+	}
+	return r
+}
+
+func TestPolygonContains(t *testing.T) {
+	donut := Polygon{square(121, 24, 1, true), square(121, 24, 0.25, false)}
+	tests := []struct {
+		name string
+		poly Polygon
+		pt   Point
+		want bool
+	}{
+		{"empty", nil, Point{121, 24}, false},
+		{"inside", Polygon{square(121, 24, 1, true)}, Point{121.5, 24.5}, true},
+		{"outside", Polygon{square(121, 24, 1, true)}, Point{122.5, 24}, false},
+		{"in the ring", donut, Point{121.5, 24}, true},
+		{"in the hole", donut, Point{121.1, 24.1}, false},
+		{"outside the ring", donut, Point{119, 24}, false},
+		{"either winding", Polygon{square(121, 24, 1, false)}, Point{121, 24}, true},
+	}
+	for _, tt := range tests {
+		if got := tt.poly.Contains(tt.pt); got != tt.want {
+			t.Errorf("%s: Contains(%v) = %v, want %v", tt.name, tt.pt, got, tt.want)
+		}
+	}
+}
+
+// shpRecord encodes one polygon record with a part per ring.
+func shpRecord(rings ...Ring) []byte {
+	var parts []uint32
+	var pts []Point
+	for _, r := range rings {
+		parts = append(parts, uint32(len(pts)))
+		pts = append(pts, r...)
+	}
+	var b bytes.Buffer
+	le := func(v interface{}) { binary.Write(&b, binary.LittleEndian, v) }
+	le(uint32(5))
+	le([4]float64{})
+	le(uint32(len(parts)))
+	le(uint32(len(pts)))
+	le(parts)
+	for _, p := range pts {
+		le(math.Float64bits(p.Lon))
+		le(math.Float64bits(p.Lat))
+	}
+	return b.Bytes()
+}
+
+// shpFile wraps records in a header; a nil record is a null shape.
+func shpFile(records ...[]byte) []byte {
+	var b bytes.Buffer
+	b.Write(make([]byte, 100))
+	for n, rec := range records {
+		if rec == nil {
+			rec = []byte{0, 0, 0, 0}
+		}
+		binary.Write(&b, binary.BigEndian, uint32(n+1))
+		binary.Write(&b, binary.BigEndian, uint32(len(rec)/2))
+		b.Write(rec)
+	}
+	d := b.Bytes()
+	binary.BigEndian.PutUint32(d[0:4], 9994)
+	binary.BigEndian.PutUint32(d[24:28], uint32(len(d)/2))
+	return d
+}
+
+func TestReadShp(t *testing.T) {
+	outer, hole := square(121, 24, 1, true), square(121, 24, 0.25, false)
+	tests := []struct {
+		name  string
+		data  []byte
+		polys []int // rings in each polygon of each shape
+		err   bool
+	}{
+		{"not a shapefile", make([]byte, 100), nil, true},
+		{"single ring", shpFile(shpRecord(outer)), []int{1}, false},
+		{"ring with hole", shpFile(shpRecord(outer, hole)), []int{2}, false},
+		{"two outer rings", shpFile(shpRecord(outer, square(125, 24, 1, true))), []int{1, 1}, false},
+		{"null shape", shpFile(nil, shpRecord(outer)), []int{-1, 1}, false},
+		{"truncated", shpFile(shpRecord(outer))[:150], nil, true},
+	}
+	for _, tt := range tests {
+		shapes, err := readShp(tt.data, WGS84)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: err = %v", tt.name, err)
+			continue
+		}
+		if tt.err {
+			continue
+		}
+		var got []int
+		for _, s := range shapes {
+			if s == nil {
+				got = append(got, -1)
+			}
+			for _, p := range s {
+				got = append(got, len(p))
+			}
+		}
+		if len(got) != len(tt.polys) {
+			t.Errorf("%s: shapes %v, want %v", tt.name, got, tt.polys)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.polys[i] {
+				t.Errorf("%s: shapes %v, want %v", tt.name, got, tt.polys)
+				break
+			}
+		}
+	}
+
+	shapes, err := readShp(shpFile(shpRecord(outer, hole)), WGS84)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := shapes[0][0]; !p.Contains(Point{121.5, 24}) || p.Contains(Point{121, 24}) {
+		t.Errorf("hole was not kept as a hole: %v", p)
+	}
+}
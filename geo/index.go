@@ -0,0 +1,124 @@
+package geo
+
+import (
+	"math"
+	"sort"
+)
+
+const nodeCapacity = 16
+
+// Item is anything the index can hold.
+type Item interface {
+	Bounds() Rect
+}
+
+type node struct {
+	bounds   Rect
+	children []*node
+	items    []Item
+}
+
+// Index is a static R-tree bulk loaded with sort-tile-recursive packing.
+// Parcel datasets are loaded once at start up, so it is never updated.
+type Index struct {
+	root *node
+	size int
+}
+
+// NewIndex packs items into a new index.
+func NewIndex(items []Item) *Index {
+	idx := &Index{size: len(items)}
+	if len(items) == 0 {
+		return idx
+	}
+	leaves := make([]*node, 0, len(items)/nodeCapacity+1)
+	for _, group := range strPack(items, func(it Item) Rect { return it.Bounds() }) {
+		n := &node{bounds: emptyRect()}
+		for _, it := range group {
+			n.items = append(n.items, it)
+			n.bounds = n.bounds.union(it.Bounds())
+		}
+		leaves = append(leaves, n)
+	}
+	level := leaves
+	for len(level) > 1 {
+		wrapped := make([]Item, len(level))
+		for i, n := range level {
+			wrapped[i] = n
+		}
+		var next []*node
+		for _, group := range strPack(wrapped, func(it Item) Rect { return it.Bounds() }) {
+			n := &node{bounds: emptyRect()}
+			for _, it := range group {
+				c := it.(*node)
+				n.children = append(n.children, c)
+				n.bounds = n.bounds.union(c.bounds)
+			}
+			next = append(next, n)
+		}
+		level = next
+	}
+	idx.root = level[0]
+	return idx
+}
+
+func (n *node) Bounds() Rect {
+	return n.bounds
+}
+
+// strPack sorts items into vertical slices by x, then each slice by y, and
+// cuts runs of nodeCapacity.
+func strPack(items []Item, bounds func(Item) Rect) [][]Item {
+	leafCount := int(math.Ceil(float64(len(items)) / nodeCapacity))
+	slices := int(math.Ceil(math.Sqrt(float64(leafCount))))
+	sorted := append([]Item(nil), items...)
+	sort.Slice(sorted, func(i, j int) bool { return bounds(sorted[i]).center().Lon < bounds(sorted[j]).center().Lon })
+	per := slices * nodeCapacity
+	var groups [][]Item
+	for s := 0; s < len(sorted); s += per {
+		e := s + per
+		if e > len(sorted) {
+			e = len(sorted)
+		}
+		slice := sorted[s:e]
+		sort.Slice(slice, func(i, j int) bool { return bounds(slice[i]).center().Lat < bounds(slice[j]).center().Lat })
+		for g := 0; g < len(slice); g += nodeCapacity {
+			ge := g + nodeCapacity
+			if ge > len(slice) {
+				ge = len(slice)
+			}
+			groups = append(groups, slice[g:ge])
+		}
+	}
+	return groups
+}
+
+// Len is the number of items in the index.
+func (idx *Index) Len() int {
+	return idx.size
+}
+
+// Search calls fn for every item whose bounds intersect r until fn returns
+// false.
+func (idx *Index) Search(r Rect, fn func(Item) bool) {
+	if idx.root != nil {
+		idx.root.search(r, fn)
+	}
+}
+
+func (n *node) search(r Rect, fn func(Item) bool) bool {
+	if !n.bounds.Intersects(r) {
+		return true
+	}
+	for _, c := range n.children {
+		if !c.search(r, fn) {
+			return false
+		}
+	}
+	for _, it := range n.items {
+		if it.Bounds().Intersects(r) && !fn(it) {
+			return false
+		}
+	}
+	return true
+}
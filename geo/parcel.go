@@ -0,0 +1,382 @@
+package geo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strings"
+)
+
+// Parcel is one cadastral lot, identified by its section (地段) and
+// number (地號).
+type Parcel struct {
+	Section string    `json:"section"`
+	Number  string    `json:"number"`
+	Shape   []Polygon `json:"-"`
+	bounds  Rect
+}
+
+func NewParcel(section string, number string, shape []Polygon) *Parcel {
+	p := &Parcel{Section: section, Number: number, Shape: shape, bounds: emptyRect()}
+	for _, poly := range shape {
+		p.bounds = p.bounds.union(poly.Bounds())
+	}
+	return p
+}
+
+func (p *Parcel) Bounds() Rect {
+	return p.bounds
+}
+
+func (p *Parcel) Contains(pt Point) bool {
+	if !p.bounds.Contains(pt) {
+		return false
+	}
+	for _, poly := range p.Shape {
+		if poly.Contains(pt) {
+			return true
+		}
+	}
+	return false
+}
+
+// Label is the 地段地號 string stored in BCdataa.DDDH.
+func (p *Parcel) Label() string {
+	return strings.TrimSpace(p.Section + " " + p.Number)
+}
+
+// Attribute names tried, in order, for the section and number of a parcel.
+var (
+	SectionFields = []string{"section", "SECTION", "SECT_NAME", "SECTNAME", "地段"}
+	NumberFields  = []string{"number", "NUMBER", "LAND_NO", "LANDNO", "地號"}
+)
+
+func pickField(props map[string]string, names []string) string {
+	for _, n := range names {
+		if v, ok := props[n]; ok && v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// Projection converts dataset coordinates to WGS84.
+type Projection func(x, y float64) Point
+
+// WGS84 leaves coordinates as they are.
+func WGS84(x, y float64) Point {
+	return Point{Lon: x, Lat: y}
+}
+
+// tm2 is the inverse transverse mercator used by the Taiwan cadastre
+// (TWD97, GRS80 ellipsoid, 2 degree zones, k0 0.9999, false easting 250km).
+func tm2(lon0 float64) Projection {
+	const (
+		a  = 6378137.0
+		f  = 1 / 298.257222101
+		k0 = 0.9999
+		fe = 250000.0
+	)
+	e2 := f * (2 - f)
+	ep2 := e2 / (1 - e2)
+	e1 := (1 - math.Sqrt(1-e2)) / (1 + math.Sqrt(1-e2))
+	return func(x, y float64) Point {
+		m := y / k0
+		mu := m / (a * (1 - e2/4 - 3*e2*e2/64 - 5*e2*e2*e2/256))
+		phi1 := mu + (3*e1/2-27*math.Pow(e1, 3)/32)*math.Sin(2*mu) +
+			(21*e1*e1/16-55*math.Pow(e1, 4)/32)*math.Sin(4*mu) +
+			(151*math.Pow(e1, 3)/96)*math.Sin(6*mu) +
+			(1097*math.Pow(e1, 4)/512)*math.Sin(8*mu)
+		sin, cos, tan := math.Sin(phi1), math.Cos(phi1), math.Tan(phi1)
+		c1 := ep2 * cos * cos
+		t1 := tan * tan
+		n1 := a / math.Sqrt(1-e2*sin*sin)
+		r1 := a * (1 - e2) / math.Pow(1-e2*sin*sin, 1.5)
+		d := (x - fe) / (n1 * k0)
+		lat := phi1 - (n1*tan/r1)*(d*d/2-(5+3*t1+10*c1-4*c1*c1-9*ep2)*math.Pow(d, 4)/24+
+			(61+90*t1+298*c1+45*t1*t1-252*ep2-3*c1*c1)*math.Pow(d, 6)/720)
+		lon := (d - (1+2*t1+c1)*math.Pow(d, 3)/6 +
+			(5-2*c1+28*t1-3*c1*c1+8*ep2+24*t1*t1)*math.Pow(d, 5)/120) / cos
+		return Point{Lon: lon0 + deg(lon), Lat: deg(lat)}
+	}
+}
+
+var (
+	// TWD97TM2 is EPSG:3826, Taiwan main island.
+	TWD97TM2 = tm2(121)
+	// TWD97TM2Penghu is EPSG:3825 for the 119E zone.
+	TWD97TM2Penghu = tm2(119)
+)
+
+// ProjectionFor maps an EPSG code or CRS name to a Projection. Unknown
+// names return nil.
+func ProjectionFor(crs string) Projection {
+	c := strings.ToUpper(crs)
+	switch {
+	case c == "", strings.HasSuffix(c, "4326"), strings.HasSuffix(c, "CRS84"), strings.Contains(c, "WGS_1984"), strings.Contains(c, "WGS 84"):
+		return WGS84
+	case strings.HasSuffix(c, "3826"), strings.Contains(c, "TM2") && strings.Contains(c, "121"), strings.Contains(c, "TWD_1997_TM_TAIWAN"):
+		return TWD97TM2
+	case strings.HasSuffix(c, "3825"), strings.Contains(c, "TM2") && strings.Contains(c, "119"), strings.Contains(c, "TWD_1997_TM_PENGHU"):
+		return TWD97TM2Penghu
+	}
+	return nil
+}
+
+// LoadFile picks a loader from the file extension. proj may be nil, in
+// which case the CRS declared by the file is used.
+func LoadFile(path string, proj Projection) ([]*Parcel, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".geojson", ".json":
+		return LoadGeoJSON(path, proj)
+	case ".shp":
+		return LoadShapefile(path, proj)
+	}
+	return nil, fmt.Errorf("geo: unsupported parcel file %s", path)
+}
+
+type geoJSONFeature struct {
+	Properties map[string]interface{} `json:"properties"`
+	Geometry   struct {
+		Type        string          `json:"type"`
+		Coordinates json.RawMessage `json:"coordinates"`
+	} `json:"geometry"`
+}
+
+// LoadGeoJSON reads a FeatureCollection of Polygon or MultiPolygon
+// features.
+func LoadGeoJSON(path string, proj Projection) ([]*Parcel, error) {
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var fc struct {
+		Type string `json:"type"`
+		CRS  struct {
+			Properties struct {
+				Name string `json:"name"`
+			} `json:"properties"`
+		} `json:"crs"`
+		Features []geoJSONFeature `json:"features"`
+	}
+	if err := json.Unmarshal(d, &fc); err != nil {
+		return nil, err
+	}
+	if fc.Type != "FeatureCollection" {
+		return nil, errors.New("geo: expected a FeatureCollection")
+	}
+	if proj == nil {
+		if proj = ProjectionFor(fc.CRS.Properties.Name); proj == nil {
+			return nil, fmt.Errorf("geo: unsupported crs %q", fc.CRS.Properties.Name)
+		}
+	}
+
+	conv := func(rings [][][]float64) Polygon {
+		var poly Polygon
+		for _, r := range rings {
+			ring := make(Ring, 0, len(r))
+			for _, c := range r {
+				if len(c) >= 2 {
+					ring = append(ring, proj(c[0], c[1]))
+				}
+			}
+			poly = append(poly, ring)
+		}
+		return poly
+	}
+
+	var parcels []*Parcel
+	for _, f := range fc.Features {
+		var shape []Polygon
+		switch f.Geometry.Type {
+		case "Polygon":
+			var c [][][]float64
+			if err := json.Unmarshal(f.Geometry.Coordinates, &c); err != nil {
+				return nil, err
+			}
+			shape = append(shape, conv(c))
+		case "MultiPolygon":
+			var c [][][][]float64
+			if err := json.Unmarshal(f.Geometry.Coordinates, &c); err != nil {
+				return nil, err
+			}
+			for _, p := range c {
+				shape = append(shape, conv(p))
+			}
+		default:
+			continue
+		}
+		props := map[string]string{}
+		for k, v := range f.Properties {
+			if v != nil {
+				props[k] = strings.TrimSpace(fmt.Sprint(v))
+			}
+		}
+		parcels = append(parcels, NewParcel(pickField(props, SectionFields), pickField(props, NumberFields), shape))
+	}
+	return parcels, nil
+}
+
+// LoadShapefile reads polygon records from path and their attributes from
+// the .dbf beside it. Attribute text must be UTF-8; Big5 exports need to be
+// re-encoded first.
+func LoadShapefile(path string, proj Projection) ([]*Parcel, error) {
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+	if cpg, err := ioutil.ReadFile(base + ".cpg"); err == nil {
+		enc := strings.ToUpper(strings.TrimSpace(string(cpg)))
+		if enc != "UTF-8" && enc != "UTF8" && enc != "65001" {
+			return nil, fmt.Errorf("geo: %s.dbf is %s encoded, re-encode it as UTF-8", base, enc)
+		}
+	}
+	if proj == nil {
+		prj, err := ioutil.ReadFile(base + ".prj")
+		if err != nil {
+			proj = WGS84
+		} else if proj = ProjectionFor(string(prj)); proj == nil {
+			return nil, fmt.Errorf("geo: unsupported projection in %s.prj", base)
+		}
+	}
+
+	shp, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dbf, err := ioutil.ReadFile(base + ".dbf")
+	if err != nil {
+		return nil, err
+	}
+	shapes, err := readShp(shp, proj)
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := readDbf(dbf)
+	if err != nil {
+		return nil, err
+	}
+	if len(attrs) != len(shapes) {
+		return nil, fmt.Errorf("geo: %d shapes but %d attribute rows", len(shapes), len(attrs))
+	}
+
+	var parcels []*Parcel
+	for i, shape := range shapes {
+		if len(shape) == 0 {
+			continue
+		}
+		parcels = append(parcels, NewParcel(pickField(attrs[i], SectionFields), pickField(attrs[i], NumberFields), shape))
+	}
+	return parcels, nil
+}
+
+// readShp decodes polygon shapes (types 5, 15 and 25). Per the ESRI spec
+// outer rings run clockwise and holes counter-clockwise.
+func readShp(d []byte, proj Projection) ([][]Polygon, error) {
+	if len(d) < 100 || binary.BigEndian.Uint32(d[0:4]) != 9994 {
+		return nil, errors.New("geo: not a shapefile")
+	}
+	var shapes [][]Polygon
+	for off := 100; off+8 <= len(d); {
+		length := int(binary.BigEndian.Uint32(d[off+4:off+8])) * 2
+		rec := d[off+8:]
+		if length > len(rec) {
+			return nil, errors.New("geo: truncated shapefile record")
+		}
+		rec = rec[:length]
+		off += 8 + length
+
+		if len(rec) < 4 {
+			return nil, errors.New("geo: short shapefile record")
+		}
+		typ := binary.LittleEndian.Uint32(rec[0:4])
+		if typ == 0 {
+			shapes = append(shapes, nil)
+			continue
+		}
+		if typ != 5 && typ != 15 && typ != 25 {
+			return nil, fmt.Errorf("geo: shape type %d is not a polygon", typ)
+		}
+		if len(rec) < 44 {
+			return nil, errors.New("geo: short polygon record")
+		}
+		numParts := int(binary.LittleEndian.Uint32(rec[36:40]))
+		numPoints := int(binary.LittleEndian.Uint32(rec[40:44]))
+		pts := 44 + 4*numParts
+		if len(rec) < pts+16*numPoints {
+			return nil, errors.New("geo: short polygon record")
+		}
+		var polys []Polygon
+		for p := 0; p < numParts; p++ {
+			start := int(binary.LittleEndian.Uint32(rec[44+4*p:]))
+			end := numPoints
+			if p+1 < numParts {
+				end = int(binary.LittleEndian.Uint32(rec[48+4*p:]))
+			}
+			if start < 0 || end > numPoints || start >= end {
+				return nil, errors.New("geo: bad polygon part index")
+			}
+			ring := make(Ring, 0, end-start)
+			area := 0.0
+			var px, py float64
+			for i := start; i < end; i++ {
+				b := rec[pts+16*i:]
+				x := math.Float64frombits(binary.LittleEndian.Uint64(b[0:8]))
+				y := math.Float64frombits(binary.LittleEndian.Uint64(b[8:16]))
+				if i > start {
+					area += px*y - x*py
+				}
+				px, py = x, y
+				ring = append(ring, proj(x, y))
+			}
+			if area <= 0 || len(polys) == 0 {
+				polys = append(polys, Polygon{ring})
+			} else {
+				polys[len(polys)-1] = append(polys[len(polys)-1], ring)
+			}
+		}
+		shapes = append(shapes, polys)
+	}
+	return shapes, nil
+}
+
+func readDbf(d []byte) ([]map[string]string, error) {
+	if len(d) < 32 {
+		return nil, errors.New("geo: not a dbf file")
+	}
+	numRecords := int(binary.LittleEndian.Uint32(d[4:8]))
+	headerLen := int(binary.LittleEndian.Uint16(d[8:10]))
+	recordLen := int(binary.LittleEndian.Uint16(d[10:12]))
+	type field struct {
+		name   string
+		length int
+	}
+	var fields []field
+	for off := 32; off+32 <= len(d) && d[off] != 0x0d; off += 32 {
+		name := d[off : off+11]
+		if i := bytes.IndexByte(name, 0); i >= 0 {
+			name = name[:i]
+		}
+		fields = append(fields, field{name: string(name), length: int(d[off+16])})
+	}
+	if headerLen+numRecords*recordLen > len(d) {
+		return nil, errors.New("geo: truncated dbf file")
+	}
+	rows := make([]map[string]string, 0, numRecords)
+	for r := 0; r < numRecords; r++ {
+		rec := d[headerLen+r*recordLen : headerLen+(r+1)*recordLen]
+		row := map[string]string{}
+		pos := 1 // deletion flag
+		for _, f := range fields {
+			if pos+f.length > len(rec) {
+				break
+			}
+			row[f.name] = strings.TrimSpace(string(rec[pos : pos+f.length]))
+			pos += f.length
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"mongo/geo"
+)
+
+// A photo within geofenceNear metres of a boundary, plus its own GPS
+// accuracy, counts as near rather than outside.
+const geofenceNear = 50.0
+
+// Geofence statuses stored on ImageEntry.Geofence.
+const (
+	fenceInside       = "inside"
+	fenceNear         = "near"
+	fenceOutside      = "outside"
+	fenceNoGPS        = "nogps"
+	fenceUnregistered = "unregistered"
+)
+
+// Boundary is a registered farm area. It belongs either to a single post
+// (by tag) or to a farm shared by several posts. Parcels lists the 地段地號
+// labels the farm occupies, if known.
+type Boundary struct {
+	ID      primitive.ObjectID `json:"id" bson:"_id"`
+	Post    string             `json:"post,omitempty" bson:"post,omitempty"`
+	Farm    string             `json:"farm,omitempty" bson:"farm,omitempty"`
+	Name    string             `json:"name" bson:"name"`
+	Polygon geo.Polygon        `json:"polygon" bson:"polygon"`
+	Parcels []string           `json:"parcels,omitempty" bson:"parcels,omitempty"`
+	Date    string             `json:"date" bson:"date"`
+}
+
+// GeofenceCheck is the verdict for one photo. Review is set for photos a
+// person has to look at.
+type GeofenceCheck struct {
+	Status   string  `json:"status" bson:"status"`
+	Distance float64 `json:"distance" bson:"distance"`
+	Boundary string  `json:"boundary,omitempty" bson:"boundary,omitempty"`
+	Parcel   bool    `json:"parcel,omitempty" bson:"parcel,omitempty"`
+	Review   bool    `json:"review" bson:"review"`
+	Reason   string  `json:"reason,omitempty" bson:"reason,omitempty"`
+}
+
+func (s *service) boundariesFor(ctx context.Context, p *Post) ([]*Boundary, error) {
+	or := bson.A{bson.M{"post": p.Tag}}
+	if p.Farm != "" {
+		or = append(or, bson.M{"farm": p.Farm})
+	}
+	cur, err := s.db.QueryFilter(ctx, "boundaries", bson.M{"$or": or})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	var ret []*Boundary
+	for cur.Next(ctx) {
+		b := &Boundary{}
+		if err := cur.Decode(b); err != nil {
+			return nil, err
+		}
+		ret = append(ret, b)
+	}
+	return ret, nil
+}
+
+// checkGeofence classifies a photo against the post's boundaries using its
+// GPS fix and, when available, the cadastral lookup.
+func checkGeofence(bounds []*Boundary, meta *PhotoMeta, cad *geo.Result) *GeofenceCheck {
+	if meta == nil || meta.GPS == nil {
+		return &GeofenceCheck{Status: fenceNoGPS, Review: true, Reason: "photo has no GPS position"}
+	}
+	if len(bounds) == 0 {
+		return &GeofenceCheck{Status: fenceUnregistered, Reason: "post has no registered boundary"}
+	}
+
+	pt := geo.Point{Lon: meta.GPS.Long, Lat: meta.GPS.Lat}
+	c := &GeofenceCheck{Distance: math.Inf(1)}
+	for _, b := range bounds {
+		if d := geo.DistanceToPolygon(pt, b.Polygon); d < c.Distance {
+			c.Distance = d
+			c.Boundary = b.Name
+		}
+		if cad != nil && cad.Best != nil {
+			for _, label := range b.Parcels {
+				if label == cad.Best.Label {
+					c.Parcel = true
+				}
+			}
+		}
+	}
+	c.Distance = math.Round(c.Distance*10) / 10
+
+	near := geofenceNear
+	if meta.GPS.Accuracy != nil {
+		near += *meta.GPS.Accuracy
+	}
+	switch {
+	case c.Distance == 0:
+		c.Status = fenceInside
+	case c.Distance <= near:
+		c.Status = fenceNear
+	case c.Parcel:
+		// the camera stood outside but is looking at a registered parcel
+		c.Status = fenceNear
+		c.Reason = "camera outside boundary but facing registered parcel"
+	default:
+		c.Status = fenceOutside
+		c.Review = true
+		c.Reason = fmt.Sprintf("%.0fm from %s", c.Distance, c.Boundary)
+	}
+	return c
+}
+
+type boundaryRequest struct {
+	Name     string   `json:"name"`
+	Parcels  []string `json:"parcels"`
+	Geometry struct {
+		Type        string          `json:"type"`
+		Coordinates json.RawMessage `json:"coordinates"`
+	} `json:"geometry"`
+}
+
+// polygons accepts a GeoJSON Polygon or MultiPolygon geometry.
+func (br *boundaryRequest) polygons() ([]geo.Polygon, error) {
+	switch br.Geometry.Type {
+	case "Polygon":
+		var c [][][]float64
+		if err := json.Unmarshal(br.Geometry.Coordinates, &c); err != nil {
+			return nil, err
+		}
+		return []geo.Polygon{geo.NewPolygon(c)}, nil
+	case "MultiPolygon":
+		var c [][][][]float64
+		if err := json.Unmarshal(br.Geometry.Coordinates, &c); err != nil {
+			return nil, err
+		}
+		var ret []geo.Polygon
+		for _, p := range c {
+			ret = append(ret, geo.NewPolygon(p))
+		}
+		return ret, nil
+	}
+	return nil, fmt.Errorf("unsupported geometry type %q", br.Geometry.Type)
+}
+
+func (s *service) addBoundary(w http.ResponseWriter, r *http.Request, post string, farm string) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	req := &boundaryRequest{}
+	if err := json.Unmarshal(body, req); err != nil {
+		log.Println("err unmarshaling boundary")
+		writeMessage(w, http.StatusBadRequest, "invalid boundary")
+		return
+	}
+	polys, err := req.polygons()
+	if err != nil || len(polys) == 0 || len(polys[0]) == 0 || len(polys[0][0]) < 3 {
+		writeMessage(w, http.StatusBadRequest, "boundary needs a Polygon or MultiPolygon geometry")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	date := time.Now().Add(time.Hour * 8).Format(time.ANSIC)
+	var ret []*Boundary
+	for i, p := range polys {
+		b := &Boundary{ID: primitive.NewObjectID(), Post: post, Farm: farm, Name: req.Name, Polygon: p, Parcels: req.Parcels, Date: date}
+		if len(polys) > 1 {
+			b.Name = fmt.Sprintf("%s #%d", req.Name, i+1)
+		}
+		if _, err := s.db.Add(ctx, "boundaries", b); err != nil {
+			log.Println("err adding boundary")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		ret = append(ret, b)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(ret)
+	if err != nil {
+		log.Println("err encoding boundaries")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *service) findPost(ctx context.Context, key string, val interface{}) (*Post, error) {
+	cur := s.db.QueryOne(ctx, "posts", key, val)
+	p := &Post{}
+	err := cur.Decode(p)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (s *service) postFromVars(w http.ResponseWriter, r *http.Request) (*Post, bool) {
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		log.Println("err object id from hex")
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	p, err := s.findPost(ctx, "_id", id)
+	if err != nil {
+		writeMessage(w, http.StatusNotFound, "post not found")
+		return nil, false
+	}
+	return p, true
+}
+
+func (s *service) newPostBoundary(w http.ResponseWriter, r *http.Request) {
+	log.Println("newpostboundary called")
+	p, ok := s.postFromVars(w, r)
+	if !ok {
+		return
+	}
+	s.addBoundary(w, r, p.Tag, "")
+}
+
+func (s *service) newFarmBoundary(w http.ResponseWriter, r *http.Request) {
+	log.Println("newfarmboundary called")
+	s.addBoundary(w, r, "", mux.Vars(r)["farm"])
+}
+
+func (s *service) postBoundaries(w http.ResponseWriter, r *http.Request) {
+	log.Println("postboundaries called")
+	p, ok := s.postFromVars(w, r)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	bounds, err := s.boundariesFor(ctx, p)
+	if err != nil {
+		log.Println("err querying boundaries")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(bounds)
+	if err != nil {
+		log.Println("err encoding boundaries")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *service) deleteBoundary(w http.ResponseWriter, r *http.Request) {
+	log.Println("deleteboundary called")
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		log.Println("err object id from hex")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := s.db.DeleteOne(ctx, "boundaries", "_id", id)
+	if err != nil {
+		log.Println("err delete one")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	ret := map[string]interface{}{"id": result.DeletedCount}
+	err = json.NewEncoder(w).Encode(ret)
+	if err != nil {
+		log.Println("err encoding to json response")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+type flaggedEvidence struct {
+	Post    primitive.ObjectID `json:"post"`
+	Tag     string             `json:"tag"`
+	Factory string             `json:"factory"`
+	Image   ImageEntry         `json:"image"`
+}
+
+// flagged lists every photo of a factory's posts that needs review.
+func (s *service) flagged(w http.ResponseWriter, r *http.Request) {
+	log.Println("flagged called")
+	factory := mux.Vars(r)["factory"]
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	filter := bson.M{"factory": factory, "$or": bson.A{
+		bson.M{"images.geofence.review": true},
+		bson.M{"images.authenticity.review": true},
+	}}
+	cur, err := s.db.QueryFilter(ctx, "bcposts", filter)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer cur.Close(ctx)
+
+	ret := []*flaggedEvidence{}
+	for cur.Next(ctx) {
+		bc := &BCdataa{}
+		if err := cur.Decode(bc); err != nil {
+			log.Println(err)
+			continue
+		}
+		for _, img := range bc.Images {
+			if (img.Geofence != nil && img.Geofence.Review) || (img.Authenticity != nil && img.Authenticity.Review) {
+				ret = append(ret, &flaggedEvidence{Post: bc.ID, Tag: bc.Tag, Factory: bc.Factory, Image: img})
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(ret)
+	if err != nil {
+		log.Println("err encoding flagged evidence")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Println("flagged call succeed!")
+}
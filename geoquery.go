@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"mongo/geo"
+)
+
+// maxSearchRadius keeps radius searches to something a farm survey needs.
+const maxSearchRadius = 50000.0
+
+// GeoPoint is a GeoJSON Point as MongoDB's 2dsphere index expects it.
+type GeoPoint struct {
+	Type        string    `json:"type" bson:"type"`
+	Coordinates []float64 `json:"coordinates" bson:"coordinates"`
+}
+
+func newGeoPoint(lat float64, long float64) *GeoPoint {
+	return &GeoPoint{Type: "Point", Coordinates: []float64{long, lat}}
+}
+
+func (p *GeoPoint) point() geo.Point {
+	return geo.Point{Lon: p.Coordinates[0], Lat: p.Coordinates[1]}
+}
+
+// ensureGeoIndex creates the 2dsphere indexes and backfills locations for
+// bcposts stored before they existed, from the formatted Lat/Long strings
+// and from extracted photo metadata.
+func (s *service) ensureGeoIndex() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	for _, key := range []string{"location", "images.location"} {
+		if _, err := s.db.CreateIndex(ctx, "bcposts", bson.M{key: "2dsphere"}); err != nil {
+			return err
+		}
+	}
+
+	cur, err := s.db.QueryFilter(ctx, "bcposts", bson.M{"location": bson.M{"$exists": false}, "lat": bson.M{"$ne": ""}})
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+	n := 0
+	for cur.Next(ctx) {
+		bc := &BCdataa{}
+		if err := cur.Decode(bc); err != nil {
+			log.Println(err)
+			continue
+		}
+		set := bson.M{}
+		lat, err1 := strconv.ParseFloat(bc.Lat, 64)
+		long, err2 := strconv.ParseFloat(bc.Long, 64)
+		if err1 == nil && err2 == nil {
+			set["location"] = newGeoPoint(lat, long)
+		}
+		for i, img := range bc.Images {
+			if img.Location == nil && img.Meta != nil && img.Meta.GPS != nil {
+				set["images."+strconv.Itoa(i)+".location"] = newGeoPoint(img.Meta.GPS.Lat, img.Meta.GPS.Long)
+			}
+		}
+		if len(set) == 0 {
+			continue
+		}
+		if err := s.db.Update(ctx, "bcposts", "_id", bc.ID, set).Err(); err != nil {
+			log.Println("err backfilling location", bc.ID.Hex(), err)
+			continue
+		}
+		n++
+	}
+	if n > 0 {
+		log.Println("backfilled locations on", n, "bcposts")
+	}
+	return nil
+}
+
+type geoHit struct {
+	Post     primitive.ObjectID `json:"post"`
+	Tag      string             `json:"tag"`
+	Factory  string             `json:"factory"`
+	Image    ImageEntry         `json:"image"`
+	Distance *float64           `json:"distance,omitempty"`
+}
+
+// geoSearch runs filter against the images.location index, then keeps only
+// the images that match on their own, since the index matches whole posts.
+func (s *service) geoSearch(w http.ResponseWriter, filter bson.M, match func(geo.Point) bool, center *geo.Point) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cur, err := s.db.QueryFilter(ctx, "bcposts", bson.M{"images.location": filter})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer cur.Close(ctx)
+
+	hits := []*geoHit{}
+	for cur.Next(ctx) {
+		bc := &BCdataa{}
+		if err := cur.Decode(bc); err != nil {
+			log.Println(err)
+			continue
+		}
+		for _, img := range bc.Images {
+			if img.Location == nil || !match(img.Location.point()) {
+				continue
+			}
+			h := &geoHit{Post: bc.ID, Tag: bc.Tag, Factory: bc.Factory, Image: img}
+			if center != nil {
+				d := math.Round(geo.Distance(*center, img.Location.point())*10) / 10
+				h.Distance = &d
+			}
+			hits = append(hits, h)
+		}
+	}
+	if center != nil {
+		sort.Slice(hits, func(i, j int) bool { return *hits[i].Distance < *hits[j].Distance })
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(hits)
+	if err != nil {
+		log.Println("err encoding geo search")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// nearBcPost answers GET /bcpost/near?lat=..&long=..&radius=metres.
+func (s *service) nearBcPost(w http.ResponseWriter, r *http.Request) {
+	log.Println("nearbcpost called")
+	q := r.URL.Query()
+	lat, err1 := strconv.ParseFloat(q.Get("lat"), 64)
+	long, err2 := strconv.ParseFloat(q.Get("long"), 64)
+	radius, err3 := strconv.ParseFloat(q.Get("radius"), 64)
+	if err1 != nil || err2 != nil || err3 != nil || radius <= 0 || radius > maxSearchRadius ||
+		math.Abs(lat) > 90 || math.Abs(long) > 180 {
+		writeMessage(w, http.StatusBadRequest, "need lat, long and a radius in metres up to 50000")
+		return
+	}
+	center := geo.Point{Lon: long, Lat: lat}
+	filter := bson.M{"$geoWithin": bson.M{"$centerSphere": bson.A{bson.A{long, lat}, radius / 6378100}}}
+	s.geoSearch(w, filter, func(p geo.Point) bool { return geo.Distance(center, p) <= radius }, &center)
+}
+
+// boxBcPost answers GET /bcpost/box?bbox=minLong,minLat,maxLong,maxLat.
+func (s *service) boxBcPost(w http.ResponseWriter, r *http.Request) {
+	log.Println("boxbcpost called")
+	parts := strings.Split(r.URL.Query().Get("bbox"), ",")
+	var v [4]float64
+	ok := len(parts) == 4
+	for i := 0; ok && i < 4; i++ {
+		f, err := strconv.ParseFloat(strings.TrimSpace(parts[i]), 64)
+		ok = err == nil
+		v[i] = f
+	}
+	if !ok || v[0] >= v[2] || v[1] >= v[3] {
+		writeMessage(w, http.StatusBadRequest, "bbox must be minLong,minLat,maxLong,maxLat")
+		return
+	}
+	box := geo.Rect{Min: geo.Point{Lon: v[0], Lat: v[1]}, Max: geo.Point{Lon: v[2], Lat: v[3]}}
+	ring := bson.A{bson.A{v[0], v[1]}, bson.A{v[2], v[1]}, bson.A{v[2], v[3]}, bson.A{v[0], v[3]}, bson.A{v[0], v[1]}}
+	filter := bson.M{"$geoWithin": bson.M{"$geometry": bson.M{"type": "Polygon", "coordinates": bson.A{ring}}}}
+	s.geoSearch(w, filter, box.Contains, nil)
+}
+
+// withinBcPost answers POST /bcpost/within with a GeoJSON Polygon body,
+// e.g. a township boundary.
+func (s *service) withinBcPost(w http.ResponseWriter, r *http.Request) {
+	log.Println("withinbcpost called")
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var g struct {
+		Type        string        `json:"type"`
+		Coordinates [][][]float64 `json:"coordinates"`
+	}
+	if err := json.Unmarshal(body, &g); err != nil || g.Type != "Polygon" || len(g.Coordinates) == 0 || len(g.Coordinates[0]) < 4 {
+		writeMessage(w, http.StatusBadRequest, "body must be a closed GeoJSON Polygon")
+		return
+	}
+	poly := geo.NewPolygon(g.Coordinates)
+	filter := bson.M{"$geoWithin": bson.M{"$geometry": bson.M{"type": "Polygon", "coordinates": g.Coordinates}}}
+	s.geoSearch(w, filter, poly.Contains, nil)
+}
@@ -0,0 +1,274 @@
+// Package gs1 handles the identifiers lots are tagged with: GS1 GTINs with
+// a lot number, serialised GTINs, SSCCs of logistic units and the
+// service's own internal serials, with their check digits.
+package gs1
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Kind is the type of an identifier.
+type Kind string
+
+const (
+	// LGTIN is a GTIN with a batch or lot number, AI (01) and (10).
+	LGTIN Kind = "lgtin"
+	// SGTIN is a GTIN with a serial number, AI (01) and (21).
+	SGTIN Kind = "sgtin"
+	// SSCC is a serial shipping container code, AI (00).
+	SSCC Kind = "sscc"
+	// Internal is a serial of letters and digits ending in a check digit,
+	// for lots that carry no GS1 code.
+	Internal Kind = "internal"
+)
+
+// MaxAttribute is the longest lot or serial number GS1 allows.
+const MaxAttribute = 20
+
+// ID is a parsed identifier. GTIN is always the 14 digit form.
+type ID struct {
+	Kind     Kind   `json:"kind"`
+	GTIN     string `json:"gtin,omitempty"`
+	Lot      string `json:"lot,omitempty"`
+	Serial   string `json:"serial,omitempty"`
+	SSCC     string `json:"sscc,omitempty"`
+	Internal string `json:"internal,omitempty"`
+}
+
+// CheckDigit computes the GS1 mod 10 check digit of digits, weighting them
+// 3 and 1 alternately from the right.
+func CheckDigit(digits string) (byte, error) {
+	sum := 0
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := digits[i]
+		if d < '0' || d > '9' {
+			return 0, fmt.Errorf("%q is not all digits", digits)
+		}
+		n := int(d - '0')
+		if (len(digits)-1-i)%2 == 0 {
+			n *= 3
+		}
+		sum += n
+	}
+	return byte('0' + (10-sum%10)%10), nil
+}
+
+// Valid says whether the last digit of digits checks the others.
+func Valid(digits string) bool {
+	if len(digits) < 2 {
+		return false
+	}
+	c, err := CheckDigit(digits[:len(digits)-1])
+	return err == nil && c == digits[len(digits)-1]
+}
+
+// WithCheck appends the check digit to digits.
+func WithCheck(digits string) (string, error) {
+	c, err := CheckDigit(digits)
+	if err != nil {
+		return "", err
+	}
+	return digits + string(c), nil
+}
+
+// NormalizeGTIN takes a GTIN-8, -12, -13 or -14 and returns it as 14
+// digits after checking it.
+func NormalizeGTIN(gtin string) (string, error) {
+	switch len(gtin) {
+	case 8, 12, 13, 14:
+	default:
+		return "", fmt.Errorf("a GTIN has 8, 12, 13 or 14 digits, not %d", len(gtin))
+	}
+	if !Valid(gtin) {
+		return "", fmt.Errorf("GTIN %s fails its check digit", gtin)
+	}
+	return strings.Repeat("0", 14-len(gtin)) + gtin, nil
+}
+
+func checkSSCC(sscc string) error {
+	if len(sscc) != 18 || !Valid(sscc) {
+		return fmt.Errorf("SSCC %s is not 18 digits with a correct check digit", sscc)
+	}
+	return nil
+}
+
+// attrChars are the characters of GS1 character set 82 a lot or serial
+// may use here; the rest would not survive as a file name or in a URL
+// path, or would make the bracketed form ambiguous.
+const attrChars = "!&'*+,-.:;=_"
+
+func checkAttribute(name string, v string) error {
+	if v == "" || len(v) > MaxAttribute {
+		return fmt.Errorf("a %s has 1 to %d characters", name, MaxAttribute)
+	}
+	for _, c := range v {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune(attrChars, c)) {
+			return fmt.Errorf("%s %q has a character outside %s and letters and digits", name, v, attrChars)
+		}
+	}
+	return nil
+}
+
+// CheckPrefix checks a GS1 company prefix, 6 to 12 digits.
+func CheckPrefix(prefix string) error {
+	if len(prefix) < 6 || len(prefix) > 12 {
+		return fmt.Errorf("a company prefix has 6 to 12 digits")
+	}
+	if _, err := strconv.ParseUint(prefix, 10, 64); err != nil {
+		return fmt.Errorf("company prefix %s is not all digits", prefix)
+	}
+	return nil
+}
+
+// CheckInternalPrefix checks the letters internal serials start with.
+func CheckInternalPrefix(prefix string) error {
+	if len(prefix) < 2 || len(prefix) > 6 {
+		return fmt.Errorf("an internal prefix has 2 to 6 letters")
+	}
+	for _, c := range prefix {
+		if c < 'A' || c > 'Z' {
+			return fmt.Errorf("internal prefix %s is not all capital letters", prefix)
+		}
+	}
+	return nil
+}
+
+// NewLGTIN makes the identifier of lot of gtin.
+func NewLGTIN(gtin string, lot string) (*ID, error) {
+	g, err := NormalizeGTIN(gtin)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAttribute("lot", lot); err != nil {
+		return nil, err
+	}
+	return &ID{Kind: LGTIN, GTIN: g, Lot: lot}, nil
+}
+
+// NewSGTIN makes the identifier of item serial of gtin.
+func NewSGTIN(gtin string, serial string) (*ID, error) {
+	g, err := NormalizeGTIN(gtin)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAttribute("serial", serial); err != nil {
+		return nil, err
+	}
+	return &ID{Kind: SGTIN, GTIN: g, Serial: serial}, nil
+}
+
+// NewSSCC makes the n-th SSCC of a company prefix with extension digit 0.
+func NewSSCC(prefix string, n int64) (*ID, error) {
+	if err := CheckPrefix(prefix); err != nil {
+		return nil, err
+	}
+	width := 16 - len(prefix)
+	ref := strconv.FormatInt(n, 10)
+	if n < 0 || len(ref) > width {
+		return nil, fmt.Errorf("company prefix %s has no SSCC number %d", prefix, n)
+	}
+	sscc, _ := WithCheck("0" + prefix + strings.Repeat("0", width-len(ref)) + ref)
+	return &ID{Kind: SSCC, SSCC: sscc}, nil
+}
+
+// NewInternal makes the n-th internal serial of prefix: the prefix, n as
+// at least seven digits, and a check digit.
+func NewInternal(prefix string, n int64) (*ID, error) {
+	if err := CheckInternalPrefix(prefix); err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		return nil, fmt.Errorf("internal serials count from 0")
+	}
+	digits, _ := WithCheck(fmt.Sprintf("%07d", n))
+	return &ID{Kind: Internal, Internal: prefix + digits}, nil
+}
+
+// String is the identifier as a tag: the bracketed GS1 element string,
+// such as (01)09506000134352(10)A1, or the internal serial.
+func (id *ID) String() string {
+	switch id.Kind {
+	case LGTIN:
+		return "(01)" + id.GTIN + "(10)" + id.Lot
+	case SGTIN:
+		return "(01)" + id.GTIN + "(21)" + id.Serial
+	case SSCC:
+		return "(00)" + id.SSCC
+	}
+	return id.Internal
+}
+
+// HasPrefix says whether the identifier was allocated under the company
+// prefix.
+func (id *ID) HasPrefix(prefix string) bool {
+	switch id.Kind {
+	case LGTIN, SGTIN:
+		return strings.HasPrefix(id.GTIN[1:], prefix)
+	case SSCC:
+		return strings.HasPrefix(id.SSCC[1:], prefix)
+	}
+	return false
+}
+
+// Parse reads a tag written by String.
+func Parse(tag string) (*ID, error) {
+	if !strings.HasPrefix(tag, "(") {
+		return parseInternal(tag)
+	}
+	ais := map[string]string{}
+	var order []string
+	for rest := tag; rest != ""; {
+		end := strings.Index(rest, ")")
+		if !strings.HasPrefix(rest, "(") || end < 0 {
+			return nil, fmt.Errorf("%s is not a bracketed element string", tag)
+		}
+		ai := rest[1:end]
+		rest = rest[end+1:]
+		next := strings.Index(rest, "(")
+		if next < 0 {
+			next = len(rest)
+		}
+		if _, ok := ais[ai]; ok {
+			return nil, fmt.Errorf("%s repeats (%s)", tag, ai)
+		}
+		ais[ai] = rest[:next]
+		order = append(order, ai)
+		rest = rest[next:]
+	}
+	return fromAIs(tag, order, ais)
+}
+
+// fromAIs builds an identifier from application identifier values, which
+// must be exactly one of the shapes String writes.
+func fromAIs(what string, order []string, ais map[string]string) (*ID, error) {
+	shape := strings.Join(order, ",")
+	switch shape {
+	case "01,10":
+		return NewLGTIN(ais["01"], ais["10"])
+	case "01,21":
+		return NewSGTIN(ais["01"], ais["21"])
+	case "00":
+		if err := checkSSCC(ais["00"]); err != nil {
+			return nil, err
+		}
+		return &ID{Kind: SSCC, SSCC: ais["00"]}, nil
+	}
+	return nil, fmt.Errorf("%s is not a GTIN with a lot or serial, or an SSCC", what)
+}
+
+func parseInternal(tag string) (*ID, error) {
+	i := strings.IndexFunc(tag, func(c rune) bool { return c >= '0' && c <= '9' })
+	if i < 0 {
+		return nil, fmt.Errorf("%s is not a typed identifier", tag)
+	}
+	if err := CheckInternalPrefix(tag[:i]); err != nil {
+		return nil, fmt.Errorf("%s is not a typed identifier: %s", tag, err.Error())
+	}
+	digits := tag[i:]
+	if len(digits) < 8 || !Valid(digits) {
+		return nil, fmt.Errorf("internal serial %s needs at least eight digits ending in a correct check digit", tag)
+	}
+	return &ID{Kind: Internal, Internal: tag}, nil
+}
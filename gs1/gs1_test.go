@@ -0,0 +1,232 @@
+package gs1
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCheckDigit(t *testing.T) {
+	tests := []struct {
+		digits string
+		want   byte
+		err    bool
+	}{
+		{"0950600013435", '2', false},
+		{"9638507", '4', false},
+		{"62910415002", '4', false},
+		{"03600029145", '2', false},
+		{"00614141123456789", '0', false},
+		{"", '0', false},
+		{"95O6", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := CheckDigit(tt.digits)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("CheckDigit(%q) = %q, %v; want %q", tt.digits, got, err, tt.want)
+		}
+	}
+}
+
+func TestNormalizeGTIN(t *testing.T) {
+	tests := []struct {
+		gtin string
+		want string
+	}{
+		{"96385074", "00000096385074"},
+		{"629104150024", "00629104150024"},
+		{"9506000134352", "09506000134352"},
+		{"09506000134352", "09506000134352"},
+		{"09506000134353", ""},
+		{"950600013435", ""},
+		{"0950600013435a", ""},
+	}
+	for _, tt := range tests {
+		got, err := NormalizeGTIN(tt.gtin)
+		if got != tt.want || (err != nil) != (tt.want == "") {
+			t.Errorf("NormalizeGTIN(%q) = %q, %v; want %q", tt.gtin, got, err, tt.want)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		tag  string
+		want *ID
+	}{
+		{"(01)09506000134352(10)A1", &ID{Kind: LGTIN, GTIN: "09506000134352", Lot: "A1"}},
+		{"(01)09506000134352(21)12345", &ID{Kind: SGTIN, GTIN: "09506000134352", Serial: "12345"}},
+		{"(00)106141412345678908", &ID{Kind: SSCC, SSCC: "106141412345678908"}},
+		{"FARM00000017", &ID{Kind: Internal, Internal: "FARM00000017"}},
+		{"(01)09506000134353(10)A1", nil},
+		{"(01)09506000134352(10)", nil},
+		{"(01)09506000134352(10)A/1", nil},
+		{"(01)09506000134352(10)ABCDEFGHIJKLMNOPQRSTU", nil},
+		{"(01)09506000134352(10)A1(10)A2", nil},
+		{"(10)A1(01)09506000134352", nil},
+		{"(01)09506000134352", nil},
+		{"(00)106141412345678909", nil},
+		{"(00106141412345678908", nil},
+		{"FARM00000018", nil},
+		{"F00000017", nil},
+		{"farm00000017", nil},
+		{"FARM0000017", nil},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.tag)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("Parse(%q) = %+v, want an error", tt.tag, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Parse(%q) = %+v, %v; want %+v", tt.tag, got, err, tt.want)
+			continue
+		}
+		if s := got.String(); s != tt.tag {
+			t.Errorf("Parse(%q).String() = %q", tt.tag, s)
+		}
+	}
+}
+
+func TestNewIDs(t *testing.T) {
+	sscc, err := NewSSCC("0614141", 123456789)
+	if err != nil || sscc.SSCC != "006141411234567890" {
+		t.Errorf("NewSSCC = %+v, %v", sscc, err)
+	}
+	if _, err := NewSSCC("0614141", 1000000000); err == nil {
+		t.Error("NewSSCC overflowed the serial reference")
+	}
+	in, err := NewInternal("FARM", 1)
+	if err != nil || in.Internal != "FARM00000017" {
+		t.Errorf("NewInternal = %+v, %v", in, err)
+	}
+	for _, id := range []*ID{sscc, in} {
+		if back, err := Parse(id.String()); err != nil || !reflect.DeepEqual(back, id) {
+			t.Errorf("Parse(%q) = %+v, %v", id.String(), back, err)
+		}
+	}
+}
+
+func TestHasPrefix(t *testing.T) {
+	tests := []struct {
+		tag    string
+		prefix string
+		want   bool
+	}{
+		{"(01)09506000134352(10)A1", "9506000", true},
+		{"(01)09506000134352(10)A1", "950601", false},
+		{"(01)09506000134352(21)1", "950600013", true},
+		{"(00)106141412345678908", "0614141", true},
+		{"(00)106141412345678908", "1061414", false},
+		{"FARM00000017", "FARM", false},
+	}
+	for _, tt := range tests {
+		id, err := Parse(tt.tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := id.HasPrefix(tt.prefix); got != tt.want {
+			t.Errorf("%s HasPrefix(%s) = %v", tt.tag, tt.prefix, got)
+		}
+	}
+}
+
+func TestParseURN(t *testing.T) {
+	tests := []struct {
+		urn string
+		tag string
+	}{
+		{"urn:epc:id:sgtin:0614141.812345.6789", "(01)80614141123458(21)6789"},
+		{"urn:epc:id:sgtin:9506000.013435.A%2DB", "(01)09506000134352(21)A-B"},
+		{"urn:epc:class:lgtin:4012345.012345.998877", "(01)04012345123456(10)998877"},
+		{"urn:epc:id:sscc:0614141.1234567890", "(00)106141412345678908"},
+		{"urn:epc:id:sgtin:0614141.812345", ""},
+		{"urn:epc:id:sgtin:0614141.81234.6789", ""},
+		{"urn:epc:id:sscc:0614141.123456789", ""},
+		{"urn:epc:id:giai:0614141.12345", ""},
+		{"urn:epc:id:sgtin:0614141.812345.67/89", ""},
+	}
+	for _, tt := range tests {
+		id, err := ParseURN(tt.urn)
+		if tt.tag == "" {
+			if err == nil {
+				t.Errorf("ParseURN(%q) = %+v, want an error", tt.urn, id)
+			}
+			continue
+		}
+		if err != nil || id.String() != tt.tag {
+			t.Errorf("ParseURN(%q) = %v, %v; want %s", tt.urn, id, err, tt.tag)
+		}
+	}
+}
+
+func TestDigitalLink(t *testing.T) {
+	tests := []struct {
+		tag  string
+		link string
+	}{
+		{"(01)09506000134352(10)A1", "https://id.gs1.org/01/09506000134352/10/A1"},
+		{"(01)09506000134352(21)A&B", "https://id.gs1.org/01/09506000134352/21/A&B"},
+		{"(01)09506000134352(10)X'1", "https://id.gs1.org/01/09506000134352/10/X%271"},
+		{"(00)106141412345678908", "https://id.gs1.org/00/106141412345678908"},
+		{"FARM00000017", ""},
+	}
+	for _, tt := range tests {
+		id, err := Parse(tt.tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		link := id.DigitalLink(Resolver + "/")
+		if link != tt.link {
+			t.Errorf("%s DigitalLink = %q, want %q", tt.tag, link, tt.link)
+		}
+		if link == "" {
+			continue
+		}
+		back, err := ParseDigitalLink(link)
+		if err != nil || !reflect.DeepEqual(back, id) {
+			t.Errorf("ParseDigitalLink(%q) = %+v, %v; want %+v", link, back, err, id)
+		}
+	}
+
+	parsed := []struct {
+		uri string
+		tag string
+	}{
+		{"https://example.com/p/01/09506000134352/10/A1?17=261231", "(01)09506000134352(10)A1"},
+		{"http://example.com/gtin/09506000134352/ser/7", "(01)09506000134352(21)7"},
+		{"https://example.com/sscc/106141412345678908", "(00)106141412345678908"},
+		{"https://example.com/01/09506000134352", ""},
+		{"https://example.com/01/09506000134352/10", ""},
+		{"https://example.com/01/09506000134352/10/A1/10/A2", ""},
+		{"ftp://example.com/01/09506000134352/10/A1", ""},
+		{"https://example.com/about", ""},
+	}
+	for _, tt := range parsed {
+		id, err := ParseDigitalLink(tt.uri)
+		if tt.tag == "" {
+			if err == nil {
+				t.Errorf("ParseDigitalLink(%q) = %+v, want an error", tt.uri, id)
+			}
+			continue
+		}
+		if err != nil || id.String() != tt.tag {
+			t.Errorf("ParseDigitalLink(%q) = %v, %v; want %s", tt.uri, id, err, tt.tag)
+		}
+	}
+}
+
+func TestParseAny(t *testing.T) {
+	for _, s := range []string{
+		"(01)09506000134352(10)A1",
+		"https://id.gs1.org/01/09506000134352/10/A1",
+		"urn:epc:class:lgtin:9506000.013435.A1",
+	} {
+		id, err := ParseAny(s)
+		if err != nil || id.String() != "(01)09506000134352(10)A1" {
+			t.Errorf("ParseAny(%q) = %v, %v", s, id, err)
+		}
+	}
+}
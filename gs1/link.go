@@ -0,0 +1,136 @@
+package gs1
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Resolver is the GS1 resolver Digital Links point at unless told
+// otherwise.
+const Resolver = "https://id.gs1.org"
+
+// linkAIs are the short names Digital Link allows in place of the numeric
+// application identifiers.
+var linkAIs = map[string]string{
+	"gtin": "01",
+	"lot":  "10",
+	"ser":  "21",
+	"sscc": "00",
+}
+
+// DigitalLink is the GS1 Digital Link URI of the identifier on base, such
+// as https://id.gs1.org/01/09506000134352/10/A1. Internal serials have
+// none.
+func (id *ID) DigitalLink(base string) string {
+	base = strings.TrimSuffix(base, "/")
+	switch id.Kind {
+	case LGTIN:
+		return base + "/01/" + id.GTIN + "/10/" + url.PathEscape(id.Lot)
+	case SGTIN:
+		return base + "/01/" + id.GTIN + "/21/" + url.PathEscape(id.Serial)
+	case SSCC:
+		return base + "/00/" + id.SSCC
+	}
+	return ""
+}
+
+// ParseDigitalLink reads the identifier of a Digital Link URI on any
+// resolver, with or without a path before the primary key. Data in the
+// query string, such as an expiry date, is ignored.
+func ParseDigitalLink(uri string) (*ID, error) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("%s is not a web URI", uri)
+	}
+	segs := strings.Split(strings.Trim(u.EscapedPath(), "/"), "/")
+	start := -1
+	for i, s := range segs {
+		if ai := linkAI(s); (ai == "01" || ai == "00") && i+1 < len(segs) {
+			start = i
+			break
+		}
+	}
+	if start < 0 || (len(segs)-start)%2 != 0 {
+		return nil, fmt.Errorf("%s is not a GS1 Digital Link", uri)
+	}
+	ais := map[string]string{}
+	var order []string
+	for i := start; i < len(segs); i += 2 {
+		ai := linkAI(segs[i])
+		v, err := url.PathUnescape(segs[i+1])
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a GS1 Digital Link", uri)
+		}
+		if _, ok := ais[ai]; ok {
+			return nil, fmt.Errorf("%s repeats (%s)", uri, ai)
+		}
+		ais[ai] = v
+		order = append(order, ai)
+	}
+	return fromAIs(uri, order, ais)
+}
+
+func linkAI(seg string) string {
+	if ai, ok := linkAIs[seg]; ok {
+		return ai
+	}
+	return seg
+}
+
+var urnPrefixes = map[string]string{
+	"sgtin": "urn:epc:id:sgtin:",
+	"sscc":  "urn:epc:id:sscc:",
+	"lgtin": "urn:epc:class:lgtin:",
+}
+
+// ParseURN reads the EPC pure identity URNs of the Tag Data Standard:
+// urn:epc:id:sgtin:, urn:epc:id:sscc: and urn:epc:class:lgtin:.
+func ParseURN(urn string) (*ID, error) {
+	var kind, body string
+	for k, p := range urnPrefixes {
+		if strings.HasPrefix(urn, p) {
+			kind, body = k, urn[len(p):]
+		}
+	}
+	if kind == "" {
+		return nil, fmt.Errorf("%s is not an SGTIN, SSCC or LGTIN URN", urn)
+	}
+	fields := strings.Split(body, ".")
+	if kind == "sscc" {
+		if len(fields) != 2 || fields[1] == "" || len(fields[0])+len(fields[1]) != 17 {
+			return nil, fmt.Errorf("%s is not an SSCC URN", urn)
+		}
+		sscc, err := WithCheck(fields[1][:1] + fields[0] + fields[1][1:])
+		if err != nil {
+			return nil, fmt.Errorf("%s is not an SSCC URN", urn)
+		}
+		return &ID{Kind: SSCC, SSCC: sscc}, nil
+	}
+	if len(fields) != 3 || fields[1] == "" || len(fields[0])+len(fields[1]) != 13 {
+		return nil, fmt.Errorf("%s is not an %s URN", urn, strings.ToUpper(kind))
+	}
+	gtin, err := WithCheck(fields[1][:1] + fields[0] + fields[1][1:])
+	if err != nil {
+		return nil, fmt.Errorf("%s is not an %s URN", urn, strings.ToUpper(kind))
+	}
+	attr, err := url.PathUnescape(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("%s is not an %s URN", urn, strings.ToUpper(kind))
+	}
+	if kind == "sgtin" {
+		return NewSGTIN(gtin, attr)
+	}
+	return NewLGTIN(gtin, attr)
+}
+
+// ParseAny reads a tag, a Digital Link or an EPC URN.
+func ParseAny(s string) (*ID, error) {
+	switch {
+	case strings.HasPrefix(s, "urn:epc:"):
+		return ParseURN(s)
+	case strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://"):
+		return ParseDigitalLink(s)
+	}
+	return Parse(s)
+}
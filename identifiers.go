@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"mongo/gs1"
+)
+
+// maxAllocation is how many identifiers one request may allocate.
+const maxAllocation = 100
+
+// companyPrefixes are the GS1 company prefixes GTIN lots, serials and SSCCs
+// are allocated under, GS1_COMPANY_PREFIXES, the first being the default.
+func companyPrefixes() []string {
+	var ret []string
+	for _, p := range strings.Split(os.Getenv("GS1_COMPANY_PREFIXES"), ",") {
+		if p = strings.TrimSpace(p); gs1.CheckPrefix(p) == nil {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+// internalPrefix starts internal serials, TAG_PREFIX or SC.
+func internalPrefix() string {
+	if p := os.Getenv("TAG_PREFIX"); p != "" {
+		return p
+	}
+	return "SC"
+}
+
+// linkResolver is where exported Digital Links point, GS1_RESOLVER or the
+// GS1 resolver.
+func linkResolver() string {
+	if r := os.Getenv("GS1_RESOLVER"); r != "" {
+		return r
+	}
+	return gs1.Resolver
+}
+
+// typedTag is the check a new tag passes: a typed identifier written the
+// way the service writes it.
+func typedTag(tag string) (*gs1.ID, error) {
+	id, err := gs1.Parse(tag)
+	if err != nil {
+		return nil, err
+	}
+	if id.String() != tag {
+		return nil, fmt.Errorf("write %s as %s", tag, id.String())
+	}
+	if !validTag(tag) {
+		return nil, fmt.Errorf("%s cannot be used as a tag", tag)
+	}
+	return id, nil
+}
+
+// tagKind is the type of a tag, empty for tags from before tags were
+// typed.
+func tagKind(tag string) gs1.Kind {
+	if id, err := typedTag(tag); err == nil {
+		return id.Kind
+	}
+	return ""
+}
+
+// canonicalTag turns what a scanner read, a Digital Link, an EPC URN or a
+// tag, into the tag posts are stored under.
+func canonicalTag(v string) string {
+	if id, err := gs1.ParseAny(v); err == nil {
+		return id.String()
+	}
+	return v
+}
+
+// Identifier is an identifier as the API shows it.
+type Identifier struct {
+	Tag string `json:"tag"`
+	*gs1.ID
+	DigitalLink string `json:"digitallink,omitempty"`
+}
+
+func newIdentifier(id *gs1.ID) *Identifier {
+	return &Identifier{Tag: id.String(), ID: id, DigitalLink: id.DigitalLink(linkResolver())}
+}
+
+type identifierRequest struct {
+	Kind gs1.Kind `json:"kind"`
+	// Prefix is the company prefix of an SSCC, or the letters of an
+	// internal serial.
+	Prefix string `json:"prefix"`
+	// GTIN is the product of a GTIN lot or serial.
+	GTIN  string `json:"gtin"`
+	Count int    `json:"count"`
+}
+
+// nextSerial counts up the counter named key and returns the new count.
+func (s *service) nextSerial(ctx context.Context, key string) (int64, error) {
+	var c struct {
+		N int64 `bson:"n"`
+	}
+	if err := s.db.Increment(ctx, "counters", "_id", key, "n", 1).Decode(&c); err != nil {
+		return 0, err
+	}
+	return c.N, nil
+}
+
+func ownPrefix(prefix string) bool {
+	for _, p := range companyPrefixes() {
+		if p == prefix {
+			return true
+		}
+	}
+	return false
+}
+
+// ownID says whether id was allocated under one of our company prefixes.
+func ownID(id *gs1.ID) bool {
+	for _, p := range companyPrefixes() {
+		if id.HasPrefix(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// allocateTag makes a new identifier no post has yet. GTIN lots are
+// numbered by farm day, such as 261019-3, and GTIN serials and SSCCs
+// counted per GTIN and company prefix.
+func (s *service) allocateTag(ctx context.Context, in *identifierRequest) (*gs1.ID, error) {
+	for {
+		var id *gs1.ID
+		switch in.Kind {
+		case gs1.Internal, "":
+			prefix := in.Prefix
+			if prefix == "" {
+				prefix = internalPrefix()
+			}
+			if err := gs1.CheckInternalPrefix(prefix); err != nil {
+				return nil, uploadErrorf(http.StatusBadRequest, "%s", err.Error())
+			}
+			n, err := s.nextSerial(ctx, "internal:"+prefix)
+			if err != nil {
+				return nil, err
+			}
+			if id, err = gs1.NewInternal(prefix, n); err != nil {
+				return nil, uploadErrorf(http.StatusConflict, "%s", err.Error())
+			}
+		case gs1.SSCC:
+			prefix := in.Prefix
+			if prefix == "" && len(companyPrefixes()) > 0 {
+				prefix = companyPrefixes()[0]
+			}
+			if !ownPrefix(prefix) {
+				return nil, uploadErrorf(http.StatusBadRequest, "%q is not one of GS1_COMPANY_PREFIXES", prefix)
+			}
+			n, err := s.nextSerial(ctx, "sscc:"+prefix)
+			if err != nil {
+				return nil, err
+			}
+			if id, err = gs1.NewSSCC(prefix, n); err != nil {
+				return nil, uploadErrorf(http.StatusConflict, "%s", err.Error())
+			}
+		case gs1.LGTIN, gs1.SGTIN:
+			gtin, err := gs1.NormalizeGTIN(in.GTIN)
+			if err != nil {
+				return nil, uploadErrorf(http.StatusBadRequest, "%s", err.Error())
+			}
+			if !ownID(&gs1.ID{Kind: in.Kind, GTIN: gtin}) {
+				return nil, uploadErrorf(http.StatusBadRequest, "GTIN %s is not under GS1_COMPANY_PREFIXES", gtin)
+			}
+			var n int64
+			if in.Kind == gs1.SGTIN {
+				if n, err = s.nextSerial(ctx, "serial:"+gtin); err != nil {
+					return nil, err
+				}
+				id, err = gs1.NewSGTIN(gtin, strconv.FormatInt(n, 10))
+			} else {
+				day := time.Now().In(farmZone).Format("060102")
+				if n, err = s.nextSerial(ctx, "lot:"+gtin+":"+day); err != nil {
+					return nil, err
+				}
+				id, err = gs1.NewLGTIN(gtin, day+"-"+strconv.FormatInt(n, 10))
+			}
+			if err != nil {
+				return nil, uploadErrorf(http.StatusConflict, "%s", err.Error())
+			}
+		default:
+			return nil, uploadErrorf(http.StatusBadRequest, "kind must be lgtin, sgtin, sscc or internal")
+		}
+		// a tag entered by hand may have taken the number already
+		if _, err := s.findPost(ctx, "tag", id.String()); err != nil {
+			return id, nil
+		}
+	}
+}
+
+// allocateIdentifiers answers POST /identifiers with count new
+// identifiers of a kind.
+func (s *service) allocateIdentifiers(w http.ResponseWriter, r *http.Request) {
+	if s.sessionFrom(r) == nil {
+		writeMessage(w, http.StatusUnauthorized, "session required")
+		return
+	}
+	in := &identifierRequest{}
+	if err := json.NewDecoder(r.Body).Decode(in); err != nil {
+		writeMessage(w, http.StatusBadRequest, "body must be a json identifier request")
+		return
+	}
+	if in.Count == 0 {
+		in.Count = 1
+	}
+	if in.Count < 0 || in.Count > maxAllocation {
+		writeMessage(w, http.StatusBadRequest, "count must be 1 to "+strconv.Itoa(maxAllocation))
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var ret []*Identifier
+	for i := 0; i < in.Count; i++ {
+		id, err := s.allocateTag(ctx, in)
+		if err != nil {
+			writeMessage(w, uploadStatus(err), err.Error())
+			return
+		}
+		ret = append(ret, newIdentifier(id))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"identifiers": ret})
+}
+
+// parseIdentifier answers GET /identifiers/parse?uri= with the identifier
+// of a tag, Digital Link or EPC URN.
+func (s *service) parseIdentifier(w http.ResponseWriter, r *http.Request) {
+	id, err := gs1.ParseAny(r.URL.Query().Get("uri"))
+	if err != nil {
+		writeMessage(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newIdentifier(id))
+}
+
+// resolveLink makes the service a Digital Link resolver for its own tags:
+// GET /01/... and /00/... go to the tag's verification page, so the same
+// QR code works in GS1 scanning apps and a phone's camera.
+func (s *service) resolveLink(w http.ResponseWriter, r *http.Request) {
+	u := url.URL{Scheme: "https", Host: r.Host, Path: r.URL.Path, RawPath: r.URL.RawPath}
+	id, err := gs1.ParseDigitalLink(u.String())
+	if err != nil {
+		writeMessage(w, http.StatusNotFound, err.Error())
+		return
+	}
+	http.Redirect(w, r, "/verify/"+url.PathEscape(id.String()), http.StatusTemporaryRedirect)
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Job and stage statuses.
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+	jobPending = "pending"
+)
+
+const jobQueueSize = 1024
+
+type JobStage struct {
+	Name     string     `json:"name" bson:"name"`
+	Status   string     `json:"status" bson:"status"`
+	Started  *time.Time `json:"started,omitempty" bson:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty" bson:"finished,omitempty"`
+	Error    string     `json:"error,omitempty" bson:"error,omitempty"`
+}
+
+// Job is an accepted upload waiting for or going through the pipeline,
+// kept in the "jobs" collection. Code is the HTTP status the synchronous
+// endpoint would have answered with.
+type Job struct {
+	ID       primitive.ObjectID `json:"id" bson:"_id"`
+	Status   string             `json:"status" bson:"status"`
+	Code     int                `json:"code,omitempty" bson:"code,omitempty"`
+	Error    string             `json:"error,omitempty" bson:"error,omitempty"`
+	Tag      string             `json:"tag" bson:"tag"`
+	Post     primitive.ObjectID `json:"post" bson:"post"`
+	File     string             `json:"file" bson:"file"`
+	Path     string             `json:"-" bson:"path"`
+	Date     string             `json:"-" bson:"date"`
+	Original string             `json:"original,omitempty" bson:"original,omitempty"`
+	Note     string             `json:"note,omitempty" bson:"note,omitempty"`
+	SHA256   string             `json:"-" bson:"sha256,omitempty"`
+	Stages   []JobStage         `json:"stages" bson:"stages"`
+	Result   *ImageEntry        `json:"result,omitempty" bson:"result,omitempty"`
+	Created  time.Time          `json:"created" bson:"created"`
+	Updated  time.Time          `json:"updated" bson:"updated"`
+}
+
+func (j *Job) finished() bool {
+	return j.Status == jobDone || j.Status == jobFailed
+}
+
+func (j *Job) stage(name string) *JobStage {
+	for i := range j.Stages {
+		if j.Stages[i].Name == name {
+			return &j.Stages[i]
+		}
+	}
+	return nil
+}
+
+func newJob(u *pendingUpload) *Job {
+	now := time.Now()
+	j := &Job{ID: primitive.NewObjectID(), Status: jobQueued, Tag: u.Post.Tag, Post: u.Post.ID, File: u.Filename, Path: u.Path, Date: u.Date, Original: u.Info.File, Note: u.Info.Note, SHA256: u.Info.SHA256, Created: now, Updated: now}
+	for _, st := range uploadStages {
+		j.Stages = append(j.Stages, JobStage{Name: st.Name, Status: jobPending})
+	}
+	return j
+}
+
+type jobWork struct {
+	job    *Job
+	upload *pendingUpload
+}
+
+// jobRunner feeds queued uploads to a fixed pool of workers and fans job
+// updates out to live subscribers.
+type jobRunner struct {
+	queue chan *jobWork
+
+	mu   sync.Mutex
+	subs map[primitive.ObjectID]map[chan *Job]bool
+}
+
+func newJobRunner() *jobRunner {
+	return &jobRunner{queue: make(chan *jobWork, jobQueueSize), subs: map[primitive.ObjectID]map[chan *Job]bool{}}
+}
+
+func (jr *jobRunner) subscribe(id primitive.ObjectID) chan *Job {
+	ch := make(chan *Job, 16)
+	jr.mu.Lock()
+	defer jr.mu.Unlock()
+	if jr.subs[id] == nil {
+		jr.subs[id] = map[chan *Job]bool{}
+	}
+	jr.subs[id][ch] = true
+	return ch
+}
+
+func (jr *jobRunner) unsubscribe(id primitive.ObjectID, ch chan *Job) {
+	jr.mu.Lock()
+	defer jr.mu.Unlock()
+	delete(jr.subs[id], ch)
+	if len(jr.subs[id]) == 0 {
+		delete(jr.subs, id)
+	}
+}
+
+func (jr *jobRunner) publish(j *Job) {
+	c := *j
+	c.Stages = append([]JobStage(nil), j.Stages...)
+	jr.mu.Lock()
+	defer jr.mu.Unlock()
+	for ch := range jr.subs[j.ID] {
+		select {
+		case ch <- &c:
+		default:
+			// a slow reader may miss intermediate states, but the final
+			// one replaces whatever it has not read yet
+			if c.finished() {
+				select {
+				case <-ch:
+				default:
+				}
+				select {
+				case ch <- &c:
+				default:
+				}
+			}
+		}
+	}
+}
+
+func jobWorkers() int {
+	n, err := strconv.Atoi(os.Getenv("JOB_WORKERS"))
+	if err != nil || n < 1 {
+		return 2
+	}
+	return n
+}
+
+func (s *service) saveJob(j *Job) {
+	j.Updated = time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.db.Update(ctx, "jobs", "_id", j.ID, j).Err(); err != nil && err != mongo.ErrNoDocuments {
+		log.Println("err saving job", j.ID.Hex(), err)
+	}
+	s.jobs.publish(j)
+}
+
+// startJobs starts the workers and picks up jobs left by a previous run.
+// Queued jobs are run again. A job that was running is only retried when
+// it had not reached anchoring, since a transaction may already be sent.
+func (s *service) startJobs() error {
+	s.jobs = newJobRunner()
+	for i := 0; i < jobWorkers(); i++ {
+		go s.jobWorker()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	cur, err := s.db.QueryFilter(ctx, "jobs", bson.M{"status": bson.M{"$in": bson.A{jobQueued, jobRunning}}}, options.Find().SetSort(bson.M{"created": 1}))
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		j := &Job{}
+		if err := cur.Decode(j); err != nil {
+			log.Println(err)
+			continue
+		}
+		p, _ := s.findPost(ctx, "_id", j.Post)
+		u := j.requeue(p)
+		if u == nil {
+			os.Remove(j.File)
+			s.saveJob(j)
+			continue
+		}
+		select {
+		case s.jobs.queue <- &jobWork{job: j, upload: u}:
+			log.Println("job requeued", j.ID.Hex())
+		default:
+			j.Status, j.Code, j.Error = jobFailed, http.StatusServiceUnavailable, "job queue full"
+			os.Remove(j.File)
+			s.saveJob(j)
+		}
+	}
+	return nil
+}
+
+// requeue readies a job left by a previous run to go through the
+// pipeline again for p, its post or nil when that is gone. When the job
+// cannot run again it is failed and requeue returns nil.
+func (j *Job) requeue(p *Post) *pendingUpload {
+	if a := j.stage("anchor"); j.Status == jobRunning && a != nil && a.Status != jobPending {
+		j.Status, j.Code, j.Error = jobFailed, http.StatusInternalServerError, "interrupted by restart during anchoring"
+		return nil
+	}
+	if p == nil {
+		j.Status, j.Code, j.Error = jobFailed, http.StatusNotFound, "post no longer exists"
+		return nil
+	}
+	for i := range j.Stages {
+		j.Stages[i] = JobStage{Name: j.Stages[i].Name, Status: jobPending}
+	}
+	j.Status = jobQueued
+	return &pendingUpload{Info: &uploadInfo{File: j.Original, ID: j.Tag, Note: j.Note, SHA256: j.SHA256}, Post: p, Path: j.Path, Date: j.Date, Filename: j.File}
+}
+
+func (s *service) jobWorker() {
+	for w := range s.jobs.queue {
+		j := w.job
+		j.Status = jobRunning
+		s.saveJob(j)
+		err := s.processUpload(w.upload, func(name string, done bool, err error) {
+			st := j.stage(name)
+			if st == nil {
+				return
+			}
+			now := time.Now()
+			switch {
+			case !done:
+				st.Status, st.Started = jobRunning, &now
+			case err != nil:
+				st.Status, st.Finished, st.Error = jobFailed, &now, err.Error()
+			default:
+				st.Status, st.Finished = jobDone, &now
+			}
+			s.saveJob(j)
+		})
+		if err != nil {
+			log.Println("job failed", j.ID.Hex(), err)
+			j.Status, j.Code, j.Error = jobFailed, uploadStatus(err), err.Error()
+		} else {
+			j.Status, j.Code, j.Result = jobDone, http.StatusCreated, w.upload.img
+		}
+		s.saveJob(j)
+	}
+}
+
+// queueUpload records a job for a received upload and queues it. The
+// photo is removed when it cannot be queued.
+func (s *service) queueUpload(u *pendingUpload) (*Job, error) {
+	j := newJob(u)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := s.db.Add(ctx, "jobs", j); err != nil {
+		log.Println("err adding job", err)
+		os.Remove(u.Filename)
+		return nil, err
+	}
+	select {
+	case s.jobs.queue <- &jobWork{job: j, upload: u}:
+	default:
+		j.Status, j.Code, j.Error = jobFailed, http.StatusServiceUnavailable, "job queue full"
+		s.saveJob(j)
+		os.Remove(u.Filename)
+		return nil, uploadErrorf(j.Code, "%s", j.Error)
+	}
+	return j, nil
+}
+
+// uploadFileAsync stores the photo and answers 202 with the job that will
+// process it.
+func (s *service) uploadFileAsync(w http.ResponseWriter, r *http.Request) {
+	log.Println("uploadfileasync called")
+	err := r.ParseMultipartForm(32 << 20)
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, "invalid multipart form")
+		return
+	}
+	file, header, err := r.FormFile("image")
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, "missing image")
+		return
+	}
+	defer file.Close()
+	in := &uploadInfo{File: header.Filename, ID: r.FormValue("id"), Note: r.FormValue("note")}
+
+	u, err := s.receiveUpload(file, in)
+	if err != nil {
+		writeMessage(w, uploadStatus(err), err.Error())
+		return
+	}
+	j, err := s.queueUpload(u)
+	if err != nil {
+		writeMessage(w, uploadStatus(err), err.Error())
+		return
+	}
+
+	w.Header().Set("Location", "/jobs/"+j.ID.Hex())
+	w.Header().Set("Access-Control-Expose-Headers", "Location")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	err = json.NewEncoder(w).Encode(j)
+	if err != nil {
+		log.Println("err encoding job")
+		return
+	}
+}
+
+func (s *service) findJob(ctx context.Context, id primitive.ObjectID) (*Job, error) {
+	j := &Job{}
+	if err := s.db.QueryOne(ctx, "jobs", "_id", id).Decode(j); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (s *service) job(w http.ResponseWriter, r *http.Request) {
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		log.Println("err object id from hex")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	j, err := s.findJob(ctx, id)
+	if err != nil {
+		writeMessage(w, http.StatusNotFound, "job not found")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(j)
+	if err != nil {
+		log.Println("err encoding job")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// allJobs lists jobs newest first, optionally for one tag or status.
+func (s *service) allJobs(w http.ResponseWriter, r *http.Request) {
+	filter := bson.M{}
+	if tag := r.URL.Query().Get("tag"); tag != "" {
+		filter["tag"] = tag
+	}
+	if st := r.URL.Query().Get("status"); st != "" {
+		filter["status"] = st
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cur, err := s.db.QueryFilter(ctx, "jobs", filter, options.Find().SetSort(bson.M{"created": -1}).SetLimit(200))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer cur.Close(ctx)
+	ret := []*Job{}
+	for cur.Next(ctx) {
+		j := &Job{}
+		if err := cur.Decode(j); err != nil {
+			log.Println(err)
+			continue
+		}
+		ret = append(ret, j)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(ret)
+	if err != nil {
+		log.Println("err encoding jobs")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// jobEvents streams a job as server-sent events: the current state first,
+// then every change, until the job is done or failed.
+func (s *service) jobEvents(w http.ResponseWriter, r *http.Request) {
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		log.Println("err object id from hex")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	// subscribe before reading so no update falls in between
+	ch := s.jobs.subscribe(id)
+	defer s.jobs.unsubscribe(id, ch)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	j, err := s.findJob(ctx, id)
+	cancel()
+	if err != nil {
+		writeMessage(w, http.StatusNotFound, "job not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	send := func(j *Job) bool {
+		data, err := json.Marshal(j)
+		if err != nil {
+			return false
+		}
+		if _, err := fmt.Fprintf(w, "event: job\nid: %d\ndata: %s\n\n", j.Updated.UnixNano(), data); err != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+	if !send(j) || j.finished() {
+		return
+	}
+
+	ping := time.NewTicker(15 * time.Second)
+	defer ping.Stop()
+	for {
+		select {
+		case j := <-ch:
+			if !send(j) || j.finished() {
+				return
+			}
+		case <-ping.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestRequeue(t *testing.T) {
+	post := &Post{ID: primitive.NewObjectID(), Tag: "FARM00000017"}
+	upload := &pendingUpload{Info: &uploadInfo{File: "field.jpg", ID: post.Tag, Note: "east slope", SHA256: "9f86d081884c7d65"}, Post: post, Path: "images/FARM00000017/", Date: "Mon Mar  2 09:00:00 2026", Filename: "images/FARM00000017/1.jpg"}
+	// at marks the stages before name done and name itself running
+	at := func(j *Job, name string) {
+		j.Status = jobRunning
+		for i := range j.Stages {
+			if j.Stages[i].Name == name {
+				j.Stages[i].Status = jobRunning
+				return
+			}
+			j.Stages[i].Status = jobDone
+		}
+	}
+	tests := []struct {
+		name  string
+		stage string
+		post  *Post
+		code  int
+	}{
+		{"queued", "", post, 0},
+		{"running metadata", "metadata", post, 0},
+		{"running authenticity", "authenticity", post, 0},
+		{"running anchor", "anchor", post, http.StatusInternalServerError},
+		{"past anchor", "geofence", post, http.StatusInternalServerError},
+		{"queued, post gone", "", nil, http.StatusNotFound},
+		{"running, post gone", "metadata", nil, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		j := newJob(upload)
+		if tt.stage != "" {
+			at(j, tt.stage)
+		}
+		u := j.requeue(tt.post)
+		if tt.code != 0 {
+			if u != nil || j.Status != jobFailed || j.Code != tt.code || j.Error == "" {
+				t.Errorf("%s: requeue = %v, job %s %d %q; want it failed with %d", tt.name, u, j.Status, j.Code, j.Error, tt.code)
+			}
+			continue
+		}
+		if u == nil || j.Status != jobQueued {
+			t.Errorf("%s: requeue = %v, job %s; want it queued", tt.name, u, j.Status)
+			continue
+		}
+		for _, st := range j.Stages {
+			if st.Status != jobPending || st.Started != nil || st.Finished != nil {
+				t.Errorf("%s: stage %s left %s", tt.name, st.Name, st.Status)
+			}
+		}
+		if !reflect.DeepEqual(u.Info, upload.Info) || u.Post != post || u.Path != upload.Path || u.Date != upload.Date || u.Filename != upload.Filename {
+			t.Errorf("%s: requeued %+v %+v, want %+v %+v", tt.name, u, u.Info, upload, upload.Info)
+		}
+	}
+}
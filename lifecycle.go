@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Roles are the parties named on a post: its user is the farmer.
+const (
+	roleFarmer  = "farmer"
+	roleFactory = "factory"
+	roleMarket  = "market"
+)
+
+const eventsDir = "events/"
+
+// LifecycleStage is a value Post.Progress may take, who may move a post
+// into it and what they have to show for it.
+type LifecycleStage struct {
+	Name      string `json:"name"`
+	Role      string `json:"role"`
+	Photos    bool   `json:"photos"`
+	Paperwork bool   `json:"paperwork"`
+}
+
+// lifecycle is the order a post goes through. A post can only move to the
+// stage after its current one; posts whose progress is not a stage, such
+// as those from before stages existed, start from the beginning.
+var lifecycle = []LifecycleStage{
+	{Name: "planted", Role: roleFarmer, Photos: true},
+	{Name: "growing", Role: roleFarmer, Photos: true},
+	{Name: "harvested", Role: roleFarmer, Photos: true},
+	{Name: "processed", Role: roleFactory, Photos: true, Paperwork: true},
+	{Name: "packed", Role: roleFactory, Photos: true},
+	{Name: "shipped", Role: roleFactory, Paperwork: true},
+	{Name: "market", Role: roleMarket, Photos: true},
+}
+
+// lifecycleLocks keeps one transition per post in flight, so two requests
+// do not both anchor an event for the same step.
+var lifecycleLocks sync.Map
+
+func stageIndex(name string) int {
+	for i, st := range lifecycle {
+		if st.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// nextStage is the only stage a post at progress may move to.
+func nextStage(progress string) (LifecycleStage, bool) {
+	i := stageIndex(progress) + 1
+	if i >= len(lifecycle) {
+		return LifecycleStage{}, false
+	}
+	return lifecycle[i], true
+}
+
+// partyFor is the username that plays role on p.
+func partyFor(p *Post, role string) string {
+	switch role {
+	case roleFarmer:
+		return p.User
+	case roleFactory:
+		return p.Factory
+	case roleMarket:
+		return p.Market
+	}
+	return ""
+}
+
+// Evidence is a file backing a transition with the sha256 it had then.
+type Evidence struct {
+	File   string `json:"file" bson:"file"`
+	SHA256 string `json:"sha256" bson:"sha256"`
+}
+
+// LifecycleEvent records one transition. Hash is the sha256 of the JSON
+// kept at Record, which is the event without Hash and TxHash; that is what
+// was anchored. PrevHash chains each event to the one before it.
+type LifecycleEvent struct {
+	Post      string     `json:"post" bson:"post"`
+	Tag       string     `json:"tag" bson:"tag"`
+	Seq       int        `json:"seq" bson:"seq"`
+	From      string     `json:"from" bson:"from"`
+	To        string     `json:"to" bson:"to"`
+	Role      string     `json:"role" bson:"role"`
+	Actor     string     `json:"actor" bson:"actor"`
+	Time      string     `json:"time" bson:"time"`
+	Note      string     `json:"note,omitempty" bson:"note,omitempty"`
+	Photos    []Evidence `json:"photos,omitempty" bson:"photos,omitempty"`
+	Paperwork []Evidence `json:"paperwork,omitempty" bson:"paperwork,omitempty"`
+	PrevHash  string     `json:"prevhash,omitempty" bson:"prevhash,omitempty"`
+	Record    string     `json:"record,omitempty" bson:"record,omitempty"`
+	Hash      string     `json:"hash,omitempty" bson:"hash,omitempty"`
+	TxHash    string     `json:"txhash,omitempty" bson:"txhash,omitempty"`
+	// Source is the EPCIS event a transition was captured from.
+	Source string `json:"source,omitempty" bson:"source,omitempty"`
+}
+
+type transitionRequest struct {
+	To        string   `json:"to"`
+	Photos    []string `json:"photos"`
+	Paperwork []string `json:"paperwork"`
+	Note      string   `json:"note"`
+	// Source and At are set on transitions captured from EPCIS.
+	Source string    `json:"-"`
+	At     time.Time `json:"-"`
+}
+
+func fileSHA256(name string) (string, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// anchorRecord writes v as indented JSON to path and anchors the file, so
+// the record on disk is what its hash covers. The file is removed again if
+// anchoring fails.
+func anchorRecord(path string, v interface{}) (string, string, error) {
+	record, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return "", "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return "", "", err
+	}
+	if err := ioutil.WriteFile(path, record, 0666); err != nil {
+		return "", "", err
+	}
+	hash, tx, err := anchor(path)
+	if err != nil {
+		os.Remove(path)
+		return "", "", err
+	}
+	return hash, tx, nil
+}
+
+func (s *service) lastEvent(ctx context.Context, post string) (*LifecycleEvent, error) {
+	cur, err := s.db.QueryFilter(ctx, "lifecycle", bson.M{"post": post}, options.Find().SetSort(bson.M{"seq": -1}).SetLimit(1))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	if !cur.Next(ctx) {
+		return nil, nil
+	}
+	ev := &LifecycleEvent{}
+	return ev, cur.Decode(ev)
+}
+
+// transitionEvidence checks the photos and paperwork named in a request
+// belong to the post and came in after since, and records their hashes.
+func (s *service) transitionEvidence(ctx context.Context, p *Post, in *transitionRequest, since time.Time) ([]Evidence, []Evidence, error) {
+	var photos []Evidence
+	if len(in.Photos) > 0 {
+		bc, err := s.findBcPost(ctx, "bcposts", "_id", p.ID)
+		if err != nil {
+			return nil, nil, uploadErrorf(http.StatusNotFound, "post has no bcpost")
+		}
+		for _, f := range in.Photos {
+			f = strings.TrimPrefix(f, "/")
+			var img *ImageEntry
+			for i := range bc.Images {
+				if bc.Images[i].File == f {
+					img = &bc.Images[i]
+				}
+			}
+			if img == nil {
+				return nil, nil, uploadErrorf(http.StatusUnprocessableEntity, "%s is not a photo of %s", f, p.Tag)
+			}
+			uploaded, err := time.ParseInLocation("2006-01-02_150405", img.Date, farmZone)
+			if err == nil && uploaded.Before(since) {
+				return nil, nil, uploadErrorf(http.StatusUnprocessableEntity, "%s was uploaded before the last transition", f)
+			}
+			photos = append(photos, Evidence{File: f, SHA256: img.ImgHash})
+		}
+	}
+	paperwork, err := s.paperworkEvidence(ctx, p.Tag, in.Paperwork, since)
+	if err != nil {
+		return nil, nil, err
+	}
+	return photos, paperwork, nil
+}
+
+// paperworkEvidence checks files, named with or without their file/<tag>/
+// prefix, are versions of documents of tag filed after since, and records
+// the hashes the versions were anchored with. A file that no longer
+// matches its hash is refused.
+func (s *service) paperworkEvidence(ctx context.Context, tag string, files []string, since time.Time) ([]Evidence, error) {
+	var ret []Evidence
+	for _, f := range files {
+		name := strings.TrimPrefix(strings.TrimPrefix(f, "/"), "file/"+tag+"/")
+		if !validTag(name) {
+			return nil, uploadErrorf(http.StatusUnprocessableEntity, "%s is not paperwork of %s", f, tag)
+		}
+		path := "file/" + tag + "/" + name
+		d := &Document{}
+		if err := s.db.QueryFilterOne(ctx, "documents", bson.M{"tag": tag, "versions.file": path}).Decode(d); err != nil {
+			return nil, uploadErrorf(http.StatusUnprocessableEntity, "%s is not a document of %s", f, tag)
+		}
+		var v *DocumentVersion
+		for _, dv := range d.Versions {
+			if dv.File == path {
+				v = dv
+			}
+		}
+		filed, err := time.Parse(time.RFC3339, v.Time)
+		if err != nil || filed.Before(since) {
+			return nil, uploadErrorf(http.StatusUnprocessableEntity, "%s was filed before the last transition", f)
+		}
+		h, err := fileSHA256(path)
+		if err != nil || h != v.SHA256 {
+			return nil, uploadErrorf(http.StatusConflict, "%s no longer matches the hash it was filed with", f)
+		}
+		ret = append(ret, Evidence{File: path, SHA256: h})
+	}
+	return ret, nil
+}
+
+// transition moves a post to its next stage. The caller has to be the
+// party the stage belongs to, or one of LIFECYCLE_IDENTITIES acting for
+// them, and has to name the evidence the stage requires. The event is
+// written to events/<tag>/ and anchored before progress changes.
+func (s *service) transition(w http.ResponseWriter, r *http.Request) {
+	se := s.sessionFrom(r)
+	if se == nil {
+		writeMessage(w, http.StatusUnauthorized, "session required")
+		return
+	}
+	p, ok := s.postFromVars(w, r)
+	if !ok {
+		return
+	}
+	in := &transitionRequest{}
+	if err := json.NewDecoder(r.Body).Decode(in); err != nil {
+		writeMessage(w, http.StatusBadRequest, "body must be a json transition")
+		return
+	}
+	ret, ev, err := s.applyTransition(se, p, in)
+	if err != nil {
+		writeMessage(w, uploadStatus(err), err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"post": ret, "event": ev})
+}
+
+// applyTransition does the work of transition. Transitions captured from
+// another system carry their Source and time; they stand in for their own
+// evidence only when captured by one of EPCIS_TRUSTED_IDENTITIES.
+func (s *service) applyTransition(se *session, p *Post, in *transitionRequest) (*Post, *LifecycleEvent, error) {
+	mu, _ := lifecycleLocks.LoadOrStore(p.ID.Hex(), &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	defer mu.(*sync.Mutex).Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// reread under the lock, the post may have moved on meanwhile
+	p, err := s.findPost(ctx, "_id", p.ID)
+	if err != nil {
+		return nil, nil, uploadErrorf(http.StatusNotFound, "post not found")
+	}
+	from := p.Progress
+	if stageIndex(from) < 0 {
+		from = ""
+	}
+	next, ok := nextStage(from)
+	if !ok {
+		return nil, nil, uploadErrorf(http.StatusConflict, "%s is already at %s", p.Tag, from)
+	}
+	if stageIndex(in.To) < 0 {
+		return nil, nil, uploadErrorf(http.StatusBadRequest, "unknown stage %s", in.To)
+	}
+	if in.To != next.Name {
+		return nil, nil, uploadErrorf(http.StatusConflict, "%s can go from %q to %s only", p.Tag, from, next.Name)
+	}
+	party := partyFor(p, next.Role)
+	if !identitySet("LIFECYCLE_IDENTITIES", "admin")[se.Identity] && (party == "" || se.Username != party) {
+		return nil, nil, uploadErrorf(http.StatusForbidden, "%s is recorded by the %s of %s", next.Name, next.Role, p.Tag)
+	}
+
+	last, err := s.lastEvent(ctx, p.ID.Hex())
+	if err != nil {
+		log.Println("err reading lifecycle", err)
+		return nil, nil, err
+	}
+	var since time.Time
+	ev := &LifecycleEvent{Post: p.ID.Hex(), Tag: p.Tag, Seq: 1, From: from, To: next.Name, Role: next.Role, Actor: se.Username, Note: in.Note, Source: in.Source}
+	if last != nil {
+		ev.Seq, ev.PrevHash = last.Seq+1, last.Hash
+		since, _ = time.Parse(time.RFC3339, last.Time)
+	}
+	ev.Photos, ev.Paperwork, err = s.transitionEvidence(ctx, p, in, since)
+	if err != nil {
+		return nil, nil, err
+	}
+	trusted := in.Source != "" && identitySet("EPCIS_TRUSTED_IDENTITIES", "")[se.Identity]
+	if !trusted && next.Photos && len(ev.Photos) == 0 {
+		return nil, nil, uploadErrorf(http.StatusUnprocessableEntity, "%s needs at least one photo", next.Name)
+	}
+	if !trusted && next.Paperwork && len(ev.Paperwork) == 0 {
+		return nil, nil, uploadErrorf(http.StatusUnprocessableEntity, "%s needs paperwork", next.Name)
+	}
+	at := time.Now()
+	if !in.At.IsZero() {
+		if err := checkEventTime(in.At); err != nil {
+			return nil, nil, err
+		}
+		if in.At.Before(since) {
+			return nil, nil, uploadErrorf(http.StatusConflict, "%s is dated before the last transition of %s", next.Name, p.Tag)
+		}
+		at = in.At
+	}
+	ev.Time = at.In(farmZone).Format(time.RFC3339)
+
+	if !validTag(p.Tag) {
+		return nil, nil, uploadErrorf(http.StatusConflict, "post has no usable tag")
+	}
+	ev.Record = fmt.Sprintf("%s%s/%03d_%s.json", eventsDir, p.Tag, ev.Seq, ev.To)
+	ev.Hash, ev.TxHash, err = anchorRecord(ev.Record, ev)
+	if err != nil {
+		log.Println("err anchoring "+ev.Record, err)
+		return nil, nil, uploadErrorf(http.StatusBadGateway, "could not anchor the transition")
+	}
+
+	// anchoring can take a while, use a fresh context for the writes
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// move the post first so a lost race leaves no event behind
+	ret := &Post{}
+	err = s.db.ModifyFilter(ctx, "posts", bson.M{"_id": p.ID, "progress": p.Progress}, bson.M{"$set": bson.M{"progress": next.Name}}).Decode(ret)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil, uploadErrorf(http.StatusConflict, "%s changed while recording %s", p.Tag, next.Name)
+	}
+	if err != nil {
+		log.Println("err updating progress", err)
+		return nil, nil, err
+	}
+	if _, err := s.db.Add(ctx, "lifecycle", ev); err != nil {
+		log.Println("err saving event", err)
+		back := bson.M{"$set": bson.M{"progress": p.Progress}}
+		if err := s.db.ModifyFilter(ctx, "posts", bson.M{"_id": p.ID, "progress": next.Name}, back).Err(); err != nil {
+			log.Println("err restoring progress of", p.Tag, err)
+		}
+		return nil, nil, err
+	}
+	return ret, ev, nil
+}
+
+// lifecycleEvents lists a post's transitions in order.
+func (s *service) lifecycleEvents(w http.ResponseWriter, r *http.Request) {
+	p, ok := s.postFromVars(w, r)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cur, err := s.db.QueryFilter(ctx, "lifecycle", bson.M{"post": p.ID.Hex()}, options.Find().SetSort(bson.M{"seq": 1}))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer cur.Close(ctx)
+	ret := []*LifecycleEvent{}
+	for cur.Next(ctx) {
+		ev := &LifecycleEvent{}
+		if err := cur.Decode(ev); err != nil {
+			log.Println(err)
+			continue
+		}
+		ret = append(ret, ev)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ret)
+}
+
+// lifecycleStages describes the stages so clients need not hard code them.
+func (s *service) lifecycleStages(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lifecycle)
+}
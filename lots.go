@@ -0,0 +1,557 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"mongo/gs1"
+	"mongo/server"
+)
+
+// Kinds of lot operation.
+const (
+	lotSplit     = "split"
+	lotMerge     = "merge"
+	lotTransform = "transform"
+)
+
+// maxLineageDepth stops a walk over a malformed graph; real chains are a
+// handful of steps long.
+const maxLineageDepth = 64
+
+// LotLink ties a post to one parent it was made from and how much of the
+// parent went into it.
+type LotLink struct {
+	Post   primitive.ObjectID `json:"post" bson:"post"`
+	Tag    string             `json:"tag" bson:"tag"`
+	Amount int                `json:"amount" bson:"amount"`
+	Unit   string             `json:"unit,omitempty" bson:"unit,omitempty"`
+	Op     primitive.ObjectID `json:"op" bson:"op"`
+	Kind   string             `json:"kind" bson:"kind"`
+}
+
+// LotInput is how much of an existing post an operation draws.
+type LotInput struct {
+	Post   string `json:"post"`
+	Amount int    `json:"amount"`
+}
+
+// LotOutput is a post an operation creates. Unit defaults to the first
+// input's and Certification to the class all inputs share.
+type LotOutput struct {
+	Tag           string `json:"tag"`
+	Title         string `json:"title"`
+	Name          string `json:"name"`
+	Factory       string `json:"factory"`
+	Market        string `json:"market"`
+	Amount        int    `json:"amount"`
+	Unit          string `json:"unit"`
+	Certification string `json:"certification"`
+}
+
+// lotRequest is the body of a lot operation. Process names the yield a
+// transform is held to.
+type lotRequest struct {
+	Inputs  []LotInput  `json:"inputs"`
+	Outputs []LotOutput `json:"outputs"`
+	Process string      `json:"process"`
+	Note    string      `json:"note"`
+	// Source and At are set on operations captured from EPCIS.
+	Source string    `json:"-"`
+	At     time.Time `json:"-"`
+}
+
+// LotOperation records a split, merge or transform as a whole.
+type LotOperation struct {
+	ID      primitive.ObjectID `json:"id" bson:"_id"`
+	Kind    string             `json:"kind" bson:"kind"`
+	Inputs  []LotLink          `json:"inputs" bson:"inputs"`
+	Outputs []LotLink          `json:"outputs" bson:"outputs"`
+	Actor   string             `json:"actor" bson:"actor"`
+	Note    string             `json:"note,omitempty" bson:"note,omitempty"`
+	Date    string             `json:"date" bson:"date"`
+	Balance *BalanceCheck      `json:"balance,omitempty" bson:"balance,omitempty"`
+	// Source is the EPCIS event an operation was captured from.
+	Source string `json:"source,omitempty" bson:"source,omitempty"`
+}
+
+// checkLotShape enforces what each kind of operation looks like: a split
+// divides one input, a merge combines inputs into one lot, and a transform
+// turns inputs into one lot of something else. Whether the quantities add
+// up is for the mass balance.
+func checkLotShape(kind string, in *lotRequest) error {
+	if len(in.Inputs) == 0 || len(in.Outputs) == 0 {
+		return fmt.Errorf("inputs and outputs are required")
+	}
+	for _, i := range in.Inputs {
+		if i.Amount <= 0 {
+			return fmt.Errorf("input amounts must be positive")
+		}
+	}
+	tags := map[string]bool{}
+	for _, o := range in.Outputs {
+		if o.Amount <= 0 {
+			return fmt.Errorf("output amounts must be positive")
+		}
+		if _, err := typedTag(o.Tag); err != nil {
+			return err
+		}
+		if tags[o.Tag] {
+			return fmt.Errorf("outputs need distinct tags")
+		}
+		tags[o.Tag] = true
+	}
+	switch kind {
+	case lotSplit:
+		if len(in.Inputs) != 1 || len(in.Outputs) < 2 {
+			return fmt.Errorf("a split takes one input and makes two or more lots")
+		}
+	case lotMerge:
+		if len(in.Inputs) < 2 || len(in.Outputs) != 1 {
+			return fmt.Errorf("a merge takes two or more inputs and makes one lot")
+		}
+	case lotTransform:
+		if len(in.Outputs) != 1 {
+			return fmt.Errorf("a transform makes one lot")
+		}
+	}
+	return nil
+}
+
+// allocate reserves amount of a parent for its children, failing when less
+// than that is left.
+func (s *service) allocate(ctx context.Context, id primitive.ObjectID, amount int) error {
+	filter := bson.M{"_id": id, "$expr": bson.M{"$lte": bson.A{
+		bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$allocated", 0}}, amount}},
+		"$amount",
+	}}}
+	err := s.db.ModifyFilter(ctx, "posts", filter, bson.M{"$inc": bson.M{"allocated": amount}}).Err()
+	if err == mongo.ErrNoDocuments {
+		return uploadErrorf(http.StatusConflict, "not enough left of %s for %d", id.Hex(), amount)
+	}
+	return err
+}
+
+func (s *service) release(ctx context.Context, id primitive.ObjectID, amount int) {
+	if err := s.db.Modify(ctx, "posts", "_id", id, bson.M{"$inc": bson.M{"allocated": -amount}}).Err(); err != nil {
+		log.Println("err releasing allocation of", id.Hex(), err)
+	}
+}
+
+// allocateInputs reserves what each input of an operation draws. When one
+// cannot be reserved, those reserved before it are released.
+func allocateInputs(inputs []LotLink, allocate func(LotLink) error, release func(LotLink)) error {
+	for n, l := range inputs {
+		if err := allocate(l); err != nil {
+			for _, done := range inputs[:n] {
+				release(done)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// lotChildren makes the posts the outputs of op become, unsaved. Each
+// links to every input; the child of a split draws only its own share,
+// in the parent's unit.
+func (mb *massBalance) lotChildren(op *LotOperation, parents []*Post, outputs []LotOutput) []*Post {
+	progress, farm, cert := parents[0].Progress, parents[0].Farm, commonCertification(parents)
+	for _, p := range parents[1:] {
+		if p.Progress != progress {
+			progress = ""
+		}
+		if p.Farm != farm {
+			farm = ""
+		}
+	}
+	var children []*Post
+	for _, o := range outputs {
+		if o.Unit == "" {
+			o.Unit = op.Inputs[0].Unit
+		}
+		if o.Certification == "" {
+			o.Certification = cert
+		}
+		links := make([]LotLink, len(op.Inputs))
+		copy(links, op.Inputs)
+		if op.Kind == lotSplit {
+			b, _, _ := mb.base(o.Amount, o.Unit)
+			links[0].Amount = int(math.Round(b / mb.Units[links[0].Unit].Factor))
+		}
+		children = append(children, &Post{ID: primitive.NewObjectID(), Tag: o.Tag, Title: o.Title, User: parents[0].User, Name: o.Name, Date: op.Date, Factory: o.Factory, Market: o.Market, Amount: o.Amount, Unit: o.Unit, Certification: o.Certification, Progress: progress, Paperwork: "file/" + o.Tag + "/", Farm: farm, Parents: links, TagKind: tagKind(o.Tag)})
+	}
+	return children
+}
+
+// lotOperation handles POST /lot/{kind}. The caller needs rights on every
+// input. Children take the stage their parents share, the farm of a single
+// parent and the user of the first.
+func (s *service) lotOperation(w http.ResponseWriter, r *http.Request, kind string) {
+	se := s.sessionFrom(r)
+	if se == nil {
+		writeMessage(w, http.StatusUnauthorized, "session required")
+		return
+	}
+	in := &lotRequest{}
+	if err := json.NewDecoder(r.Body).Decode(in); err != nil {
+		writeMessage(w, http.StatusBadRequest, "body must be a json lot operation")
+		return
+	}
+	op, children, err := s.applyLotOperation(se, kind, in)
+	if err != nil {
+		if op != nil && op.Balance != nil && uploadStatus(err) == http.StatusUnprocessableEntity {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			json.NewEncoder(w).Encode(map[string]interface{}{"message": err.Error(), "balance": op.Balance})
+			return
+		}
+		writeMessage(w, uploadStatus(err), err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"operation": op, "posts": children})
+}
+
+// applyLotOperation does the work of lotOperation. When the mass balance
+// rejects it, the operation is returned along with the error to show why.
+// Outputs without a tag are given an internal serial.
+func (s *service) applyLotOperation(se *session, kind string, in *lotRequest) (*LotOperation, []*Post, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for n := range in.Outputs {
+		if in.Outputs[n].Tag == "" {
+			id, err := s.allocateTag(ctx, &identifierRequest{Kind: gs1.Internal})
+			if err != nil {
+				return nil, nil, err
+			}
+			in.Outputs[n].Tag = id.String()
+		}
+	}
+	if err := checkLotShape(kind, in); err != nil {
+		return nil, nil, uploadErrorf(http.StatusBadRequest, "%s", err.Error())
+	}
+
+	date := time.Now().Add(time.Hour * 8).Format(time.ANSIC)
+	if !in.At.IsZero() {
+		if err := checkEventTime(in.At); err != nil {
+			return nil, nil, err
+		}
+		date = in.At.In(farmZone).Format(time.ANSIC)
+	}
+	op := &LotOperation{ID: primitive.NewObjectID(), Kind: kind, Actor: se.Username, Note: in.Note, Date: date, Source: in.Source}
+	var parents []*Post
+	for _, i := range in.Inputs {
+		id, err := primitive.ObjectIDFromHex(i.Post)
+		if err != nil {
+			return nil, nil, uploadErrorf(http.StatusBadRequest, "bad post id %s", i.Post)
+		}
+		p, err := s.findPost(ctx, "_id", id)
+		if err != nil {
+			return nil, nil, uploadErrorf(http.StatusNotFound, "no post %s", i.Post)
+		}
+		if !canAccessPost(se, p) {
+			return nil, nil, uploadErrorf(http.StatusForbidden, "%s has no rights on %s", se.Username, p.Tag)
+		}
+		if p.Package != "" {
+			return nil, nil, uploadErrorf(http.StatusBadRequest, "%s is a %s, not a lot", p.Tag, p.Package)
+		}
+		if p.Container != "" {
+			return nil, nil, uploadErrorf(http.StatusConflict, "%s is packed in %s, unpack it first", p.Tag, p.Container)
+		}
+		parents = append(parents, p)
+		op.Inputs = append(op.Inputs, LotLink{Post: p.ID, Tag: p.Tag, Amount: i.Amount, Unit: unitOf(p), Op: op.ID, Kind: kind})
+	}
+	balance, err := s.balance.check(kind, in.Process, parents, in)
+	if err != nil {
+		return nil, nil, uploadErrorf(http.StatusBadRequest, "%s", err.Error())
+	}
+	op.Balance = balance
+	if len(balance.Problems) > 0 {
+		if s.balance.Mode == balanceReject {
+			return op, nil, uploadErrorf(http.StatusUnprocessableEntity, "mass balance exceeded")
+		}
+		balance.Flagged = true
+	}
+	for _, o := range in.Outputs {
+		if _, err := s.findPost(ctx, "tag", o.Tag); err == nil {
+			return nil, nil, uploadErrorf(http.StatusConflict, "tag %s is taken", o.Tag)
+		}
+	}
+
+	err = allocateInputs(op.Inputs, func(l LotLink) error {
+		return s.allocate(ctx, l.Post, l.Amount)
+	}, func(l LotLink) {
+		s.release(ctx, l.Post, l.Amount)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	children := s.balance.lotChildren(op, parents, in.Outputs)
+	var added []*Post
+	// undo gives the allocations back and removes the children added so
+	// far when a later step fails
+	undo := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		for _, l := range op.Inputs {
+			s.release(ctx, l.Post, l.Amount)
+		}
+		for _, c := range added {
+			s.db.DeleteOne(ctx, "bcposts", "_id", c.ID)
+			s.db.DeleteOne(ctx, "posts", "_id", c.ID)
+		}
+	}
+	for _, child := range children {
+		os.MkdirAll(child.Paperwork, 0777)
+		bc := &BCdataa{ID: child.ID, Tag: child.Tag, Name: child.Name, Factory: child.Factory, ImgHash: []string{}, Hash: []string{}}
+		if _, err := s.db.Add(ctx, "posts", child); err != nil {
+			undo()
+			if server.IsDuplicateKey(err) {
+				return nil, nil, uploadErrorf(http.StatusConflict, "tag %s is taken", child.Tag)
+			}
+			log.Println("err adding lot", child.Tag, err)
+			return nil, nil, err
+		}
+		added = append(added, child)
+		if _, err := s.db.Add(ctx, "bcposts", bc); err != nil {
+			log.Println("err adding lot", child.Tag, err)
+			undo()
+			return nil, nil, err
+		}
+		op.Outputs = append(op.Outputs, LotLink{Post: child.ID, Tag: child.Tag, Amount: child.Amount, Unit: child.Unit, Op: op.ID, Kind: kind})
+	}
+	if _, err := s.db.Add(ctx, "lots", op); err != nil {
+		log.Println("err recording lot operation", err)
+		undo()
+		return nil, nil, err
+	}
+	if balance.Flagged {
+		s.flagBalance(ctx, op)
+	}
+	return op, children, nil
+}
+
+func (s *service) splitLot(w http.ResponseWriter, r *http.Request) {
+	s.lotOperation(w, r, lotSplit)
+}
+
+func (s *service) mergeLots(w http.ResponseWriter, r *http.Request) {
+	s.lotOperation(w, r, lotMerge)
+}
+
+func (s *service) transformLots(w http.ResponseWriter, r *http.Request) {
+	s.lotOperation(w, r, lotTransform)
+}
+
+// LineageNode is a post reached from the root, Depth steps away.
+type LineageNode struct {
+	ID       primitive.ObjectID `json:"id"`
+	Tag      string             `json:"tag"`
+	Name     string             `json:"name"`
+	Farm     string             `json:"farm,omitempty"`
+	Factory  string             `json:"factory,omitempty"`
+	Market   string             `json:"market,omitempty"`
+	Amount   int                `json:"amount"`
+	Progress string             `json:"progress"`
+	Depth    int                `json:"depth"`
+}
+
+// LineageEdge says Amount of Parent went into Child.
+type LineageEdge struct {
+	Parent primitive.ObjectID `json:"parent"`
+	Child  primitive.ObjectID `json:"child"`
+	Amount int                `json:"amount"`
+	Kind   string             `json:"kind"`
+	Op     primitive.ObjectID `json:"op"`
+}
+
+// Lineage is the graph around a post with the parties found in it.
+type Lineage struct {
+	Root      primitive.ObjectID `json:"root"`
+	Nodes     []*LineageNode     `json:"nodes"`
+	Edges     []*LineageEdge     `json:"edges"`
+	Farms     []string           `json:"farms"`
+	Factories []string           `json:"factories"`
+	Markets   []string           `json:"markets"`
+}
+
+func lineageNode(p *Post, depth int) *LineageNode {
+	return &LineageNode{ID: p.ID, Tag: p.Tag, Name: p.Name, Farm: p.Farm, Factory: p.Factory, Market: p.Market, Amount: p.Amount, Progress: p.Progress, Depth: depth}
+}
+
+func (s *service) postsWhere(ctx context.Context, filter bson.M) ([]*Post, error) {
+	cur, err := s.db.QueryFilter(ctx, "posts", filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	var ret []*Post
+	for cur.Next(ctx) {
+		p := &Post{}
+		if err := cur.Decode(p); err != nil {
+			log.Println(err)
+			continue
+		}
+		ret = append(ret, p)
+	}
+	return ret, nil
+}
+
+// lineage walks up to the posts root was made from, down to the posts made
+// from it, or both, breadth first and at most depth steps. Upstream nodes
+// get negative depths.
+func (s *service) lineage(ctx context.Context, root *Post, up bool, down bool, depth int) (*Lineage, error) {
+	g := &Lineage{Root: root.ID, Nodes: []*LineageNode{lineageNode(root, 0)}, Edges: []*LineageEdge{}}
+	seen := map[primitive.ObjectID]bool{root.ID: true}
+	edges := map[string]bool{}
+	addEdge := func(l LotLink, child primitive.ObjectID) {
+		k := l.Post.Hex() + child.Hex() + l.Op.Hex()
+		if !edges[k] {
+			edges[k] = true
+			g.Edges = append(g.Edges, &LineageEdge{Parent: l.Post, Child: child, Amount: l.Amount, Kind: l.Kind, Op: l.Op})
+		}
+	}
+
+	if up {
+		frontier := []*Post{root}
+		for d := 1; d <= depth && len(frontier) > 0; d++ {
+			var ids bson.A
+			for _, p := range frontier {
+				for _, l := range p.Parents {
+					addEdge(l, p.ID)
+					if !seen[l.Post] {
+						seen[l.Post] = true
+						ids = append(ids, l.Post)
+					}
+				}
+			}
+			if len(ids) == 0 {
+				break
+			}
+			next, err := s.postsWhere(ctx, bson.M{"_id": bson.M{"$in": ids}})
+			if err != nil {
+				return nil, err
+			}
+			for _, p := range next {
+				g.Nodes = append(g.Nodes, lineageNode(p, -d))
+			}
+			frontier = next
+		}
+	}
+	if down {
+		frontier := []primitive.ObjectID{root.ID}
+		for d := 1; d <= depth && len(frontier) > 0; d++ {
+			ids := bson.A{}
+			for _, id := range frontier {
+				ids = append(ids, id)
+			}
+			children, err := s.postsWhere(ctx, bson.M{"parents.post": bson.M{"$in": ids}})
+			if err != nil {
+				return nil, err
+			}
+			parent := map[primitive.ObjectID]bool{}
+			for _, id := range frontier {
+				parent[id] = true
+			}
+			frontier = nil
+			for _, c := range children {
+				for _, l := range c.Parents {
+					if parent[l.Post] {
+						addEdge(l, c.ID)
+					}
+				}
+				if !seen[c.ID] {
+					seen[c.ID] = true
+					g.Nodes = append(g.Nodes, lineageNode(c, d))
+					frontier = append(frontier, c.ID)
+				}
+			}
+		}
+	}
+
+	farms, factories, markets := map[string]bool{}, map[string]bool{}, map[string]bool{}
+	g.Farms, g.Factories, g.Markets = []string{}, []string{}, []string{}
+	for _, n := range g.Nodes {
+		if n.Farm != "" && !farms[n.Farm] {
+			farms[n.Farm] = true
+			g.Farms = append(g.Farms, n.Farm)
+		}
+		if n.Factory != "" && !factories[n.Factory] {
+			factories[n.Factory] = true
+			g.Factories = append(g.Factories, n.Factory)
+		}
+		if n.Market != "" && !markets[n.Market] {
+			markets[n.Market] = true
+			g.Markets = append(g.Markets, n.Market)
+		}
+	}
+	return g, nil
+}
+
+// postLineage answers GET /post/{id}/lineage. ?direction= is up (what fed
+// this lot), down (where it went) or both, ?depth= limits the steps.
+func (s *service) postLineage(w http.ResponseWriter, r *http.Request) {
+	p, ok := s.postFromVars(w, r)
+	if !ok {
+		return
+	}
+	up, down := true, true
+	switch r.URL.Query().Get("direction") {
+	case "up":
+		down = false
+	case "down":
+		up = false
+	case "", "both":
+	default:
+		writeMessage(w, http.StatusBadRequest, "direction must be up, down or both")
+		return
+	}
+	depth := maxLineageDepth
+	if v := r.URL.Query().Get("depth"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeMessage(w, http.StatusBadRequest, "depth must be a positive number")
+			return
+		}
+		if n < depth {
+			depth = n
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	g, err := s.lineage(ctx, p, up, down, depth)
+	if err != nil {
+		log.Println("err walking lineage", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(g)
+}
+
+// ensureLotIndex makes downstream lookups by parent cheap, and keeps two
+// posts from taking the same tag when they are added at once. Packing,
+// allocation and EPCIS capture rely on that, so posts already sharing a
+// tag stop the service until they are told apart.
+func (s *service) ensureLotIndex() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if _, err := s.db.CreateUniqueIndex(ctx, "posts", bson.M{"tag": 1}); err != nil {
+		return fmt.Errorf("making tags unique, are some taken twice? %v", err)
+	}
+	_, err := s.db.CreateIndex(ctx, "posts", bson.M{"parents.post": 1})
+	return err
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestCheckLotShape(t *testing.T) {
+	in := func(amounts ...int) []LotInput {
+		var ret []LotInput
+		for _, a := range amounts {
+			ret = append(ret, LotInput{Post: primitive.NewObjectID().Hex(), Amount: a})
+		}
+		return ret
+	}
+	out := func(tag string, amount int) LotOutput {
+		return LotOutput{Tag: tag, Amount: amount}
+	}
+	a, b := "FARM00000017", "(01)09506000134352(10)A1"
+	tests := []struct {
+		name string
+		kind string
+		in   *lotRequest
+		err  bool
+	}{
+		{"split", lotSplit, &lotRequest{Inputs: in(10), Outputs: []LotOutput{out(a, 4), out(b, 6)}}, false},
+		{"split into one", lotSplit, &lotRequest{Inputs: in(10), Outputs: []LotOutput{out(a, 10)}}, true},
+		{"split of two", lotSplit, &lotRequest{Inputs: in(5, 5), Outputs: []LotOutput{out(a, 4), out(b, 6)}}, true},
+		{"merge", lotMerge, &lotRequest{Inputs: in(5, 5), Outputs: []LotOutput{out(a, 10)}}, false},
+		{"merge of one", lotMerge, &lotRequest{Inputs: in(10), Outputs: []LotOutput{out(a, 10)}}, true},
+		{"merge into two", lotMerge, &lotRequest{Inputs: in(5, 5), Outputs: []LotOutput{out(a, 4), out(b, 6)}}, true},
+		{"transform", lotTransform, &lotRequest{Inputs: in(10), Outputs: []LotOutput{out(a, 3)}}, false},
+		{"transform into two", lotTransform, &lotRequest{Inputs: in(10), Outputs: []LotOutput{out(a, 3), out(b, 3)}}, true},
+		{"no inputs", lotTransform, &lotRequest{Outputs: []LotOutput{out(a, 3)}}, true},
+		{"no outputs", lotTransform, &lotRequest{Inputs: in(10)}, true},
+		{"empty input", lotMerge, &lotRequest{Inputs: in(5, 0), Outputs: []LotOutput{out(a, 5)}}, true},
+		{"empty output", lotSplit, &lotRequest{Inputs: in(10), Outputs: []LotOutput{out(a, 10), out(b, 0)}}, true},
+		{"same tag twice", lotSplit, &lotRequest{Inputs: in(10), Outputs: []LotOutput{out(a, 4), out(a, 6)}}, true},
+		{"bad check digit", lotTransform, &lotRequest{Inputs: in(10), Outputs: []LotOutput{out("FARM00000018", 3)}}, true},
+	}
+	for _, tt := range tests {
+		if err := checkLotShape(tt.kind, tt.in); (err != nil) != tt.err {
+			t.Errorf("%s: checkLotShape = %v", tt.name, err)
+		}
+	}
+}
+
+func TestAllocateInputs(t *testing.T) {
+	inputs := []LotLink{{Tag: "a", Amount: 1}, {Tag: "b", Amount: 2}, {Tag: "c", Amount: 3}}
+	tests := []struct {
+		name     string
+		fail     string
+		released []string
+	}{
+		{"all allocated", "", nil},
+		{"first short", "a", nil},
+		{"second short", "b", []string{"a"}},
+		{"last short", "c", []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		var allocated, released []string
+		err := allocateInputs(inputs, func(l LotLink) error {
+			if l.Tag == tt.fail {
+				return errors.New("not enough left")
+			}
+			allocated = append(allocated, l.Tag)
+			return nil
+		}, func(l LotLink) {
+			released = append(released, l.Tag)
+		})
+		if (err != nil) != (tt.fail != "") {
+			t.Errorf("%s: allocateInputs = %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(released, tt.released) {
+			t.Errorf("%s: released %v, want %v", tt.name, released, tt.released)
+		}
+		if tt.fail != "" && !reflect.DeepEqual(allocated, released) {
+			t.Errorf("%s: allocated %v but released %v", tt.name, allocated, released)
+		}
+	}
+}
+
+func TestLotChildren(t *testing.T) {
+	mb := newMassBalance()
+	parent := func(amount int, unit, progress, farm, cert string) *Post {
+		return &Post{ID: primitive.NewObjectID(), User: "ann", Amount: amount, Unit: unit, Progress: progress, Farm: farm, Certification: cert}
+	}
+	op := func(kind string, parents ...*Post) *LotOperation {
+		o := &LotOperation{Kind: kind, Date: "Mon Mar  2 09:00:00 2026"}
+		for _, p := range parents {
+			o.Inputs = append(o.Inputs, LotLink{Post: p.ID, Amount: p.Amount, Unit: unitOf(p), Kind: kind})
+		}
+		return o
+	}
+	tests := []struct {
+		name     string
+		parents  []*Post
+		kind     string
+		outputs  []LotOutput
+		draws    [][]int
+		unit     string
+		progress string
+		farm     string
+		cert     string
+	}{
+		{"split in the parent's unit", []*Post{parent(10, "kg", "harvested", "f1", "organic")}, lotSplit,
+			[]LotOutput{{Tag: "a", Amount: 4}, {Tag: "b", Amount: 6}}, [][]int{{4}, {6}}, "kg", "harvested", "f1", "organic"},
+		{"split into grams", []*Post{parent(10, "kg", "", "", "")}, lotSplit,
+			[]LotOutput{{Tag: "a", Amount: 4000, Unit: "g"}, {Tag: "b", Amount: 6, Unit: "kg"}}, [][]int{{4}, {6}}, "g", "", "", ""},
+		{"merge draws every input whole", []*Post{parent(5, "", "dried", "f1", "organic"), parent(7, "", "dried", "f2", "organic")}, lotMerge,
+			[]LotOutput{{Tag: "a", Amount: 12}}, [][]int{{5, 7}}, "kg", "dried", "", "organic"},
+		{"merge of mixed stages and classes", []*Post{parent(5, "", "dried", "f1", "organic"), parent(7, "", "harvested", "f1", "")}, lotMerge,
+			[]LotOutput{{Tag: "a", Amount: 12}}, [][]int{{5, 7}}, "kg", "", "f1", ""},
+		{"transform names its own class", []*Post{parent(100, "", "harvested", "f1", "")}, lotTransform,
+			[]LotOutput{{Tag: "a", Amount: 30, Certification: "organic"}}, [][]int{{100}}, "kg", "harvested", "f1", "organic"},
+	}
+	for _, tt := range tests {
+		o := op(tt.kind, tt.parents...)
+		children := mb.lotChildren(o, tt.parents, tt.outputs)
+		if len(children) != len(tt.outputs) {
+			t.Errorf("%s: %d children, want %d", tt.name, len(children), len(tt.outputs))
+			continue
+		}
+		for n, c := range children {
+			var draws []int
+			for i, l := range c.Parents {
+				draws = append(draws, l.Amount)
+				if l.Post != tt.parents[i].ID {
+					t.Errorf("%s: child %d links to %s, want %s", tt.name, n, l.Post.Hex(), tt.parents[i].ID.Hex())
+				}
+			}
+			if !reflect.DeepEqual(draws, tt.draws[n]) {
+				t.Errorf("%s: child %d draws %v, want %v", tt.name, n, draws, tt.draws[n])
+			}
+			if c.Tag != tt.outputs[n].Tag || c.User != "ann" || c.Date != o.Date || c.Paperwork != "file/"+c.Tag+"/" {
+				t.Errorf("%s: child %d is %+v", tt.name, n, c)
+			}
+		}
+		c := children[0]
+		if c.Unit != tt.unit || c.Progress != tt.progress || c.Farm != tt.farm || c.Certification != tt.cert {
+			t.Errorf("%s: unit %q progress %q farm %q class %q; want %q %q %q %q", tt.name, c.Unit, c.Progress, c.Farm, c.Certification, tt.unit, tt.progress, tt.farm, tt.cert)
+		}
+	}
+	// the split must not have changed what the operation records
+	o := op(lotSplit, parent(10, "kg", "", "", ""))
+	mb.lotChildren(o, []*Post{parent(10, "kg", "", "", "")}, []LotOutput{{Tag: "a", Amount: 4}, {Tag: "b", Amount: 6}})
+	if o.Inputs[0].Amount != 10 {
+		t.Errorf("split changed the operation's input to %d", o.Inputs[0].Amount)
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	alertMassBalance = "massbalance"
+
+	balanceReject = "reject"
+	balanceFlag   = "flag"
+
+	// defaultUnit is what amounts recorded before units existed are in.
+	defaultUnit = "kg"
+)
+
+// Unit converts to the base of its dimension: kg for mass, pcs for counts.
+type Unit struct {
+	Dimension string  `json:"dimension"`
+	Factor    float64 `json:"factor"`
+}
+
+var baseUnits = map[string]string{"mass": "kg", "count": "pcs"}
+
+// Yield bounds how much output a process may make from its input, as a
+// fraction of the input.
+type Yield struct {
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+}
+
+// balanceEpsilon is how far a split or merge may drift from an exact
+// balance, which is only ever float rounding.
+const balanceEpsilon = 1e-9
+
+// massBalance is loaded from MASS_BALANCE_CONFIG (default
+// massbalance.json), which can set the mode, the tolerance, and add or
+// override units and yields. The tolerance applies to transform yields.
+type massBalance struct {
+	Mode      string           `json:"mode"`
+	Tolerance float64          `json:"tolerance"`
+	Units     map[string]Unit  `json:"units"`
+	Yields    map[string]Yield `json:"yields"`
+}
+
+func newMassBalance() *massBalance {
+	mb := &massBalance{
+		Mode:      balanceReject,
+		Tolerance: 0.01,
+		Units: map[string]Unit{
+			"g":     {"mass", 0.001},
+			"kg":    {"mass", 1},
+			"t":     {"mass", 1000},
+			"lb":    {"mass", 0.45359237},
+			"jin":   {"mass", 0.6},
+			"pcs":   {"count", 1},
+			"dozen": {"count", 12},
+		},
+		Yields: map[string]Yield{
+			"":        {0, 1},
+			"washing": {0.85, 1},
+			"sorting": {0.6, 1},
+			"drying":  {0.1, 0.35},
+			"hulling": {0.6, 0.8},
+			"milling": {0.6, 0.75},
+			"juicing": {0.3, 0.7},
+			"packing": {0.95, 1},
+		},
+	}
+	path := os.Getenv("MASS_BALANCE_CONFIG")
+	if path == "" {
+		path = "massbalance.json"
+	}
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		return mb
+	}
+	conf := &massBalance{}
+	if err := json.Unmarshal(d, conf); err != nil {
+		log.Println("err parsing", path, err)
+		return mb
+	}
+	if conf.Mode == balanceReject || conf.Mode == balanceFlag {
+		mb.Mode = conf.Mode
+	}
+	if conf.Tolerance > 0 {
+		mb.Tolerance = conf.Tolerance
+	}
+	for k, u := range conf.Units {
+		if baseUnits[u.Dimension] != "" && u.Factor > 0 {
+			mb.Units[k] = u
+		}
+	}
+	for k, y := range conf.Yields {
+		if y.Max > 0 && y.Min <= y.Max {
+			mb.Yields[k] = y
+		}
+	}
+	return mb
+}
+
+func unitOf(p *Post) string {
+	if p.Unit == "" {
+		return defaultUnit
+	}
+	return p.Unit
+}
+
+// base converts amount of unit to its dimension's base.
+func (mb *massBalance) base(amount int, unit string) (float64, string, error) {
+	u, ok := mb.Units[unit]
+	if !ok {
+		return 0, "", fmt.Errorf("unknown unit %s", unit)
+	}
+	return float64(amount) * u.Factor, u.Dimension, nil
+}
+
+// BalanceCheck is how an operation's quantities came out. Problems are
+// what would make it over-claim; they reject the operation or, in flag
+// mode, raise an alert.
+type BalanceCheck struct {
+	Process  string   `json:"process,omitempty" bson:"process,omitempty"`
+	Unit     string   `json:"unit" bson:"unit"`
+	Input    float64  `json:"input" bson:"input"`
+	Output   float64  `json:"output" bson:"output"`
+	Ratio    float64  `json:"ratio" bson:"ratio"`
+	Yield    Yield    `json:"yield" bson:"yield"`
+	Problems []string `json:"problems,omitempty" bson:"problems,omitempty"`
+	Notes    []string `json:"notes,omitempty" bson:"notes,omitempty"`
+	Flagged  bool     `json:"flagged,omitempty" bson:"flagged,omitempty"`
+}
+
+// commonCertification is the class every parent holds, or "".
+func commonCertification(parents []*Post) string {
+	c := parents[0].Certification
+	for _, p := range parents[1:] {
+		if p.Certification != c {
+			return ""
+		}
+	}
+	return c
+}
+
+// check weighs an operation's outputs against its inputs. Splits and
+// merges have to balance exactly; a transform has to stay within the
+// yield of its process. An output can only claim a certification class
+// every input holds.
+func (mb *massBalance) check(kind string, process string, parents []*Post, in *lotRequest) (*BalanceCheck, error) {
+	c := &BalanceCheck{Process: process}
+	y, ok := mb.Yields[process]
+	tol := mb.Tolerance
+	if kind != lotTransform {
+		// only leave room for unit conversion rounding
+		y, tol = Yield{1, 1}, balanceEpsilon
+	} else if !ok {
+		return nil, fmt.Errorf("unknown process %q", process)
+	}
+	c.Yield = y
+
+	dim := ""
+	for n, i := range in.Inputs {
+		b, d, err := mb.base(i.Amount, unitOf(parents[n]))
+		if err != nil {
+			return nil, err
+		}
+		if dim != "" && d != dim {
+			return nil, fmt.Errorf("inputs mix %s and %s", dim, d)
+		}
+		dim = d
+		c.Input += b
+	}
+	for _, o := range in.Outputs {
+		unit := o.Unit
+		if unit == "" {
+			unit = unitOf(parents[0])
+		}
+		b, d, err := mb.base(o.Amount, unit)
+		if err != nil {
+			return nil, err
+		}
+		if d != dim {
+			return nil, fmt.Errorf("cannot make %s from %s", d, dim)
+		}
+		c.Output += b
+	}
+	c.Unit = baseUnits[dim]
+	c.Ratio = c.Output / c.Input
+
+	if c.Ratio > y.Max*(1+tol) {
+		c.Problems = append(c.Problems, fmt.Sprintf("%.3f %s out of %.3f %s is more than the %.0f%% yield allowed", c.Output, c.Unit, c.Input, c.Unit, y.Max*100))
+	}
+	if c.Ratio < y.Min*(1-tol) {
+		c.Notes = append(c.Notes, fmt.Sprintf("yield %.0f%% is below the usual %.0f%%", c.Ratio*100, y.Min*100))
+	}
+	held := commonCertification(parents)
+	for _, o := range in.Outputs {
+		if o.Certification != "" && o.Certification != held {
+			c.Problems = append(c.Problems, fmt.Sprintf("%s claims %s but not every input is %s", o.Tag, o.Certification, o.Certification))
+		}
+	}
+	return c, nil
+}
+
+// flagBalance raises an alert for an operation let through in flag mode.
+func (s *service) flagBalance(ctx context.Context, op *LotOperation) {
+	var tags []string
+	for _, l := range append(append([]LotLink{}, op.Inputs...), op.Outputs...) {
+		tags = append(tags, l.Tag)
+	}
+	a := &FraudAlert{
+		ID:     primitive.NewObjectID(),
+		Kind:   alertMassBalance,
+		Date:   op.Date,
+		Reason: op.Kind + ": " + strings.Join(op.Balance.Problems, "; "),
+		Tags:   tags,
+		Images: []*PhotoHash{},
+	}
+	if _, err := s.db.Add(ctx, "alerts", a); err != nil {
+		log.Println("err raising mass balance alert", err)
+	}
+}
+
+// ClassBalance is the running balance of one certification class in one
+// dimension. Origin is what entered as lots of their own, such as
+// harvests; Derived is what lot operations made; Consumed is what those
+// operations drew; Available is what is left to draw.
+type ClassBalance struct {
+	Class     string  `json:"class"`
+	Unit      string  `json:"unit"`
+	Lots      int     `json:"lots"`
+	Origin    float64 `json:"origin"`
+	Derived   float64 `json:"derived"`
+	Consumed  float64 `json:"consumed"`
+	Available float64 `json:"available"`
+	Flagged   int     `json:"flagged"`
+}
+
+// balanceReport answers GET /massbalance with one running balance per
+// certification class, narrowed by ?class= and ?factory=.
+func (s *service) balanceReport(w http.ResponseWriter, r *http.Request) {
+	filter := bson.M{}
+	if c := r.URL.Query().Get("class"); c != "" {
+		filter["certification"] = c
+	}
+	if f := r.URL.Query().Get("factory"); f != "" {
+		filter["factory"] = f
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	posts, err := s.postsWhere(ctx, filter)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	classes := map[string]*ClassBalance{}
+	class := map[string]string{}
+	for _, p := range posts {
+		amount, dim, err := s.balance.base(p.Amount, unitOf(p))
+		if err != nil {
+			log.Println("err in balance of", p.Tag, err)
+			continue
+		}
+		allocated, _, _ := s.balance.base(p.Allocated, unitOf(p))
+		key := p.Certification + "/" + dim
+		b := classes[key]
+		if b == nil {
+			b = &ClassBalance{Class: p.Certification, Unit: baseUnits[dim]}
+			classes[key] = b
+		}
+		class[p.Tag] = key
+		b.Lots++
+		if len(p.Parents) == 0 {
+			b.Origin += amount
+		} else {
+			b.Derived += amount
+		}
+		b.Consumed += allocated
+		b.Available += amount - allocated
+	}
+
+	cur, err := s.db.QueryFilter(ctx, "lots", bson.M{"balance.flagged": true})
+	if err == nil {
+		for cur.Next(ctx) {
+			op := &LotOperation{}
+			if err := cur.Decode(op); err != nil {
+				continue
+			}
+			for _, o := range op.Outputs {
+				if b := classes[class[o.Tag]]; b != nil {
+					b.Flagged++
+				}
+			}
+		}
+		cur.Close(ctx)
+	}
+
+	ret := []*ClassBalance{}
+	for _, b := range classes {
+		b.Origin, b.Derived = math.Round(b.Origin*1000)/1000, math.Round(b.Derived*1000)/1000
+		b.Consumed, b.Available = math.Round(b.Consumed*1000)/1000, math.Round(b.Available*1000)/1000
+		ret = append(ret, b)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Class != ret[j].Class {
+			return ret[i].Class < ret[j].Class
+		}
+		return ret[i].Unit < ret[j].Unit
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"mode": s.balance.Mode, "classes": ret})
+}
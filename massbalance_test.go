@@ -0,0 +1,59 @@
+package main
+
+import "testing"
+
+func TestMassBalanceCheck(t *testing.T) {
+	mb := newMassBalance()
+	mb.Tolerance = 0.01
+	post := func(amount int, unit string, cert string) *Post {
+		return &Post{Amount: amount, Unit: unit, Certification: cert}
+	}
+	out := func(amount int, unit string, cert string) LotOutput {
+		return LotOutput{Tag: "out", Amount: amount, Unit: unit, Certification: cert}
+	}
+	tests := []struct {
+		name     string
+		kind     string
+		process  string
+		parents  []*Post
+		inputs   []int
+		outputs  []LotOutput
+		err      bool
+		problems int
+		notes    int
+	}{
+		{"split exactly", lotSplit, "", []*Post{post(100, "", "")}, []int{100}, []LotOutput{out(60, "", ""), out(40, "", "")}, false, 0, 0},
+		{"split under", lotSplit, "", []*Post{post(100, "", "")}, []int{100}, []LotOutput{out(60, "", ""), out(39, "", "")}, false, 0, 1},
+		{"split over by 1%", lotSplit, "", []*Post{post(100, "", "")}, []int{100}, []LotOutput{out(60, "", ""), out(41, "", "")}, false, 1, 0},
+		{"split in pounds", lotSplit, "", []*Post{post(10, "lb", "")}, []int{10}, []LotOutput{out(3, "", ""), out(7, "", "")}, false, 0, 0},
+		{"merge across units", lotMerge, "", []*Post{post(50, "kg", ""), post(50000, "g", "")}, []int{50, 50000}, []LotOutput{out(100, "kg", "")}, false, 0, 0},
+		{"merge over", lotMerge, "", []*Post{post(50, "kg", ""), post(50000, "g", "")}, []int{50, 50000}, []LotOutput{out(101, "kg", "")}, false, 1, 0},
+		{"merge mixing dimensions", lotMerge, "", []*Post{post(50, "kg", ""), post(12, "pcs", "")}, []int{50, 12}, []LotOutput{out(60, "kg", "")}, true, 0, 0},
+		{"count from mass", lotSplit, "", []*Post{post(50, "kg", "")}, []int{50}, []LotOutput{out(50, "pcs", "")}, true, 0, 0},
+		{"unknown unit", lotSplit, "", []*Post{post(50, "bushel", "")}, []int{50}, []LotOutput{out(50, "kg", "")}, true, 0, 0},
+		{"unknown process", lotTransform, "roasting", []*Post{post(100, "", "")}, []int{100}, []LotOutput{out(80, "", "")}, true, 0, 0},
+		{"drying within yield", lotTransform, "drying", []*Post{post(1000, "", "")}, []int{1000}, []LotOutput{out(300, "", "")}, false, 0, 0},
+		{"drying within tolerance", lotTransform, "drying", []*Post{post(1000, "", "")}, []int{1000}, []LotOutput{out(353, "", "")}, false, 0, 0},
+		{"drying over yield", lotTransform, "drying", []*Post{post(1000, "", "")}, []int{1000}, []LotOutput{out(360, "", "")}, false, 1, 0},
+		{"drying below yield", lotTransform, "drying", []*Post{post(1000, "", "")}, []int{1000}, []LotOutput{out(50, "", "")}, false, 0, 1},
+		{"certified from certified", lotMerge, "", []*Post{post(10, "", "organic"), post(10, "", "organic")}, []int{10, 10}, []LotOutput{out(20, "", "organic")}, false, 0, 0},
+		{"certified from mixed", lotMerge, "", []*Post{post(10, "", "organic"), post(10, "", "")}, []int{10, 10}, []LotOutput{out(20, "", "organic")}, false, 1, 0},
+	}
+	for _, tt := range tests {
+		in := &lotRequest{Outputs: tt.outputs, Process: tt.process}
+		for _, a := range tt.inputs {
+			in.Inputs = append(in.Inputs, LotInput{Amount: a})
+		}
+		c, err := mb.check(tt.kind, tt.process, tt.parents, in)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: err = %v", tt.name, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if len(c.Problems) != tt.problems || len(c.Notes) != tt.notes {
+			t.Errorf("%s: problems %q notes %q, want %d and %d", tt.name, c.Problems, c.Notes, tt.problems, tt.notes)
+		}
+	}
+}
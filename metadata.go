@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+	"github.com/rwcarlsen/goexif/mknote"
+	"github.com/rwcarlsen/goexif/tiff"
+)
+
+// Tags goexif does not know about. OffsetTime* are EXIF 2.31 and
+// GPSHPositioningError is EXIF 2.31 GPS tag 0x1f.
+const (
+	offsetTime           exif.FieldName = "OffsetTime"
+	offsetTimeOriginal   exif.FieldName = "OffsetTimeOriginal"
+	gpsHPositioningError exif.FieldName = "GPSHPositioningError"
+)
+
+// Reasons recorded in PhotoMeta.Missing.
+const (
+	missingNoExif    = "no EXIF data in image"
+	missingNotTagged = "tag not present"
+	missingBadValue  = "tag present but unreadable"
+)
+
+// typical user equivalent range error in metres, used to turn GPSDOP into
+// an accuracy estimate when the camera does not record one directly
+const gpsUERE = 5.0
+
+var errNotImage = errors.New("file is not a supported image")
+
+type exif231 struct{}
+
+func (exif231) Parse(x *exif.Exif) error {
+	loadExtraDir(x, exif.ExifIFDPointer, map[uint16]exif.FieldName{0x9010: offsetTime, 0x9011: offsetTimeOriginal})
+	loadExtraDir(x, exif.GPSInfoIFDPointer, map[uint16]exif.FieldName{0x001f: gpsHPositioningError})
+	return nil
+}
+
+func loadExtraDir(x *exif.Exif, ptr exif.FieldName, fields map[uint16]exif.FieldName) {
+	tag, err := x.Get(ptr)
+	if err != nil {
+		return
+	}
+	offset, err := tag.Int64(0)
+	if err != nil {
+		return
+	}
+	r := bytes.NewReader(x.Raw)
+	if _, err := r.Seek(offset, 0); err != nil {
+		return
+	}
+	dir, _, err := tiff.DecodeDir(r, x.Tiff.Order)
+	if err != nil {
+		return
+	}
+	x.LoadTags(dir, fields, false)
+}
+
+func init() {
+	exif.RegisterParsers(mknote.All...)
+	exif.RegisterParsers(exif231{})
+}
+
+type GPSFix struct {
+	Lat            float64  `json:"lat" bson:"lat"`
+	Long           float64  `json:"long" bson:"long"`
+	Altitude       *float64 `json:"altitude,omitempty" bson:"altitude,omitempty"`
+	Accuracy       *float64 `json:"accuracy,omitempty" bson:"accuracy,omitempty"`
+	AccuracySource string   `json:"accuracysource,omitempty" bson:"accuracysource,omitempty"`
+}
+
+// CaptureTime keeps the wall clock reading from the camera. Time is only
+// an absolute instant when Offset is known.
+type CaptureTime struct {
+	Local        string     `json:"local" bson:"local"`
+	Offset       string     `json:"offset,omitempty" bson:"offset,omitempty"`
+	OffsetSource string     `json:"offsetsource,omitempty" bson:"offsetsource,omitempty"`
+	Time         *time.Time `json:"time,omitempty" bson:"time,omitempty"`
+}
+
+type Camera struct {
+	Make  string `json:"make,omitempty" bson:"make,omitempty"`
+	Model string `json:"model,omitempty" bson:"model,omitempty"`
+}
+
+type Heading struct {
+	Degrees float64 `json:"degrees" bson:"degrees"`
+	Ref     string  `json:"ref,omitempty" bson:"ref,omitempty"`
+}
+
+// PhotoMeta is what we could learn from an upload's EXIF. Every field is
+// optional; when one is nil the reason is in Missing under its json name.
+type PhotoMeta struct {
+	GPS         *GPSFix           `json:"gps,omitempty" bson:"gps,omitempty"`
+	Captured    *CaptureTime      `json:"captured,omitempty" bson:"captured,omitempty"`
+	Camera      *Camera           `json:"camera,omitempty" bson:"camera,omitempty"`
+	Orientation *int              `json:"orientation,omitempty" bson:"orientation,omitempty"`
+	FocalLength *float64          `json:"focallength,omitempty" bson:"focallength,omitempty"`
+	Heading     *Heading          `json:"heading,omitempty" bson:"heading,omitempty"`
+	Missing     map[string]string `json:"missing,omitempty" bson:"missing,omitempty"`
+}
+
+func (m *PhotoMeta) missing(field string, reason string) {
+	if m.Missing == nil {
+		m.Missing = map[string]string{}
+	}
+	m.Missing[field] = reason
+}
+
+func tagReason(err error) string {
+	if exif.IsTagNotPresentError(err) {
+		return missingNotTagged
+	}
+	return missingBadValue
+}
+
+func ratAt(x *exif.Exif, name exif.FieldName, i int) (float64, error) {
+	tag, err := x.Get(name)
+	if err != nil {
+		return 0, err
+	}
+	num, den, err := tag.Rat2(i)
+	if err != nil {
+		return 0, err
+	}
+	if den == 0 {
+		return 0, fmt.Errorf("%s has zero denominator", name)
+	}
+	return float64(num) / float64(den), nil
+}
+
+func stringTag(x *exif.Exif, name exif.FieldName) (string, error) {
+	tag, err := x.Get(name)
+	if err != nil {
+		return "", err
+	}
+	v, err := tag.StringVal()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(strings.TrimRight(v, "\x00")), nil
+}
+
+// ExtractMeta reads an uploaded photo. It only fails when the bytes are not
+// an image at all; a photo without EXIF yields a PhotoMeta whose fields are
+// all missing.
+func ExtractMeta(r io.Reader) (*PhotoMeta, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := image.DecodeConfig(bytes.NewReader(data)); err != nil {
+		return nil, errNotImage
+	}
+
+	m := &PhotoMeta{}
+	x, err := exif.Decode(bytes.NewReader(data))
+	if err != nil && (x == nil || exif.IsCriticalError(err)) {
+		for _, f := range []string{"gps", "captured", "camera", "orientation", "focallength", "heading"} {
+			m.missing(f, missingNoExif)
+		}
+		return m, nil
+	}
+
+	m.extractGPS(x)
+	m.extractCaptured(x)
+	m.extractCamera(x)
+
+	if tag, err := x.Get(exif.Orientation); err != nil {
+		m.missing("orientation", tagReason(err))
+	} else if o, err := tag.Int(0); err != nil || o < 1 || o > 8 {
+		m.missing("orientation", missingBadValue)
+	} else {
+		m.Orientation = &o
+	}
+
+	if f, err := ratAt(x, exif.FocalLength, 0); err != nil {
+		m.missing("focallength", tagReason(err))
+	} else {
+		m.FocalLength = &f
+	}
+
+	if d, err := ratAt(x, exif.GPSImgDirection, 0); err != nil {
+		m.missing("heading", tagReason(err))
+	} else {
+		ref, _ := stringTag(x, exif.GPSImgDirectionRef)
+		m.Heading = &Heading{Degrees: math.Mod(d, 360), Ref: ref}
+	}
+	return m, nil
+}
+
+func (m *PhotoMeta) extractGPS(x *exif.Exif) {
+	lat, long, err := x.LatLong()
+	if err != nil {
+		m.missing("gps", tagReason(err))
+		return
+	}
+	if math.IsNaN(lat) || math.IsNaN(long) || (lat == 0 && long == 0) {
+		m.missing("gps", missingBadValue)
+		return
+	}
+	g := &GPSFix{Lat: lat, Long: long}
+	if alt, err := ratAt(x, exif.GPSAltitude, 0); err == nil {
+		if tag, err := x.Get(exif.GPSAltitudeRef); err == nil {
+			if ref, err := tag.Int(0); err == nil && ref == 1 {
+				alt = -alt
+			}
+		}
+		g.Altitude = &alt
+	}
+	if acc, err := ratAt(x, gpsHPositioningError, 0); err == nil {
+		g.Accuracy = &acc
+		g.AccuracySource = "hpositioningerror"
+	} else if dop, err := ratAt(x, exif.GPSDOP, 0); err == nil {
+		acc := dop * gpsUERE
+		g.Accuracy = &acc
+		g.AccuracySource = "dop"
+	}
+	m.GPS = g
+}
+
+func (m *PhotoMeta) extractCaptured(x *exif.Exif) {
+	raw, err := stringTag(x, exif.DateTimeOriginal)
+	if err != nil {
+		raw, err = stringTag(x, exif.DateTime)
+	}
+	if err != nil {
+		m.missing("captured", tagReason(err))
+		return
+	}
+	local, err := time.Parse("2006:01:02 15:04:05", raw)
+	if err != nil {
+		m.missing("captured", missingBadValue)
+		return
+	}
+	c := &CaptureTime{Local: local.Format("2006-01-02T15:04:05")}
+
+	var zone *time.Location
+	if off, err := stringTag(x, offsetTimeOriginal); err == nil {
+		if t, err := time.Parse("-07:00", off); err == nil {
+			zone = t.Location()
+			c.OffsetSource = "exif"
+		}
+	}
+	if zone == nil {
+		if tz, err := x.TimeZone(); err == nil {
+			zone = tz
+			c.OffsetSource = "makernote"
+		}
+	}
+	if zone == nil {
+		if utc, err := gpsTime(x); err == nil {
+			// round to the nearest quarter hour, the finest real offset
+			diff := local.Sub(utc).Round(15 * time.Minute)
+			if diff >= -14*time.Hour && diff <= 14*time.Hour {
+				zone = time.FixedZone("", int(diff.Seconds()))
+				c.OffsetSource = "gps"
+			}
+		}
+	}
+	if zone != nil {
+		t := time.Date(local.Year(), local.Month(), local.Day(), local.Hour(), local.Minute(), local.Second(), 0, zone)
+		c.Offset = t.Format("-07:00")
+		utc := t.UTC()
+		c.Time = &utc
+	}
+	m.Captured = c
+}
+
+// gpsTime is the UTC time of the GPS fix.
+func gpsTime(x *exif.Exif) (time.Time, error) {
+	ds, err := stringTag(x, exif.GPSDateStamp)
+	if err != nil {
+		return time.Time{}, err
+	}
+	day, err := time.Parse("2006:01:02", ds)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var hms [3]float64
+	for i := range hms {
+		if hms[i], err = ratAt(x, exif.GPSTimeStamp, i); err != nil {
+			return time.Time{}, err
+		}
+	}
+	d := time.Duration((hms[0]*3600 + hms[1]*60 + hms[2]) * float64(time.Second))
+	return day.Add(d), nil
+}
+
+func (m *PhotoMeta) extractCamera(x *exif.Exif) {
+	mk, err1 := stringTag(x, exif.Make)
+	model, err2 := stringTag(x, exif.Model)
+	if err1 != nil && err2 != nil {
+		m.missing("camera", tagReason(err1))
+		return
+	}
+	m.Camera = &Camera{Make: mk, Model: model}
+}
@@ -0,0 +1,590 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	oidcStateTTL = 10 * time.Minute
+	oidcJWKSTTL  = time.Hour
+	oidcLeeway   = time.Minute
+)
+
+// oidcProvider is one partner identity provider, read from OIDC_CONFIG.
+// IdentityMap translates values of IdentityClaim into User.Identity.
+type oidcProvider struct {
+	Name            string            `json:"name"`
+	Issuer          string            `json:"issuer"`
+	ClientID        string            `json:"clientid"`
+	ClientSecret    string            `json:"clientsecret"`
+	RedirectURL     string            `json:"redirecturl"`
+	Scopes          []string          `json:"scopes"`
+	IdentityClaim   string            `json:"identityclaim"`
+	IdentityMap     map[string]string `json:"identitymap"`
+	DefaultIdentity string            `json:"defaultidentity"`
+	DepartmentClaim string            `json:"departmentclaim"`
+	PostLoginURL    string            `json:"postloginurl"`
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]crypto.PublicKey
+	keysAt    time.Time
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcPending struct {
+	provider string
+	verifier string
+	nonce    string
+	expires  time.Time
+}
+
+type oidcRegistry struct {
+	providers map[string]*oidcProvider
+	client    *http.Client
+
+	mu      sync.Mutex
+	pending map[string]*oidcPending
+}
+
+// newOIDCRegistry loads providers from the JSON file named by OIDC_CONFIG
+// (default oidc.json). A missing file just leaves federation disabled.
+func newOIDCRegistry() *oidcRegistry {
+	reg := &oidcRegistry{
+		providers: map[string]*oidcProvider{},
+		client:    &http.Client{Timeout: 10 * time.Second},
+		pending:   map[string]*oidcPending{},
+	}
+	path := os.Getenv("OIDC_CONFIG")
+	if path == "" {
+		path = "oidc.json"
+	}
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		return reg
+	}
+	var conf struct {
+		Providers []*oidcProvider `json:"providers"`
+	}
+	if err := json.Unmarshal(d, &conf); err != nil {
+		log.Println("err parsing", path, err)
+		return reg
+	}
+	for _, p := range conf.Providers {
+		if len(p.Scopes) == 0 {
+			p.Scopes = []string{"openid", "profile", "email"}
+		}
+		reg.providers[p.Name] = p
+		log.Println("oidc provider loaded:", p.Name, p.Issuer)
+	}
+	return reg
+}
+
+func randomURLString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func (reg *oidcRegistry) getJSON(u string, v interface{}) error {
+	res, err := reg.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+func (reg *oidcRegistry) discover(p *oidcProvider) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+	d := &oidcDiscovery{}
+	err := reg.getJSON(strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", d)
+	if err != nil {
+		return nil, err
+	}
+	if d.Issuer != p.Issuer {
+		return nil, fmt.Errorf("discovery issuer %q does not match %q", d.Issuer, p.Issuer)
+	}
+	p.discovery = d
+	return d, nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func b64Int(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := b64Int(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64Int(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := b64Int(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64Int(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+// key returns the signing key for kid. The JWKS is cached for oidcJWKSTTL
+// and refetched early when an unknown kid shows up, which is how providers
+// roll their keys.
+func (reg *oidcRegistry) key(p *oidcProvider, kid string) (crypto.PublicKey, error) {
+	d, err := reg.discover(p)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if k, ok := p.keys[kid]; ok && time.Since(p.keysAt) < oidcJWKSTTL {
+		return k, nil
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := reg.getJSON(d.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	p.keys = map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			log.Println("skipping jwk", k.Kid, err)
+			continue
+		}
+		p.keys[k.Kid] = pub
+	}
+	p.keysAt = time.Now()
+	k, ok := p.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("no jwk with kid %q", kid)
+	}
+	return k, nil
+}
+
+// verifyIDToken checks the signature and the standard claims of an ID token
+// and returns its claim set.
+func (reg *oidcRegistry) verifyIDToken(p *oidcProvider, token string, nonce string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed id token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	hd, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(hd, &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	pub, err := reg.key(p, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch header.Alg {
+	case "RS256":
+		k, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.New("RS256 token signed with non-RSA key")
+		}
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, sum[:], sig); err != nil {
+			return nil, err
+		}
+	case "ES256":
+		k, ok := pub.(*ecdsa.PublicKey)
+		if !ok || len(sig) != 64 {
+			return nil, errors.New("bad ES256 signature")
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(k, sum[:], r, s) {
+			return nil, errors.New("bad ES256 signature")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported alg %q", header.Alg)
+	}
+
+	pd, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	claims := map[string]interface{}{}
+	if err := json.Unmarshal(pd, &claims); err != nil {
+		return nil, err
+	}
+	if claims["iss"] != p.Issuer {
+		return nil, fmt.Errorf("unexpected issuer %v", claims["iss"])
+	}
+	if !claimContains(claims["aud"], p.ClientID) {
+		return nil, errors.New("id token not issued for this client")
+	}
+	if azp, ok := claims["azp"].(string); ok && azp != p.ClientID {
+		return nil, errors.New("id token authorised for another party")
+	}
+	now := time.Now()
+	exp, _ := claims["exp"].(float64)
+	if now.After(time.Unix(int64(exp), 0).Add(oidcLeeway)) {
+		return nil, errors.New("id token expired")
+	}
+	if iat, ok := claims["iat"].(float64); ok && time.Unix(int64(iat), 0).After(now.Add(oidcLeeway)) {
+		return nil, errors.New("id token issued in the future")
+	}
+	if claims["nonce"] != nonce {
+		return nil, errors.New("id token nonce mismatch")
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, errors.New("id token has no subject")
+	}
+	return claims, nil
+}
+
+func claimContains(v interface{}, want string) bool {
+	for _, s := range claimStrings(v) {
+		if s == want {
+			return true
+		}
+	}
+	return false
+}
+
+// claimStrings flattens a claim that may be a single string or an array.
+func claimStrings(v interface{}) []string {
+	switch t := v.(type) {
+	case string:
+		return []string{t}
+	case []interface{}:
+		var ret []string
+		for _, e := range t {
+			if s, ok := e.(string); ok {
+				ret = append(ret, s)
+			}
+		}
+		return ret
+	}
+	return nil
+}
+
+func (p *oidcProvider) mapIdentity(claims map[string]interface{}) string {
+	for _, v := range claimStrings(claims[p.IdentityClaim]) {
+		if id, ok := p.IdentityMap[v]; ok {
+			return id
+		}
+	}
+	return p.DefaultIdentity
+}
+
+func (reg *oidcRegistry) putPending(state string, pe *oidcPending) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	now := time.Now()
+	for k, v := range reg.pending {
+		if now.After(v.expires) {
+			delete(reg.pending, k)
+		}
+	}
+	reg.pending[state] = pe
+}
+
+func (reg *oidcRegistry) takePending(state string) *oidcPending {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	pe, ok := reg.pending[state]
+	if !ok {
+		return nil
+	}
+	delete(reg.pending, state)
+	if time.Now().After(pe.expires) {
+		return nil
+	}
+	return pe
+}
+
+func (reg *oidcRegistry) exchange(p *oidcProvider, d *oidcDiscovery, code string, verifier string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.RedirectURL)
+	form.Set("client_id", p.ClientID)
+	form.Set("code_verifier", verifier)
+	req, err := http.NewRequest("POST", d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+	res, err := reg.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(res.Body)
+		return "", fmt.Errorf("token endpoint: %s %s", res.Status, b)
+	}
+	var tok struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&tok); err != nil {
+		return "", err
+	}
+	if tok.IDToken == "" {
+		return "", errors.New("token response has no id_token")
+	}
+	return tok.IDToken, nil
+}
+
+// oidcLogin starts the authorisation code flow with PKCE by redirecting the
+// browser to the provider.
+func (s *service) oidcLogin(w http.ResponseWriter, r *http.Request) {
+	log.Println("oidclogin called")
+	p, ok := s.oidc.providers[mux.Vars(r)["provider"]]
+	if !ok {
+		writeMessage(w, http.StatusNotFound, "unknown identity provider")
+		return
+	}
+	d, err := s.oidc.discover(p)
+	if err != nil {
+		log.Println("err oidc discovery:", err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	state, err1 := randomURLString(24)
+	nonce, err2 := randomURLString(24)
+	verifier, err3 := randomURLString(48)
+	if err1 != nil || err2 != nil || err3 != nil {
+		log.Println("err generating oidc state")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.oidc.putPending(state, &oidcPending{provider: p.Name, verifier: verifier, nonce: nonce, expires: time.Now().Add(oidcStateTTL)})
+
+	challenge := sha256.Sum256([]byte(verifier))
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", p.ClientID)
+	q.Set("redirect_uri", p.RedirectURL)
+	q.Set("scope", strings.Join(p.Scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, d.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+}
+
+func (s *service) oidcCallback(w http.ResponseWriter, r *http.Request) {
+	log.Println("oidccallback called")
+	name := mux.Vars(r)["provider"]
+	p, ok := s.oidc.providers[name]
+	if !ok {
+		writeMessage(w, http.StatusNotFound, "unknown identity provider")
+		return
+	}
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		writeMessage(w, http.StatusUnauthorized, "identity provider error: "+e)
+		return
+	}
+	pe := s.oidc.takePending(q.Get("state"))
+	if pe == nil || pe.provider != name {
+		writeMessage(w, http.StatusBadRequest, "unknown or expired login state")
+		return
+	}
+	d, err := s.oidc.discover(p)
+	if err != nil {
+		log.Println("err oidc discovery:", err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	idToken, err := s.oidc.exchange(p, d, q.Get("code"), pe.verifier)
+	if err != nil {
+		log.Println("err oidc code exchange:", err)
+		writeMessage(w, http.StatusBadGateway, "code exchange failed")
+		return
+	}
+	claims, err := s.oidc.verifyIDToken(p, idToken, pe.nonce)
+	if err != nil {
+		log.Println("err verifying id token:", err)
+		writeMessage(w, http.StatusUnauthorized, "invalid id token")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	u, err := s.provisionOIDCUser(ctx, p, claims)
+	if err != nil {
+		log.Println("err provisioning oidc user:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// The partner IdP is responsible for its own second factor, so the
+	// TOTP policy only applies to password logins.
+	token, err := s.sessions.issue(u)
+	if err != nil {
+		log.Println("err issuing session token")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if p.PostLoginURL != "" {
+		frag := url.Values{"token": {token}, "identity": {u.Identity}, "username": {u.Username}}
+		http.Redirect(w, r, p.PostLoginURL+"#"+frag.Encode(), http.StatusFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	ret := map[string]string{"token": token, "identity": u.Identity, "username": u.Username}
+	err = json.NewEncoder(w).Encode(ret)
+	if err != nil {
+		log.Println("err encoding oidc login")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Println("oidccallback succeed")
+}
+
+// provisionOIDCUser finds the testuser record bound to issuer+subject, or
+// creates it just in time. Mapped claims are refreshed on every login so
+// role changes at the partner take effect without touching our side.
+func (s *service) provisionOIDCUser(ctx context.Context, p *oidcProvider, claims map[string]interface{}) (*User, error) {
+	sub := claims["sub"].(string)
+	identity := p.mapIdentity(claims)
+	if identity == "" {
+		return nil, errors.New("no identity mapping for subject " + sub)
+	}
+	department := p.Name
+	if v := claimStrings(claims[p.DepartmentClaim]); len(v) > 0 {
+		department = v[0]
+	}
+
+	cur := s.db.QueryOne(ctx, "testuser", "oidcsubject", p.Issuer+"|"+sub)
+	u := &User{}
+	err := cur.Decode(u)
+	if err == nil {
+		u.Identity = identity
+		u.Department = department
+		set := bson.M{"identity": identity, "department": department}
+		return u, s.db.Update(ctx, "testuser", "_id", u.ID, set).Err()
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+
+	username, _ := claims["preferred_username"].(string)
+	if username == "" {
+		username, _ = claims["email"].(string)
+	}
+	if username == "" {
+		username = sub
+	}
+	username = p.Name + ":" + username
+	name, _ := claims["name"].(string)
+	email, _ := claims["email"].(string)
+	u = &User{
+		ID:          primitive.NewObjectID(),
+		Username:    username,
+		Name:        name,
+		Department:  department,
+		Email:       email,
+		Identity:    identity,
+		OIDCIssuer:  p.Issuer,
+		OIDCSubject: p.Issuer + "|" + sub,
+	}
+	// Federated users never log in with a password; a random one keeps
+	// /verifyuser from matching an empty string.
+	pw, err := randomURLString(32)
+	if err != nil {
+		return nil, err
+	}
+	u.Password = pw
+	if _, err := s.db.Add(ctx, "testuser", u); err != nil {
+		return nil, err
+	}
+	log.Println("oidc user provisioned:", username)
+	return u, nil
+}
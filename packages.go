@@ -0,0 +1,762 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"mongo/gs1"
+)
+
+// Package levels. Items and lots go into cases or onto pallets, cases onto
+// pallets.
+const (
+	packageCase   = "case"
+	packagePallet = "pallet"
+)
+
+var packageLevels = map[string]int{packageCase: 1, packagePallet: 2}
+
+const packagesDir = "packages/"
+
+// maxPackageDepth bounds walks up and down a packing hierarchy.
+const maxPackageDepth = 8
+
+// Aggregation records children packed into, Action ADD, or unpacked from,
+// Action DELETE, the package Post tagged Parent. Hash is the sha256 of the
+// JSON kept at Record, which was anchored.
+type Aggregation struct {
+	ID       primitive.ObjectID `json:"id" bson:"_id"`
+	Post     primitive.ObjectID `json:"post" bson:"post"`
+	Parent   string             `json:"parent" bson:"parent"`
+	Level    string             `json:"level" bson:"level"`
+	Children []LotLink          `json:"children" bson:"children"`
+	Action   string             `json:"action" bson:"action"`
+	BizStep  string             `json:"bizstep,omitempty" bson:"bizstep,omitempty"`
+	Actor    string             `json:"actor" bson:"actor"`
+	Time     string             `json:"time" bson:"time"`
+	Note     string             `json:"note,omitempty" bson:"note,omitempty"`
+	Record   string             `json:"record,omitempty" bson:"record,omitempty"`
+	Hash     string             `json:"hash,omitempty" bson:"hash,omitempty"`
+	TxHash   string             `json:"txhash,omitempty" bson:"txhash,omitempty"`
+	// Source is the EPCIS event an aggregation was captured from.
+	Source string `json:"source,omitempty" bson:"source,omitempty"`
+}
+
+type packRequest struct {
+	// Level, Tag and Title describe a new package; without a tag one is
+	// allocated, an SSCC when GS1_COMPANY_PREFIXES is set.
+	Level    string   `json:"level"`
+	Tag      string   `json:"tag"`
+	Title    string   `json:"title"`
+	Children []string `json:"children"`
+	// To is where repack moves the children.
+	To   string `json:"to"`
+	Note string `json:"note"`
+	// Source and At are set on packing captured from EPCIS.
+	Source string    `json:"-"`
+	At     time.Time `json:"-"`
+}
+
+// lockPosts takes the custody locks of posts in a fixed order and returns
+// what releases them.
+func lockPosts(ids ...primitive.ObjectID) func() {
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = id.Hex()
+	}
+	sort.Strings(keys)
+	var held []*sync.Mutex
+	for i, k := range keys {
+		if i > 0 && k == keys[i-1] {
+			continue
+		}
+		mu, _ := custodyLocks.LoadOrStore(k, &sync.Mutex{})
+		mu.(*sync.Mutex).Lock()
+		held = append(held, mu.(*sync.Mutex))
+	}
+	return func() {
+		for _, mu := range held {
+			mu.Unlock()
+		}
+	}
+}
+
+// holdsWhole says whether user holds all of p with no transfer of it
+// pending.
+func (s *service) holdsWhole(ctx context.Context, user string, p *Post) (bool, error) {
+	transfers, err := s.transfersWhere(ctx, bson.M{"post": p.ID})
+	if err != nil {
+		return false, err
+	}
+	for _, t := range transfers {
+		if t.Status == transferPending {
+			return false, nil
+		}
+	}
+	return holdings(p, transfers, time.Now())[user] >= p.Amount, nil
+}
+
+// contents lists everything packed in p, and in the packages in it.
+func (s *service) contents(ctx context.Context, p *Post) ([]*Post, error) {
+	var ret []*Post
+	queue := []string{p.Tag}
+	for depth := 0; len(queue) > 0 && depth < maxPackageDepth; depth++ {
+		found, err := s.postsWhere(ctx, bson.M{"container": bson.M{"$in": queue}})
+		if err != nil {
+			return nil, err
+		}
+		queue = nil
+		for _, c := range found {
+			ret = append(ret, c)
+			if c.Package != "" {
+				queue = append(queue, c.Tag)
+			}
+		}
+	}
+	return ret, nil
+}
+
+// outermost is the tag of the package p is in, and of the one that is in,
+// up to the last; empty when p is not packed.
+func (s *service) outermost(ctx context.Context, p *Post) string {
+	top := ""
+	for depth := 0; p.Container != "" && depth < maxPackageDepth; depth++ {
+		top = p.Container
+		next, err := s.findPost(ctx, "tag", p.Container)
+		if err != nil {
+			break
+		}
+		p = next
+	}
+	return top
+}
+
+// packChildren finds the posts a request names by tag, Digital Link or
+// EPC URN.
+func (s *service) packChildren(ctx context.Context, tags []string) ([]*Post, error) {
+	var ret []*Post
+	seen := map[primitive.ObjectID]bool{}
+	for _, t := range tags {
+		p, err := s.findPost(ctx, "tag", canonicalTag(t))
+		if err != nil {
+			return nil, uploadErrorf(http.StatusNotFound, "no post with tag %s", t)
+		}
+		if seen[p.ID] {
+			return nil, uploadErrorf(http.StatusBadRequest, "%s is listed twice", p.Tag)
+		}
+		seen[p.ID] = true
+		ret = append(ret, p)
+	}
+	return ret, nil
+}
+
+// aggregate anchors an aggregation of children and saves it.
+func (s *service) aggregate(pkg *Post, children []*Post, action string, se *session, in *packRequest) (*Aggregation, error) {
+	at := time.Now()
+	if !in.At.IsZero() {
+		at = in.At
+	}
+	a := &Aggregation{ID: primitive.NewObjectID(), Post: pkg.ID, Parent: pkg.Tag, Level: pkg.Package, Action: action, BizStep: "packing", Actor: se.Username, Time: at.In(farmZone).Format(time.RFC3339), Note: in.Note, Source: in.Source}
+	if action == "DELETE" {
+		a.BizStep = "unpacking"
+	}
+	for _, c := range children {
+		a.Children = append(a.Children, LotLink{Post: c.ID, Tag: c.Tag, Amount: c.Amount, Unit: unitOf(c), Op: a.ID, Kind: "aggregation"})
+	}
+	var err error
+	a.Record = packagesDir + pkg.Tag + "/" + a.ID.Hex() + ".json"
+	a.Hash, a.TxHash, err = anchorRecord(a.Record, a)
+	if err != nil {
+		log.Println("err anchoring "+a.Record, err)
+		return nil, uploadErrorf(http.StatusBadGateway, "could not anchor the aggregation")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := s.db.Add(ctx, "aggregations", a); err != nil {
+		log.Println("err saving aggregation", err)
+		return nil, err
+	}
+	return a, nil
+}
+
+// pack puts the posts in.Children into pkg. The caller has to hold the
+// package and every child whole, and a child has to be unpacked and of a
+// lower level than the package.
+func (s *service) pack(se *session, pkg *Post, in *packRequest) (*Aggregation, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	children, err := s.packChildren(ctx, in.Children)
+	if err != nil {
+		return nil, err
+	}
+	if len(children) == 0 {
+		return nil, uploadErrorf(http.StatusBadRequest, "children are required")
+	}
+	ids := []primitive.ObjectID{pkg.ID}
+	for _, c := range children {
+		ids = append(ids, c.ID)
+	}
+	defer lockPosts(ids...)()
+
+	// reread under the locks
+	if pkg, err = s.findPost(ctx, "_id", pkg.ID); err != nil {
+		return nil, uploadErrorf(http.StatusNotFound, "package not found")
+	}
+	for i, c := range children {
+		if children[i], err = s.findPost(ctx, "_id", c.ID); err != nil {
+			return nil, uploadErrorf(http.StatusNotFound, "post not found")
+		}
+	}
+	if err := s.checkPack(ctx, se, pkg, children, ""); err != nil {
+		return nil, err
+	}
+
+	// the children are packed before the aggregation is recorded, and
+	// unpacked again when it cannot be
+	if err := s.moveContainer(children, "", pkg.Tag); err != nil {
+		return nil, err
+	}
+	a, err := s.aggregate(pkg, children, "ADD", se, in)
+	if err != nil {
+		if merr := s.moveContainer(children, pkg.Tag, ""); merr != nil {
+			log.Println("err undoing packing into", pkg.Tag, merr)
+		}
+		return nil, err
+	}
+	return a, nil
+}
+
+// checkPack says whether se may pack children, now in container from, into
+// pkg: they have to be of a lower level and held whole, as does pkg.
+func (s *service) checkPack(ctx context.Context, se *session, pkg *Post, children []*Post, from string) error {
+	if pkg.Package == "" {
+		return uploadErrorf(http.StatusBadRequest, "%s is not a package", pkg.Tag)
+	}
+	if ok, err := s.holdsWhole(ctx, se.Username, pkg); err != nil || !ok {
+		return uploadErrorf(http.StatusConflict, "%s does not hold %s", se.Username, pkg.Tag)
+	}
+	for _, c := range children {
+		if c.ID == pkg.ID || packageLevels[c.Package] >= packageLevels[pkg.Package] {
+			return uploadErrorf(http.StatusBadRequest, "%s cannot go in a %s", c.Tag, pkg.Package)
+		}
+		if c.Container != from {
+			return uploadErrorf(http.StatusConflict, "%s is packed in %s", c.Tag, c.Container)
+		}
+		if ok, err := s.holdsWhole(ctx, se.Username, c); err != nil || !ok {
+			return uploadErrorf(http.StatusConflict, "%s does not hold all of %s", se.Username, c.Tag)
+		}
+	}
+	return nil
+}
+
+// moveContainer moves children from container from to container to, ""
+// being unpacked. When one has moved meanwhile or cannot be written, those
+// already moved are put back.
+func (s *service) moveContainer(children []*Post, from string, to string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	move := func(c *Post, from string, to string) error {
+		filter := bson.M{"_id": c.ID, "container": from}
+		if from == "" {
+			filter["container"] = bson.M{"$in": bson.A{nil, ""}}
+		}
+		update := bson.M{"$set": bson.M{"container": to}}
+		if to == "" {
+			update = bson.M{"$unset": bson.M{"container": ""}}
+		}
+		err := s.db.ModifyFilter(ctx, "posts", filter, update).Err()
+		if err == mongo.ErrNoDocuments {
+			return uploadErrorf(http.StatusConflict, "%s was moved meanwhile", c.Tag)
+		}
+		return err
+	}
+	for n, c := range children {
+		if err := move(c, from, to); err != nil {
+			log.Println("err moving", c.Tag, "from", from, "to", to, err)
+			for _, done := range children[:n] {
+				if err := move(done, to, from); err != nil {
+					log.Println("err moving back", done.Tag, err)
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// unpack takes in.Children, or everything when none are named, out of
+// pkg.
+func (s *service) unpack(se *session, pkg *Post, in *packRequest) (*Aggregation, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	defer lockPosts(pkg.ID)()
+	pkg, err := s.findPost(ctx, "_id", pkg.ID)
+	if err != nil {
+		return nil, uploadErrorf(http.StatusNotFound, "package not found")
+	}
+	if ok, err := s.holdsWhole(ctx, se.Username, pkg); err != nil || !ok {
+		return nil, uploadErrorf(http.StatusConflict, "%s does not hold %s", se.Username, pkg.Tag)
+	}
+	var children []*Post
+	if len(in.Children) == 0 {
+		children, err = s.postsWhere(ctx, bson.M{"container": pkg.Tag})
+	} else {
+		children, err = s.packChildren(ctx, in.Children)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(children) == 0 {
+		return nil, uploadErrorf(http.StatusConflict, "%s is empty", pkg.Tag)
+	}
+	for _, c := range children {
+		if c.Container != pkg.Tag {
+			return nil, uploadErrorf(http.StatusConflict, "%s is not in %s", c.Tag, pkg.Tag)
+		}
+	}
+
+	if err := s.moveContainer(children, pkg.Tag, ""); err != nil {
+		return nil, err
+	}
+	a, err := s.aggregate(pkg, children, "DELETE", se, in)
+	if err != nil {
+		if merr := s.moveContainer(children, "", pkg.Tag); merr != nil {
+			log.Println("err undoing unpacking from", pkg.Tag, merr)
+		}
+		return nil, err
+	}
+	return a, nil
+}
+
+// common is the value every post has for f, or empty.
+func common(posts []*Post, f func(*Post) string) string {
+	if len(posts) == 0 {
+		return ""
+	}
+	v := f(posts[0])
+	for _, p := range posts[1:] {
+		if f(p) != v {
+			return ""
+		}
+	}
+	return v
+}
+
+// newPackage makes a package post held by the caller and packs
+// in.Children into it. A package takes the stage, factory and market its
+// children share, so its journey can go on from there.
+func (s *service) newPackage(se *session, in *packRequest) (*Post, *Aggregation, error) {
+	if packageLevels[in.Level] == 0 {
+		return nil, nil, uploadErrorf(http.StatusBadRequest, "level must be case or pallet")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	tag := in.Tag
+	if tag == "" {
+		req := &identifierRequest{Kind: gs1.Internal}
+		if len(companyPrefixes()) > 0 {
+			req.Kind = gs1.SSCC
+		}
+		id, err := s.allocateTag(ctx, req)
+		if err != nil {
+			return nil, nil, err
+		}
+		tag = id.String()
+	} else if _, err := typedTag(tag); err != nil {
+		return nil, nil, uploadErrorf(http.StatusBadRequest, "%s", err.Error())
+	} else if _, err := s.findPost(ctx, "tag", tag); err == nil {
+		return nil, nil, uploadErrorf(http.StatusConflict, "tag %s is taken", tag)
+	}
+	children, err := s.packChildren(ctx, in.Children)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	at := time.Now()
+	if !in.At.IsZero() {
+		at = in.At
+	}
+	path := "file/" + tag + "/"
+	p := &Post{ID: primitive.NewObjectID(), Tag: tag, Title: in.Title, User: se.Username, Date: at.In(farmZone).Format(time.ANSIC), Amount: 1, Unit: "pcs", Paperwork: path, TagKind: tagKind(tag), Package: in.Level}
+	p.Progress = common(children, func(c *Post) string { return c.Progress })
+	p.Factory = common(children, func(c *Post) string { return c.Factory })
+	p.Market = common(children, func(c *Post) string { return c.Market })
+	p.Certification = common(children, func(c *Post) string { return c.Certification })
+	bc := &BCdataa{ID: p.ID, Tag: tag, Factory: p.Factory, ImgHash: []string{}, Hash: []string{}}
+	if _, err := s.db.Add(ctx, "posts", p); err != nil {
+		return nil, nil, err
+	}
+	if _, err := s.db.Add(ctx, "bcposts", bc); err != nil {
+		return nil, nil, err
+	}
+	os.MkdirAll(path, 0777)
+	if len(children) == 0 {
+		return p, nil, nil
+	}
+	a, err := s.pack(se, p, in)
+	if err != nil && a == nil {
+		// nothing went in, the package was never used
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		s.db.DeleteOne(ctx, "posts", "_id", p.ID)
+		s.db.DeleteOne(ctx, "bcposts", "_id", p.ID)
+		return nil, nil, err
+	}
+	return p, a, err
+}
+
+// packageTransfers opens, along with the transfer t of a package, one
+// transfer of everything in it, so they change hands together. The
+// sender has to hold all of each.
+func (s *service) packageTransfers(ctx context.Context, se *session, p *Post, t *Transfer) ([]*Transfer, error) {
+	contents, err := s.contents(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	var ret []*Transfer
+	for _, c := range contents {
+		if ok, err := s.holdsWhole(ctx, se.Username, c); err != nil || !ok {
+			return nil, uploadErrorf(http.StatusConflict, "%s does not hold all of %s in %s", se.Username, c.Tag, p.Tag)
+		}
+		ct := &Transfer{ID: primitive.NewObjectID(), Post: c.ID, Tag: c.Tag, Sender: t.Sender, Receiver: t.Receiver, Amount: c.Amount, Unit: unitOf(c), Note: t.Note, Created: t.Created, Status: transferPending, PartOf: t.ID, Source: t.Source}
+		ct.SenderSignature = s.countersign(se, ct, "send")
+		ret = append(ret, ct)
+		t.Contents = append(t.Contents, ct.ID)
+	}
+	return ret, nil
+}
+
+// settleContents gives the transfers of a package's contents the outcome
+// of the package's own. They share its anchored record, which lists them.
+// Each update is tried a few times; contents still pending after that are
+// reported, and settling the package again retries them.
+func (s *service) settleContents(se *session, t *Transfer) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var failed []string
+	for _, id := range t.Contents {
+		var err error
+		for try := 0; try < 3; try++ {
+			if try > 0 {
+				time.Sleep(time.Duration(try) * time.Second)
+			}
+			if err = s.settleContent(ctx, se, t, id); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			log.Println("err settling", id.Hex(), "with", t.ID.Hex(), err)
+			failed = append(failed, id.Hex())
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("transfers %s of package transfer %s are still pending", strings.Join(failed, ", "), t.ID.Hex())
+	}
+	return nil
+}
+
+func (s *service) settleContent(ctx context.Context, se *session, t *Transfer, id primitive.ObjectID) error {
+	ct, err := s.findTransfer(ctx, id)
+	if err != nil {
+		return err
+	}
+	if ct.Status != transferPending {
+		return nil
+	}
+	set := bson.M{"status": t.Status}
+	if t.Status != transferCancelled {
+		action := map[string]string{transferAccepted: "accept", transferRejected: "reject"}[t.Status]
+		sig := s.countersign(se, ct, action)
+		set["receivernote"], set["receiversignature"], set["decided"] = t.ReceiverNote, sig, t.Decided
+	}
+	if t.Status == transferAccepted {
+		set["record"], set["hash"], set["txhash"] = t.Record, t.Hash, t.TxHash
+	}
+	err = s.db.ModifyFilter(ctx, "transfers", bson.M{"_id": id, "status": transferPending}, bson.M{"$set": set}).Err()
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	return err
+}
+
+func (s *service) packageFromVars(w http.ResponseWriter, r *http.Request) (*session, *Post, bool) {
+	se := s.sessionFrom(r)
+	if se == nil {
+		writeMessage(w, http.StatusUnauthorized, "session required")
+		return nil, nil, false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	p, err := s.findPost(ctx, "tag", canonicalTag(mux.Vars(r)["tag"]))
+	if err != nil || p.Package == "" {
+		writeMessage(w, http.StatusNotFound, "package not found")
+		return nil, nil, false
+	}
+	return se, p, true
+}
+
+func decodePack(w http.ResponseWriter, r *http.Request) (*packRequest, bool) {
+	in := &packRequest{}
+	if err := json.NewDecoder(r.Body).Decode(in); err != nil {
+		writeMessage(w, http.StatusBadRequest, "body must be a json packing request")
+		return nil, false
+	}
+	return in, true
+}
+
+// createPackage handles POST /packages.
+func (s *service) createPackage(w http.ResponseWriter, r *http.Request) {
+	se := s.sessionFrom(r)
+	if se == nil {
+		writeMessage(w, http.StatusUnauthorized, "session required")
+		return
+	}
+	in, ok := decodePack(w, r)
+	if !ok {
+		return
+	}
+	p, a, err := s.newPackage(se, in)
+	if err != nil {
+		writeMessage(w, uploadStatus(err), err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"package": p, "aggregation": a})
+}
+
+// packInto handles POST /packages/{tag}/pack.
+func (s *service) packInto(w http.ResponseWriter, r *http.Request) {
+	se, p, ok := s.packageFromVars(w, r)
+	if !ok {
+		return
+	}
+	in, ok := decodePack(w, r)
+	if !ok {
+		return
+	}
+	a, err := s.pack(se, p, in)
+	if err != nil {
+		writeMessage(w, uploadStatus(err), err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(a)
+}
+
+// unpackFrom handles POST /packages/{tag}/unpack.
+func (s *service) unpackFrom(w http.ResponseWriter, r *http.Request) {
+	se, p, ok := s.packageFromVars(w, r)
+	if !ok {
+		return
+	}
+	in, ok := decodePack(w, r)
+	if !ok {
+		return
+	}
+	a, err := s.unpack(se, p, in)
+	if err != nil {
+		writeMessage(w, uploadStatus(err), err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(a)
+}
+
+// repack handles POST /packages/{tag}/repack, moving children to the
+// package To. If they cannot go in there they are packed back.
+func (s *service) repack(w http.ResponseWriter, r *http.Request) {
+	se, p, ok := s.packageFromVars(w, r)
+	if !ok {
+		return
+	}
+	in, ok := decodePack(w, r)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	to, err := s.findPost(ctx, "tag", canonicalTag(in.To))
+	if err != nil || to.Package == "" || to.ID == p.ID {
+		writeMessage(w, http.StatusBadRequest, "to must be another package")
+		return
+	}
+	if len(in.Children) == 0 {
+		inside, err := s.postsWhere(ctx, bson.M{"container": p.Tag})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		for _, c := range inside {
+			in.Children = append(in.Children, c.Tag)
+		}
+	}
+	// check the move before anything is unpacked, so it fails rarely once
+	// it starts
+	children, err := s.packChildren(ctx, in.Children)
+	if err != nil {
+		writeMessage(w, uploadStatus(err), err.Error())
+		return
+	}
+	if err := s.checkPack(ctx, se, to, children, p.Tag); err != nil {
+		writeMessage(w, uploadStatus(err), err.Error())
+		return
+	}
+	out, err := s.unpack(se, p, in)
+	if err != nil {
+		writeMessage(w, uploadStatus(err), err.Error())
+		return
+	}
+	into, err := s.pack(se, to, in)
+	if err != nil {
+		if _, berr := s.pack(se, p, in); berr != nil {
+			log.Println("err packing back into", p.Tag, berr)
+			writeMessage(w, http.StatusInternalServerError, "could not pack into "+to.Tag+" ("+err.Error()+") nor back into "+p.Tag+" ("+berr.Error()+"), the contents are unpacked")
+			return
+		}
+		writeMessage(w, uploadStatus(err), err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"unpacked": out, "packed": into})
+}
+
+// PackageNode is a package or item in a package tree.
+type PackageNode struct {
+	Tag      string         `json:"tag"`
+	Level    string         `json:"level,omitempty"`
+	Title    string         `json:"title,omitempty"`
+	Amount   int            `json:"amount"`
+	Unit     string         `json:"unit"`
+	Progress string         `json:"progress,omitempty"`
+	Contents []*PackageNode `json:"contents,omitempty"`
+}
+
+// packageTree answers GET /packages/{tag} with what is in a package, in
+// what it is, and its packing history.
+func (s *service) packageTree(w http.ResponseWriter, r *http.Request) {
+	se, p, ok := s.packageFromVars(w, r)
+	if !ok {
+		return
+	}
+	if !canAccessPost(se, p) {
+		writeMessage(w, http.StatusForbidden, se.Username+" has no rights on "+p.Tag)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	contents, err := s.contents(ctx, p)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	nodes := map[string]*PackageNode{}
+	node := func(q *Post) *PackageNode {
+		n := &PackageNode{Tag: q.Tag, Level: q.Package, Title: q.Title, Amount: q.Amount, Unit: unitOf(q), Progress: q.Progress}
+		nodes[q.Tag] = n
+		return n
+	}
+	root := node(p)
+	for _, c := range contents {
+		n := node(c)
+		if parent := nodes[c.Container]; parent != nil {
+			parent.Contents = append(parent.Contents, n)
+		}
+	}
+
+	cur, err := s.db.QueryFilter(ctx, "aggregations", bson.M{"post": p.ID}, options.Find().SetSort(bson.M{"time": 1}))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer cur.Close(ctx)
+	history := []*Aggregation{}
+	for cur.Next(ctx) {
+		a := &Aggregation{}
+		if err := cur.Decode(a); err == nil {
+			history = append(history, a)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"package": root, "in": p.Container, "outermost": s.outermost(ctx, p), "history": history})
+}
+
+// VerifiedPackage is a package a lot travelled in, between Packed and
+// Unpacked.
+type VerifiedPackage struct {
+	Tag      string `json:"tag"`
+	Level    string `json:"level"`
+	Packed   string `json:"packed"`
+	Unpacked string `json:"unpacked,omitempty"`
+
+	post     primitive.ObjectID
+	from, to time.Time
+}
+
+// packageJourney finds the packages the posts ids were in within from and
+// to, a zero to meaning still, and the packages those were in.
+func (s *service) packageJourney(ctx context.Context, ids []primitive.ObjectID, from time.Time, to time.Time, depth int) []*VerifiedPackage {
+	if len(ids) == 0 || depth >= maxPackageDepth {
+		return nil
+	}
+	cur, err := s.db.QueryFilter(ctx, "aggregations", bson.M{"children.post": bson.M{"$in": ids}}, options.Find().SetSort(bson.M{"time": 1}))
+	if err != nil {
+		return nil
+	}
+	var ret []*VerifiedPackage
+	open := map[string]*VerifiedPackage{}
+	for cur.Next(ctx) {
+		a := &Aggregation{}
+		if err := cur.Decode(a); err != nil {
+			continue
+		}
+		t, _ := time.Parse(time.RFC3339, a.Time)
+		for _, c := range a.Children {
+			key := c.Post.Hex() + a.Post.Hex()
+			if a.Action == "ADD" && open[key] == nil {
+				open[key] = &VerifiedPackage{Tag: a.Parent, Level: a.Level, post: a.Post, from: t}
+				ret = append(ret, open[key])
+			} else if a.Action == "DELETE" && open[key] != nil {
+				open[key].to = t
+				delete(open, key)
+			}
+		}
+	}
+	cur.Close(ctx)
+
+	var kept []*VerifiedPackage
+	for _, vp := range ret {
+		if vp.from.Before(from) {
+			vp.from = from
+		}
+		if !to.IsZero() && (vp.to.IsZero() || vp.to.After(to)) {
+			vp.to = to
+		}
+		if !vp.to.IsZero() && !vp.from.Before(vp.to) {
+			continue
+		}
+		vp.Packed = vp.from.In(farmZone).Format(time.RFC3339)
+		if !vp.to.IsZero() {
+			vp.Unpacked = vp.to.In(farmZone).Format(time.RFC3339)
+		}
+		kept = append(kept, vp)
+		kept = append(kept, s.packageJourney(ctx, []primitive.ObjectID{vp.post}, vp.from, vp.to, depth+1)...)
+	}
+	return kept
+}
@@ -0,0 +1,88 @@
+package phash
+
+import "sync"
+
+// Match is an entry found by Tree.Search.
+type Match struct {
+	Hash     uint64
+	ID       string
+	Distance int
+}
+
+type bkNode struct {
+	hash     uint64
+	ids      []string
+	children map[int]*bkNode
+}
+
+// Tree is a BK-tree over Hamming distance. It is safe for concurrent use.
+type Tree struct {
+	mu   sync.RWMutex
+	root *bkNode
+	size int
+}
+
+func NewTree() *Tree {
+	return &Tree{}
+}
+
+// Add stores id under hash. Several ids may share a hash.
+func (t *Tree) Add(hash uint64, id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.size++
+	if t.root == nil {
+		t.root = &bkNode{hash: hash, ids: []string{id}}
+		return
+	}
+	n := t.root
+	for {
+		d := Distance(n.hash, hash)
+		if d == 0 {
+			n.ids = append(n.ids, id)
+			return
+		}
+		c, ok := n.children[d]
+		if !ok {
+			if n.children == nil {
+				n.children = map[int]*bkNode{}
+			}
+			n.children[d] = &bkNode{hash: hash, ids: []string{id}}
+			return
+		}
+		n = c
+	}
+}
+
+// Search returns every id whose hash is within max of hash.
+func (t *Tree) Search(hash uint64, max int) []Match {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var ret []Match
+	if t.root == nil {
+		return ret
+	}
+	stack := []*bkNode{t.root}
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		d := Distance(n.hash, hash)
+		if d <= max {
+			for _, id := range n.ids {
+				ret = append(ret, Match{Hash: n.hash, ID: id, Distance: d})
+			}
+		}
+		for cd, c := range n.children {
+			if cd >= d-max && cd <= d+max {
+				stack = append(stack, c)
+			}
+		}
+	}
+	return ret
+}
+
+func (t *Tree) Len() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.size
+}
@@ -0,0 +1,112 @@
+// Package phash computes perceptual image hashes with the standard library
+// image packages. Unlike a SHA-256 of the file, these survive re-encoding,
+// resizing and light cropping, so two hashes a small Hamming distance apart
+// are probably the same photo.
+package phash
+
+import (
+	"image"
+	"math"
+	"math/bits"
+	"sort"
+)
+
+// grey scales img to w×h luminance values with a box filter.
+func grey(img image.Image, w, h int) []float64 {
+	b := img.Bounds()
+	out := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		y0 := b.Min.Y + y*b.Dy()/h
+		y1 := b.Min.Y + (y+1)*b.Dy()/h
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < w; x++ {
+			x0 := b.Min.X + x*b.Dx()/w
+			x1 := b.Min.X + (x+1)*b.Dx()/w
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			sum, n := 0.0, 0
+			// sample at most 8×8 pixels per cell so large photos stay fast
+			sx := (x1-x0)/8 + 1
+			sy := (y1-y0)/8 + 1
+			for yy := y0; yy < y1; yy += sy {
+				for xx := x0; xx < x1; xx += sx {
+					r, g, bl, _ := img.At(xx, yy).RGBA()
+					sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(bl)
+					n++
+				}
+			}
+			out[y*w+x] = sum / float64(n)
+		}
+	}
+	return out
+}
+
+// DHash is the 64 bit difference hash: each bit says whether a pixel of a
+// 9×8 thumbnail is brighter than its right neighbour.
+func DHash(img image.Image) uint64 {
+	g := grey(img, 9, 8)
+	var h uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			h <<= 1
+			if g[y*9+x] > g[y*9+x+1] {
+				h |= 1
+			}
+		}
+	}
+	return h
+}
+
+// PHash is the 64 bit DCT hash: the low 8×8 frequencies of a 32×32
+// thumbnail, each compared with their median.
+func PHash(img image.Image) uint64 {
+	const n = 32
+	g := grey(img, n, n)
+	var cos [n][n]float64
+	for u := 0; u < n; u++ {
+		for x := 0; x < n; x++ {
+			cos[u][x] = math.Cos(float64(2*x+1) * float64(u) * math.Pi / (2 * n))
+		}
+	}
+	// separable 2D DCT-II, rows then the 8 columns we keep
+	rows := make([]float64, n*8)
+	for y := 0; y < n; y++ {
+		for u := 0; u < 8; u++ {
+			s := 0.0
+			for x := 0; x < n; x++ {
+				s += g[y*n+x] * cos[u][x]
+			}
+			rows[y*8+u] = s
+		}
+	}
+	coef := make([]float64, 64)
+	for v := 0; v < 8; v++ {
+		for u := 0; u < 8; u++ {
+			s := 0.0
+			for y := 0; y < n; y++ {
+				s += rows[y*8+u] * cos[v][y]
+			}
+			coef[v*8+u] = s
+		}
+	}
+	// the DC term only reflects overall brightness
+	sorted := append([]float64(nil), coef[1:]...)
+	sort.Float64s(sorted)
+	median := (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+	var h uint64
+	for i := 0; i < 64; i++ {
+		h <<= 1
+		if coef[i] > median {
+			h |= 1
+		}
+	}
+	return h
+}
+
+// Distance is the Hamming distance between two hashes.
+func Distance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
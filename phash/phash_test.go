@@ -0,0 +1,102 @@
+package phash
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// scene draws the same picture at any size: a few soft blobs over a
+// diagonal gradient. flip mirrors it left to right.
+func scene(w, h int, flip bool) image.Image {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			u, v := float64(x)/float64(w), float64(y)/float64(h)
+			if flip {
+				u = 1 - u
+			}
+			l := 60 + 80*u*v
+			l += 100 * math.Exp(-((u-0.3)*(u-0.3)+(v-0.3)*(v-0.3))*40)
+			l -= 50 * math.Exp(-((u-0.75)*(u-0.75)+(v-0.6)*(v-0.6))*30)
+			img.SetGray(x, y, color.Gray{uint8(l)})
+		}
+	}
+	return img
+}
+
+func TestDistance(t *testing.T) {
+	tests := []struct {
+		a, b uint64
+		want int
+	}{
+		{0, 0, 0},
+		{0, 1, 1},
+		{0xff, 0x0f, 4},
+		{0, math.MaxUint64, 64},
+		{0xaaaaaaaaaaaaaaaa, 0x5555555555555555, 64},
+	}
+	for _, tt := range tests {
+		if got := Distance(tt.a, tt.b); got != tt.want {
+			t.Errorf("Distance(%#x, %#x) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestHashes(t *testing.T) {
+	orig := scene(640, 480, false)
+	tests := []struct {
+		name  string
+		img   image.Image
+		near  bool
+		limit int
+	}{
+		{"same", scene(640, 480, false), true, 0},
+		{"resized", scene(320, 240, false), true, 6},
+		{"enlarged", scene(1024, 768, false), true, 6},
+		{"mirrored", scene(640, 480, true), false, 16},
+	}
+	hashes := []struct {
+		name string
+		fn   func(image.Image) uint64
+	}{
+		{"DHash", DHash},
+		{"PHash", PHash},
+	}
+	for _, h := range hashes {
+		a := h.fn(orig)
+		for _, tt := range tests {
+			d := Distance(a, h.fn(tt.img))
+			if tt.near && d > tt.limit {
+				t.Errorf("%s %s: distance %d, want at most %d", h.name, tt.name, d, tt.limit)
+			}
+			if !tt.near && d < tt.limit {
+				t.Errorf("%s %s: distance %d, want at least %d", h.name, tt.name, d, tt.limit)
+			}
+		}
+	}
+}
+
+func TestTreeSearch(t *testing.T) {
+	tr := NewTree()
+	for id, h := range map[string]uint64{"a": 0, "b": 0x3, "c": 0xff, "d": math.MaxUint64} {
+		tr.Add(h, id)
+	}
+	tests := []struct {
+		hash uint64
+		max  int
+		want int
+	}{
+		{0, 0, 1},
+		{0, 2, 2},
+		{0x1, 8, 3},
+		{math.MaxUint64, 3, 1},
+		{0xf0f0, 3, 0},
+	}
+	for _, tt := range tests {
+		if got := tr.Search(tt.hash, tt.max); len(got) != tt.want {
+			t.Errorf("Search(%#x, %d) = %v, want %d matches", tt.hash, tt.max, got, tt.want)
+		}
+	}
+}
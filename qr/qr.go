@@ -0,0 +1,493 @@
+// Package qr encodes text as a QR code in byte mode and draws it as an
+// image or SVG. Versions 1 to 10 are supported, enough for 271 bytes at
+// level L or 119 at level H.
+package qr
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MaxVersion is the largest code Encode makes, 57 modules a side.
+const MaxVersion = 10
+
+// Level is how much of the code can be damaged and still read: about 7%
+// for L, 15% for M, 25% for Q and 30% for H.
+type Level int
+
+const (
+	L Level = iota
+	M
+	Q
+	H
+)
+
+func (l Level) String() string {
+	return [...]string{"L", "M", "Q", "H"}[l]
+}
+
+// ParseLevel reads "L", "M", "Q" or "H" in either case.
+func ParseLevel(s string) (Level, bool) {
+	switch strings.ToUpper(s) {
+	case "L":
+		return L, true
+	case "M":
+		return M, true
+	case "Q":
+		return Q, true
+	case "H":
+		return H, true
+	}
+	return 0, false
+}
+
+// levelBits is how each level is written in the format information.
+var levelBits = [4]int{1, 0, 3, 2}
+
+// blocks gives per version and level the error correction codewords of
+// each block, then the count and data codewords of the blocks in each of
+// the two groups.
+var blocks = [MaxVersion + 1][4]struct{ ec, n1, d1, n2, d2 int }{
+	{},
+	{{7, 1, 19, 0, 0}, {10, 1, 16, 0, 0}, {13, 1, 13, 0, 0}, {17, 1, 9, 0, 0}},
+	{{10, 1, 34, 0, 0}, {16, 1, 28, 0, 0}, {22, 1, 22, 0, 0}, {28, 1, 16, 0, 0}},
+	{{15, 1, 55, 0, 0}, {26, 1, 44, 0, 0}, {18, 2, 17, 0, 0}, {22, 2, 13, 0, 0}},
+	{{20, 1, 80, 0, 0}, {18, 2, 32, 0, 0}, {26, 2, 24, 0, 0}, {16, 4, 9, 0, 0}},
+	{{26, 1, 108, 0, 0}, {24, 2, 43, 0, 0}, {18, 2, 15, 2, 16}, {22, 2, 11, 2, 12}},
+	{{18, 2, 68, 0, 0}, {16, 4, 27, 0, 0}, {24, 4, 19, 0, 0}, {28, 4, 15, 0, 0}},
+	{{20, 2, 78, 0, 0}, {18, 4, 31, 0, 0}, {18, 2, 14, 4, 15}, {26, 4, 13, 1, 14}},
+	{{24, 2, 97, 0, 0}, {22, 2, 38, 2, 39}, {22, 4, 18, 2, 19}, {26, 4, 14, 2, 15}},
+	{{30, 2, 116, 0, 0}, {22, 3, 36, 2, 37}, {20, 4, 16, 4, 17}, {24, 4, 12, 4, 13}},
+	{{18, 2, 68, 2, 69}, {26, 4, 43, 1, 44}, {24, 6, 19, 2, 20}, {28, 6, 15, 2, 16}},
+}
+
+// alignment is where alignment patterns are centred, along both axes.
+var alignment = [MaxVersion + 1][]int{
+	nil, nil,
+	{6, 18}, {6, 22}, {6, 26}, {6, 30}, {6, 34},
+	{6, 22, 38}, {6, 24, 42}, {6, 26, 46}, {6, 28, 50},
+}
+
+func dataCodewords(version int, level Level) int {
+	b := blocks[version][level]
+	return b.n1*b.d1 + b.n2*b.d2
+}
+
+func countBits(version int) int {
+	if version <= 9 {
+		return 8
+	}
+	return 16
+}
+
+// Code is an encoded symbol. Module (x, y) is column x of row y, counted
+// from the top left.
+type Code struct {
+	Version int
+	Level   Level
+	Mask    int
+	Size    int
+	dark    []bool
+	fixed   []bool
+}
+
+// Dark says whether a module is dark. Anything outside the symbol is the
+// light quiet zone.
+func (c *Code) Dark(x, y int) bool {
+	if x < 0 || y < 0 || x >= c.Size || y >= c.Size {
+		return false
+	}
+	return c.dark[y*c.Size+x]
+}
+
+// Encode makes the smallest code that holds text at level.
+func Encode(text string, level Level) (*Code, error) {
+	if level < L || level > H {
+		return nil, fmt.Errorf("qr: unknown level %d", level)
+	}
+	data := []byte(text)
+	version := 0
+	for v := 1; v <= MaxVersion; v++ {
+		if 4+countBits(v)+8*len(data) <= 8*dataCodewords(v, level) {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, fmt.Errorf("qr: %d bytes do not fit a version %d code at level %s", len(data), MaxVersion, level)
+	}
+
+	size := 17 + 4*version
+	c := &Code{Version: version, Level: level, Size: size, dark: make([]bool, size*size), fixed: make([]bool, size*size)}
+	c.drawFunctions()
+	c.place(interleave(encodeData(data, version, level), version, level))
+
+	best := -1
+	for m := 0; m < 8; m++ {
+		c.applyMask(m)
+		c.drawFormat(m)
+		if p := c.penalty(); best < 0 || p < best {
+			best, c.Mask = p, m
+		}
+		c.applyMask(m)
+	}
+	c.applyMask(c.Mask)
+	c.drawFormat(c.Mask)
+	return c, nil
+}
+
+type bitBuffer struct {
+	b []byte
+	n int
+}
+
+func (bb *bitBuffer) put(v uint, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if bb.n%8 == 0 {
+			bb.b = append(bb.b, 0)
+		}
+		if v>>uint(i)&1 == 1 {
+			bb.b[bb.n/8] |= 0x80 >> uint(bb.n%8)
+		}
+		bb.n++
+	}
+}
+
+// encodeData lays data out as one byte mode segment, then terminates and
+// pads it to the version's data capacity.
+func encodeData(data []byte, version int, level Level) []byte {
+	capacity := 8 * dataCodewords(version, level)
+	bb := &bitBuffer{}
+	bb.put(4, 4)
+	bb.put(uint(len(data)), countBits(version))
+	for _, d := range data {
+		bb.put(uint(d), 8)
+	}
+	t := capacity - bb.n
+	if t > 4 {
+		t = 4
+	}
+	bb.put(0, t)
+	if bb.n%8 != 0 {
+		bb.put(0, 8-bb.n%8)
+	}
+	for pad := uint(0xEC); bb.n < capacity; pad ^= 0xEC ^ 0x11 {
+		bb.put(pad, 8)
+	}
+	return bb.b
+}
+
+// interleave splits the data into blocks, adds each block's error
+// correction and interleaves them codeword by codeword.
+func interleave(data []byte, version int, level Level) []byte {
+	b := blocks[version][level]
+	gen := generator(b.ec)
+	var ds, es [][]byte
+	for _, g := range [2][2]int{{b.n1, b.d1}, {b.n2, b.d2}} {
+		for i := 0; i < g[0]; i++ {
+			d := data[:g[1]]
+			data = data[g[1]:]
+			ds = append(ds, d)
+			es = append(es, remainder(d, gen))
+		}
+	}
+	longest := b.d1
+	if b.n2 > 0 {
+		longest = b.d2
+	}
+	var out []byte
+	for i := 0; i < longest; i++ {
+		for _, d := range ds {
+			if i < len(d) {
+				out = append(out, d[i])
+			}
+		}
+	}
+	for i := 0; i < b.ec; i++ {
+		for _, e := range es {
+			out = append(out, e[i])
+		}
+	}
+	return out
+}
+
+// gfMul multiplies in GF(256) modulo x^8+x^4+x^3+x^2+1.
+func gfMul(x, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = z<<1 ^ (z>>7)*0x11D
+		z ^= int(y>>uint(i)&1) * int(x)
+	}
+	return byte(z)
+}
+
+// generator is the Reed-Solomon generator polynomial of degree n, highest
+// power first with the leading 1 left out.
+func generator(n int) []byte {
+	g := make([]byte, n)
+	g[n-1] = 1
+	root := byte(1)
+	for i := 0; i < n; i++ {
+		for j := range g {
+			g[j] = gfMul(g[j], root)
+			if j+1 < n {
+				g[j] ^= g[j+1]
+			}
+		}
+		root = gfMul(root, 2)
+	}
+	return g
+}
+
+// remainder is the error correction of data: data times x^n divided by
+// the generator.
+func remainder(data []byte, gen []byte) []byte {
+	r := make([]byte, len(gen))
+	for _, d := range data {
+		f := d ^ r[0]
+		copy(r, r[1:])
+		r[len(r)-1] = 0
+		for i := range r {
+			r[i] ^= gfMul(gen[i], f)
+		}
+	}
+	return r
+}
+
+func (c *Code) set(x, y int, dark bool) {
+	c.dark[y*c.Size+x] = dark
+	c.fixed[y*c.Size+x] = true
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func ring(dx, dy int) int {
+	if abs(dx) > abs(dy) {
+		return abs(dx)
+	}
+	return abs(dy)
+}
+
+// drawFunctions draws the timing, finder and alignment patterns and
+// reserves the format and version areas.
+func (c *Code) drawFunctions() {
+	n := c.Size
+	for i := 0; i < n; i++ {
+		c.set(6, i, i%2 == 0)
+		c.set(i, 6, i%2 == 0)
+	}
+	for _, f := range [3][2]int{{3, 3}, {n - 4, 3}, {3, n - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := f[0]+dx, f[1]+dy
+				if x >= 0 && y >= 0 && x < n && y < n {
+					d := ring(dx, dy)
+					c.set(x, y, d != 2 && d != 4)
+				}
+			}
+		}
+	}
+	pos := alignment[c.Version]
+	last := len(pos) - 1
+	for i, x := range pos {
+		for j, y := range pos {
+			if i == 0 && j == 0 || i == 0 && j == last || i == last && j == 0 {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					c.set(x+dx, y+dy, ring(dx, dy) != 1)
+				}
+			}
+		}
+	}
+	c.drawFormat(0)
+	c.drawVersion()
+}
+
+// drawFormat writes both copies of the level and mask, and the dark
+// module beside the bottom left finder.
+func (c *Code) drawFormat(mask int) {
+	data := levelBits[c.Level]<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return bits>>uint(i)&1 == 1 }
+
+	n := c.Size
+	for i := 0; i <= 5; i++ {
+		c.set(8, i, bit(i))
+	}
+	c.set(8, 7, bit(6))
+	c.set(8, 8, bit(7))
+	c.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		c.set(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		c.set(n-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		c.set(8, n-15+i, bit(i))
+	}
+	c.set(8, n-8, true)
+}
+
+// drawVersion writes both copies of the version from version 7 up.
+func (c *Code) drawVersion() {
+	if c.Version < 7 {
+		return
+	}
+	rem := c.Version
+	for i := 0; i < 12; i++ {
+		rem = rem<<1 ^ (rem>>11)*0x1F25
+	}
+	bits := c.Version<<12 | rem
+	for i := 0; i < 18; i++ {
+		dark := bits>>uint(i)&1 == 1
+		a, b := c.Size-11+i%3, i/3
+		c.set(a, b, dark)
+		c.set(b, a, dark)
+	}
+}
+
+// place fills the free modules with codewords, two columns at a time in
+// a zigzag from the bottom right, stepping over the vertical timing
+// pattern. Modules left over stay light.
+func (c *Code) place(data []byte) {
+	n := c.Size
+	i := 0
+	for right := n - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < n; vert++ {
+			for j := 0; j < 2; j++ {
+				x, y := right-j, vert
+				if (right+1)&2 == 0 {
+					y = n - 1 - vert
+				}
+				if !c.fixed[y*n+x] && i < len(data)*8 {
+					c.dark[y*n+x] = data[i>>3]>>uint(7-i&7)&1 == 1
+					i++
+				}
+			}
+		}
+	}
+}
+
+// applyMask flips the data modules mask selects. Applying it twice undoes
+// it.
+func (c *Code) applyMask(mask int) {
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			var flip bool
+			switch mask {
+			case 0:
+				flip = (x+y)%2 == 0
+			case 1:
+				flip = y%2 == 0
+			case 2:
+				flip = x%3 == 0
+			case 3:
+				flip = (x+y)%3 == 0
+			case 4:
+				flip = (x/3+y/2)%2 == 0
+			case 5:
+				flip = x*y%2+x*y%3 == 0
+			case 6:
+				flip = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				flip = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if i := y*c.Size + x; flip && !c.fixed[i] {
+				c.dark[i] = !c.dark[i]
+			}
+		}
+	}
+}
+
+// finderLike is the 1:1:3:1:1 pattern readers look for.
+var finderLike = []bool{true, false, true, true, true, false, true}
+
+// penalty scores how hard the symbol is to read; the mask with the lowest
+// score is used.
+func (c *Code) penalty() int {
+	n := c.Size
+	p := 0
+	line := make([]bool, n)
+	for _, vertical := range []bool{false, true} {
+		for a := 0; a < n; a++ {
+			for b := 0; b < n; b++ {
+				if vertical {
+					line[b] = c.Dark(a, b)
+				} else {
+					line[b] = c.Dark(b, a)
+				}
+			}
+			p += linePenalty(line)
+		}
+	}
+	dark := 0
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			d := c.Dark(x, y)
+			if d {
+				dark++
+			}
+			if x+1 < n && y+1 < n && d == c.Dark(x+1, y) && d == c.Dark(x, y+1) && d == c.Dark(x+1, y+1) {
+				p += 3
+			}
+		}
+	}
+	total := n * n
+	if k := (abs(dark*20-total*10)+total-1)/total - 1; k > 0 {
+		p += 10 * k
+	}
+	return p
+}
+
+// linePenalty scores runs of five or more modules of one colour and
+// finder-like patterns with four light modules on either side.
+func linePenalty(line []bool) int {
+	p := 0
+	run := 1
+	for i := 1; i <= len(line); i++ {
+		if i < len(line) && line[i] == line[i-1] {
+			run++
+			continue
+		}
+		if run >= 5 {
+			p += 3 + run - 5
+		}
+		run = 1
+	}
+	light := func(from, to int) bool {
+		for i := from; i < to; i++ {
+			if i >= 0 && i < len(line) && line[i] {
+				return false
+			}
+		}
+		return true
+	}
+	for i := 0; i+len(finderLike) <= len(line); i++ {
+		match := true
+		for j, d := range finderLike {
+			if line[i+j] != d {
+				match = false
+				break
+			}
+		}
+		if match && (light(i-4, i) || light(i+len(finderLike), i+len(finderLike)+4)) {
+			p += 40
+		}
+	}
+	return p
+}
@@ -0,0 +1,277 @@
+package qr
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// formatStrings is the format information table of ISO/IEC 18004, by
+// level and mask.
+var formatStrings = [4][8]string{
+	{"111011111000100", "111001011110011", "111110110101010", "111100010011101", "110011000101111", "110001100011000", "110110001000001", "110100101110110"},
+	{"101010000010010", "101000100100101", "101111001111100", "101101101001011", "100010111111001", "100000011001110", "100111110010111", "100101010100000"},
+	{"011010101011111", "011000001101000", "011111100110001", "011101000000110", "010010010110100", "010000110000011", "010111011011010", "010101111101101"},
+	{"001011010001001", "001001110111110", "001110011100111", "001100111010000", "000011101100010", "000001001010101", "000110100001100", "000100000111011"},
+}
+
+// versionStrings is the version information table from version 7 up.
+var versionStrings = map[int]string{
+	7:  "000111110010010100",
+	8:  "001000010110111100",
+	9:  "001001101010011001",
+	10: "001010010011010011",
+}
+
+func bitString(c *Code, n int, at func(i int) (int, int)) string {
+	var b []byte
+	for i := n - 1; i >= 0; i-- {
+		x, y := at(i)
+		if c.Dark(x, y) {
+			b = append(b, '1')
+		} else {
+			b = append(b, '0')
+		}
+	}
+	return string(b)
+}
+
+// readFormat reads both copies of the format information, most
+// significant bit first.
+func readFormat(c *Code) (string, string) {
+	n := c.Size
+	first := bitString(c, 15, func(i int) (int, int) {
+		switch {
+		case i <= 5:
+			return 8, i
+		case i == 6:
+			return 8, 7
+		case i == 7:
+			return 8, 8
+		case i == 8:
+			return 7, 8
+		}
+		return 14 - i, 8
+	})
+	second := bitString(c, 15, func(i int) (int, int) {
+		if i < 8 {
+			return n - 1 - i, 8
+		}
+		return 8, n - 15 + i
+	})
+	return first, second
+}
+
+// readCodewords unmasks the symbol and reads the codewords back in
+// placement order.
+func readCodewords(c *Code) []byte {
+	n := c.Size
+	var out []byte
+	var cur byte
+	bits := 0
+	for right := n - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < n; vert++ {
+			for j := 0; j < 2; j++ {
+				x, y := right-j, vert
+				if (right+1)&2 == 0 {
+					y = n - 1 - vert
+				}
+				if c.fixed[y*n+x] {
+					continue
+				}
+				cur <<= 1
+				if c.Dark(x, y) != masked(c.Mask, x, y) {
+					cur |= 1
+				}
+				if bits++; bits%8 == 0 {
+					out = append(out, cur)
+				}
+			}
+		}
+	}
+	return out
+}
+
+func masked(mask int, x, y int) bool {
+	switch mask {
+	case 0:
+		return (x+y)%2 == 0
+	case 1:
+		return y%2 == 0
+	case 2:
+		return x%3 == 0
+	case 3:
+		return (x+y)%3 == 0
+	case 4:
+		return (x/3+y/2)%2 == 0
+	case 5:
+		return x*y%2+x*y%3 == 0
+	case 6:
+		return (x*y%2+x*y%3)%2 == 0
+	}
+	return ((x+y)%2+x*y%3)%2 == 0
+}
+
+// syndromesZero evaluates a block with its error correction at the
+// generator's roots.
+func syndromesZero(block []byte, ec int) bool {
+	root := byte(1)
+	for i := 0; i < ec; i++ {
+		s := byte(0)
+		for _, b := range block {
+			s = gfMul(s, root) ^ b
+		}
+		if s != 0 {
+			return false
+		}
+		root = gfMul(root, 2)
+	}
+	return true
+}
+
+// decode undoes the interleaving, checks every block and reads the byte
+// mode segment.
+func decode(t *testing.T, c *Code) string {
+	b := blocks[c.Version][c.Level]
+	cw := readCodewords(c)
+	var sizes []int
+	for i := 0; i < b.n1; i++ {
+		sizes = append(sizes, b.d1)
+	}
+	for i := 0; i < b.n2; i++ {
+		sizes = append(sizes, b.d2)
+	}
+	ds := make([][]byte, len(sizes))
+	k := 0
+	for i := 0; i < b.d2 || i < b.d1; i++ {
+		for n, size := range sizes {
+			if i < size {
+				ds[n] = append(ds[n], cw[k])
+				k++
+			}
+		}
+	}
+	var data []byte
+	for n := range ds {
+		block := ds[n]
+		for i := 0; i < b.ec; i++ {
+			block = append(block, cw[k+i*len(sizes)+n])
+		}
+		if !syndromesZero(block, b.ec) {
+			t.Errorf("version %d-%s: block %d does not check", c.Version, c.Level, n)
+		}
+		data = append(data, ds[n]...)
+	}
+
+	bb := bitReader{b: data}
+	if mode := bb.get(4); mode != 4 {
+		t.Fatalf("mode %d is not byte mode", mode)
+	}
+	count := bb.get(countBits(c.Version))
+	var text []byte
+	for i := 0; i < count; i++ {
+		text = append(text, byte(bb.get(8)))
+	}
+	return string(text)
+}
+
+type bitReader struct {
+	b []byte
+	n int
+}
+
+func (br *bitReader) get(n int) int {
+	v := 0
+	for i := 0; i < n; i++ {
+		v = v<<1 | int(br.b[br.n/8]>>uint(7-br.n%8)&1)
+		br.n++
+	}
+	return v
+}
+
+func TestRemainder(t *testing.T) {
+	// the worked 1-M example of the standard's tutorials, HELLO WORLD
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if got := remainder(data, generator(10)); !bytes.Equal(got, want) {
+		t.Errorf("remainder = %v, want %v", got, want)
+	}
+}
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		text    string
+		level   Level
+		version int
+	}{
+		{"", L, 1},
+		{"https://example.com", L, 2},
+		{strings.Repeat("a", 17), L, 1},
+		{strings.Repeat("a", 18), L, 2},
+		{strings.Repeat("a", 7), H, 1},
+		{strings.Repeat("a", 14), M, 1},
+		{strings.Repeat("a", 11), Q, 1},
+		{"https://example.com/01/09506000134352/10/ABC123", M, 4},
+		{strings.Repeat("0123456789", 15), L, 7},
+		{strings.Repeat("x", 64), H, 7},
+		{strings.Repeat("x", 65), H, 8},
+		{strings.Repeat("z", 271), L, 10},
+		{strings.Repeat("z", 119), H, 10},
+		{strings.Repeat("q", 151), Q, 10},
+	}
+	for _, tt := range tests {
+		c, err := Encode(tt.text, tt.level)
+		if err != nil {
+			t.Errorf("Encode(%d bytes, %s): %v", len(tt.text), tt.level, err)
+			continue
+		}
+		name := strconv.Itoa(len(tt.text)) + " bytes at " + tt.level.String()
+		if c.Version != tt.version || c.Size != 17+4*tt.version {
+			t.Errorf("%s: version %d size %d, want version %d", name, c.Version, c.Size, tt.version)
+			continue
+		}
+		first, second := readFormat(c)
+		if want := formatStrings[tt.level][c.Mask]; first != want || second != want {
+			t.Errorf("%s: format %s and %s, want %s", name, first, second, want)
+		}
+		if want, ok := versionStrings[c.Version]; ok {
+			got := bitString(c, 18, func(i int) (int, int) { return i / 3, c.Size - 11 + i%3 })
+			other := bitString(c, 18, func(i int) (int, int) { return c.Size - 11 + i%3, i / 3 })
+			if got != want || other != want {
+				t.Errorf("%s: version %s and %s, want %s", name, got, other, want)
+			}
+		}
+		for _, f := range [3][2]int{{0, 0}, {c.Size - 7, 0}, {0, c.Size - 7}} {
+			if !c.Dark(f[0], f[1]) || !c.Dark(f[0]+3, f[1]+3) || c.Dark(f[0]+1, f[1]+1) {
+				t.Errorf("%s: no finder at %v", name, f)
+			}
+		}
+		if got := decode(t, c); got != tt.text {
+			t.Errorf("%s: decoded %q", name, got)
+		}
+	}
+}
+
+func TestEncodeTooLong(t *testing.T) {
+	tests := []struct {
+		n     int
+		level Level
+	}{
+		{272, L},
+		{214, M},
+		{152, Q},
+		{120, H},
+	}
+	for _, tt := range tests {
+		if _, err := Encode(strings.Repeat("a", tt.n), tt.level); err == nil {
+			t.Errorf("Encode(%d bytes, %s) fit", tt.n, tt.level)
+		}
+	}
+	if _, err := Encode("a", Level(4)); err == nil {
+		t.Error("Encode accepted level 4")
+	}
+}
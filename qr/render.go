@@ -0,0 +1,59 @@
+package qr
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// QuietZone is the light border, in modules, readers need around a code.
+const QuietZone = 4
+
+// Image draws the code scale pixels to a module with a quiet zone of
+// border modules, as a two colour paletted image.
+func (c *Code) Image(scale int, border int) *image.Paletted {
+	if scale < 1 {
+		scale = 1
+	}
+	side := (c.Size + 2*border) * scale
+	img := image.NewPaletted(image.Rect(0, 0, side, side), color.Palette{color.White, color.Black})
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if !c.Dark(x, y) {
+				continue
+			}
+			px, py := (x+border)*scale, (y+border)*scale
+			for dy := 0; dy < scale; dy++ {
+				row := img.Pix[(py+dy)*img.Stride:]
+				for dx := 0; dx < scale; dx++ {
+					row[px+dx] = 1
+				}
+			}
+		}
+	}
+	return img
+}
+
+// SVG draws the code as one path of unit squares in a viewBox of modules,
+// sized scale pixels to a module, with a quiet zone of border modules.
+func (c *Code) SVG(scale int, border int) []byte {
+	if scale < 1 {
+		scale = 1
+	}
+	side := c.Size + 2*border
+	var b bytes.Buffer
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`+"\n", side*scale, side*scale, side, side)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="#fff"/>`+"\n", side, side)
+	b.WriteString(`<path fill="#000" d="`)
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if c.Dark(x, y) {
+				fmt.Fprintf(&b, "M%d %dh1v1h-1z", x+border, y+border)
+			}
+		}
+	}
+	b.WriteString("\"/>\n</svg>\n")
+	return b.Bytes()
+}
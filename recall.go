@@ -0,0 +1,636 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Recall states. A recall is notified once its notices are out, and ends
+// closed or cancelled.
+const (
+	recallOpen       = "open"
+	recallNotified   = "notified"
+	recallInProgress = "in_progress"
+	recallClosed     = "closed"
+	recallCancelled  = "cancelled"
+)
+
+var recallMoves = map[string][]string{
+	recallOpen:       {recallNotified, recallInProgress, recallClosed, recallCancelled},
+	recallNotified:   {recallInProgress, recallClosed, recallCancelled},
+	recallInProgress: {recallClosed, recallCancelled},
+}
+
+// RecallCriteria says where a recall starts. Post, Farm and Parcel pick
+// suspect lots; From and To (farm dates, inclusive) keep those harvested in
+// the window, or pick every lot harvested then when nothing else is given.
+type RecallCriteria struct {
+	Post   string `json:"post,omitempty" bson:"post,omitempty"`
+	Farm   string `json:"farm,omitempty" bson:"farm,omitempty"`
+	Parcel string `json:"parcel,omitempty" bson:"parcel,omitempty"`
+	From   string `json:"from,omitempty" bson:"from,omitempty"`
+	To     string `json:"to,omitempty" bson:"to,omitempty"`
+}
+
+// AffectedLot is a lot to pull, Depth steps downstream of the suspect lot
+// Seed, with who has it now.
+type AffectedLot struct {
+	Post     primitive.ObjectID `json:"post" bson:"post"`
+	Tag      string             `json:"tag" bson:"tag"`
+	Name     string             `json:"name" bson:"name"`
+	Amount   int                `json:"amount" bson:"amount"`
+	Unit     string             `json:"unit" bson:"unit"`
+	Progress string             `json:"progress" bson:"progress"`
+	Seed     string             `json:"seed" bson:"seed"`
+	Depth    int                `json:"depth" bson:"depth"`
+	Farm     string             `json:"farm,omitempty" bson:"farm,omitempty"`
+	Factory  string             `json:"factory,omitempty" bson:"factory,omitempty"`
+	Market   string             `json:"market,omitempty" bson:"market,omitempty"`
+	Holders  []Holding          `json:"holders" bson:"holders"`
+	// Package is the outermost package the lot is packed in now.
+	Package string `json:"package,omitempty" bson:"package,omitempty"`
+}
+
+// AffectedParty is an organisation with a part in affected lots.
+type AffectedParty struct {
+	Name  string   `json:"name" bson:"name"`
+	Roles []string `json:"roles" bson:"roles"`
+	Lots  []string `json:"lots" bson:"lots"`
+}
+
+// RecallStatus is one entry of a recall's history.
+type RecallStatus struct {
+	Status string `json:"status" bson:"status"`
+	By     string `json:"by" bson:"by"`
+	Time   string `json:"time" bson:"time"`
+	Note   string `json:"note,omitempty" bson:"note,omitempty"`
+}
+
+// Recall is a pull of every lot downstream of the suspect ones.
+type Recall struct {
+	ID       primitive.ObjectID `json:"id" bson:"_id"`
+	Reason   string             `json:"reason" bson:"reason"`
+	Criteria RecallCriteria     `json:"criteria" bson:"criteria"`
+	Status   string             `json:"status" bson:"status"`
+	History  []RecallStatus     `json:"history" bson:"history"`
+	Lots     []*AffectedLot     `json:"lots" bson:"lots"`
+	Parties  []*AffectedParty   `json:"parties" bson:"parties"`
+	Created  string             `json:"created" bson:"created"`
+}
+
+// Notification is a notice for one user, such as a recall of lots they
+// have had a part in.
+type Notification struct {
+	ID           primitive.ObjectID `json:"id" bson:"_id"`
+	Recipient    string             `json:"recipient" bson:"recipient"`
+	Kind         string             `json:"kind" bson:"kind"`
+	Ref          primitive.ObjectID `json:"ref" bson:"ref"`
+	Subject      string             `json:"subject" bson:"subject"`
+	Lots         []string           `json:"lots" bson:"lots"`
+	Created      string             `json:"created" bson:"created"`
+	Acknowledged string             `json:"acknowledged,omitempty" bson:"acknowledged,omitempty"`
+}
+
+func (s *service) recallAllowed(w http.ResponseWriter, r *http.Request) (*session, bool) {
+	se := s.sessionFrom(r)
+	if se == nil {
+		writeMessage(w, http.StatusUnauthorized, "session required")
+		return nil, false
+	}
+	if !identitySet("RECALL_IDENTITIES", "admin")[se.Identity] {
+		writeMessage(w, http.StatusForbidden, "recalls are not available to "+se.Identity)
+		return nil, false
+	}
+	return se, true
+}
+
+// harvestTimes maps posts to when they were recorded harvested.
+func (s *service) harvestTimes(ctx context.Context) (map[string]time.Time, error) {
+	cur, err := s.db.QueryFilter(ctx, "lifecycle", bson.M{"to": "harvested"})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	ret := map[string]time.Time{}
+	for cur.Next(ctx) {
+		ev := &LifecycleEvent{}
+		if err := cur.Decode(ev); err != nil {
+			continue
+		}
+		if t, err := time.Parse(time.RFC3339, ev.Time); err == nil {
+			ret[ev.Post] = t
+		}
+	}
+	return ret, nil
+}
+
+// window reads the harvest window of c as [from, to), to being the day
+// after c.To. Either is zero when not given.
+func (c *RecallCriteria) window() (time.Time, time.Time, error) {
+	var from, to time.Time
+	var err error
+	if c.From != "" {
+		if from, err = time.ParseInLocation("2006-01-02", c.From, farmZone); err != nil {
+			return from, to, uploadErrorf(http.StatusBadRequest, "from must be a date like 2006-01-02")
+		}
+	}
+	if c.To != "" {
+		if to, err = time.ParseInLocation("2006-01-02", c.To, farmZone); err != nil {
+			return from, to, uploadErrorf(http.StatusBadRequest, "to must be a date like 2006-01-02")
+		}
+		to = to.AddDate(0, 0, 1)
+	}
+	if !from.IsZero() && !to.IsZero() && !from.Before(to) {
+		return from, to, uploadErrorf(http.StatusBadRequest, "from must not be after to")
+	}
+	return from, to, nil
+}
+
+// harvestedIn keeps the posts harvested in [from, to), by the recorded
+// harvest in harvested or, without one, by the post's date.
+func harvestedIn(posts []*Post, harvested map[string]time.Time, from, to time.Time) []*Post {
+	var ret []*Post
+	for _, p := range posts {
+		t, ok := harvested[p.ID.Hex()]
+		if !ok {
+			var err error
+			if t, err = time.ParseInLocation(time.ANSIC, p.Date, farmZone); err != nil {
+				continue
+			}
+		}
+		if (from.IsZero() || !t.Before(from)) && (to.IsZero() || t.Before(to)) {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+// recallSeeds finds the suspect lots c describes.
+func (s *service) recallSeeds(ctx context.Context, c *RecallCriteria) ([]*Post, error) {
+	from, to, err := c.window()
+	if err != nil {
+		return nil, err
+	}
+	window := !from.IsZero() || !to.IsZero()
+
+	or := bson.A{}
+	if c.Post != "" {
+		id, err := primitive.ObjectIDFromHex(c.Post)
+		if err != nil {
+			return nil, uploadErrorf(http.StatusBadRequest, "bad post id %s", c.Post)
+		}
+		or = append(or, bson.M{"_id": id})
+	}
+	if c.Farm != "" {
+		or = append(or, bson.M{"farm": c.Farm})
+	}
+	if c.Parcel != "" {
+		cur, err := s.db.QueryFilter(ctx, "bcposts", bson.M{"$or": bson.A{bson.M{"dddh": c.Parcel}, bson.M{"images.cadastral.best.label": c.Parcel}}})
+		if err != nil {
+			return nil, err
+		}
+		ids := bson.A{}
+		for cur.Next(ctx) {
+			bc := &BCdataa{}
+			if err := cur.Decode(bc); err == nil {
+				ids = append(ids, bc.ID)
+			}
+		}
+		cur.Close(ctx)
+		or = append(or, bson.M{"_id": bson.M{"$in": ids}})
+	}
+	filter := bson.M{}
+	if len(or) > 0 {
+		filter["$or"] = or
+	} else if !window {
+		return nil, uploadErrorf(http.StatusBadRequest, "a post, farm, parcel or date window is required")
+	} else {
+		// only lots of their own are harvested, derived lots come
+		// from the walk
+		filter["parents"] = bson.M{"$exists": false}
+	}
+	posts, err := s.postsWhere(ctx, filter)
+	if err != nil || !window {
+		return posts, err
+	}
+
+	harvested, err := s.harvestTimes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return harvestedIn(posts, harvested, from, to), nil
+}
+
+// recallImpact walks downstream of every seed and collects the lots, who
+// holds them and every party that has had them. A package recalls what is
+// packed in it.
+func (s *service) recallImpact(ctx context.Context, seeds []*Post) ([]*AffectedLot, []*AffectedParty, error) {
+	var packed []*Post
+	for _, seed := range seeds {
+		if seed.Package == "" {
+			continue
+		}
+		contents, err := s.contents(ctx, seed)
+		if err != nil {
+			return nil, nil, err
+		}
+		packed = append(packed, contents...)
+	}
+	seeds = append(seeds, packed...)
+	lots := map[primitive.ObjectID]*AffectedLot{}
+	var order []*AffectedLot
+	posts := map[primitive.ObjectID]*Post{}
+	for _, seed := range seeds {
+		g, err := s.lineage(ctx, seed, false, true, maxLineageDepth)
+		if err != nil {
+			return nil, nil, err
+		}
+		var ids bson.A
+		for _, n := range g.Nodes {
+			if _, ok := lots[n.ID]; ok {
+				continue
+			}
+			lots[n.ID] = &AffectedLot{Post: n.ID, Tag: n.Tag, Name: n.Name, Amount: n.Amount, Progress: n.Progress, Seed: seed.Tag, Depth: n.Depth, Farm: n.Farm, Factory: n.Factory, Market: n.Market}
+			order = append(order, lots[n.ID])
+			ids = append(ids, n.ID)
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		found, err := s.postsWhere(ctx, bson.M{"_id": bson.M{"$in": ids}})
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, p := range found {
+			posts[p.ID] = p
+		}
+	}
+
+	parties := recallParties{}
+	for _, l := range order {
+		p := posts[l.Post]
+		if p == nil {
+			continue
+		}
+		l.Package = s.outermost(ctx, p)
+		transfers, err := s.transfersWhere(ctx, bson.M{"post": p.ID, "status": transferAccepted})
+		if err != nil {
+			return nil, nil, err
+		}
+		parties.affect(l, p, transfers, time.Now())
+	}
+	return order, parties.list(), nil
+}
+
+// recallParties gathers the parties of a recall by name.
+type recallParties map[string]*AffectedParty
+
+func (rp recallParties) involve(name string, role string, lot string) {
+	if name == "" {
+		return
+	}
+	p := rp[name]
+	if p == nil {
+		p = &AffectedParty{Name: name}
+		rp[name] = p
+	}
+	if !containsString(p.Roles, role) {
+		p.Roles = append(p.Roles, role)
+	}
+	if !containsString(p.Lots, lot) {
+		p.Lots = append(p.Lots, lot)
+	}
+}
+
+// affect fills in the unit and holders of l, the lot of p, from its
+// accepted transfers, and involves everyone who has had a part in it.
+func (rp recallParties) affect(l *AffectedLot, p *Post, transfers []*Transfer, now time.Time) {
+	l.Unit = unitOf(p)
+	l.Holders = []Holding{}
+	for party, amount := range holdings(p, transfers, now) {
+		l.Holders = append(l.Holders, Holding{Party: party, Amount: amount})
+		rp.involve(party, "holder", l.Tag)
+	}
+	sort.Slice(l.Holders, func(i, j int) bool { return l.Holders[i].Party < l.Holders[j].Party })
+	for _, t := range transfers {
+		rp.involve(t.Sender, "handled", l.Tag)
+		rp.involve(t.Receiver, "handled", l.Tag)
+	}
+	rp.involve(p.User, roleFarmer, l.Tag)
+	rp.involve(p.Factory, roleFactory, l.Tag)
+	rp.involve(p.Market, roleMarket, l.Tag)
+}
+
+// list is the parties by name.
+func (rp recallParties) list() []*AffectedParty {
+	var names []string
+	for n := range rp {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	ret := []*AffectedParty{}
+	for _, n := range names {
+		ret = append(ret, rp[n])
+	}
+	return ret
+}
+
+func containsString(list []string, v string) bool {
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// notifyRecall leaves a notice for every affected party and, when
+// RECALL_WEBHOOK_URL is set, posts each notice there as well.
+func (s *service) notifyRecall(ctx context.Context, rc *Recall) int {
+	n := 0
+	hook := os.Getenv("RECALL_WEBHOOK_URL")
+	for _, p := range rc.Parties {
+		note := &Notification{ID: primitive.NewObjectID(), Recipient: p.Name, Kind: "recall", Ref: rc.ID, Subject: "Recall: " + rc.Reason, Lots: p.Lots, Created: rc.Created}
+		if _, err := s.db.Add(ctx, "notifications", note); err != nil {
+			log.Println("err notifying", p.Name, err)
+			continue
+		}
+		n++
+		if hook != "" {
+			go postWebhook(hook, note)
+		}
+	}
+	return n
+}
+
+func postWebhook(url string, v interface{}) {
+	d, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	res, err := client.Post(url, "application/json", bytes.NewReader(d))
+	if err != nil {
+		log.Println("err posting webhook", err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		log.Println("webhook answered", res.Status)
+	}
+}
+
+// newRecall handles POST /recalls: it works out the impact, records the
+// recall and notifies everyone affected.
+func (s *service) newRecall(w http.ResponseWriter, r *http.Request) {
+	se, ok := s.recallAllowed(w, r)
+	if !ok {
+		return
+	}
+	var in struct {
+		RecallCriteria
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil || in.Reason == "" {
+		writeMessage(w, http.StatusBadRequest, "a reason is required")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	seeds, err := s.recallSeeds(ctx, &in.RecallCriteria)
+	if err != nil {
+		writeMessage(w, uploadStatus(err), err.Error())
+		return
+	}
+	if len(seeds) == 0 {
+		writeMessage(w, http.StatusNotFound, "no lots match")
+		return
+	}
+	lots, parties, err := s.recallImpact(ctx, seeds)
+	if err != nil {
+		log.Println("err working out recall impact", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now().In(farmZone).Format(time.RFC3339)
+	rc := &Recall{ID: primitive.NewObjectID(), Reason: in.Reason, Criteria: in.RecallCriteria, Status: recallOpen, Lots: lots, Parties: parties, Created: now}
+	rc.History = []RecallStatus{{Status: recallOpen, By: se.Username, Time: now}}
+	if _, err := s.db.Add(ctx, "recalls", rc); err != nil {
+		log.Println("err adding recall", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	// only tell the parties once the recall they are pointed at exists
+	if n := s.notifyRecall(ctx, rc); n > 0 {
+		h := RecallStatus{Status: recallNotified, By: se.Username, Time: now, Note: strconv.Itoa(n) + " parties notified"}
+		update := bson.M{"$set": bson.M{"status": recallNotified}, "$push": bson.M{"history": h}}
+		if err := s.db.ModifyFilter(ctx, "recalls", bson.M{"_id": rc.ID, "status": recallOpen}, update).Decode(rc); err != nil {
+			log.Println("err marking recall notified", rc.ID.Hex(), err)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(rc)
+}
+
+func (s *service) recallFromVars(ctx context.Context, w http.ResponseWriter, r *http.Request) (*Recall, bool) {
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, false
+	}
+	rc := &Recall{}
+	if err := s.db.QueryOne(ctx, "recalls", "_id", id).Decode(rc); err != nil {
+		writeMessage(w, http.StatusNotFound, "recall not found")
+		return nil, false
+	}
+	return rc, true
+}
+
+// allRecalls lists recalls, newest first, narrowed by ?status=.
+func (s *service) allRecalls(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.recallAllowed(w, r); !ok {
+		return
+	}
+	filter := bson.M{}
+	if st := r.URL.Query().Get("status"); st != "" {
+		filter["status"] = st
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cur, err := s.db.QueryFilter(ctx, "recalls", filter, options.Find().SetSort(bson.M{"created": -1}))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer cur.Close(ctx)
+	ret := []*Recall{}
+	for cur.Next(ctx) {
+		rc := &Recall{}
+		if err := cur.Decode(rc); err != nil {
+			log.Println(err)
+			continue
+		}
+		ret = append(ret, rc)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ret)
+}
+
+func (s *service) recall(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.recallAllowed(w, r); !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rc, ok := s.recallFromVars(ctx, w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rc)
+}
+
+// recallStatus moves a recall on, keeping the history.
+func (s *service) recallStatus(w http.ResponseWriter, r *http.Request) {
+	se, ok := s.recallAllowed(w, r)
+	if !ok {
+		return
+	}
+	var in struct {
+		Status string `json:"status"`
+		Note   string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		writeMessage(w, http.StatusBadRequest, "body must be a json status")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rc, ok := s.recallFromVars(ctx, w, r)
+	if !ok {
+		return
+	}
+	if !containsString(recallMoves[rc.Status], in.Status) {
+		writeMessage(w, http.StatusConflict, "a "+rc.Status+" recall cannot become "+in.Status)
+		return
+	}
+	h := RecallStatus{Status: in.Status, By: se.Username, Time: time.Now().In(farmZone).Format(time.RFC3339), Note: in.Note}
+	update := bson.M{"$set": bson.M{"status": in.Status}, "$push": bson.M{"history": h}}
+	err := s.db.ModifyFilter(ctx, "recalls", bson.M{"_id": rc.ID, "status": rc.Status}, update).Decode(rc)
+	if err == mongo.ErrNoDocuments {
+		writeMessage(w, http.StatusConflict, "recall changed meanwhile")
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rc)
+}
+
+// exportRecall writes the affected lots as CSV, or as JSON with the
+// parties when ?format=json.
+func (s *service) exportRecall(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.recallAllowed(w, r); !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rc, ok := s.recallFromVars(ctx, w, r)
+	if !ok {
+		return
+	}
+	name := "recall_" + rc.ID.Hex()
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.json"`)
+		json.NewEncoder(w).Encode(map[string]interface{}{"recall": rc.ID, "reason": rc.Reason, "status": rc.Status, "lots": rc.Lots, "parties": rc.Parties})
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.csv"`)
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"tag", "name", "amount", "unit", "progress", "seed", "depth", "farm", "factory", "market", "holders"})
+	for _, l := range rc.Lots {
+		var holders []string
+		for _, h := range l.Holders {
+			holders = append(holders, h.Party+":"+strconv.Itoa(h.Amount))
+		}
+		cw.Write([]string{l.Tag, l.Name, strconv.Itoa(l.Amount), l.Unit, l.Progress, l.Seed, strconv.Itoa(l.Depth), l.Farm, l.Factory, l.Market, strings.Join(holders, ";")})
+	}
+	cw.Flush()
+}
+
+// notifications lists the caller's notices, unacknowledged first.
+func (s *service) notifications(w http.ResponseWriter, r *http.Request) {
+	se := s.sessionFrom(r)
+	if se == nil {
+		writeMessage(w, http.StatusUnauthorized, "session required")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cur, err := s.db.QueryFilter(ctx, "notifications", bson.M{"recipient": se.Username}, options.Find().SetSort(bson.M{"created": -1}).SetLimit(200))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer cur.Close(ctx)
+	ret := []*Notification{}
+	for cur.Next(ctx) {
+		n := &Notification{}
+		if err := cur.Decode(n); err != nil {
+			continue
+		}
+		ret = append(ret, n)
+	}
+	sort.SliceStable(ret, func(i, j int) bool { return ret[i].Acknowledged == "" && ret[j].Acknowledged != "" })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ret)
+}
+
+func (s *service) ackNotification(w http.ResponseWriter, r *http.Request) {
+	se := s.sessionFrom(r)
+	if se == nil {
+		writeMessage(w, http.StatusUnauthorized, "session required")
+		return
+	}
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	n := &Notification{}
+	filter := bson.M{"_id": id, "recipient": se.Username}
+	err = s.db.ModifyFilter(ctx, "notifications", filter, bson.M{"$set": bson.M{"acknowledged": time.Now().In(farmZone).Format(time.RFC3339)}}).Decode(n)
+	if err == mongo.ErrNoDocuments {
+		writeMessage(w, http.StatusNotFound, "notification not found")
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(n)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// recallTime reads a farm wall clock time.
+func recallTime(s string) time.Time {
+	t, err := time.ParseInLocation("2006-01-02 15:04", s, farmZone)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestRecallWindow(t *testing.T) {
+	tests := []struct {
+		name     string
+		c        RecallCriteria
+		from, to string
+		err      bool
+	}{
+		{"none", RecallCriteria{Farm: "f1"}, "", "", false},
+		{"from only", RecallCriteria{From: "2026-03-01"}, "2026-03-01 00:00", "", false},
+		{"to is inclusive", RecallCriteria{To: "2026-03-31"}, "", "2026-04-01 00:00", false},
+		{"one day", RecallCriteria{From: "2026-03-01", To: "2026-03-01"}, "2026-03-01 00:00", "2026-03-02 00:00", false},
+		{"reversed", RecallCriteria{From: "2026-03-02", To: "2026-03-01"}, "", "", true},
+		{"bad from", RecallCriteria{From: "1 March 2026"}, "", "", true},
+		{"bad to", RecallCriteria{To: "2026-02-30"}, "", "", true},
+	}
+	for _, tt := range tests {
+		from, to, err := tt.c.window()
+		if (err != nil) != tt.err {
+			t.Errorf("%s: window = %v", tt.name, err)
+			continue
+		}
+		if err != nil {
+			if uploadStatus(err) != 400 {
+				t.Errorf("%s: status %d, want 400", tt.name, uploadStatus(err))
+			}
+			continue
+		}
+		for _, b := range []struct {
+			got  time.Time
+			want string
+		}{{from, tt.from}, {to, tt.to}} {
+			if b.want == "" && !b.got.IsZero() || b.want != "" && !b.got.Equal(recallTime(b.want)) {
+				t.Errorf("%s: window = %v, %v; want %q, %q", tt.name, from, to, tt.from, tt.to)
+			}
+		}
+	}
+}
+
+func TestHarvestedIn(t *testing.T) {
+	post := func(tag, date string) *Post {
+		return &Post{ID: primitive.NewObjectID(), Tag: tag, Date: date}
+	}
+	early := post("early", "Sun Mar  1 08:00:00 2026")
+	late := post("late", "Tue Mar 31 23:59:00 2026")
+	april := post("april", "Wed Apr  1 00:00:00 2026")
+	// recorded in March but harvested in February
+	stored := post("stored", "Mon Mar  2 09:00:00 2026")
+	undated := post("undated", "2026-03-05")
+	posts := []*Post{early, late, april, stored, undated}
+	harvested := map[string]time.Time{stored.ID.Hex(): recallTime("2026-02-27 10:00")}
+
+	tests := []struct {
+		name     string
+		from, to string
+		want     []*Post
+	}{
+		{"march", "2026-03-01 00:00", "2026-04-01 00:00", []*Post{early, late}},
+		{"from february", "2026-02-01 00:00", "", []*Post{early, late, april, stored}},
+		{"until march", "", "2026-03-01 00:00", []*Post{stored}},
+		{"after everything", "2026-05-01 00:00", "", nil},
+	}
+	at := func(s string) time.Time {
+		if s == "" {
+			return time.Time{}
+		}
+		return recallTime(s)
+	}
+	for _, tt := range tests {
+		got := harvestedIn(posts, harvested, at(tt.from), at(tt.to))
+		if !reflect.DeepEqual(got, tt.want) {
+			var tags []string
+			for _, p := range got {
+				tags = append(tags, p.Tag)
+			}
+			t.Errorf("%s: harvestedIn = %v", tt.name, tags)
+		}
+	}
+}
+
+func TestRecallParties(t *testing.T) {
+	at := time.Date(2026, 3, 10, 0, 0, 0, 0, farmZone)
+	tr := func(from, to string, amount int, decided string) *Transfer {
+		return &Transfer{Sender: from, Receiver: to, Amount: amount, Status: transferAccepted, Decided: decided}
+	}
+	harvest := &Post{ID: primitive.NewObjectID(), Tag: "H", User: "ann", Factory: "mill", Amount: 100, Unit: "kg"}
+	lot := &Post{ID: primitive.NewObjectID(), Tag: "L", User: "ann", Factory: "mill", Market: "shop", Amount: 40, Unit: "g", Parents: []LotLink{{Tag: "H"}}}
+
+	rp := recallParties{}
+	h := &AffectedLot{Post: harvest.ID, Tag: "H"}
+	rp.affect(h, harvest, []*Transfer{
+		tr("ann", "mill", 60, "2026-03-02T09:00:00+08:00"),
+		tr("ann", "bob", 10, "2026-03-11T09:00:00+08:00"),
+	}, at)
+	l := &AffectedLot{Post: lot.ID, Tag: "L"}
+	rp.affect(l, lot, []*Transfer{tr("mill", "shop", 40, "2026-03-05T09:00:00+08:00")}, at)
+
+	if want := []Holding{{"ann", 40}, {"mill", 60}}; !reflect.DeepEqual(h.Holders, want) || h.Unit != "kg" {
+		t.Errorf("harvest held by %v in %s, want %v in kg", h.Holders, h.Unit, want)
+	}
+	if want := []Holding{{"shop", 40}}; !reflect.DeepEqual(l.Holders, want) || l.Unit != "g" {
+		t.Errorf("lot held by %v in %s, want %v in g", l.Holders, l.Unit, want)
+	}
+	want := []*AffectedParty{
+		{Name: "ann", Roles: []string{"holder", "handled", roleFarmer}, Lots: []string{"H", "L"}},
+		{Name: "bob", Roles: []string{"handled"}, Lots: []string{"H"}},
+		{Name: "mill", Roles: []string{"holder", "handled", roleFactory}, Lots: []string{"H", "L"}},
+		{Name: "shop", Roles: []string{"holder", "handled", roleMarket}, Lots: []string{"L"}},
+	}
+	if got := rp.list(); !reflect.DeepEqual(got, want) {
+		for _, p := range got {
+			t.Errorf("party %+v", *p)
+		}
+	}
+	if got := (recallParties{}).list(); got == nil || len(got) != 0 {
+		t.Errorf("no parties = %v, want an empty list", got)
+	}
+}
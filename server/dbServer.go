@@ -103,6 +103,71 @@ func (m *Mongodb) Update(ctx context.Context, col string, key string, val interf
 	return cur
 }
 
+// Modify applies a full update document such as {"$set": ..., "$push": ...}
+// and returns the document as it is afterwards.
+func (m *Mongodb) Modify(ctx context.Context, col string, key string, val interface{}, update interface{}) *mongo.SingleResult {
+	collection := m.client.Database(m.dbName).Collection(col)
+
+	q := bson.M{key: val}
+	ops := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	cur := collection.FindOneAndUpdate(ctx, q, update, ops)
+
+	return cur
+}
+
+// ModifyFilter is Modify for a document matching filter, so an update can
+// be made conditional on the document's current state.
+func (m *Mongodb) ModifyFilter(ctx context.Context, col string, filter interface{}, update interface{}) *mongo.SingleResult {
+	collection := m.client.Database(m.dbName).Collection(col)
+
+	ops := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	cur := collection.FindOneAndUpdate(ctx, filter, update, ops)
+
+	return cur
+}
+
+// Increment adds by to field of the document where key is val, creating
+// the document when there is none, and returns it as it is afterwards.
+func (m *Mongodb) Increment(ctx context.Context, col string, key string, val interface{}, field string, by int64) *mongo.SingleResult {
+	collection := m.client.Database(m.dbName).Collection(col)
+
+	q := bson.M{key: val}
+	ops := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	cur := collection.FindOneAndUpdate(ctx, q, bson.M{"$inc": bson.M{field: by}}, ops)
+
+	return cur
+}
+
+func (m *Mongodb) CreateIndex(ctx context.Context, col string, keys interface{}) (string, error) {
+	collection := m.client.Database(m.dbName).Collection(col)
+
+	return collection.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: keys})
+}
+
+// CreateUniqueIndex is CreateIndex for keys no two documents may share.
+func (m *Mongodb) CreateUniqueIndex(ctx context.Context, col string, keys interface{}) (string, error) {
+	collection := m.client.Database(m.dbName).Collection(col)
+
+	return collection.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: keys, Options: options.Index().SetUnique(true)})
+}
+
+// IsDuplicateKey says whether a write failed on a unique index.
+func IsDuplicateKey(err error) bool {
+	var errs mongo.WriteErrors
+	switch e := err.(type) {
+	case mongo.WriteException:
+		errs = e.WriteErrors
+	case mongo.WriteErrors:
+		errs = e
+	}
+	for _, we := range errs {
+		if we.Code == 11000 {
+			return true
+		}
+	}
+	return false
+}
+
 type Post struct {
 	ID        primitive.ObjectID `json:"id,omitempty" bson:"_id"`
 	Tag       string             `json:"tag" bson:"tag"`
@@ -135,6 +200,13 @@ func (m *Mongodb) QueryOne(ctx context.Context, col string, key string, val inte
 	return cur
 }
 
+// QueryFilterOne is QueryOne for a document matching filter.
+func (m *Mongodb) QueryFilterOne(ctx context.Context, col string, filter interface{}) *mongo.SingleResult {
+	collection := m.client.Database(m.dbName).Collection(col)
+
+	return collection.FindOne(ctx, filter)
+}
+
 func (m *Mongodb) Query(ctx context.Context, col string, key string, val interface{}) (*mongo.Cursor, error) {
 	collection := m.client.Database(m.dbName).Collection(col)
 	cur, err := collection.Find(ctx, bson.D{{key, val}})
@@ -148,6 +220,18 @@ func (m *Mongodb) Query(ctx context.Context, col string, key string, val interfa
 
 }
 
+func (m *Mongodb) QueryFilter(ctx context.Context, col string, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	collection := m.client.Database(m.dbName).Collection(col)
+	cur, err := collection.Find(ctx, filter, opts...)
+
+	if err != nil {
+		fmt.Println("find err")
+		return nil, err
+	}
+
+	return cur, nil
+}
+
 func (m *Mongodb) QueryAll(ctx context.Context, col string) (*mongo.Cursor, error) {
 	collection := m.client.Database(m.dbName).Collection(col)
 	cur, err := collection.Find(ctx, bson.D{})
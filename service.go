@@ -7,16 +7,16 @@ import (
 	"github.com/gocolly/colly"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
-	"github.com/rwcarlsen/goexif/exif"
-	"github.com/rwcarlsen/goexif/mknote"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"io"
 	"io/ioutil"
 	"log"
+	"mongo/geo"
+	"mongo/gs1"
 	"mongo/server"
 	"net/http"
 	"os"
-	"os/exec"
+	"reflect"
 	"strconv"
 	"strings"
 	"time"
@@ -31,34 +31,71 @@ type service struct {
 	db   *server.Mongodb
 	ip   string
 	port string
+
+	totp     *totpPolicy
+	sessions *sessionSigner
+	oidc     *oidcRegistry
+	cadastre *geo.Cadastre
+	photos   *photoIndex
+	jobs     *jobRunner
+	balance  *massBalance
 }
 
 type User struct {
-	ID         primitive.ObjectID `json:"id,omitempty" bson:"_id"`
-	Username   string             `json:"username" bson:"username"`
-	Name       string             `json:"name,omitempty" bson:"name"`
-	Department string             `json:"department,omitempty" bson:"department"`
-	Email      string             `json:"email,omitempty" bson:"email"`
-	Phone      string             `json:"phone,omitempty" bson:"phone"`
-	Password   string             `json:"password" bson:"password"`
-	Identity   string             `json:"identity" bson:"identity"`
+	ID            primitive.ObjectID `json:"id,omitempty" bson:"_id"`
+	Username      string             `json:"username" bson:"username"`
+	Name          string             `json:"name,omitempty" bson:"name"`
+	Department    string             `json:"department,omitempty" bson:"department"`
+	Email         string             `json:"email,omitempty" bson:"email"`
+	Phone         string             `json:"phone,omitempty" bson:"phone"`
+	Password      string             `json:"password" bson:"password"`
+	Identity      string             `json:"identity" bson:"identity"`
+	TOTPEnabled   bool               `json:"totpenabled,omitempty" bson:"totpenabled,omitempty"`
+	TOTPSecret    string             `json:"-" bson:"totpsecret,omitempty"`
+	TOTPPending   string             `json:"-" bson:"totppending,omitempty"`
+	TOTPLastStep  int64              `json:"-" bson:"totplaststep,omitempty"`
+	RecoveryCodes []string           `json:"-" bson:"recoverycodes,omitempty"`
+	OIDCIssuer    string             `json:"-" bson:"oidcissuer,omitempty"`
+	OIDCSubject   string             `json:"-" bson:"oidcsubject,omitempty"`
 }
 
 type BCdataa struct {
-	ID      primitive.ObjectID `json:"id" bson:"_id"`
-	Tag     string             `json:"tag" bson:"tag"`
-	Name    string             `json:"name,omitempty" bson:"name"`
-	Factory string             `json:"factory" bson:"factory"`
-	Date    string             `json:"date" bson:"date"`
-	Chain   string             `json:"chain" bson:"chain"`
-	Hash    []string           `json:"hash" bson:"hash"`
-	ImgHash []string           `json:"imghash" bson:"imghash"`
-	Image   string             `json:"image" bson:"image"`
-	Lat     string             `json:"lat" bson:"lat"`
-	Long    string             `json:"long" bson:"long"`
-	Dir     string             `json:"dir" bson:"dir"`
-	FocLen  string             `json:"foclen" bson:"foclen"`
-	DDDH    string             `json:"dddh" bson:"dddh"`
+	ID       primitive.ObjectID `json:"id" bson:"_id"`
+	Tag      string             `json:"tag" bson:"tag"`
+	Name     string             `json:"name,omitempty" bson:"name"`
+	Factory  string             `json:"factory" bson:"factory"`
+	Date     string             `json:"date" bson:"date"`
+	Chain    string             `json:"chain" bson:"chain"`
+	Hash     []string           `json:"hash" bson:"hash"`
+	ImgHash  []string           `json:"imghash" bson:"imghash"`
+	Image    string             `json:"image" bson:"image"`
+	Lat      string             `json:"lat" bson:"lat"`
+	Long     string             `json:"long" bson:"long"`
+	Dir      string             `json:"dir" bson:"dir"`
+	FocLen   string             `json:"foclen" bson:"foclen"`
+	DDDH     string             `json:"dddh" bson:"dddh"`
+	Images   []ImageEntry       `json:"images,omitempty" bson:"images,omitempty"`
+	Location *GeoPoint          `json:"location,omitempty" bson:"location,omitempty"`
+}
+
+// ImageEntry is one uploaded photo of a bcpost. Hash and ImgHash repeat the
+// matching elements of the parallel BCdataa slices.
+type ImageEntry struct {
+	File         string            `json:"file" bson:"file"`
+	ImgHash      string            `json:"imghash" bson:"imghash"`
+	Hash         string            `json:"hash" bson:"hash"`
+	Date         string            `json:"date" bson:"date"`
+	Original     string            `json:"original,omitempty" bson:"original,omitempty"`
+	Note         string            `json:"note,omitempty" bson:"note,omitempty"`
+	Meta         *PhotoMeta        `json:"meta,omitempty" bson:"meta,omitempty"`
+	Cadastral    *geo.Result       `json:"cadastral,omitempty" bson:"cadastral,omitempty"`
+	Geofence     *GeofenceCheck    `json:"geofence,omitempty" bson:"geofence,omitempty"`
+	Location     *GeoPoint         `json:"location,omitempty" bson:"location,omitempty"`
+	DHash        string            `json:"dhash,omitempty" bson:"dhash,omitempty"`
+	PHash        string            `json:"phash,omitempty" bson:"phash,omitempty"`
+	Duplicates   []*DuplicateMatch `json:"duplicates,omitempty" bson:"duplicates,omitempty"`
+	Authenticity *Authenticity     `json:"authenticity,omitempty" bson:"authenticity,omitempty"`
+	URL          string            `json:"url,omitempty" bson:"-"`
 }
 
 type BCdata struct {
@@ -90,6 +127,21 @@ type Post struct {
 	Amount    int                `json:"amount,string" bson:"amount"`
 	Progress  string             `json:"progress" bson:"progress"`
 	Paperwork string             `json:"paperwork" bson:"paperwork"`
+	Farm      string             `json:"farm,omitempty" bson:"farm,omitempty"`
+	Parents   []LotLink          `json:"parents,omitempty" bson:"parents,omitempty"`
+	Allocated int                `json:"allocated,omitempty" bson:"allocated,omitempty"`
+	// Unit is what Amount counts, kg when empty. Certification is the
+	// class, such as organic, the lot is sold as.
+	Unit          string           `json:"unit,omitempty" bson:"unit,omitempty"`
+	Certification string           `json:"certification,omitempty" bson:"certification,omitempty"`
+	Files         []*PaperworkFile `json:"files,omitempty" bson:"-"`
+	// TagKind is the type of identifier Tag is, empty on posts tagged
+	// before tags were typed.
+	TagKind gs1.Kind `json:"tagkind,omitempty" bson:"tagkind,omitempty"`
+	// Package is case or pallet on posts that are packages. Container is
+	// the tag of the package a post is packed in.
+	Package   string `json:"package,omitempty" bson:"package,omitempty"`
+	Container string `json:"container,omitempty" bson:"container,omitempty"`
 	// BCData    string             `json:"bcdata" bson:"bcdata"`
 }
 
@@ -108,7 +160,7 @@ type Image struct {
 // }
 
 func NewService(ip string, port string) *service {
-	return &service{db: server.NewDB(), ip: ip, port: port}
+	return &service{db: server.NewDB(), ip: ip, port: port, totp: newTOTPPolicy(), sessions: newSessionSigner(), oidc: newOIDCRegistry(), balance: newMassBalance()}
 }
 
 func (s *service) Start(dbip string, dbport string, dbname string) error {
@@ -118,6 +170,33 @@ func (s *service) Start(dbip string, dbport string, dbname string) error {
 	}
 	log.Println("db connected!")
 
+	s.cadastre, err = loadCadastre()
+	if err != nil {
+		return err
+	}
+	err = s.ensureGeoIndex()
+	if err != nil {
+		return err
+	}
+	err = s.loadPhotoIndex()
+	if err != nil {
+		return err
+	}
+	err = s.ensureLotIndex()
+	if err != nil {
+		return err
+	}
+	err = s.ensureDocumentIndex()
+	if err != nil {
+		return err
+	}
+	go s.reapTusUploads()
+	go s.watchDocuments()
+	err = s.startJobs()
+	if err != nil {
+		return err
+	}
+
 	r := mux.NewRouter().StrictSlash(true)
 	r.HandleFunc("/user", s.newUser).Methods("POST")
 	r.HandleFunc("/user", s.allUser).Methods("GET")
@@ -126,30 +205,106 @@ func (s *service) Start(dbip string, dbport string, dbname string) error {
 	r.HandleFunc("/user/{id}", s.deleteUser).Methods("DELETE")
 	r.HandleFunc("/verifyuser", s.verifyUser).Methods("POST")
 	r.HandleFunc("/verify", s.verifyUserAndReturnPost).Methods("POST")
+	r.HandleFunc("/user/{id}/totp", s.beginTOTP).Methods("POST")
+	r.HandleFunc("/user/{id}/totp/confirm", s.confirmTOTP).Methods("POST")
+	r.HandleFunc("/user/{id}/totp/recovery", s.regenerateRecoveryCodes).Methods("POST")
+	r.HandleFunc("/user/{id}/totp", s.disableTOTP).Methods("DELETE")
+	r.HandleFunc("/oidc/{provider}/login", s.oidcLogin).Methods("GET")
+	r.HandleFunc("/oidc/{provider}/callback", s.oidcCallback).Methods("GET")
 	r.HandleFunc("/post", s.allPost).Methods("GET")
 	r.HandleFunc("/post/{id}", s.post).Methods("GET")
 	r.HandleFunc("/post/{id}", s.deletePost).Methods("DELETE")
 	r.HandleFunc("/post", s.newPost).Methods("POST")
 	r.HandleFunc("/post/{id}", s.updatePost).Methods("PUT")
 	r.HandleFunc("/uploadfile", s.uploadFile).Methods("POST")
+	r.HandleFunc("/uploadfile/batch", s.uploadBatch).Methods("POST")
+	r.HandleFunc("/uploadfile/async", s.uploadFileAsync).Methods("POST")
+	r.HandleFunc("/jobs", s.allJobs).Methods("GET")
+	r.HandleFunc("/jobs/{id}", s.job).Methods("GET")
+	r.HandleFunc("/jobs/{id}/events", s.jobEvents).Methods("GET")
+	r.HandleFunc("/files", s.tusOptions).Methods("OPTIONS")
+	r.HandleFunc("/files", s.tusCreate).Methods("POST")
+	r.HandleFunc("/files/{id}", s.tusOptions).Methods("OPTIONS")
+	r.HandleFunc("/files/{id}", s.tusHead).Methods("HEAD")
+	r.HandleFunc("/files/{id}", s.tusPatch).Methods("PATCH")
+	r.HandleFunc("/files/{id}", s.tusDelete).Methods("DELETE")
+	r.HandleFunc("/files/{id}", s.tusResult).Methods("GET")
 	r.HandleFunc("/uploadfile", s.allBcPost).Methods("GET")
 	r.HandleFunc("/uploadfile/{id}", s.bcPost).Methods("GET")
 	r.HandleFunc("/bcpost", s.allBcPost).Methods("GET")
+	r.HandleFunc("/bcpost/near", s.nearBcPost).Methods("GET")
+	r.HandleFunc("/bcpost/box", s.boxBcPost).Methods("GET")
+	r.HandleFunc("/bcpost/within", s.withinBcPost).Methods("POST")
 	r.HandleFunc("/bcpost/{id}", s.bcPost).Methods("GET")
 	r.HandleFunc("/bcpost", s.newBcPost).Methods("POST")
+	r.HandleFunc("/post/{id}/transition", s.transition).Methods("POST")
+	r.HandleFunc("/post/{id}/events", s.lifecycleEvents).Methods("GET")
+	r.HandleFunc("/lifecycle", s.lifecycleStages).Methods("GET")
+	r.HandleFunc("/post/{id}/lineage", s.postLineage).Methods("GET")
+	r.HandleFunc("/lot/split", s.splitLot).Methods("POST")
+	r.HandleFunc("/lot/merge", s.mergeLots).Methods("POST")
+	r.HandleFunc("/lot/transform", s.transformLots).Methods("POST")
+	r.HandleFunc("/massbalance", s.balanceReport).Methods("GET")
+	r.HandleFunc("/post/{id}/transfers", s.initiateTransfer).Methods("POST")
+	r.HandleFunc("/post/{id}/transfers", s.postTransfers).Methods("GET")
+	r.HandleFunc("/post/{id}/custody", s.postCustody).Methods("GET")
+	r.HandleFunc("/transfers", s.myTransfers).Methods("GET")
+	r.HandleFunc("/transfers/{id}/accept", s.acceptTransfer).Methods("POST")
+	r.HandleFunc("/transfers/{id}/reject", s.rejectTransfer).Methods("POST")
+	r.HandleFunc("/transfers/{id}", s.cancelTransfer).Methods("DELETE")
+	r.HandleFunc("/recalls", s.newRecall).Methods("POST")
+	r.HandleFunc("/recalls", s.allRecalls).Methods("GET")
+	r.HandleFunc("/recalls/{id}", s.recall).Methods("GET")
+	r.HandleFunc("/recalls/{id}/status", s.recallStatus).Methods("POST")
+	r.HandleFunc("/recalls/{id}/export", s.exportRecall).Methods("GET")
+	r.HandleFunc("/notifications", s.notifications).Methods("GET")
+	r.HandleFunc("/notifications/{id}/ack", s.ackNotification).Methods("POST")
+	r.HandleFunc("/post/{id}/boundary", s.newPostBoundary).Methods("POST")
+	r.HandleFunc("/post/{id}/boundary", s.postBoundaries).Methods("GET")
+	r.HandleFunc("/farm/{farm}/boundary", s.newFarmBoundary).Methods("POST")
+	r.HandleFunc("/boundary/{id}", s.deleteBoundary).Methods("DELETE")
+	r.HandleFunc("/factory/{factory}/flagged", s.flagged).Methods("GET")
+	r.HandleFunc("/export/geojson", s.exportGeoJSON).Methods("GET")
+	r.HandleFunc("/export/kml", s.exportKML).Methods("GET")
+	r.HandleFunc("/alerts", s.alerts).Methods("GET")
+	r.HandleFunc("/alerts/{id}/resolve", s.resolveAlert).Methods("POST")
+	r.HandleFunc("/similar", s.similarImages).Methods("POST")
+	r.HandleFunc("/timeline/{tag}", s.tagTimeline).Methods("GET")
+	r.HandleFunc("/timeline/{tag}/timelapse", s.tagTimelapse).Methods("GET")
+	r.HandleFunc("/qr/{tag}", s.tagQR).Methods("GET")
+	r.HandleFunc("/verify/{tag}", s.verify).Methods("GET")
+	r.HandleFunc("/epcis/capture", s.epcisCapture).Methods("POST")
+	r.HandleFunc("/epcis/capture/{id}", s.epcisCaptureJob).Methods("GET")
+	r.HandleFunc("/epcis/events", s.epcisQuery).Methods("GET")
+	r.HandleFunc("/identifiers", s.allocateIdentifiers).Methods("POST")
+	r.HandleFunc("/identifiers/parse", s.parseIdentifier).Methods("GET")
+	r.PathPrefix("/01/").HandlerFunc(s.resolveLink).Methods("GET")
+	r.PathPrefix("/00/").HandlerFunc(s.resolveLink).Methods("GET")
+	r.HandleFunc("/post/{id}/documents", s.newDocument).Methods("POST")
+	r.HandleFunc("/post/{id}/documents", s.postDocuments).Methods("GET")
+	r.HandleFunc("/documents/expiring", s.expiringDocuments).Methods("GET")
+	r.HandleFunc("/documents/{id}", s.document).Methods("GET")
+	r.HandleFunc("/documents/{id}/versions", s.newDocumentVersion).Methods("POST")
+	r.HandleFunc("/packages", s.createPackage).Methods("POST")
+	r.HandleFunc("/packages/{tag}", s.packageTree).Methods("GET")
+	r.HandleFunc("/packages/{tag}/pack", s.packInto).Methods("POST")
+	r.HandleFunc("/packages/{tag}/unpack", s.unpackFrom).Methods("POST")
+	r.HandleFunc("/packages/{tag}/repack", s.repack).Methods("POST")
 
 	r.HandleFunc("/verifyhash/{imghash}/{txhash}", s.verifyHash).Methods("GET")
 
 	r.HandleFunc("/test", s.test).Methods("POST")
 
-	r.PathPrefix("/images/").Handler(http.StripPrefix("/images/", http.FileServer(http.Dir("./images"))))
-	r.PathPrefix("/file/").Handler(http.StripPrefix("/file/", http.FileServer(http.Dir("./file"))))
+	r.HandleFunc("/images/{tag}/{file}", s.derivedImage).Methods("GET")
+	r.HandleFunc("/original/{tag}/{file}", s.originalImage).Methods("GET")
+	r.HandleFunc("/file/{tag}/{file}", s.paperworkFile).Methods("GET")
 
-	headersOk := handlers.AllowedHeaders([]string{"X-Requested-With", "Content-Type", "Authorization"})
+	headersOk := handlers.AllowedHeaders([]string{"X-Requested-With", "Content-Type", "Authorization", "Tus-Resumable", "Upload-Length", "Upload-Offset", "Upload-Metadata", "Upload-Defer-Length", "X-HTTP-Method-Override"})
 	originsOk := handlers.AllowedOrigins([]string{"*"})
-	methodsOk := handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "DELETE", "OPTIONS"})
+	methodsOk := handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"})
 	log.Println("server starting processing...")
-	err = http.ListenAndServe(":"+s.port, handlers.CORS(headersOk, originsOk, methodsOk)(r))
+	cors := handlers.CORS(headersOk, originsOk, methodsOk)(r)
+	err = http.ListenAndServe(":"+s.port, tusMethodOverride(corsExceptDiscovery(cors, r)))
 	if err != nil {
 		fmt.Println(err)
 		return err
@@ -172,166 +327,6 @@ func (s *service) test(w http.ResponseWriter, r *http.Request) {
 	fmt.Println(buf)
 }
 
-func (s *service) uploadFile(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("uploadfile called")
-	r.ParseMultipartForm(32 << 20)
-	file, _, err := r.FormFile("image")
-	id := r.FormValue("id")
-	if err != nil {
-		fmt.Println("form file image err")
-		fmt.Println(err)
-		return
-	}
-	fmt.Println("id:", id)
-	for k, _ := range r.MultipartForm.File {
-		fmt.Println(k)
-	}
-	defer file.Close()
-
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
-	cur := s.db.QueryOne(ctx, "posts", "tag", id)
-	if err != nil {
-		fmt.Println("err query one")
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	k := &Post{}
-	err = cur.Decode(k)
-	if err != nil {
-		fmt.Println("err decode cur")
-		fmt.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	idd := k.ID.Hex()
-	// _, err = s.db.Add(ctx, "testing", image)
-	path := "images/" + id + "/"
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		os.Mkdir(path, 0777)
-	}
-	date := time.Now().Add(time.Hour * 8).Format("2006-01-02_150405")
-	// date := time.Now().Add(time.Hour*8).Format("2006-01-02")
-	fmt.Println("filename begin")
-	filename := path + date + ".jpeg"
-	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE, 0666)
-	if err != nil {
-		fmt.Println(err)
-		return
-	}
-	io.Copy(f, file)
-	defer f.Close()
-	fmt.Println("open file begin")
-	g, err := os.Open(filename)
-	if err != nil {
-		fmt.Println(err)
-		return
-	}
-	fmt.Println("python3 command begin")
-	cmd := exec.Command("python3", "./agri/tmp.py", "add", ":"+filename)
-	out, err := cmd.Output()
-	if err != nil {
-		log.Println("err output command")
-		fmt.Println("bc err")
-		fmt.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	fmt.Println("python3 command complete")
-
-	// hash := strings.TrimSpace(string(out))
-	hash := strings.Split(string(out), "\n")
-	_id, err := primitive.ObjectIDFromHex(idd)
-	if err != nil {
-		log.Println("err objectid from hex")
-		fmt.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	img := "" + path
-	// image := &Image{ID: _id, Hash: hash, Img: img}
-
-	ctx, _ = context.WithTimeout(context.Background(), 5*time.Second)
-	// _, err = s.db.Add(ctx, "testing", image)
-
-	bc, err := s.findBcPost(ctx, "bcposts", "_id", _id)
-	if err != nil {
-		log.Println("err find bc post")
-		fmt.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	exif.RegisterParsers(mknote.All...)
-	x, err := exif.Decode(g)
-	if err != nil {
-		fmt.Println("err decodeing exif " + filename)
-		log.Fatal(err)
-	}
-	str := x.String()
-	fmt.Println(str)
-	lat, long, _ := x.LatLong()
-	str_lat := strconv.FormatFloat(lat, 'f', 5, 64)
-	str_long := strconv.FormatFloat(long, 'f', 5, 64)
-	fmt.Println(str_lat, str_long)
-
-	focal, _ := x.Get(exif.FocalLength)
-	numer, denom, _ := focal.Rat2(0) // retrieve first (only) rat. value
-	focallen := fmt.Sprintf("%.3f", float64(numer)/float64(denom))
-	fmt.Println(focallen)
-
-	imgdir, _ := x.Get(exif.GPSImgDirection)
-	a, b, _ := imgdir.Rat2(0) // retrieve first (only) rat. value
-	gps_dir := fmt.Sprintf("%.15f", float64(a)/float64(b))
-	fmt.Println(gps_dir)
-	cmdd := exec.Command("ssh", "-i", "awsEC-ubuntu.pem", "ubuntu@18.219.71.129", "source ~/.bashrc", ";", "python3", "CalCadAddr.py", "-a", str_long, "-b", str_lat, "-c", gps_dir, "-d", focallen)
-	outt, err := cmdd.Output()
-	if err != nil {
-		fmt.Println(err)
-	}
-	var kk map[string]interface{}
-	err = json.Unmarshal(outt, &kk)
-	if err != nil {
-		fmt.Println(err)
-	}
-	fmt.Println(kk)
-	// 地段地號
-	dddh, ok := (kk["result"].(map[string]interface{})["cadaddr"]).(string)
-	if ok {
-		bc.DDDH = dddh
-		fmt.Println(dddh)
-	}
-
-	bc.Lat = str_lat
-	bc.Long = str_long
-	bc.Hash = append(bc.Hash, hash[1])
-	bc.ImgHash = append(bc.ImgHash, hash[0])
-	bc.Image = img
-	bc.Date = date
-	bc.Chain = "Ropsten"
-	fmt.Println(bc)
-	res := s.db.Update(ctx, "bcposts", "_id", _id, bc)
-	bcc := BCdataa{}
-	err = res.Decode(&bcc)
-	if err != nil {
-		fmt.Println(err)
-		return
-	}
-	fmt.Println(&bc)
-
-	// image := &Image{ID: _id, ImgHash: hash[0], Hash: hash[1], Img: img}
-	err = json.NewEncoder(w).Encode(bc)
-	if err != nil {
-		log.Println("err encoding return")
-		fmt.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	fmt.Println("Image Hash:" + hash[0])
-	fmt.Println("uploaded!")
-}
-
 func (s *service) file(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	args := mux.Vars(r)
@@ -491,6 +486,10 @@ func (s *service) verifyUser(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	if !s.checkSecondFactor(ctx, w, dec, body) {
+		return
+	}
+	s.setSessionHeader(w, dec)
 	err = json.NewEncoder(w).Encode(dec.Identity)
 	if err != nil {
 		log.Println("err encoding json")
@@ -565,6 +564,10 @@ func (s *service) verifyUserAndReturnPost(w http.ResponseWriter, r *http.Request
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	if !s.checkSecondFactor(ctx, w, dec, body) {
+		return
+	}
+	s.setSessionHeader(w, dec)
 	curr, err := s.db.Query(ctx, "posts", "user", dec.Username)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -572,6 +575,7 @@ func (s *service) verifyUserAndReturnPost(w http.ResponseWriter, r *http.Request
 	}
 	defer curr.Close(ctx)
 
+	se := &session{Username: dec.Username, Identity: dec.Identity}
 	var k []*Post
 	for curr.Next(ctx) {
 		// elem := &bson.D{}
@@ -581,6 +585,7 @@ func (s *service) verifyUserAndReturnPost(w http.ResponseWriter, r *http.Request
 			log.Println(err)
 		}
 		fmt.Println(elem)
+		s.signPost(se, elem)
 		k = append(k, elem)
 	}
 
@@ -680,6 +685,8 @@ func (s *service) updateUser(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	// 2FA state only changes through the /totp endpoints
+	reqData.TOTPEnabled = false
 
 	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
 	cur := s.db.Update(ctx, "testuser", "_id", val, reqData)
@@ -720,28 +727,49 @@ func (s *service) newPost(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	progress := r.FormValue("progress")
-
-	path := "file/" + tag + "/"
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		os.Mkdir(path, 0777)
+	// a new post has no stage yet, progress only moves through
+	// POST /post/{id}/transition
+	progress := ""
+	farm := r.FormValue("farm")
+	unit := r.FormValue("unit")
+	if unit != "" {
+		if _, ok := s.balance.Units[unit]; !ok {
+			writeMessage(w, http.StatusBadRequest, "unknown unit "+unit)
+			return
+		}
 	}
-	for k, _ := range files {
-		file, err := files[k].Open()
+	certification := r.FormValue("certification")
+
+	// without a tag one is allocated, of the form's tagkind with its gtin
+	// or prefix
+	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+	if tag == "" {
+		id, err := s.allocateTag(ctx, &identifierRequest{Kind: gs1.Kind(r.FormValue("tagkind")), GTIN: r.FormValue("gtin"), Prefix: r.FormValue("prefix")})
 		if err != nil {
-			fmt.Println(err)
+			writeMessage(w, uploadStatus(err), err.Error())
 			return
 		}
-		defer file.Close()
-		p := path + files[k].Filename
-		fmt.Println(p)
-		f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE, 0666)
-		if err != nil {
-			fmt.Println(err)
+		tag = id.String()
+	} else if _, err := typedTag(tag); err != nil {
+		writeMessage(w, http.StatusBadRequest, err.Error())
+		return
+	} else if _, err := s.findPost(ctx, "tag", tag); err == nil {
+		writeMessage(w, http.StatusConflict, "tag "+tag+" is taken")
+		return
+	}
+
+	// each file is filed as a document of the form's documentkind, with
+	// the form's documentissuer, documentvaliduntil and so on
+	doc := documentForm(r, "document")
+	if len(files) > 0 {
+		if err := checkNewDocument(doc); err != nil {
+			writeMessage(w, uploadStatus(err), err.Error())
 			return
 		}
-		io.Copy(f, file)
-		f.Close()
+	}
+	path := "file/" + tag + "/"
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		os.Mkdir(path, 0777)
 	}
 
 	filename := "" + path
@@ -749,12 +777,14 @@ func (s *service) newPost(w http.ResponseWriter, r *http.Request) {
 	_id := primitive.NewObjectID()
 	_date := time.Now().Add(time.Hour * 8).Format(time.ANSIC)
 
-	post := &Post{ID: _id, Tag: tag, Title: title, User: user, Name: name, Date: _date, Factory: factory, Market: market, Amount: amount, Progress: progress, Paperwork: filename}
+	post := &Post{ID: _id, Tag: tag, Title: title, User: user, Name: name, Date: _date, Factory: factory, Market: market, Amount: amount, Progress: progress, Paperwork: filename, Farm: farm, Unit: unit, Certification: certification, TagKind: tagKind(tag)}
 	bc := &BCdataa{ID: _id, Tag: tag, Name: name, Factory: factory, ImgHash: []string{}, Hash: []string{}}
 
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
 	_, err = s.db.Add(ctx, "posts", post)
-	if err != nil {
+	if server.IsDuplicateKey(err) {
+		writeMessage(w, http.StatusConflict, "tag "+tag+" is taken")
+		return
+	} else if err != nil {
 		fmt.Println(err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -765,6 +795,18 @@ func (s *service) newPost(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+		for _, fh := range files {
+			in := *doc
+			f, err := fh.Open()
+			if err == nil {
+				_, err = s.fileDocument(user, post, nil, &in, fh.Filename, f)
+				f.Close()
+			}
+			if err != nil {
+				writeMessage(w, uploadStatus(err), "post "+tag+" was added but "+fh.Filename+" was not: "+err.Error())
+				return
+			}
+		}
 
 		if d, err := json.Marshal(post); err != nil {
 			fmt.Println(err)
@@ -954,6 +996,7 @@ func (s *service) post(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	s.signPost(s.sessionFrom(r), k)
 
 	// ret, err := json.Marshal(res)
 
@@ -987,6 +1030,7 @@ func (s *service) bcPost(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	s.signImages(ctx, s.sessionFrom(r), k)
 
 	w.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(w).Encode(k)
@@ -1011,6 +1055,33 @@ func (s *service) findBcPost(ctx context.Context, col string, key string, val in
 	}
 }
 
+func (s *service) findUser(ctx context.Context, key string, val interface{}) (*User, error) {
+	cur := s.db.QueryOne(ctx, "testuser", key, val)
+	u := &User{}
+	err := cur.Decode(u)
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// postEditable are the post fields PUT /post/{id} writes, by JSON name,
+// which is also their BSON name. The rest change elsewhere or never:
+// progress by transitions, parents and allocated by /lot, package and
+// container by packing; tag and tagkind name the post's files and
+// anchored events, and amount, unit and certification are what its mass
+// balance was checked against.
+var postEditable = map[string]bool{
+	"title":     true,
+	"user":      true,
+	"name":      true,
+	"factory":   true,
+	"market":    true,
+	"date":      true,
+	"paperwork": true,
+	"farm":      true,
+}
+
 func (s *service) updatePost(w http.ResponseWriter, r *http.Request) {
 	log.Println("updatepost called")
 	args := mux.Vars(r)
@@ -1037,7 +1108,37 @@ func (s *service) updatePost(w http.ResponseWriter, r *http.Request) {
 	}
 
 	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
-	cur := s.db.Update(ctx, "posts", "_id", val, reqData)
+	old, err := s.findPost(ctx, "_id", val)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	// fields not in postEditable may be sent back as they are, or empty,
+	// but not changed; files are signed links made when a post is read
+	var fields, stored map[string]interface{}
+	b, _ := json.Marshal(old)
+	json.Unmarshal(b, &stored)
+	json.Unmarshal(data, &fields)
+	set := bson.M{}
+	for k, v := range fields {
+		if !postEditable[k] {
+			if v != nil && v != "" && k != "files" && !reflect.DeepEqual(v, stored[k]) {
+				writeMessage(w, http.StatusConflict, k+" cannot change through PUT /post/{id}")
+				return
+			}
+			continue
+		}
+		if _, ok := v.(string); !ok {
+			writeMessage(w, http.StatusBadRequest, k+" must be a string")
+			return
+		}
+		set[k] = v
+	}
+	if len(set) == 0 {
+		writeMessage(w, http.StatusBadRequest, "nothing to update")
+		return
+	}
+	cur := s.db.Modify(ctx, "posts", "_id", val, bson.M{"$set": set})
 
 	ret := &Post{}
 	err = cur.Decode(ret)
@@ -1063,7 +1164,7 @@ func (s *service) verifyHash(w http.ResponseWriter, r *http.Request) {
 	args := mux.Vars(r)
 	imghash := args["imghash"]
 	txhash := args["txhash"]
-	url := "https://ropsten.etherscan.io/tx/" + txhash
+	url := etherscanTx + txhash
 	fmt.Println(imghash, txhash)
 	res := Cmpurlhash(imghash, url)
 	if res {
@@ -1077,6 +1178,12 @@ func (s *service) verifyHash(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+func writeMessage(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"message": msg})
+}
+
 func Cmpurlhash(Hash string, Url string) bool {
 	fmt.Println("cmpurlhash called")
 	var cmp string
@@ -1103,6 +1210,12 @@ func Cmpurlhash(Hash string, Url string) bool {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		if err := runExport(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	a := NewService("localhost", "8000")
 	a.Start("localhost", "27017", "testing")
 
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const sessionTTL = 12 * time.Hour
+
+// session is what a signed token carries. Tokens are stateless so any
+// instance holding SESSION_KEY can verify them.
+type session struct {
+	Username string `json:"u"`
+	Identity string `json:"i"`
+	Expires  int64  `json:"exp"`
+}
+
+type sessionSigner struct {
+	key []byte
+}
+
+// newSessionSigner uses SESSION_KEY when set. Otherwise a random key is
+// generated, which means tokens do not survive a restart.
+func newSessionSigner() *sessionSigner {
+	key := []byte(os.Getenv("SESSION_KEY"))
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			log.Fatal(err)
+		}
+		log.Println("SESSION_KEY not set, using an ephemeral session key")
+	}
+	return &sessionSigner{key: key}
+}
+
+func (ss *sessionSigner) sign(payload []byte) string {
+	mac := hmac.New(sha256.New, ss.key)
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (ss *sessionSigner) issue(u *User) (string, error) {
+	d, err := json.Marshal(&session{Username: u.Username, Identity: u.Identity, Expires: time.Now().Add(sessionTTL).Unix()})
+	if err != nil {
+		return "", err
+	}
+	p := base64.RawURLEncoding.EncodeToString(d)
+	return p + "." + ss.sign([]byte(p)), nil
+}
+
+func (ss *sessionSigner) parse(token string) (*session, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, errors.New("malformed session token")
+	}
+	if !hmac.Equal([]byte(ss.sign([]byte(parts[0]))), []byte(parts[1])) {
+		return nil, errors.New("bad session signature")
+	}
+	d, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	se := &session{}
+	if err := json.Unmarshal(d, se); err != nil {
+		return nil, err
+	}
+	if time.Now().Unix() > se.Expires {
+		return nil, errors.New("session expired")
+	}
+	return se, nil
+}
+
+// sessionFrom returns the caller's session from an "Authorization: Bearer"
+// header, or nil when there is none or it does not verify.
+func (s *service) sessionFrom(r *http.Request) *session {
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return nil
+	}
+	se, err := s.sessions.parse(strings.TrimPrefix(h, "Bearer "))
+	if err != nil {
+		log.Println("err parsing session:", err)
+		return nil
+	}
+	return se
+}
+
+// setSessionHeader hands a fresh token to a client that just logged in
+// without changing the existing response bodies.
+func (s *service) setSessionHeader(w http.ResponseWriter, u *User) {
+	token, err := s.sessions.issue(u)
+	if err != nil {
+		log.Println("err issuing session token")
+		return
+	}
+	w.Header().Set("X-Session-Token", token)
+	w.Header().Set("Access-Control-Expose-Headers", "X-Session-Token")
+}
+
+// identitySet reads a comma separated list of identities from env, or def
+// when it is unset.
+func identitySet(env string, def string) map[string]bool {
+	list := os.Getenv(env)
+	if list == "" {
+		list = def
+	}
+	ret := map[string]bool{}
+	for _, r := range strings.Split(list, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			ret[r] = true
+		}
+	}
+	return ret
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image/gif"
+	"image/jpeg"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"mongo/derive"
+)
+
+const (
+	maxTimelapseFrames     = 120
+	defaultTimelapseFrames = 60
+)
+
+// TimelineAnchor says whether a photo's sha256 made it on chain.
+type TimelineAnchor struct {
+	Status  string `json:"status"`
+	ImgHash string `json:"imghash,omitempty"`
+	TxHash  string `json:"txhash,omitempty"`
+}
+
+// TimelineEntry is one photo of a tag's timeline. CapturedFrom says
+// whether Captured came from the photo's EXIF or, lacking that, from the
+// time it was uploaded.
+type TimelineEntry struct {
+	File         string             `json:"file"`
+	URL          string             `json:"url"`
+	Thumb        string             `json:"thumb"`
+	Captured     time.Time          `json:"captured"`
+	CapturedFrom string             `json:"capturedfrom"`
+	Uploaded     string             `json:"uploaded,omitempty"`
+	Post         primitive.ObjectID `json:"post"`
+	Anchor       TimelineAnchor     `json:"anchor"`
+	Geofence     string             `json:"geofence,omitempty"`
+	Score        *int               `json:"score,omitempty"`
+	Location     *GeoPoint          `json:"location,omitempty"`
+	Meta         *PhotoMeta         `json:"meta,omitempty"`
+}
+
+// captureTime picks the best time a photo was taken: the EXIF time with
+// its zone, the EXIF wall clock read as farm time, then the upload time.
+func captureTime(meta *PhotoMeta, uploaded string) (time.Time, string) {
+	if meta != nil && meta.Captured != nil {
+		if meta.Captured.Time != nil {
+			return *meta.Captured.Time, "exif"
+		}
+		if t, err := time.ParseInLocation("2006-01-02T15:04:05", meta.Captured.Local, farmZone); err == nil {
+			return t, "exif"
+		}
+	}
+	if len(uploaded) >= 17 {
+		if t, err := time.ParseInLocation("2006-01-02_150405", uploaded[:17], farmZone); err == nil {
+			return t, "upload"
+		}
+	}
+	return time.Time{}, "unknown"
+}
+
+func newTimelineEntry(post primitive.ObjectID, file string, uploaded string, meta *PhotoMeta) *TimelineEntry {
+	e := &TimelineEntry{File: file, URL: "/" + file, Thumb: "/" + file + "?size=thumb", Uploaded: uploaded, Post: post, Meta: meta}
+	e.Captured, e.CapturedFrom = captureTime(meta, uploaded)
+	e.Anchor.Status = "unanchored"
+	return e
+}
+
+// timeline gathers a tag's photos oldest first. Photos recorded in a
+// bcpost's images come with what was learnt on upload; files in
+// images/<tag>/ from before images were recorded are matched to the
+// anchored hashes by their sha256.
+func (s *service) timeline(ctx context.Context, tag string) ([]*TimelineEntry, error) {
+	cur, err := s.db.Query(ctx, "bcposts", "tag", tag)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var entries []*TimelineEntry
+	seen := map[string]bool{}
+	anchored := map[string]string{}
+	var post primitive.ObjectID
+	for cur.Next(ctx) {
+		bc := &BCdataa{}
+		if err := cur.Decode(bc); err != nil {
+			log.Println(err)
+			continue
+		}
+		post = bc.ID
+		for i, h := range bc.ImgHash {
+			if i < len(bc.Hash) {
+				anchored[h] = bc.Hash[i]
+			}
+		}
+		for _, img := range bc.Images {
+			seen[img.File] = true
+			e := newTimelineEntry(bc.ID, img.File, img.Date, img.Meta)
+			if img.ImgHash != "" && img.Hash != "" {
+				e.Anchor = TimelineAnchor{Status: "anchored", ImgHash: img.ImgHash, TxHash: img.Hash}
+			}
+			if img.Geofence != nil {
+				e.Geofence = img.Geofence.Status
+			}
+			if img.Authenticity != nil {
+				score := img.Authenticity.Score
+				e.Score = &score
+			}
+			e.Location = img.Location
+			entries = append(entries, e)
+		}
+	}
+
+	dir := "images/" + tag + "/"
+	files, _ := ioutil.ReadDir(dir)
+	for _, fi := range files {
+		ext := strings.ToLower(filepath.Ext(fi.Name()))
+		if fi.IsDir() || (ext != ".jpeg" && ext != ".jpg") || seen[dir+fi.Name()] {
+			continue
+		}
+		data, err := ioutil.ReadFile(dir + fi.Name())
+		if err != nil {
+			log.Println("err reading", dir+fi.Name(), err)
+			continue
+		}
+		var meta *PhotoMeta
+		if m, err := ExtractMeta(bytes.NewReader(data)); err == nil {
+			meta = m
+		}
+		e := newTimelineEntry(post, dir+fi.Name(), strings.TrimSuffix(fi.Name(), filepath.Ext(fi.Name())), meta)
+		sum := sha256.Sum256(data)
+		h := hex.EncodeToString(sum[:])
+		if tx, ok := anchored[h]; ok {
+			e.Anchor = TimelineAnchor{Status: "anchored", ImgHash: h, TxHash: tx}
+		}
+		if e.CapturedFrom == "unknown" {
+			e.Captured, e.CapturedFrom = fi.ModTime().In(farmZone), "upload"
+		}
+		entries = append(entries, e)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Captured.Before(entries[j].Captured)
+	})
+	return entries, nil
+}
+
+// timelineRange keeps the entries captured between ?from= and ?to=, both
+// farm dates and both inclusive.
+func timelineRange(entries []*TimelineEntry, r *http.Request) ([]*TimelineEntry, error) {
+	var from, to time.Time
+	if v := r.URL.Query().Get("from"); v != "" {
+		t, err := time.ParseInLocation("2006-01-02", v, farmZone)
+		if err != nil {
+			return nil, fmt.Errorf("from must be a date like 2006-01-02")
+		}
+		from = t
+	}
+	if v := r.URL.Query().Get("to"); v != "" {
+		t, err := time.ParseInLocation("2006-01-02", v, farmZone)
+		if err != nil {
+			return nil, fmt.Errorf("to must be a date like 2006-01-02")
+		}
+		to = t.AddDate(0, 0, 1)
+	}
+	var ret []*TimelineEntry
+	for _, e := range entries {
+		if !from.IsZero() && e.Captured.Before(from) {
+			continue
+		}
+		if !to.IsZero() && !e.Captured.Before(to) {
+			continue
+		}
+		ret = append(ret, e)
+	}
+	return ret, nil
+}
+
+func validTag(tag string) bool {
+	return tag != "" && tag == filepath.Base(tag) && !strings.HasPrefix(tag, ".")
+}
+
+func (s *service) tagTimeline(w http.ResponseWriter, r *http.Request) {
+	tag := mux.Vars(r)["tag"]
+	if !validTag(tag) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !s.authorizeTag(w, r, tag, r.URL.Path) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	entries, err := s.timeline(ctx, tag)
+	if err != nil {
+		log.Println("err building timeline", tag, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	entries, err = timelineRange(entries, r)
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if entries == nil {
+		entries = []*TimelineEntry{}
+	}
+	for _, e := range entries {
+		e.URL = s.signURL(e.URL, e.URL)
+		e.Thumb = e.URL + "&size=thumb"
+	}
+	timelapse := "/timeline/" + tag + "/timelapse"
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"tag": tag, "count": len(entries), "entries": entries, "timelapse": s.signURL(timelapse, timelapse)})
+}
+
+// timelapseOptions are the query parameters of a time-lapse.
+type timelapseOptions struct {
+	Format string
+	Size   int
+	Frames int
+	Cols   int
+	Delay  int
+}
+
+func parseTimelapse(r *http.Request) (*timelapseOptions, error) {
+	q := r.URL.Query()
+	o := &timelapseOptions{Format: q.Get("format"), Frames: defaultTimelapseFrames, Delay: 50}
+	switch o.Format {
+	case "", "gif":
+		o.Format, o.Size = "gif", 480
+	case "jpeg", "jpg", "sheet":
+		o.Format, o.Size, o.Cols = "jpeg", 240, 6
+	default:
+		return nil, fmt.Errorf("format must be gif or jpeg")
+	}
+	ints := []struct {
+		name     string
+		v        *int
+		min, max int
+	}{
+		{"size", &o.Size, 64, 1024},
+		{"frames", &o.Frames, 1, maxTimelapseFrames},
+		{"cols", &o.Cols, 1, 20},
+		{"delay", &o.Delay, 2, 1000},
+	}
+	for _, p := range ints {
+		v := q.Get(p.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < p.min || n > p.max {
+			return nil, fmt.Errorf("%s must be between %d and %d", p.name, p.min, p.max)
+		}
+		*p.v = n
+	}
+	return o, nil
+}
+
+// tagTimelapse renders a tag's photos as an animated GIF or a contact
+// sheet JPEG, sampled to at most ?frames= photos, cropped to 4:3, lined up
+// and captioned with their capture dates. Renders are cached under
+// derived/<tag>/ by what went into them.
+func (s *service) tagTimelapse(w http.ResponseWriter, r *http.Request) {
+	tag := mux.Vars(r)["tag"]
+	if !validTag(tag) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !s.authorizeTag(w, r, tag, r.URL.Path) {
+		return
+	}
+	o, err := parseTimelapse(r)
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	entries, err := s.timeline(ctx, tag)
+	if err != nil {
+		log.Println("err building timeline", tag, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	entries, err = timelineRange(entries, r)
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var picked []*TimelineEntry
+	for _, i := range derive.Sample(len(entries), o.Frames) {
+		picked = append(picked, entries[i])
+	}
+	if len(picked) == 0 {
+		writeMessage(w, http.StatusNotFound, "no photos for "+tag)
+		return
+	}
+
+	key := sha256.New()
+	fmt.Fprintf(key, "%s %d %d %d\n", o.Format, o.Size, o.Cols, o.Delay)
+	for _, e := range picked {
+		fi, err := os.Stat(e.File)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(key, "%s %d %d\n", e.File, fi.Size(), fi.ModTime().UnixNano())
+	}
+	cached := derivedDir + tag + "/timelapse_" + hex.EncodeToString(key.Sum(nil))[:16] + "." + o.Format
+
+	mu, _ := derivedLocks.LoadOrStore(cached, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	if _, err = os.Stat(cached); err != nil {
+		err = writeTimelapse(picked, o, cached)
+	}
+	mu.(*sync.Mutex).Unlock()
+	if err != nil {
+		log.Println("err rendering timelapse", tag, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/"+o.Format)
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	http.ServeFile(w, r, cached)
+}
+
+func writeTimelapse(entries []*TimelineEntry, o *timelapseOptions, cached string) error {
+	w, h := o.Size, o.Size*3/4
+	var frames []derive.Frame
+	for _, e := range entries {
+		img, _, err := loadUpright(e.File)
+		if err != nil {
+			log.Println("err loading frame", e.File, err)
+			continue
+		}
+		// shrink straight away so a long sequence of full size
+		// originals is never held at once
+		frames = append(frames, derive.Frame{Image: derive.Fit(img, 2*o.Size), Caption: e.Captured.In(farmZone).Format("2006-01-02")})
+	}
+	if len(frames) == 0 {
+		return fmt.Errorf("no readable photos")
+	}
+	frames = derive.Normalize(frames, w, h)
+
+	var buf bytes.Buffer
+	var err error
+	if o.Format == "gif" {
+		err = gif.EncodeAll(&buf, derive.GIF(frames, o.Delay))
+	} else {
+		err = jpeg.Encode(&buf, derive.Sheet(frames, o.Cols, 4), &jpeg.Options{Quality: derivedQuality})
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(cached), 0777); err != nil {
+		return err
+	}
+	tmp := cached + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmp, cached)
+}
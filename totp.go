@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// RFC 6238 parameters. These are the defaults every authenticator app
+// understands, so they are not configurable.
+const (
+	totpDigits        = 6
+	totpPeriod        = 30
+	totpSkew          = 1
+	recoveryCodeCount = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpPolicy decides which identities must log in with a second factor.
+type totpPolicy struct {
+	issuer   string
+	required map[string]bool
+}
+
+// newTOTPPolicy reads TOTP_ISSUER and TOTP_REQUIRED_IDENTITIES (comma
+// separated User.Identity values). Admin and factory accounts are required
+// by default since they can change progress and delete records.
+func newTOTPPolicy() *totpPolicy {
+	issuer := os.Getenv("TOTP_ISSUER")
+	if issuer == "" {
+		issuer = "SC-blockchain"
+	}
+	return &totpPolicy{issuer: issuer, required: identitySet("TOTP_REQUIRED_IDENTITIES", "admin,factory")}
+}
+
+func (p *totpPolicy) requires(identity string) bool {
+	return p.required[identity]
+}
+
+func (p *totpPolicy) uri(account string, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", p.issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+	label := url.PathEscape(p.issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+func newTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// hotp implements the RFC 4226 dynamic truncation.
+func hotp(key []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	off := sum[len(sum)-1] & 0x0f
+	v := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, v%mod)
+}
+
+// validateTOTP checks code against the steps around t and returns the
+// matching step. Steps at or before lastStep are rejected so a code cannot
+// be replayed within its window.
+func validateTOTP(secret string, code string, t time.Time, lastStep int64) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, false
+	}
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	now := t.Unix() / totpPeriod
+	for i := -totpSkew; i <= totpSkew; i++ {
+		step := now + int64(i)
+		if step <= lastStep {
+			continue
+		}
+		if hmac.Equal([]byte(hotp(key, uint64(step))), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// newRecoveryCodes returns the codes to show the user once and the hashes
+// that are stored in testuser.
+func newRecoveryCodes() ([]string, []string, error) {
+	var plain, hashed []string
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		h := hex.EncodeToString(b)
+		c := h[:5] + "-" + h[5:]
+		plain = append(plain, c)
+		hashed = append(hashed, hashRecoveryCode(c))
+	}
+	return plain, hashed, nil
+}
+
+type totpRequest struct {
+	Password string `json:"password"`
+	Code     string `json:"totp"`
+	Recovery string `json:"recovery"`
+}
+
+func (s *service) totpUser(w http.ResponseWriter, r *http.Request) (*User, *totpRequest, bool) {
+	args := mux.Vars(r)
+	id, err := primitive.ObjectIDFromHex(args["id"])
+	if err != nil {
+		log.Println("err object id from hex")
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, nil, false
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, nil, false
+	}
+	req := &totpRequest{}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, req); err != nil {
+			log.Println("err unmarshaling totp request")
+			w.WriteHeader(http.StatusBadRequest)
+			return nil, nil, false
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	u, err := s.findUser(ctx, "_id", id)
+	if err != nil {
+		log.Println("err finding user")
+		w.WriteHeader(http.StatusNotFound)
+		return nil, nil, false
+	}
+	return u, req, true
+}
+
+func (s *service) updateTOTP(u *User, set bson.M) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.db.Update(ctx, "testuser", "_id", u.ID, set).Err()
+}
+
+// beginTOTP starts enrolment. The secret is kept pending until the user
+// proves their authenticator works through confirmTOTP.
+func (s *service) beginTOTP(w http.ResponseWriter, r *http.Request) {
+	log.Println("begintotp called")
+	u, req, ok := s.totpUser(w, r)
+	if !ok {
+		return
+	}
+	if u.Password != req.Password {
+		writeMessage(w, http.StatusUnauthorized, "wrong password")
+		return
+	}
+	if u.TOTPEnabled {
+		writeMessage(w, http.StatusConflict, "totp already enabled")
+		return
+	}
+	secret, err := newTOTPSecret()
+	if err != nil {
+		log.Println("err generating totp secret")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err := s.updateTOTP(u, bson.M{"totppending": secret}); err != nil {
+		log.Println("err storing pending totp secret")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	uri := s.totp.uri(u.Username, secret)
+	ret := map[string]string{"secret": secret, "uri": uri, "qrpayload": uri}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(ret)
+	if err != nil {
+		log.Println("err encoding totp enrolment")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Println("begintotp succeed")
+}
+
+func (s *service) confirmTOTP(w http.ResponseWriter, r *http.Request) {
+	log.Println("confirmtotp called")
+	u, req, ok := s.totpUser(w, r)
+	if !ok {
+		return
+	}
+	if u.TOTPPending == "" {
+		writeMessage(w, http.StatusConflict, "no totp enrolment in progress")
+		return
+	}
+	step, ok := validateTOTP(u.TOTPPending, req.Code, time.Now(), 0)
+	if !ok {
+		writeMessage(w, http.StatusUnauthorized, "invalid totp code")
+		return
+	}
+	plain, hashed, err := newRecoveryCodes()
+	if err != nil {
+		log.Println("err generating recovery codes")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	set := bson.M{
+		"totpenabled":   true,
+		"totpsecret":    u.TOTPPending,
+		"totppending":   "",
+		"totplaststep":  step,
+		"recoverycodes": hashed,
+	}
+	if err := s.updateTOTP(u, set); err != nil {
+		log.Println("err enabling totp")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(map[string][]string{"recoverycodes": plain})
+	if err != nil {
+		log.Println("err encoding recovery codes")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Println("confirmtotp succeed")
+}
+
+func (s *service) regenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	log.Println("regeneraterecoverycodes called")
+	u, req, ok := s.totpUser(w, r)
+	if !ok {
+		return
+	}
+	if !u.TOTPEnabled {
+		writeMessage(w, http.StatusConflict, "totp not enabled")
+		return
+	}
+	step, ok := validateTOTP(u.TOTPSecret, req.Code, time.Now(), u.TOTPLastStep)
+	if !ok {
+		writeMessage(w, http.StatusUnauthorized, "invalid totp code")
+		return
+	}
+	plain, hashed, err := newRecoveryCodes()
+	if err != nil {
+		log.Println("err generating recovery codes")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err := s.updateTOTP(u, bson.M{"totplaststep": step, "recoverycodes": hashed}); err != nil {
+		log.Println("err storing recovery codes")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(map[string][]string{"recoverycodes": plain})
+	if err != nil {
+		log.Println("err encoding recovery codes")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Println("regeneraterecoverycodes succeed")
+}
+
+func (s *service) disableTOTP(w http.ResponseWriter, r *http.Request) {
+	log.Println("disabletotp called")
+	u, req, ok := s.totpUser(w, r)
+	if !ok {
+		return
+	}
+	if !u.TOTPEnabled {
+		writeMessage(w, http.StatusConflict, "totp not enabled")
+		return
+	}
+	if s.totp.requires(u.Identity) {
+		writeMessage(w, http.StatusForbidden, "totp is mandatory for "+u.Identity)
+		return
+	}
+	if _, ok := validateTOTP(u.TOTPSecret, req.Code, time.Now(), u.TOTPLastStep); !ok {
+		writeMessage(w, http.StatusUnauthorized, "invalid totp code")
+		return
+	}
+	set := bson.M{"totpenabled": false, "totpsecret": "", "totplaststep": 0, "recoverycodes": []string{}}
+	if err := s.updateTOTP(u, set); err != nil {
+		log.Println("err disabling totp")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	log.Println("disabletotp succeed")
+}
+
+// checkSecondFactor runs after the password has matched. It writes the
+// response itself and returns false when the login must not proceed.
+func (s *service) checkSecondFactor(ctx context.Context, w http.ResponseWriter, u *User, body []byte) bool {
+	if !u.TOTPEnabled {
+		if s.totp.requires(u.Identity) {
+			writeMessage(w, http.StatusForbidden, "totp enrolment required")
+			return false
+		}
+		return true
+	}
+
+	req := &totpRequest{}
+	_ = json.Unmarshal(body, req)
+	switch {
+	case req.Code != "":
+		step, ok := validateTOTP(u.TOTPSecret, req.Code, time.Now(), u.TOTPLastStep)
+		if !ok {
+			writeMessage(w, http.StatusUnauthorized, "invalid totp code")
+			return false
+		}
+		// only one login may spend a step, a concurrent one with the same
+		// code finds the step already moved on
+		unspent := bson.A{bson.M{"totplaststep": bson.M{"$lt": step}}, bson.M{"totplaststep": bson.M{"$exists": false}}}
+		err := s.db.ModifyFilter(ctx, "testuser", bson.M{"_id": u.ID, "$or": unspent}, bson.M{"$set": bson.M{"totplaststep": step}}).Err()
+		if err == mongo.ErrNoDocuments {
+			writeMessage(w, http.StatusUnauthorized, "invalid totp code")
+			return false
+		}
+		if err != nil {
+			log.Println("err storing totp step")
+			w.WriteHeader(http.StatusInternalServerError)
+			return false
+		}
+		return true
+	case req.Recovery != "":
+		h := hashRecoveryCode(req.Recovery)
+		found := ""
+		for _, c := range u.RecoveryCodes {
+			if hmac.Equal([]byte(c), []byte(h)) {
+				found = c
+			}
+		}
+		if found == "" {
+			writeMessage(w, http.StatusUnauthorized, "invalid recovery code")
+			return false
+		}
+		// the code has to still be there when it is pulled, so two logins
+		// cannot both spend it
+		left := &User{}
+		err := s.db.ModifyFilter(ctx, "testuser", bson.M{"_id": u.ID, "recoverycodes": found}, bson.M{"$pull": bson.M{"recoverycodes": found}}).Decode(left)
+		if err == mongo.ErrNoDocuments {
+			writeMessage(w, http.StatusUnauthorized, "invalid recovery code")
+			return false
+		}
+		if err != nil {
+			log.Println("err consuming recovery code")
+			w.WriteHeader(http.StatusInternalServerError)
+			return false
+		}
+		log.Println("recovery code used,", len(left.RecoveryCodes), "left for", u.Username)
+		return true
+	}
+	writeMessage(w, http.StatusUnauthorized, "totp required")
+	return false
+}
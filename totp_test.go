@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 key of the RFC 4226 and RFC 6238 test vectors,
+// "12345678901234567890", in base32.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestHOTP(t *testing.T) {
+	// RFC 4226 appendix D
+	want := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+	for c, w := range want {
+		if got := hotp([]byte("12345678901234567890"), uint64(c)); got != w {
+			t.Errorf("hotp(%d) = %s, want %s", c, got, w)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	// RFC 6238 appendix B, SHA-1, cut to six digits
+	vectors := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, v := range vectors {
+		step, ok := validateTOTP(rfcSecret, v.code, time.Unix(v.unix, 0), 0)
+		if !ok || step != v.unix/totpPeriod {
+			t.Errorf("validateTOTP at %d = %d, %v; want step %d", v.unix, step, ok, v.unix/totpPeriod)
+		}
+	}
+
+	const at = 1111111109 // step 37037036
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		unix     int64
+		lastStep int64
+		step     int64
+		ok       bool
+	}{
+		{"current step", rfcSecret, "081804", at, 37037035, 37037036, true},
+		{"replayed", rfcSecret, "081804", at, 37037036, 0, false},
+		{"later step spent", rfcSecret, "081804", at, 37037037, 0, false},
+		{"next step within skew", rfcSecret, "050471", at, 37037036, 37037037, true},
+		{"previous step within skew", rfcSecret, "081804", at + totpPeriod, 0, 37037036, true},
+		{"outside skew", rfcSecret, "081804", at + 3*totpPeriod, 0, 0, false},
+		{"spaces", rfcSecret, " 081804 ", at, 0, 37037036, true},
+		{"lower case secret", "gezdgnbvgy3tqojqgezdgnbvgy3tqojq", "081804", at, 0, 37037036, true},
+		{"wrong code", rfcSecret, "081805", at, 0, 0, false},
+		{"short code", rfcSecret, "81804", at, 0, 0, false},
+		{"bad secret", "not base32!", "081804", at, 0, 0, false},
+	}
+	for _, tt := range tests {
+		step, ok := validateTOTP(tt.secret, tt.code, time.Unix(tt.unix, 0), tt.lastStep)
+		if ok != tt.ok || step != tt.step {
+			t.Errorf("%s: validateTOTP = %d, %v; want %d, %v", tt.name, step, ok, tt.step, tt.ok)
+		}
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashed, err := newRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount || len(hashed) != recoveryCodeCount {
+		t.Fatalf("%d codes and %d hashes, want %d", len(codes), len(hashed), recoveryCodeCount)
+	}
+	seen := map[string]bool{}
+	for i, c := range codes {
+		if seen[c] {
+			t.Errorf("code %s repeats", c)
+		}
+		seen[c] = true
+		if hashRecoveryCode(c) != hashed[i] {
+			t.Errorf("code %d does not hash to its stored hash", i)
+		}
+	}
+}
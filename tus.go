@@ -0,0 +1,573 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// tus 1.0 resumable uploads, https://tus.io/protocols/resumable-upload.
+// Chunks are appended to tus/<id> and hashed as they arrive; a finished
+// upload goes through storeUpload like /uploadfile, or is filed as a
+// document. Paperwork needs a session with rights on the post and takes
+// the document fields from its metadata, documentkind, documenttitle,
+// documentissuer and so on.
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,creation-with-upload,expiration,termination"
+	tusDir        = "tus/"
+	tusExpiry     = 24 * time.Hour
+)
+
+const (
+	tusKindImage     = "image"
+	tusKindPaperwork = "paperwork"
+)
+
+const tusExposed = "Location,Tus-Resumable,Tus-Version,Tus-Extension,Tus-Max-Size,Upload-Offset,Upload-Length,Upload-Metadata,Upload-Expires,Job-Location"
+
+// tusLocks keeps PATCH requests for the same upload from interleaving.
+var tusLocks sync.Map
+
+func tusLock(id string) *sync.Mutex {
+	m, _ := tusLocks.LoadOrStore(id, &sync.Mutex{})
+	return m.(*sync.Mutex)
+}
+
+func tusMaxSize() int64 {
+	n, err := strconv.ParseInt(os.Getenv("TUS_MAX_SIZE"), 10, 64)
+	if err != nil || n <= 0 {
+		return 256 << 20
+	}
+	return n
+}
+
+// TusUpload is the state of one resumable upload, kept in the
+// "tusuploads" collection. HashState is the marshalled sha256 of the bytes
+// received so far.
+type TusUpload struct {
+	ID        string            `json:"id" bson:"_id"`
+	Length    int64             `json:"length" bson:"length"`
+	Offset    int64             `json:"offset" bson:"offset"`
+	Metadata  map[string]string `json:"metadata" bson:"metadata"`
+	Created   time.Time         `json:"created" bson:"created"`
+	Expires   time.Time         `json:"expires" bson:"expires"`
+	HashState []byte            `json:"-" bson:"hashstate"`
+	SHA256    string            `json:"sha256,omitempty" bson:"sha256,omitempty"`
+	Done      bool              `json:"done" bson:"done"`
+	Status    int               `json:"status,omitempty" bson:"status,omitempty"`
+	Error     string            `json:"error,omitempty" bson:"error,omitempty"`
+	Image     *ImageEntry       `json:"image,omitempty" bson:"image,omitempty"`
+	File      string            `json:"file,omitempty" bson:"file,omitempty"`
+	// User files paperwork, Document is what it was filed as. Job
+	// processes a photo.
+	User     string             `json:"user,omitempty" bson:"user,omitempty"`
+	Document primitive.ObjectID `json:"document,omitempty" bson:"document,omitempty"`
+	Job      primitive.ObjectID `json:"job,omitempty" bson:"job,omitempty"`
+}
+
+func (u *TusUpload) path() string {
+	return tusDir + u.ID
+}
+
+func (u *TusUpload) kind() string {
+	if u.Metadata["kind"] == tusKindPaperwork {
+		return tusKindPaperwork
+	}
+	return tusKindImage
+}
+
+// parseTusMetadata decodes "key base64value,key2 base64value2".
+func parseTusMetadata(h string) (map[string]string, error) {
+	ret := map[string]string{}
+	if strings.TrimSpace(h) == "" {
+		return ret, nil
+	}
+	for _, pair := range strings.Split(h, ",") {
+		kv := strings.Fields(pair)
+		if len(kv) == 0 || len(kv) > 2 {
+			return nil, fmt.Errorf("bad metadata pair %q", pair)
+		}
+		v := ""
+		if len(kv) == 2 {
+			b, err := base64.StdEncoding.DecodeString(kv[1])
+			if err != nil {
+				return nil, fmt.Errorf("bad metadata value for %s", kv[0])
+			}
+			v = string(b)
+		}
+		ret[kv[0]] = v
+	}
+	return ret, nil
+}
+
+func formatTusMetadata(m map[string]string) string {
+	var parts []string
+	for k, v := range m {
+		parts = append(parts, k+" "+base64.StdEncoding.EncodeToString([]byte(v)))
+	}
+	return strings.Join(parts, ",")
+}
+
+func tusHeaders(w http.ResponseWriter) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Access-Control-Expose-Headers", tusExposed)
+}
+
+// tusCheckVersion enforces the Tus-Resumable header every request but
+// OPTIONS must carry.
+func tusCheckVersion(w http.ResponseWriter, r *http.Request) bool {
+	tusHeaders(w)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// tusMethodOverride lets clients behind proxies that drop PATCH and
+// DELETE send them as POST with X-HTTP-Method-Override.
+func tusMethodOverride(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m := r.Header.Get("X-HTTP-Method-Override"); m != "" && r.Method == "POST" && strings.HasPrefix(r.URL.Path, "/files/") {
+			r.Method = strings.ToUpper(m)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// corsExceptDiscovery sends OPTIONS requests that are not CORS preflights,
+// such as tus discovery, past the CORS handler, which would reject them.
+func corsExceptDiscovery(cors http.Handler, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cors.ServeHTTP(w, r)
+	})
+}
+
+func (s *service) tusOptions(w http.ResponseWriter, r *http.Request) {
+	tusHeaders(w)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(tusMaxSize(), 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *service) findTusUpload(ctx context.Context, id string) (*TusUpload, error) {
+	u := &TusUpload{}
+	if err := s.db.QueryOne(ctx, "tusuploads", "_id", id).Decode(u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (s *service) saveTusUpload(ctx context.Context, u *TusUpload) error {
+	err := s.db.Update(ctx, "tusuploads", "_id", u.ID, u).Err()
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	return err
+}
+
+func (s *service) removeTusUpload(ctx context.Context, u *TusUpload) {
+	os.Remove(u.path())
+	if _, err := s.db.DeleteOne(ctx, "tusuploads", "_id", u.ID); err != nil {
+		log.Println("err deleting tus upload", u.ID)
+	}
+	tusLocks.Delete(u.ID)
+}
+
+func (s *service) tusCreate(w http.ResponseWriter, r *http.Request) {
+	log.Println("tuscreate called")
+	if !tusCheckVersion(w, r) {
+		return
+	}
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		writeMessage(w, http.StatusBadRequest, "Upload-Defer-Length is not supported")
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		writeMessage(w, http.StatusBadRequest, "missing or invalid Upload-Length")
+		return
+	}
+	if length > tusMaxSize() {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	meta, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if meta["id"] == "" {
+		writeMessage(w, http.StatusBadRequest, "Upload-Metadata needs the post tag as id")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	p, err := s.findPost(ctx, "tag", meta["id"])
+	if err != nil {
+		writeMessage(w, http.StatusNotFound, "no post with tag "+meta["id"])
+		return
+	}
+	user := ""
+	if meta["kind"] == tusKindPaperwork {
+		se := s.sessionFrom(r)
+		if se == nil {
+			writeMessage(w, http.StatusUnauthorized, "paperwork needs a session")
+			return
+		}
+		if !canAccessPost(se, p) {
+			writeMessage(w, http.StatusForbidden, se.Username+" has no rights on "+p.Tag)
+			return
+		}
+		if err := checkNewDocument(documentFields(func(k string) string { return meta[k] }, "document")); err != nil {
+			writeMessage(w, uploadStatus(err), err.Error())
+			return
+		}
+		user = se.Username
+	}
+	if _, err := os.Stat(tusDir); os.IsNotExist(err) {
+		os.Mkdir(tusDir, 0777)
+	}
+
+	state, _ := sha256.New().(encoding.BinaryMarshaler).MarshalBinary()
+	now := time.Now()
+	u := &TusUpload{ID: primitive.NewObjectID().Hex(), Length: length, Metadata: meta, Created: now, Expires: now.Add(tusExpiry), HashState: state, User: user}
+	f, err := os.OpenFile(u.path(), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	f.Close()
+	if _, err := s.db.Add(ctx, "tusuploads", u); err != nil {
+		log.Println("err adding tus upload")
+		os.Remove(u.path())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", "/files/"+u.ID)
+	w.Header().Set("Upload-Expires", u.Expires.UTC().Format(http.TimeFormat))
+	if r.Header.Get("Content-Type") == "application/offset+octet-stream" && r.ContentLength != 0 {
+		// creation-with-upload: the body is the first chunk
+		s.tusWrite(w, r, u, http.StatusCreated)
+		return
+	}
+	if length == 0 {
+		s.tusWrite(w, r, u, http.StatusCreated)
+		return
+	}
+	w.Header().Set("Upload-Offset", "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *service) tusHead(w http.ResponseWriter, r *http.Request) {
+	if !tusCheckVersion(w, r) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	u, err := s.findTusUpload(ctx, mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if !u.Done && time.Now().After(u.Expires) {
+		s.removeTusUpload(ctx, u)
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	if len(u.Metadata) > 0 {
+		w.Header().Set("Upload-Metadata", formatTusMetadata(u.Metadata))
+	}
+	if !u.Done {
+		w.Header().Set("Upload-Expires", u.Expires.UTC().Format(http.TimeFormat))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *service) tusPatch(w http.ResponseWriter, r *http.Request) {
+	if !tusCheckVersion(w, r) {
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+	id := mux.Vars(r)["id"]
+	mu := tusLock(id)
+	mu.Lock()
+	defer mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	u, err := s.findTusUpload(ctx, id)
+	cancel()
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch u.checkOffset(r.Header.Get("Upload-Offset")) {
+	case http.StatusBadRequest:
+		writeMessage(w, http.StatusBadRequest, "missing or invalid Upload-Offset")
+		return
+	case http.StatusConflict:
+		w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	s.tusWrite(w, r, u, http.StatusNoContent)
+}
+
+// checkOffset says why a PATCH sent with the Upload-Offset h cannot be
+// written: 400 when h is no offset, 409 when it is not where the upload
+// stands. It is 0 when it can.
+func (u *TusUpload) checkOffset(h string) int {
+	offset, err := strconv.ParseInt(h, 10, 64)
+	if err != nil || offset < 0 {
+		return http.StatusBadRequest
+	}
+	if offset != u.Offset {
+		return http.StatusConflict
+	}
+	return 0
+}
+
+// writeChunk writes body to f at u.Offset, no further than u.Length, and
+// moves the offset and hash state past what was written, also when body
+// breaks off part way. SHA256 is set once the last byte is in.
+func (u *TusUpload) writeChunk(f io.WriteSeeker, body io.Reader) error {
+	h := sha256.New()
+	if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(u.HashState); err != nil {
+		return fmt.Errorf("restoring hash state: %v", err)
+	}
+	if _, err := f.Seek(u.Offset, io.SeekStart); err != nil {
+		return err
+	}
+	n, copyErr := io.Copy(io.MultiWriter(f, h), io.LimitReader(body, u.Length-u.Offset))
+	state, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	u.Offset += n
+	u.HashState = state
+	if u.Offset == u.Length {
+		u.SHA256 = hex.EncodeToString(h.Sum(nil))
+	}
+	return copyErr
+}
+
+// tusWrite appends the request body at u.Offset, saves the new offset and
+// hash state even when the connection drops part way, and processes the
+// upload once the last byte is in. The caller holds the upload's lock or
+// has just created it.
+func (s *service) tusWrite(w http.ResponseWriter, r *http.Request, u *TusUpload, status int) {
+	if u.Done {
+		writeMessage(w, http.StatusConflict, "upload already complete")
+		return
+	}
+	if time.Now().After(u.Expires) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		s.removeTusUpload(ctx, u)
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+
+	f, err := os.OpenFile(u.path(), os.O_WRONLY, 0666)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	copyErr := u.writeChunk(f, r.Body)
+	if err := f.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	if copyErr != nil {
+		// keep what arrived; the client resumes from the saved offset
+		log.Println("tus chunk interrupted", u.ID, copyErr)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.saveTusUpload(ctx, u); err != nil {
+		log.Println("err saving tus upload", u.ID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	if copyErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if u.Offset < u.Length {
+		w.Header().Set("Upload-Expires", u.Expires.UTC().Format(http.TimeFormat))
+		w.WriteHeader(status)
+		return
+	}
+
+	s.finishTusUpload(u)
+	if u.Error != "" {
+		writeMessage(w, u.Status, u.Error)
+		return
+	}
+	if !u.Job.IsZero() {
+		w.Header().Set("Job-Location", "/jobs/"+u.Job.Hex())
+	}
+	w.WriteHeader(status)
+}
+
+// finishTusUpload queues a complete upload on the image pipeline or files
+// it as a document, and records the outcome for GET /files/{id}. A photo
+// is reported with its job, as /uploadfile/async does.
+func (s *service) finishTusUpload(u *TusUpload) {
+	u.Done = true
+	u.Status = http.StatusCreated
+	switch u.kind() {
+	case tusKindPaperwork:
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		p, err := s.findPost(ctx, "tag", u.Metadata["id"])
+		cancel()
+		if err != nil {
+			u.Status, u.Error = http.StatusNotFound, "no post with tag "+u.Metadata["id"]
+			break
+		}
+		f, err := os.Open(u.path())
+		if err != nil {
+			u.Status, u.Error = http.StatusInternalServerError, err.Error()
+			break
+		}
+		name := filepath.Base(u.Metadata["filename"])
+		if name == "." || name == "/" || name == "" {
+			name = u.ID
+		}
+		in := documentFields(func(k string) string { return u.Metadata[k] }, "document")
+		d, err := s.fileDocument(u.User, p, nil, in, name, f)
+		f.Close()
+		if err != nil {
+			u.Status, u.Error = uploadStatus(err), err.Error()
+			break
+		}
+		os.Remove(u.path())
+		u.Document = d.ID
+		u.File = d.Versions[len(d.Versions)-1].File
+	default:
+		f, err := os.Open(u.path())
+		if err != nil {
+			u.Status, u.Error = http.StatusInternalServerError, err.Error()
+			break
+		}
+		in := &uploadInfo{File: u.Metadata["filename"], ID: u.Metadata["id"], Note: u.Metadata["note"], SHA256: u.SHA256}
+		pu, err := s.receiveUpload(f, in)
+		f.Close()
+		if err != nil {
+			u.Status, u.Error = uploadStatus(err), err.Error()
+			break
+		}
+		os.Remove(u.path())
+		j, err := s.queueUpload(pu)
+		if err != nil {
+			u.Status, u.Error = uploadStatus(err), err.Error()
+			break
+		}
+		u.Status, u.Job, u.File = http.StatusAccepted, j.ID, pu.Filename
+	}
+	if u.Error != "" {
+		// a failed upload is not retried from its bytes, and the reaper
+		// only looks at unfinished ones
+		os.Remove(u.path())
+	}
+	u.HashState = nil
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.saveTusUpload(ctx, u); err != nil {
+		log.Println("err saving tus upload", u.ID, err)
+	}
+}
+
+func (s *service) tusDelete(w http.ResponseWriter, r *http.Request) {
+	if !tusCheckVersion(w, r) {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	mu := tusLock(id)
+	mu.Lock()
+	defer mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	u, err := s.findTusUpload(ctx, id)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	s.removeTusUpload(ctx, u)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tusResult reports what became of an upload after its last chunk.
+func (s *service) tusResult(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	u, err := s.findTusUpload(ctx, mux.Vars(r)["id"])
+	if err != nil {
+		writeMessage(w, http.StatusNotFound, "upload not found")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(u)
+	if err != nil {
+		log.Println("err encoding tus upload")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// reapTusUploads deletes unfinished uploads past their expiry.
+func (s *service) reapTusUploads() {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		cur, err := s.db.QueryFilter(ctx, "tusuploads", bson.M{"done": false, "expires": bson.M{"$lt": time.Now()}})
+		if err == nil {
+			for cur.Next(ctx) {
+				u := &TusUpload{}
+				if err := cur.Decode(u); err != nil {
+					continue
+				}
+				log.Println("tus upload expired", u.ID)
+				s.removeTusUpload(ctx, u)
+			}
+			cur.Close(ctx)
+		}
+		cancel()
+		time.Sleep(time.Hour)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestParseTusMetadata(t *testing.T) {
+	tests := []struct {
+		header string
+		want   map[string]string
+	}{
+		{"", map[string]string{}},
+		{"id RkFSTTAwMDAwMDE3", map[string]string{"id": "FARM00000017"}},
+		{"id RkFSTTAwMDAwMDE3,kind cGFwZXJ3b3Jr, note", map[string]string{"id": "FARM00000017", "kind": "paperwork", "note": ""}},
+		{"filename 6L6y5ZywLmpwZw==", map[string]string{"filename": "農地.jpg"}},
+		{"id RkFSTTAwMDAwMDE3,", nil},
+		{"id not-base64!", nil},
+		{"id a b", nil},
+	}
+	for _, tt := range tests {
+		got, err := parseTusMetadata(tt.header)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("parseTusMetadata(%q) = %v, want an error", tt.header, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseTusMetadata(%q) = %v, %v; want %v", tt.header, got, err, tt.want)
+			continue
+		}
+		back, err := parseTusMetadata(formatTusMetadata(got))
+		if err != nil || !reflect.DeepEqual(back, got) {
+			t.Errorf("metadata %v does not survive formatting: %v, %v", got, back, err)
+		}
+	}
+}
+
+func TestCheckOffset(t *testing.T) {
+	u := &TusUpload{Length: 100, Offset: 40}
+	tests := []struct {
+		header string
+		want   int
+	}{
+		{"40", 0},
+		{"0", http.StatusConflict},
+		{"39", http.StatusConflict},
+		{"100", http.StatusConflict},
+		{"", http.StatusBadRequest},
+		{"-40", http.StatusBadRequest},
+		{"forty", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if got := u.checkOffset(tt.header); got != tt.want {
+			t.Errorf("checkOffset(%q) = %d, want %d", tt.header, got, tt.want)
+		}
+	}
+}
+
+// brokenReader gives n bytes of r and then fails, as a dropped connection
+// does.
+type brokenReader struct {
+	r io.Reader
+	n int
+}
+
+func (b *brokenReader) Read(p []byte) (int, error) {
+	if b.n <= 0 {
+		return 0, errors.New("connection reset")
+	}
+	if len(p) > b.n {
+		p = p[:b.n]
+	}
+	n, err := b.r.Read(p)
+	b.n -= n
+	return n, err
+}
+
+func TestWriteChunk(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64)
+	f, err := ioutil.TempFile("", "tus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	state, _ := sha256.New().(encoding.BinaryMarshaler).MarshalBinary()
+	u := &TusUpload{Length: int64(len(data)), HashState: state}
+	steps := []struct {
+		name   string
+		body   io.Reader
+		err    bool
+		offset int64
+	}{
+		{"first chunk", bytes.NewReader(data[:100]), false, 100},
+		{"dropped part way", &brokenReader{r: bytes.NewReader(data[100:600]), n: 250}, true, 350},
+		{"resumed", bytes.NewReader(data[350:900]), false, 900},
+		{"empty chunk", bytes.NewReader(nil), false, 900},
+		{"past the length", bytes.NewReader(append(data[900:], "trailing"...)), false, int64(len(data))},
+	}
+	for _, st := range steps {
+		err := u.writeChunk(f, st.body)
+		if (err != nil) != st.err || u.Offset != st.offset {
+			t.Fatalf("%s: writeChunk = %v at %d, want offset %d", st.name, err, u.Offset, st.offset)
+		}
+		if u.Offset < u.Length && u.SHA256 != "" {
+			t.Errorf("%s: SHA256 set at %d of %d", st.name, u.Offset, u.Length)
+		}
+	}
+	sum := sha256.Sum256(data)
+	if u.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("SHA256 = %s, want %x", u.SHA256, sum)
+	}
+	got, err := ioutil.ReadFile(f.Name())
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("file holds %d bytes, want the %d sent", len(got), len(data))
+	}
+
+	bad := &TusUpload{Length: 10, Offset: 4, HashState: []byte("garbage")}
+	if err := bad.writeChunk(f, bytes.NewReader([]byte("456789"))); err == nil || bad.Offset != 4 {
+		t.Errorf("writeChunk with a bad hash state = %v at %d", err, bad.Offset)
+	}
+}
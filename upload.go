@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"mongo/geo"
+)
+
+// maxBatchFiles caps one batch request. Larger visits can be split.
+const maxBatchFiles = 100
+
+// agri/tmp.py takes its nonce from the account's transaction count, so two
+// runs at once would sign transactions with the same nonce.
+var anchorMu sync.Mutex
+
+// anchor hashes a file and records the hash on chain. It returns the
+// sha256 of the file and the transaction hash.
+func anchor(filename string) (string, string, error) {
+	anchorMu.Lock()
+	defer anchorMu.Unlock()
+	out, err := exec.Command("python3", "./agri/tmp.py", "add", ":"+filename).Output()
+	if err != nil {
+		return "", "", err
+	}
+	hash := strings.Split(string(out), "\n")
+	if len(hash) < 2 {
+		return "", "", fmt.Errorf("unexpected anchor output %q", out)
+	}
+	return hash[0], hash[1], nil
+}
+
+// uploadError carries the status a failed upload should be reported with.
+type uploadError struct {
+	Status  int
+	Message string
+}
+
+func (e *uploadError) Error() string {
+	return e.Message
+}
+
+func uploadErrorf(status int, format string, args ...interface{}) error {
+	return &uploadError{Status: status, Message: fmt.Sprintf(format, args...)}
+}
+
+func uploadStatus(err error) int {
+	if e, ok := err.(*uploadError); ok {
+		return e.Status
+	}
+	return http.StatusInternalServerError
+}
+
+// uploadInfo is what the client tells us about one file besides its bytes.
+// SHA256, when set, is what the bytes were hashed to as they arrived.
+type uploadInfo struct {
+	File   string `json:"file"`
+	ID     string `json:"id"`
+	Note   string `json:"note"`
+	SHA256 string `json:"-"`
+}
+
+// createUpload opens a new file under path named after date, adding a
+// counter when several photos of a post arrive in the same second.
+func createUpload(path string, date string) (*os.File, string, error) {
+	for i := 0; i < 1000; i++ {
+		name := path + date + ".jpeg"
+		if i > 0 {
+			name = path + date + "_" + strconv.Itoa(i) + ".jpeg"
+		}
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) {
+			continue
+		}
+		return f, name, err
+	}
+	return nil, "", fmt.Errorf("no free file name for %s%s", path, date)
+}
+
+// pendingUpload carries one photo through the pipeline stages. Each stage
+// fills in the fields the later ones need.
+type pendingUpload struct {
+	Info     *uploadInfo
+	Post     *Post
+	Path     string
+	Date     string
+	Filename string
+
+	data    []byte
+	meta    *PhotoMeta
+	dh, ph  uint64
+	auth    *Authenticity
+	imgHash string
+	txHash  string
+	cad     *geo.Result
+	fence   *GeofenceCheck
+	dups    []*DuplicateMatch
+	img     *ImageEntry
+	bc      *BCdataa
+}
+
+// uploadStage is one named step of processing an upload.
+type uploadStage struct {
+	Name string
+	Run  func(s *service, ctx context.Context, u *pendingUpload) error
+}
+
+// uploadStages run in order after receiveUpload has saved the file.
+var uploadStages = []uploadStage{
+	{"metadata", (*service).stageMetadata},
+	{"authenticity", (*service).stageAuthenticity},
+	{"anchor", (*service).stageAnchor},
+	{"cadastre", (*service).stageCadastre},
+	{"geofence", (*service).stageGeofence},
+	{"duplicates", (*service).stageDuplicates},
+	{"record", (*service).stageRecord},
+}
+
+// receiveUpload checks the post exists and writes the photo to images/.
+func (s *service) receiveUpload(src io.Reader, in *uploadInfo) (*pendingUpload, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	in.ID = canonicalTag(in.ID)
+	k, err := s.findPost(ctx, "tag", in.ID)
+	if err != nil {
+		return nil, uploadErrorf(http.StatusNotFound, "no post with tag %s", in.ID)
+	}
+	if !validTag(k.Tag) {
+		return nil, uploadErrorf(http.StatusUnprocessableEntity, "tag %s cannot name a directory", k.Tag)
+	}
+
+	path := "images/" + k.Tag + "/"
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		os.Mkdir(path, 0777)
+	}
+	date := time.Now().Add(time.Hour * 8).Format("2006-01-02_150405")
+	f, filename, err := createUpload(path, date)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(f, src)
+	f.Close()
+	if err != nil {
+		os.Remove(filename)
+		return nil, uploadErrorf(http.StatusBadRequest, "upload interrupted")
+	}
+	return &pendingUpload{Info: in, Post: k, Path: path, Date: date, Filename: filename}, nil
+}
+
+// processUpload runs the stages. progress, when not nil, is told when each
+// stage starts and how it ended. A photo that does not make it through is
+// removed, since no bcpost lists it.
+func (s *service) processUpload(u *pendingUpload, progress func(stage string, done bool, err error)) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	for _, st := range uploadStages {
+		if progress != nil {
+			progress(st.Name, false, nil)
+		}
+		err := st.Run(s, ctx, u)
+		if progress != nil {
+			progress(st.Name, true, err)
+		}
+		if err != nil {
+			os.Remove(u.Filename)
+			return err
+		}
+	}
+	return nil
+}
+
+// storeUpload saves and processes one photo in the caller's goroutine. The
+// returned bcpost is as stored afterwards.
+func (s *service) storeUpload(src io.Reader, in *uploadInfo) (*BCdataa, *ImageEntry, error) {
+	u, err := s.receiveUpload(src, in)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := s.processUpload(u, nil); err != nil {
+		return nil, nil, err
+	}
+	return u.bc, u.img, nil
+}
+
+func (s *service) stageMetadata(ctx context.Context, u *pendingUpload) error {
+	data, err := ioutil.ReadFile(u.Filename)
+	if err != nil {
+		return err
+	}
+	u.data = data
+	u.meta, err = ExtractMeta(bytes.NewReader(data))
+	if err != nil {
+		return uploadErrorf(http.StatusUnsupportedMediaType, "%s", err.Error())
+	}
+	u.dh, u.ph, err = hashImage(bytes.NewReader(data))
+	if err != nil {
+		return uploadErrorf(http.StatusUnsupportedMediaType, "%s", errNotImage.Error())
+	}
+	return nil
+}
+
+func (s *service) stageAuthenticity(ctx context.Context, u *pendingUpload) error {
+	u.auth = s.checkAuthenticity(ctx, u.data, u.meta, time.Now())
+	if u.auth.Review {
+		log.Println("photo flagged for review: authenticity score", u.auth.Score)
+	}
+	return nil
+}
+
+func (s *service) stageAnchor(ctx context.Context, u *pendingUpload) error {
+	var err error
+	u.imgHash, u.txHash, err = anchor(u.Filename)
+	if err != nil {
+		log.Println("err anchoring " + u.Filename)
+		return err
+	}
+	if u.Info.SHA256 != "" && u.imgHash != u.Info.SHA256 {
+		log.Println("anchored hash differs from received bytes", u.Filename, u.imgHash, u.Info.SHA256)
+		return uploadErrorf(http.StatusInternalServerError, "anchored hash %s differs from the %s received", u.imgHash, u.Info.SHA256)
+	}
+	fmt.Println("Image Hash:" + u.imgHash)
+	return nil
+}
+
+func (s *service) stageCadastre(ctx context.Context, u *pendingUpload) error {
+	// 地段地號
+	u.cad = s.lookupParcel(u.meta)
+	return nil
+}
+
+func (s *service) stageGeofence(ctx context.Context, u *pendingUpload) error {
+	bounds, err := s.boundariesFor(ctx, u.Post)
+	if err != nil {
+		log.Println("err querying boundaries")
+		fmt.Println(err)
+	}
+	u.fence = checkGeofence(bounds, u.meta, u.cad)
+	if u.fence.Review {
+		log.Println("photo flagged for review:", u.fence.Reason)
+	}
+	return nil
+}
+
+func (s *service) stageDuplicates(ctx context.Context, u *pendingUpload) error {
+	var err error
+	u.dups, err = s.checkDuplicates(ctx, newPhotoHash(u.Post.ID, u.Post.Tag, u.Filename, u.Date, u.meta, u.dh, u.ph))
+	if err != nil {
+		log.Println("err checking duplicates")
+		fmt.Println(err)
+	}
+	return nil
+}
+
+// stageRecord appends the image to the post's bcpost in one atomic update,
+// so concurrent uploads to the same post do not overwrite each other.
+func (s *service) stageRecord(ctx context.Context, u *pendingUpload) error {
+	meta := u.meta
+	set := bson.M{"image": u.Path, "date": u.Date, "chain": "Ropsten"}
+	var loc *GeoPoint
+	if meta.GPS != nil {
+		loc = newGeoPoint(meta.GPS.Lat, meta.GPS.Long)
+		set["location"] = loc
+		set["lat"] = strconv.FormatFloat(meta.GPS.Lat, 'f', 5, 64)
+		set["long"] = strconv.FormatFloat(meta.GPS.Long, 'f', 5, 64)
+	}
+	if meta.FocalLength != nil {
+		set["foclen"] = fmt.Sprintf("%.3f", *meta.FocalLength)
+	}
+	if meta.Heading != nil {
+		set["dir"] = fmt.Sprintf("%.15f", meta.Heading.Degrees)
+	}
+	if u.cad != nil && u.cad.Best != nil {
+		set["dddh"] = u.cad.Best.Label
+	}
+
+	u.img = &ImageEntry{File: u.Filename, ImgHash: u.imgHash, Hash: u.txHash, Date: u.Date, Note: u.Info.Note, Original: u.Info.File, Meta: meta, Cadastral: u.cad, Geofence: u.fence, Location: loc, DHash: hexHash(u.dh), PHash: hexHash(u.ph), Duplicates: u.dups, Authenticity: u.auth}
+	update := bson.M{
+		"$set":  set,
+		"$push": bson.M{"hash": u.txHash, "imghash": u.imgHash, "images": u.img},
+	}
+	bc := &BCdataa{}
+	err := s.db.Modify(ctx, "bcposts", "_id", u.Post.ID, update).Decode(bc)
+	if err == mongo.ErrNoDocuments {
+		return uploadErrorf(http.StatusNotFound, "post %s has no bcpost", u.Info.ID)
+	}
+	if err != nil {
+		return err
+	}
+	u.bc = bc
+	return nil
+}
+
+func (s *service) uploadFile(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("uploadfile called")
+	err := r.ParseMultipartForm(32 << 20)
+	if err != nil {
+		fmt.Println("err parsing multipart form")
+		writeMessage(w, http.StatusBadRequest, "invalid multipart form")
+		return
+	}
+	file, header, err := r.FormFile("image")
+	if err != nil {
+		fmt.Println("form file image err")
+		fmt.Println(err)
+		writeMessage(w, http.StatusBadRequest, "missing image")
+		return
+	}
+	defer file.Close()
+	in := &uploadInfo{File: header.Filename, ID: r.FormValue("id"), Note: r.FormValue("note")}
+	fmt.Println("id:", in.ID)
+
+	bc, _, err := s.storeUpload(file, in)
+	if err != nil {
+		fmt.Println(err)
+		writeMessage(w, uploadStatus(err), err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(bc)
+	if err != nil {
+		log.Println("err encoding return")
+		fmt.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	fmt.Println("uploaded!")
+}
+
+// batchResult is the outcome for one file of a batch, in request order.
+type batchResult struct {
+	Index  int         `json:"index"`
+	File   string      `json:"file"`
+	ID     string      `json:"id"`
+	Status int         `json:"status"`
+	Error  string      `json:"error,omitempty"`
+	Image  *ImageEntry `json:"image,omitempty"`
+}
+
+func uploadWorkers() int {
+	n, err := strconv.Atoi(os.Getenv("UPLOAD_WORKERS"))
+	if err != nil || n < 1 {
+		return 4
+	}
+	return n
+}
+
+// batchInfo matches the "meta" form field to the files. Entries are
+// matched by file name first and by position otherwise; the form's "id" is
+// the default tag.
+func batchInfo(r *http.Request, files []*multipart.FileHeader) ([]*uploadInfo, error) {
+	var meta []*uploadInfo
+	if m := r.FormValue("meta"); m != "" {
+		if err := json.Unmarshal([]byte(m), &meta); err != nil {
+			return nil, err
+		}
+	}
+	byName := map[string]*uploadInfo{}
+	for _, m := range meta {
+		if m != nil && m.File != "" {
+			byName[m.File] = m
+		}
+	}
+	ret := make([]*uploadInfo, len(files))
+	for i, fh := range files {
+		in := &uploadInfo{File: fh.Filename, ID: r.FormValue("id")}
+		m := byName[fh.Filename]
+		if m == nil && i < len(meta) && meta[i] != nil && meta[i].File == "" {
+			m = meta[i]
+		}
+		if m != nil {
+			if m.ID != "" {
+				in.ID = m.ID
+			}
+			in.Note = m.Note
+		}
+		ret[i] = in
+	}
+	return ret, nil
+}
+
+// uploadBatch takes many "images" files in one request and runs them
+// through the upload pipeline with bounded parallelism. Each file gets its
+// own status; one failure does not stop the others.
+func (s *service) uploadBatch(w http.ResponseWriter, r *http.Request) {
+	log.Println("uploadbatch called")
+	err := r.ParseMultipartForm(32 << 20)
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, "invalid multipart form")
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+	files := r.MultipartForm.File["images"]
+	if len(files) == 0 {
+		writeMessage(w, http.StatusBadRequest, "no images")
+		return
+	}
+	if len(files) > maxBatchFiles {
+		writeMessage(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("at most %d images per batch", maxBatchFiles))
+		return
+	}
+	infos, err := batchInfo(r, files)
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, "invalid meta: "+err.Error())
+		return
+	}
+
+	results := make([]*batchResult, len(files))
+	sem := make(chan struct{}, uploadWorkers())
+	var wg sync.WaitGroup
+	for i := range files {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			res := &batchResult{Index: i, File: infos[i].File, ID: infos[i].ID, Status: http.StatusCreated}
+			results[i] = res
+			if infos[i].ID == "" {
+				res.Status, res.Error = http.StatusBadRequest, "missing id"
+				return
+			}
+			f, err := files[i].Open()
+			if err != nil {
+				res.Status, res.Error = http.StatusBadRequest, err.Error()
+				return
+			}
+			defer f.Close()
+			_, img, err := s.storeUpload(f, infos[i])
+			if err != nil {
+				log.Println("err batch upload", infos[i].File, err)
+				res.Status, res.Error = uploadStatus(err), err.Error()
+				return
+			}
+			res.Image = img
+		}(i)
+	}
+	wg.Wait()
+
+	status := http.StatusOK
+	failed := 0
+	for _, res := range results {
+		if res.Status >= 400 {
+			failed++
+		}
+	}
+	if failed > 0 {
+		status = http.StatusMultiStatus
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err = json.NewEncoder(w).Encode(map[string]interface{}{"uploaded": len(results) - failed, "failed": failed, "results": results})
+	if err != nil {
+		log.Println("err encoding batch results")
+		return
+	}
+}
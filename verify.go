@@ -0,0 +1,466 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"image/png"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"mongo/derive"
+	"mongo/gs1"
+	"mongo/qr"
+)
+
+const (
+	etherscanTx = "https://ropsten.etherscan.io/tx/"
+
+	defaultQRScale = 8
+	maxQRScale     = 32
+
+	// verifyPhotos is how many thumbnails a verification shows at most.
+	verifyPhotos = 12
+	// regionGrid is what photo locations are rounded to, in degrees; 0.1
+	// is about 11 km.
+	regionGrid = 0.1
+	// anchorWait is how long a verification waits on etherscan before
+	// answering with the anchors still pending.
+	anchorWait = 10 * time.Second
+	// anchorRecheck is how long an anchor that could not be verified is
+	// remembered before etherscan is asked again.
+	anchorRecheck = 10 * time.Minute
+)
+
+// verifyURL is the public address a tag's QR code points at, on
+// PUBLIC_BASE_URL or else on the host the request came to. GS1 tags point
+// at their Digital Link there, which resolveLink sends on to /verify.
+func verifyURL(r *http.Request, tag string) string {
+	base := strings.TrimSuffix(os.Getenv("PUBLIC_BASE_URL"), "/")
+	if base == "" {
+		scheme := "http"
+		if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+			scheme = "https"
+		}
+		base = scheme + "://" + r.Host
+	}
+	if id, err := typedTag(tag); err == nil && id.Kind != gs1.Internal {
+		return id.DigitalLink(base)
+	}
+	return base + "/verify/" + url.PathEscape(tag)
+}
+
+// tagQR answers GET /qr/{tag} with a QR code of the tag's verification
+// URL. ?format= is png or svg, ?scale= the pixels per module and ?level=
+// the error correction, L, M, Q or H.
+func (s *service) tagQR(w http.ResponseWriter, r *http.Request) {
+	tag := mux.Vars(r)["tag"]
+	if !validTag(tag) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format == "" {
+		format = "png"
+	}
+	if format != "png" && format != "svg" {
+		writeMessage(w, http.StatusBadRequest, "format must be png or svg")
+		return
+	}
+	scale := defaultQRScale
+	if v := q.Get("scale"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxQRScale {
+			writeMessage(w, http.StatusBadRequest, "scale must be 1 to "+strconv.Itoa(maxQRScale))
+			return
+		}
+		scale = n
+	}
+	level := qr.M
+	if v := q.Get("level"); v != "" {
+		l, ok := qr.ParseLevel(v)
+		if !ok {
+			writeMessage(w, http.StatusBadRequest, "level must be L, M, Q or H")
+			return
+		}
+		level = l
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := s.findPost(ctx, "tag", tag); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	code, err := qr.Encode(verifyURL(r, tag), level)
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Header().Set("Content-Disposition", "inline; filename=\""+tag+"."+format+"\"")
+	if format == "svg" {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write(code.SVG(scale, qr.QuietZone))
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	if err := png.Encode(w, code.Image(scale, qr.QuietZone)); err != nil {
+		log.Println("err writing qr code", tag, err)
+	}
+}
+
+// AnchorCheck is whether a hash is found in the transaction it was
+// anchored by: verified, unverified, pending while etherscan has not
+// answered yet, or unanchored.
+type AnchorCheck struct {
+	Status string `json:"status"`
+	Hash   string `json:"hash,omitempty"`
+	TxHash string `json:"txhash,omitempty"`
+	URL    string `json:"url,omitempty"`
+}
+
+func newAnchorCheck(hash string, tx string) *AnchorCheck {
+	if hash == "" || tx == "" {
+		return &AnchorCheck{Status: "unanchored"}
+	}
+	return &AnchorCheck{Status: "pending", Hash: hash, TxHash: tx, URL: etherscanTx + tx}
+}
+
+type anchorProbe struct {
+	done chan struct{}
+	ok   bool
+	at   time.Time
+}
+
+var (
+	anchorProbesMu sync.Mutex
+	anchorProbes   = map[string]*anchorProbe{}
+	// anchorSlots bounds how many etherscan pages are fetched at once.
+	anchorSlots = make(chan struct{}, 4)
+)
+
+// probeAnchor starts asking etherscan whether tx carries hash, or returns
+// the probe already asking. Hashes found are remembered for good; misses
+// are asked again after anchorRecheck.
+func probeAnchor(hash string, tx string) *anchorProbe {
+	key := hash + "/" + tx
+	anchorProbesMu.Lock()
+	defer anchorProbesMu.Unlock()
+	if p := anchorProbes[key]; p != nil {
+		select {
+		case <-p.done:
+			if p.ok || time.Since(p.at) < anchorRecheck {
+				return p
+			}
+		default:
+			return p
+		}
+	}
+	p := &anchorProbe{done: make(chan struct{})}
+	anchorProbes[key] = p
+	go func() {
+		anchorSlots <- struct{}{}
+		defer func() {
+			if err := recover(); err != nil {
+				log.Println("err checking anchor", tx, err)
+			}
+			<-anchorSlots
+			p.at = time.Now()
+			close(p.done)
+		}()
+		p.ok = Cmpurlhash(hash, etherscanTx+tx)
+	}()
+	return p
+}
+
+// checkAnchors probes every anchored check at once and fills in what
+// etherscan says, leaving those it has not answered within wait pending.
+func checkAnchors(checks []*AnchorCheck, wait time.Duration) {
+	probes := make([]*anchorProbe, len(checks))
+	for i, a := range checks {
+		if a.Status == "pending" {
+			probes[i] = probeAnchor(a.Hash, a.TxHash)
+		}
+	}
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+	expired := false
+	for i, p := range probes {
+		if p == nil {
+			continue
+		}
+		if !expired {
+			select {
+			case <-p.done:
+			case <-timeout.C:
+				expired = true
+			}
+		}
+		select {
+		case <-p.done:
+			checks[i].Status = "unverified"
+			if p.ok {
+				checks[i].Status = "verified"
+			}
+		default:
+		}
+	}
+}
+
+// FarmRegion is roughly where an origin lot was grown: the cadastral
+// sections its photos were matched to, without parcel numbers, and the
+// middle of its photo locations rounded to regionGrid.
+type FarmRegion struct {
+	Lot      string   `json:"lot"`
+	Sections []string `json:"sections,omitempty"`
+	Lat      float64  `json:"lat,omitempty"`
+	Long     float64  `json:"long,omitempty"`
+	Grid     float64  `json:"grid,omitempty"`
+}
+
+// VerifiedStage is a lifecycle transition without who made it.
+type VerifiedStage struct {
+	Lot       string       `json:"lot"`
+	Stage     string       `json:"stage"`
+	Role      string       `json:"role"`
+	Time      string       `json:"time"`
+	Photos    int          `json:"photos"`
+	Paperwork int          `json:"paperwork"`
+	Anchor    *AnchorCheck `json:"anchor"`
+}
+
+// VerifiedPhoto is a thumbnail, without metadata, of a photo of the lot
+// or a lot it came from.
+type VerifiedPhoto struct {
+	Lot      string       `json:"lot"`
+	Thumb    string       `json:"thumb"`
+	Captured time.Time    `json:"captured"`
+	Anchor   *AnchorCheck `json:"anchor"`
+}
+
+// Verification is what a consumer scanning a tag is shown. It names no
+// users and places farms no closer than regionGrid.
+type Verification struct {
+	Tag           string           `json:"tag"`
+	Title         string           `json:"title"`
+	Certification string           `json:"certification,omitempty"`
+	Progress      string           `json:"progress"`
+	Lots          []string         `json:"lots"`
+	Origins       []*FarmRegion    `json:"origins"`
+	Stages        []*VerifiedStage `json:"stages"`
+	Photos        []*VerifiedPhoto `json:"photos"`
+	Anchors       map[string]int   `json:"anchors"`
+	// Packages are the cases and pallets the lots travelled in; their
+	// stages while the lots were inside are among Stages. Contents are the
+	// tags packed in a package that was scanned.
+	Packages []*VerifiedPackage `json:"packages,omitempty"`
+	Contents []string           `json:"contents,omitempty"`
+	// Documents are the certificates and inspection reports of the lots,
+	// current versions only and without their files.
+	Documents []*VerifiedDocument `json:"documents,omitempty"`
+}
+
+// VerifiedDocument is a document as the public sees it.
+type VerifiedDocument struct {
+	Lot           string       `json:"lot"`
+	Kind          string       `json:"kind"`
+	Title         string       `json:"title"`
+	Certification string       `json:"certification,omitempty"`
+	Issuer        string       `json:"issuer,omitempty"`
+	ValidFrom     string       `json:"validfrom,omitempty"`
+	ValidUntil    string       `json:"validuntil,omitempty"`
+	Status        string       `json:"status,omitempty"`
+	Version       int          `json:"version"`
+	SHA256        string       `json:"sha256"`
+	Anchor        *AnchorCheck `json:"anchor"`
+}
+
+// duringAny says whether t falls in one of the windows a lot was in a
+// package.
+func duringAny(windows []*VerifiedPackage, t string) bool {
+	at, err := time.Parse(time.RFC3339, t)
+	if err != nil {
+		return false
+	}
+	for _, w := range windows {
+		if !at.Before(w.from) && (w.to.IsZero() || at.Before(w.to)) {
+			return true
+		}
+	}
+	return false
+}
+
+// farmRegion coarsens where a lot's photos were taken.
+func (s *service) farmRegion(ctx context.Context, tag string, entries []*TimelineEntry) *FarmRegion {
+	f := &FarmRegion{Lot: tag}
+	sections := map[string]bool{}
+	cur, err := s.db.Query(ctx, "bcposts", "tag", tag)
+	if err == nil {
+		for cur.Next(ctx) {
+			bc := &BCdataa{}
+			if err := cur.Decode(bc); err != nil {
+				continue
+			}
+			for _, img := range bc.Images {
+				if img.Cadastral != nil && img.Cadastral.Best != nil && img.Cadastral.Best.Section != "" {
+					sections[img.Cadastral.Best.Section] = true
+				}
+			}
+		}
+		cur.Close(ctx)
+	}
+	for sec := range sections {
+		f.Sections = append(f.Sections, sec)
+	}
+	sort.Strings(f.Sections)
+
+	var lat, long float64
+	n := 0
+	for _, e := range entries {
+		if e.Location != nil && len(e.Location.Coordinates) == 2 {
+			long += e.Location.Coordinates[0]
+			lat += e.Location.Coordinates[1]
+			n++
+		}
+	}
+	if n > 0 {
+		f.Lat = math.Round(lat/float64(n)/regionGrid) / (1 / regionGrid)
+		f.Long = math.Round(long/float64(n)/regionGrid) / (1 / regionGrid)
+		f.Grid = regionGrid
+	}
+	return f
+}
+
+// verify answers the public GET /verify/{tag} with the provenance of a
+// lot and the lots it came from, and whether each anchor checks out on
+// chain.
+func (s *service) verify(w http.ResponseWriter, r *http.Request) {
+	tag := mux.Vars(r)["tag"]
+	if !validTag(tag) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	p, err := s.findPost(ctx, "tag", tag)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	g, err := s.lineage(ctx, p, true, false, maxLineageDepth)
+	if err != nil {
+		log.Println("err tracing", tag, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	v := &Verification{Tag: p.Tag, Title: p.Title, Certification: p.Certification, Progress: p.Progress, Lots: []string{}, Origins: []*FarmRegion{}, Stages: []*VerifiedStage{}, Photos: []*VerifiedPhoto{}}
+	var checks []*AnchorCheck
+	derived := map[primitive.ObjectID]bool{}
+	for _, e := range g.Edges {
+		derived[e.Child] = true
+	}
+	lot := map[string]string{}
+	var ids []string
+	var oids []primitive.ObjectID
+	var photos []*VerifiedPhoto
+	for _, n := range g.Nodes {
+		v.Lots = append(v.Lots, n.Tag)
+		lot[n.ID.Hex()] = n.Tag
+		ids = append(ids, n.ID.Hex())
+		oids = append(oids, n.ID)
+		entries, err := s.timeline(ctx, n.Tag)
+		if err != nil {
+			log.Println("err building timeline", n.Tag, err)
+			continue
+		}
+		for _, e := range entries {
+			photos = append(photos, &VerifiedPhoto{Lot: n.Tag, Thumb: e.URL, Captured: e.Captured, Anchor: newAnchorCheck(e.Anchor.ImgHash, e.Anchor.TxHash)})
+		}
+		if !derived[n.ID] {
+			v.Origins = append(v.Origins, s.farmRegion(ctx, n.Tag, entries))
+		}
+	}
+
+	sort.SliceStable(photos, func(i, j int) bool {
+		return photos[i].Captured.Before(photos[j].Captured)
+	})
+	for _, i := range derive.Sample(len(photos), verifyPhotos) {
+		ph := photos[i]
+		ph.Thumb = s.signURL(ph.Thumb, ph.Thumb) + "&size=thumb"
+		v.Photos = append(v.Photos, ph)
+		checks = append(checks, ph.Anchor)
+	}
+
+	if p.Package != "" {
+		contents, err := s.contents(ctx, p)
+		if err == nil {
+			for _, c := range contents {
+				v.Contents = append(v.Contents, c.Tag)
+			}
+		}
+	}
+	// the journeys of packages count while the lots were in them
+	v.Packages = s.packageJourney(ctx, oids, time.Time{}, time.Time{}, 0)
+	inside := map[string][]*VerifiedPackage{}
+	for _, vp := range v.Packages {
+		lot[vp.post.Hex()] = vp.Tag
+		if len(inside[vp.post.Hex()]) == 0 {
+			ids = append(ids, vp.post.Hex())
+		}
+		inside[vp.post.Hex()] = append(inside[vp.post.Hex()], vp)
+	}
+
+	cur, err := s.db.QueryFilter(ctx, "lifecycle", bson.M{"post": bson.M{"$in": ids}})
+	if err == nil {
+		for cur.Next(ctx) {
+			ev := &LifecycleEvent{}
+			if err := cur.Decode(ev); err != nil {
+				continue
+			}
+			if windows, ok := inside[ev.Post]; ok && !duringAny(windows, ev.Time) {
+				continue
+			}
+			st := &VerifiedStage{Lot: lot[ev.Post], Stage: ev.To, Role: ev.Role, Time: ev.Time, Photos: len(ev.Photos), Paperwork: len(ev.Paperwork), Anchor: newAnchorCheck(ev.Hash, ev.TxHash)}
+			v.Stages = append(v.Stages, st)
+			checks = append(checks, st.Anchor)
+		}
+		cur.Close(ctx)
+	}
+	sort.SliceStable(v.Stages, func(i, j int) bool {
+		return v.Stages[i].Time < v.Stages[j].Time
+	})
+
+	docs, err := s.postDocumentsOf(ctx, bson.M{"post": bson.M{"$in": oids}, "kind": bson.M{"$in": bson.A{docCertificate, docInspection}}})
+	if err == nil {
+		now := time.Now()
+		for _, d := range docs {
+			cur := d.Versions[len(d.Versions)-1]
+			vd := &VerifiedDocument{Lot: d.Tag, Kind: d.Kind, Title: d.Title, Certification: d.Certification, Issuer: d.Issuer, ValidFrom: d.ValidFrom, ValidUntil: d.ValidUntil, Status: d.status(now), Version: d.Version, SHA256: d.SHA256, Anchor: newAnchorCheck(cur.Hash, cur.TxHash)}
+			v.Documents = append(v.Documents, vd)
+			checks = append(checks, vd.Anchor)
+		}
+	}
+
+	checkAnchors(checks, anchorWait)
+	v.Anchors = map[string]int{}
+	for _, a := range checks {
+		v.Anchors[a.Status]++
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	json.NewEncoder(w).Encode(v)
+}